@@ -0,0 +1,345 @@
+// Нагрузочный тест рассылки сообщений по WebSocket
+// Входит синтетическими пользователями через /auth/test (сервер запущен с AUTH_TEST_TOKEN),
+// открывает N подключений в M чатах, отправляет сообщения с заданной частотой
+// и считает задержку доставки и потерянные сообщения
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+type options struct {
+	url         string
+	token       string
+	connections int
+	chats       int
+	rate        float64
+	duration    time.Duration
+	drain       time.Duration
+	size        int
+	keep        bool
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.url, "url", "http://localhost:8080", "адрес сервера")
+	flag.StringVar(&opts.token, "token", os.Getenv("AUTH_TEST_TOKEN"), "токен входа без Google (AUTH_TEST_TOKEN сервера)")
+	flag.IntVar(&opts.connections, "connections", 100, "количество WebSocket подключений")
+	flag.IntVar(&opts.chats, "chats", 10, "количество чатов, подключения распределяются по ним поровну")
+	flag.Float64Var(&opts.rate, "rate", 50, "сообщений в секунду от всех подключений")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "время отправки сообщений")
+	flag.DurationVar(&opts.drain, "drain", 5*time.Second, "время ожидания доставки после окончания отправки")
+	flag.IntVar(&opts.size, "size", 64, "размер сообщения в байтах")
+	flag.BoolVar(&opts.keep, "keep", false, "не удалять созданные чаты")
+	flag.Parse()
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.TimeOnly}).With().Timestamp().Logger()
+
+	if opts.token == "" {
+		logger.Fatal().Msg("test token is required: pass -token or set AUTH_TEST_TOKEN")
+	}
+	if opts.connections < 1 || opts.chats < 1 || opts.rate <= 0 {
+		logger.Fatal().Msg("connections, chats and rate must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := run(ctx, logger, opts)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("load test failed")
+	}
+	report.print(os.Stdout)
+}
+
+// Синтетический пользователь с сессией
+type user struct {
+	id     string
+	client *http.Client
+}
+
+// Подключение пользователя к чату
+type socket struct {
+	id     int
+	chatId int
+	conn   *websocket.Conn
+}
+
+func run(ctx context.Context, logger zerolog.Logger, opts options) (*report, error) {
+	base, err := url.Parse(opts.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid url")
+	}
+	runId := strconv.FormatInt(time.Now().Unix(), 36)
+
+	// Чаты создает отдельный пользователь
+	owner, err := login(ctx, base, opts.token, "loadtest-"+runId+"-owner")
+	if err != nil {
+		return nil, err
+	}
+	chatIds, err := createChats(ctx, base, owner, runId, opts.chats)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.keep {
+		defer deleteChats(base, owner, chatIds, logger)
+	}
+	logger.Info().Ints("chat_ids", chatIds).Msg("chats created")
+
+	stats := newCollector()
+
+	// Каждое подключение - отдельный пользователь
+	sockets := make([]*socket, 0, opts.connections)
+	members := make(map[int]int)
+	defer func() {
+		for _, s := range sockets {
+			s.conn.Close()
+		}
+	}()
+	for i := 0; i < opts.connections; i++ {
+		u, err := login(ctx, base, opts.token, fmt.Sprintf("loadtest-%s-%d", runId, i))
+		if err != nil {
+			return nil, err
+		}
+
+		chatId := chatIds[i%len(chatIds)]
+		conn, err := dial(ctx, base, u, chatId)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open connection %d", i)
+		}
+		s := &socket{id: i, chatId: chatId, conn: conn}
+		sockets = append(sockets, s)
+		members[chatId]++
+	}
+	logger.Info().Int("connections", len(sockets)).Msg("connections opened")
+
+	var readers sync.WaitGroup
+	for _, s := range sockets {
+		readers.Add(1)
+		go func(s *socket) {
+			defer readers.Done()
+			read(s, runId, stats)
+		}(s)
+	}
+
+	// Отправка сообщений по кругу от всех подключений
+	logger.Info().Float64("rate", opts.rate).Dur("duration", opts.duration).Msg("sending messages")
+	interval := time.Duration(float64(time.Second) / opts.rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	deadline := time.NewTimer(opts.duration)
+	defer deadline.Stop()
+
+	started := time.Now()
+	next := 0
+send:
+	for {
+		select {
+		case <-ctx.Done():
+			break send
+		case <-deadline.C:
+			break send
+		case <-ticker.C:
+			s := sockets[next%len(sockets)]
+			next++
+
+			msgId := stats.sent(members[s.chatId])
+			payload := fmt.Sprintf("lt:%s:%d:%d:", runId, msgId, time.Now().UnixNano())
+			// Дополняем сообщение до нужного размера
+			if pad := opts.size - len(payload); pad > 0 {
+				payload += strings.Repeat("x", pad)
+			}
+			if err := s.conn.WriteMessage(websocket.TextMessage, []byte(payload)); err != nil {
+				stats.writeFailed()
+				logger.Warn().Err(err).Int("connection", s.id).Msg("failed to send message")
+			}
+		}
+	}
+	sendDuration := time.Since(started)
+
+	logger.Info().Dur("drain", opts.drain).Msg("waiting for deliveries")
+	select {
+	case <-time.After(opts.drain):
+	case <-ctx.Done():
+	}
+
+	for _, s := range sockets {
+		s.conn.Close()
+	}
+	readers.Wait()
+
+	return stats.report(opts, sendDuration), nil
+}
+
+// Вход через /auth/test, сессия остается в cookie jar клиента
+func login(ctx context.Context, base *url.URL, token string, id string) (*user, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	u := &user{id: id, client: &http.Client{
+		Jar:     jar,
+		Timeout: 10 * time.Second,
+		// Перенаправления после создания и удаления чата не нужны
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+
+	form := url.Values{"id": {id}, "name": {id}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base.JoinPath("/auth/test").String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to login")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, errors.Errorf("failed to login: status %d", resp.StatusCode)
+	}
+
+	return u, nil
+}
+
+// Создание чатов и получение их ID
+func createChats(ctx context.Context, base *url.URL, owner *user, runId string, count int) ([]int, error) {
+	names := make(map[string]bool, count)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("loadtest-%s-%d", runId, i)
+		names[name] = true
+
+		form := url.Values{"chatName": {name}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, base.JoinPath("/create-chat").String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		resp, err := owner.client.Do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create chat")
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther {
+			return nil, errors.Errorf("failed to create chat: status %d", resp.StatusCode)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.JoinPath("/get-rooms").String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := owner.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get chats")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to get chats: status %d", resp.StatusCode)
+	}
+
+	var rooms []models.RoomStruct
+	if err = json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+		return nil, errors.Wrap(err, "failed to decode chats")
+	}
+
+	ids := make([]int, 0, count)
+	for _, room := range rooms {
+		if names[room.RoomName] {
+			ids = append(ids, room.RoomId)
+		}
+	}
+	if len(ids) != count {
+		return nil, errors.Errorf("created %d chats, found %d", count, len(ids))
+	}
+
+	return ids, nil
+}
+
+// Удаление созданных чатов с сессией создателя: удалить чат может только его администратор
+// Сервер отвечает переадресацией, клиент ей не следует, поэтому любой другой статус - ошибка
+func deleteChats(base *url.URL, owner *user, chatIds []int, logger zerolog.Logger) {
+	for _, id := range chatIds {
+		resp, err := owner.client.Get(base.JoinPath("/delete-chat", strconv.Itoa(id)).String())
+		if err != nil {
+			logger.Warn().Err(err).Int("chat_id", id).Msg("failed to delete chat")
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther {
+			logger.Warn().Int("chat_id", id).Int("status", resp.StatusCode).Msg("failed to delete chat")
+		}
+	}
+}
+
+// Открытие WebSocket подключения с сессией пользователя
+func dial(ctx context.Context, base *url.URL, u *user, chatId int) (*websocket.Conn, error) {
+	wsURL := *base
+	wsURL.Scheme = "ws"
+	if base.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	}
+	wsURL.Path = "/ws"
+	wsURL.RawQuery = url.Values{"roomId": {strconv.Itoa(chatId)}}.Encode()
+
+	dialer := websocket.Dialer{Jar: u.client.Jar, HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.DialContext(ctx, wsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Чтение сообщений до закрытия подключения
+// Сообщения этого запуска имеют вид lt:<run>:<msg id>:<время отправки в наносекундах>:...
+func read(s *socket, runId string, stats *collector) {
+	prefix := "lt:" + runId + ":"
+	for {
+		var msg models.MessageOnScreen
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		received := time.Now()
+
+		if !strings.HasPrefix(msg.Msg, prefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(msg.Msg, prefix), ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		msgId, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		sentAt, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		stats.received(msgId, s.id, received.Sub(time.Unix(0, sentAt)))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Учет отправленных и полученных сообщений
+type collector struct {
+	mu sync.Mutex
+	// Ожидаемое количество доставок каждого сообщения - число подключений в его чате
+	expected map[int64]int
+	// Подключения, получившие сообщение
+	deliveries map[int64]map[int]struct{}
+	latencies  []time.Duration
+	duplicates int
+	failed     int
+	lastId     int64
+}
+
+func newCollector() *collector {
+	return &collector{
+		expected:   make(map[int64]int),
+		deliveries: make(map[int64]map[int]struct{}),
+	}
+}
+
+// Регистрация отправленного сообщения, возвращает его ID
+func (c *collector) sent(members int) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastId++
+	c.expected[c.lastId] = members
+	c.deliveries[c.lastId] = make(map[int]struct{}, members)
+
+	return c.lastId
+}
+
+// Сообщение не удалось отправить, его доставки не ожидаются
+func (c *collector) writeFailed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failed++
+	delete(c.expected, c.lastId)
+	delete(c.deliveries, c.lastId)
+}
+
+// Получение сообщения подключением
+func (c *collector) received(msgId int64, socketId int, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	got, ok := c.deliveries[msgId]
+	if !ok {
+		return
+	}
+	if _, dup := got[socketId]; dup {
+		c.duplicates++
+		return
+	}
+	got[socketId] = struct{}{}
+	c.latencies = append(c.latencies, latency)
+}
+
+// Итоги запуска
+type report struct {
+	connections  int
+	chats        int
+	duration     time.Duration
+	sent         int
+	failed       int
+	expected     int
+	delivered    int
+	duplicates   int
+	latencies    []time.Duration
+	incompletely int
+}
+
+func (c *collector) report(opts options, duration time.Duration) *report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := &report{
+		connections: opts.connections,
+		chats:       opts.chats,
+		duration:    duration,
+		sent:        len(c.expected),
+		failed:      c.failed,
+		duplicates:  c.duplicates,
+		latencies:   append([]time.Duration(nil), c.latencies...),
+	}
+	for id, expected := range c.expected {
+		got := len(c.deliveries[id])
+		r.expected += expected
+		r.delivered += got
+		if got < expected {
+			r.incompletely++
+		}
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+	return r
+}
+
+// Перцентиль задержки по отсортированным значениям
+func (r *report) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p)
+	return r.latencies[i]
+}
+
+func (r *report) print(w io.Writer) {
+	lost := r.expected - r.delivered
+	lossRate := 0.0
+	if r.expected > 0 {
+		lossRate = float64(lost) / float64(r.expected) * 100
+	}
+	throughput := 0.0
+	if r.duration > 0 {
+		throughput = float64(r.sent) / r.duration.Seconds()
+	}
+
+	fmt.Fprintf(w, "connections:        %d in %d chats\n", r.connections, r.chats)
+	fmt.Fprintf(w, "duration:           %s\n", r.duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "messages sent:      %d (%.1f msg/s), failed writes: %d\n", r.sent, throughput, r.failed)
+	fmt.Fprintf(w, "deliveries:         %d of %d expected\n", r.delivered, r.expected)
+	fmt.Fprintf(w, "lost deliveries:    %d (%.2f%%), messages not delivered to everyone: %d\n", lost, lossRate, r.incompletely)
+	fmt.Fprintf(w, "duplicates:         %d\n", r.duplicates)
+	if len(r.latencies) > 0 {
+		fmt.Fprintf(w, "latency p50/p90/p99: %s / %s / %s\n",
+			r.percentile(0.50).Round(time.Microsecond),
+			r.percentile(0.90).Round(time.Microsecond),
+			r.percentile(0.99).Round(time.Microsecond))
+		fmt.Fprintf(w, "latency max:        %s\n", r.latencies[len(r.latencies)-1].Round(time.Microsecond))
+	}
+}
@@ -2,21 +2,26 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/Yury132/Golang-Task-3/internal/bus"
 	"github.com/Yury132/Golang-Task-3/internal/client/google"
 	"github.com/Yury132/Golang-Task-3/internal/config"
+	"github.com/Yury132/Golang-Task-3/internal/health"
+	"github.com/Yury132/Golang-Task-3/internal/metrics"
 	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/natsserver"
+	"github.com/Yury132/Golang-Task-3/internal/presence"
 	"github.com/Yury132/Golang-Task-3/internal/service"
 	"github.com/Yury132/Golang-Task-3/internal/storage"
+	"github.com/Yury132/Golang-Task-3/internal/tracing"
 	transport "github.com/Yury132/Golang-Task-3/internal/transport/http"
 	"github.com/Yury132/Golang-Task-3/internal/transport/http/handlers"
+	"github.com/Yury132/Golang-Task-3/internal/worker"
 	"github.com/jackc/pgx/v5/pgxpool"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/pressly/goose/v3"
@@ -40,6 +45,12 @@ func main() {
 	// Логгер
 	logger := cfg.Logger()
 
+	// Трассировка
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracingOptions())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to setup tracing")
+	}
+
 	// Миграции
 	db, err := goose.OpenDBWithDriver(dialect, cfg.GetDBConnString())
 	if err != nil {
@@ -66,89 +77,311 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to connect to db")
 	}
 
+	// Язык поиска должен быть известен PostgreSQL, иначе не сохранится ни одно сообщение
+	if err = storage.CheckSearchLanguage(context.Background(), conn, cfg.Search.Language); err != nil {
+		logger.Fatal().Err(err).Msg("invalid search language")
+	}
+	// Векторы сообщений, построенные с прежним языком, не находились бы запросами на новом
+	reindexed, err := storage.SyncSearchLanguage(context.Background(), conn, cfg.Search.Language)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to sync search language")
+	}
+	if reindexed {
+		logger.Info().Str("language", cfg.Search.Language).Msg("messages reindexed for search")
+	}
+
+	// Проверки состояния для оркестратора
+	// Проверка миграций работает через database/sql поверх того же пула
+	migrationsDB := stdlib.OpenDBFromPool(conn)
+	checker := health.New(logger).
+		Add("postgres", health.Postgres(conn)).
+		Add("migrations", health.Migrations(migrationsDB, migrationsPath))
+
 	// Гугл
 	oauthCfg := cfg.SetupConfig()
 	googleAPI := google.New(logger)
 
-	//-------------------------------------------------------Настройка Nats------------------------------
+	//-------------------------------------------------------Настройка шины сообщений------------------------------
 
-	// Подключение к Nats
-	nc, err := nats.Connect(cfg.NATS.URL)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to connect to NATS")
-	}
-	defer func() {
-		if err = nc.Drain(); err != nil {
-			logger.Fatal().Err(err).Msg("failed to drain nats connection")
+	var (
+		msgBus bus.Bus
+		// Присутствие пользователей, общее для экземпляров сервиса
+		presenceStore presence.Store
+		// Встроенный сервер Nats, если включен
+		ns *natsserver.Server
+		// Сообщения для превью ссылок, каждое получает один экземпляр; nil - превью строятся по сообщениям из msgBus
+		previewSource bus.Subscriber
+	)
+
+	instance := cfg.PresenceInstance()
+	logger = logger.With().Str("instance", instance).Logger()
+
+	switch cfg.Bus.Driver {
+	case config.BusMemory:
+		// Шина в памяти, Nats не нужен
+		msgBus = bus.NewMemory(logger, cfg.Bus.MemorySize)
+		presenceStore = presence.NewMemory(logger, instance)
+	case config.BusJetStream:
+		natsURL := cfg.NATS.URL
+
+		// Встроенный сервер Nats
+		if cfg.NATS.Embedded.Enabled {
+			ns, err = natsserver.New(logger, cfg.NATS.Embedded.Host, cfg.NATS.Embedded.Port, cfg.NATS.Embedded.StoreDir)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("failed to start embedded NATS server")
+			}
+
+			natsURL = ns.ClientURL()
 		}
-	}()
 
-	// Создаем Jetstream
-	js, err := jetstream.New(nc)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to create new jetstream")
+		// Подключение к Nats
+		nc, err := nats.Connect(natsURL)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to connect to NATS")
+		}
+
+		// Создаем Jetstream
+		js, err := jetstream.New(nc)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to create new jetstream")
+		}
+
+		// Создаем Consumer
+		cons, err := cfg.NewJS(context.Background(), logger, js, instance)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to create new Jetstream or Consumer")
+		}
+
+		msgBus = bus.NewJetStream(logger, nc, js, cons, cfg.NATS.Subject, cfg.NATS.SignalSubject)
+
+		// Все экземпляры получают все сообщения, а ссылки разворачивает один из них
+		if cfg.Previews.Enabled {
+			shared, err := cfg.NewSharedConsumer(context.Background(), js)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("failed to create shared consumer")
+			}
+			previewSource = bus.NewJetStream(logger, nc, js, shared, cfg.NATS.Subject, cfg.NATS.SignalSubject)
+			checker.Add("jetstream_previews", health.JetStream(shared))
+		}
+
+		// Присутствие хранится в NATS KV, его видят все экземпляры
+		kv, err := cfg.PresenceKV(context.Background(), js)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to create presence bucket")
+		}
+		presenceStore = presence.NewKV(logger, kv, instance)
+
+		checker.Add("nats", health.NATS(nc)).Add("jetstream", health.JetStream(cons))
+	default:
+		logger.Fatal().Str("driver", cfg.Bus.Driver).Msg("unknown bus driver")
 	}
 
-	// Создаем Consumer
-	cons, err := cfg.NewJS(context.Background(), js, logger)
+	//-------------------------------------------------------Настройка шины сообщений------------------------------
+
+	strg := storage.New(conn, cfg.Search.Language)
+	svc := service.New(logger, oauthCfg, googleAPI, strg)
+	// Сервис чатов сохраняет сообщения, публикует их в шину и рассылает участникам
+	chats := service.NewChats(logger, strg, msgBus, presenceStore)
+	// Вложения: метаданные в PostgreSQL, содержимое в каталоге или S3
+	blobs, err := cfg.AttachmentStore()
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to create new Jetstream or Consumer")
+		logger.Fatal().Err(err).Msg("failed to create attachment store")
+	}
+	attachments := service.NewAttachments(logger, strg, blobs, cfg.AttachmentOptions())
+	handler := handlers.New(logger, oauthCfg, svc, chats).
+		WithAttachments(attachments, cfg.Attachments.MaxSize, cfg.Attachments.TransferTimeout).
+		WithWriteTimeout(cfg.Server.WSWriteTimeout)
+	if cfg.Auth.TestToken != "" {
+		logger.Warn().Msg("test login is enabled, do not use in production")
+		handler.WithTestAuth(cfg.Auth.TestToken)
+	}
+	srv := transport.New(cfg.Server.Host).
+		WithHandler(handler).
+		WithTimeouts(cfg.Server.ReadTimeout, cfg.Server.ReadHeaderTimeout, cfg.Server.WriteTimeout, cfg.Server.IdleTimeout)
+	if cfg.TLSEnabled() {
+		if srv, err = srv.WithTLS(logger, cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile, cfg.Server.TLSReloadInterval); err != nil {
+			logger.Fatal().Err(err).Msg("failed to configure tls")
+		}
 	}
 
-	// Канал для воркеров
-	jobs := make(chan *models.SendMessage, 100)
+	// Пул воркеров для рассылки
+	// Сообщения одного чата обрабатывает один и тот же воркер
+	pool := worker.New(logger, cfg.Workers.Size, cfg.Workers.QueueSize, chats.Deliver)
+	pool.Start()
 
-	// В горутине получатель беспрерывно ждет входящих сообщений
-	// При получении сообщений, передает задачи-данные-смс воркерам для последующей рассылки
-	go func() {
-		_, err := cons.Consume(func(msg jetstream.Msg) {
-			// Декодируем
-			var info = new(models.SendMessage)
-			if err := json.Unmarshal(msg.Data(), info); err != nil {
-				fmt.Println("Ошибка при декодировании....")
-			} else {
-				fmt.Println("Полученные данные Consume: ", info)
-				//fmt.Println("Отправляем данные в канал")
-				// Заполняем канал данными
-				// Воркеры начнут работать
-				jobs <- info
-			}
-			// Подтверждаем получение сообщения
-			err := msg.DoubleAck(context.Background())
+	// Сообщение из шины подтверждается после рассылки воркером, а не после постановки в очередь,
+	// поэтому сообщения, не разосланные до падения экземпляра, доставляются повторно
+	// Ссылки новых и измененных сообщений разворачиваются в фоне:
+	// с общим получателем - по его сообщениям, иначе - после передачи сообщения воркерам
+	handle := func(ctx context.Context, msg *models.SendMessage, ack bus.AckFunc) {
+		if err := pool.SubmitFunc(ctx, msg, ack); err != nil {
+			ack(err)
+		}
+	}
+	var (
+		previews   service.PreviewService
+		previewSub bus.Subscription
+	)
+	if cfg.Previews.Enabled {
+		previews = service.NewPreviews(logger, strg, cfg.PreviewFetcher(), msgBus, cfg.PreviewOptions())
+		previews.Start()
+		if previewSource != nil {
+			previewSub, err = previewSource.Subscribe(func(ctx context.Context, msg *models.SendMessage) error {
+				previews.HandleMessage(ctx, msg)
+				return nil
+			})
 			if err != nil {
-				fmt.Println("Ошибка при DoubleAck...")
+				logger.Fatal().Err(err).Msg("failed to subscribe to previews")
+			}
+		} else {
+			handle = func(ctx context.Context, msg *models.SendMessage, ack bus.AckFunc) {
+				if err := pool.SubmitFunc(ctx, msg, ack); err != nil {
+					ack(err)
+					return
+				}
+				previews.HandleMessage(ctx, msg)
 			}
-		})
-		if err != nil {
-			fmt.Println("Ошибка при Consume...")
 		}
-	}()
-	//-------------------------------------------------------Настройка Nats------------------------------
+	}
 
-	strg := storage.New(conn)
-	svc := service.New(logger, oauthCfg, googleAPI, strg)
-	// Прокидываем также Jetstream
-	handler := handlers.New(logger, oauthCfg, svc, js)
-	srv := transport.New(":8080").WithHandler(handler)
+	metrics.RegisterQueueDepth(pool.QueueDepth)
+	metrics.RegisterPgxPool(conn)
 
-	// Запускаем воркеров в горутинах
-	// Они будут ожидать получения данных для работы
-	for w := 1; w <= 3; w++ {
-		go handler.Worker(w, jobs)
+	// Получатель беспрерывно ждет входящих сообщений
+	// При получении сообщений, передает задачи-данные-смс воркерам для последующей рассылки
+	sub, err := msgBus.SubscribeAsync(handle)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to subscribe to bus")
+	}
+
+	// Сигналы набора текста не сохраняются и рассылаются сразу, минуя пул
+	signals, err := msgBus.SubscribeBroadcast(chats.Deliver)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to subscribe to signals")
 	}
 
+	// Изменения присутствия всех экземпляров и продление записей этого экземпляра
+	presenceWatch, err := presenceStore.Watch(chats.ApplyPresence)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to watch presence")
+	}
+	presenceCtx, stopPresence := context.WithCancel(context.Background())
+	go chats.KeepPresence(presenceCtx)
+
+	// Удаление вложений, которые так и не отправили в сообщении
+	cleanupCtx, stopCleanup := context.WithCancel(context.Background())
+	go attachments.KeepClean(cleanupCtx)
+
+	// Сервер проверок состояния
+	healthSrv := transport.New(cfg.Server.HealthHost).WithRouter(checker.Router())
+
+	// Сервер метрик Prometheus
+	metricsSrv := transport.New(cfg.Server.MetricsBind).WithRouter(metrics.Handler())
+
 	// graceful shutdown
 	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, syscall.SIGINT)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
 	// Запусвкаем сервер
 	go func() {
-		fmt.Println("Сервер запущен")
-		if err = srv.Run(); err != nil {
+		logger.Info().Str("addr", srv.Addr).Bool("tls", cfg.TLSEnabled()).Msg("server started")
+		if err := srv.Run(); err != nil {
 			logger.Fatal().Err(err).Msg("failed to start server")
 		}
 	}()
 
-	// Ждем нажатия Ctrl+C
-	<-shutdown
+	go func() {
+		logger.Info().Str("addr", healthSrv.Addr).Msg("health server started")
+		if err := healthSrv.Run(); err != nil {
+			logger.Fatal().Err(err).Msg("failed to start health server")
+		}
+	}()
+
+	go func() {
+		logger.Info().Str("addr", metricsSrv.Addr).Msg("metrics server started")
+		if err := metricsSrv.Run(); err != nil {
+			logger.Fatal().Err(err).Msg("failed to start metrics server")
+		}
+	}()
+
+	// Ждем нажатия Ctrl+C или сигнала остановки
+	sig := <-shutdown
+	logger.Info().Str("signal", sig.String()).Msg("shutting down")
+
+	// Оркестратор перестает направлять трафик
+	checker.SetShuttingDown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	// Перестаем принимать подключения, ждем завершения текущих запросов
+	if err = srv.Shutdown(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to shutdown server")
+	}
+
+	// Закрываем WebSocket подключения с кодом 1001
+	handler.CloseConnections()
+
+	// Перестаем получать сообщения, сигналы и присутствие
+	sub.Stop()
+	if previewSub != nil {
+		previewSub.Stop()
+	}
+	signals.Stop()
+	presenceWatch.Stop()
+	stopPresence()
+	stopCleanup()
+
+	// Воркеры дорабатывают уже полученные сообщения
+	if err = waitFor(ctx, pool.Stop); err != nil {
+		logger.Error().Err(err).Msg("failed to stop workers")
+	}
+
+	// Превью не критичны, начатые загрузки прерываются
+	if previews != nil {
+		previews.Stop()
+	}
+
+	// Дожидаемся отправки и подтверждения сообщений Nats
+	if err = msgBus.Close(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to close bus")
+	}
+	if ns != nil {
+		ns.Shutdown()
+	}
+
+	if err = migrationsDB.Close(); err != nil {
+		logger.Error().Err(err).Msg("failed to close migrations db")
+	}
+	conn.Close()
+
+	if err = healthSrv.Shutdown(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to shutdown health server")
+	}
+	if err = metricsSrv.Shutdown(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to shutdown metrics server")
+	}
+
+	// Отправляем оставшиеся спаны
+	if err = shutdownTracing(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to shutdown tracing")
+	}
+
+	logger.Info().Msg("server stopped")
+}
+
+// Ожидание завершения fn не дольше ctx
+func waitFor(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
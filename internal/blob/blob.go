@@ -0,0 +1,43 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Содержимого по ключу нет
+var ErrNotFound = errors.New("blob not found")
+
+// Хранилище содержимого файлов по ключу
+// Ключ - путь из сегментов букв, цифр, -, _ и ., разделенных /
+type Store interface {
+	// Сохранение содержимого размером size байт, существующее содержимое заменяется
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Чтение содержимого, ErrNotFound если его нет
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Удаление содержимого, отсутствующее содержимое не считается ошибкой
+	Delete(ctx context.Context, key string) error
+}
+
+// Проверка ключа: сегменты не пустые, не . и .., без символов, которые придется экранировать
+func validateKey(key string) error {
+	if key == "" {
+		return errors.New("empty blob key")
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return errors.Errorf("invalid blob key %q", key)
+		}
+		for _, r := range segment {
+			if !(r == '-' || r == '_' || r == '.' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+				return errors.Errorf("invalid blob key %q", key)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Общая проверка реализаций Store
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	data := []byte("hello, attachments")
+	if err := store.Put(ctx, "attachments/a1", bytes.NewReader(data), int64(len(data)), "text/plain"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	r, err := store.Get(ctx, "attachments/a1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get() = %q, %v, want %q", got, err, data)
+	}
+
+	// Повторная запись заменяет содержимое
+	if err = store.Put(ctx, "attachments/a1", strings.NewReader("new"), 3, "text/plain"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	r, err = store.Get(ctx, "attachments/a1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	got, _ = io.ReadAll(r)
+	r.Close()
+	if string(got) != "new" {
+		t.Errorf("Get() after replace = %q", got)
+	}
+
+	if err = store.Put(ctx, "attachments/empty", strings.NewReader(""), 0, ""); err != nil {
+		t.Fatalf("Put() empty error = %v", err)
+	}
+
+	if err = store.Delete(ctx, "attachments/a1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err = store.Get(ctx, "attachments/a1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete() error = %v, want ErrNotFound", err)
+	}
+	if err = store.Delete(ctx, "attachments/a1"); err != nil {
+		t.Errorf("Delete() missing error = %v", err)
+	}
+
+	for _, key := range []string{"", "../etc/passwd", "a//b", "a/./b", "a b", "a?b"} {
+		if err = store.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put(%q) error = nil, want invalid key", key)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocal(dir)
+	if err != nil {
+		t.Fatalf("NewLocal() error = %v", err)
+	}
+
+	testStore(t, store)
+
+	// Недописанное содержимое не остается в каталоге
+	err = store.Put(context.Background(), "attachments/short", strings.NewReader("abc"), 10, "")
+	if err == nil {
+		t.Fatal("Put() with wrong size error = nil")
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "attachments"))
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "empty" {
+			t.Errorf("unexpected file %s", entry.Name())
+		}
+	}
+}
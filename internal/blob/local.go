@@ -0,0 +1,106 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Хранилище в каталоге локальной файловой системы
+// Содержимое пишется во временный файл и переименовывается, поэтому читатели не видят недописанных файлов
+type localStore struct {
+	dir string
+}
+
+func (s *localStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return errors.Wrap(err, "failed to create blob directory")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create blob file")
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write blob")
+	}
+	if size >= 0 && written != size {
+		tmp.Close()
+		return errors.Errorf("blob size mismatch: written %d bytes, want %d", written, size)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to sync blob")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close blob")
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "failed to rename blob")
+	}
+
+	return nil
+}
+
+func (s *localStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open blob")
+	}
+
+	return f, nil
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrap(err, "failed to delete blob")
+	}
+
+	return nil
+}
+
+// Путь к файлу ключа внутри каталога хранилища
+func (s *localStore) path(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Каталог создается, если его нет
+func NewLocal(dir string) (Store, error) {
+	if dir == "" {
+		return nil, errors.New("empty blob directory")
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, errors.Wrap(err, "failed to create blob directory")
+	}
+
+	return &localStore{dir: dir}, nil
+}
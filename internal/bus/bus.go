@@ -0,0 +1,53 @@
+package bus
+
+import (
+	"context"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+)
+
+// Обработчик сообщения из шины
+// Возврат ошибки означает, что сообщение нужно доставить повторно
+type HandlerFunc func(ctx context.Context, msg *models.SendMessage) error
+
+// Подтверждение обработки сообщения
+// Ошибка означает, что сообщение нужно доставить повторно
+type AckFunc func(err error)
+
+// Обработчик, который подтверждает сообщение сам, когда оно действительно обработано, в том числе из другой горутины
+// ack вызывается ровно один раз
+type AsyncHandlerFunc func(ctx context.Context, msg *models.SendMessage, ack AckFunc)
+
+// Отправка событий чатов в шину
+type Publisher interface {
+	Publish(ctx context.Context, msg *models.SendMessage) error
+}
+
+// Получение событий чатов из шины
+type Subscriber interface {
+	Subscribe(handler HandlerFunc) (Subscription, error)
+	// Сообщение подтверждается вызовом ack, а не возвратом из обработчика
+	SubscribeAsync(handler AsyncHandlerFunc) (Subscription, error)
+}
+
+// Кратковременные сигналы чатов, например набор текста
+// Сигналы не сохраняются и не доставляются повторно, каждый сигнал получают все подписчики
+type Broadcaster interface {
+	Broadcast(ctx context.Context, msg *models.SendMessage) error
+	SubscribeBroadcast(handler HandlerFunc) (Subscription, error)
+}
+
+// Активная подписка
+type Subscription interface {
+	// Прекращает получение новых сообщений
+	Stop()
+}
+
+// Шина сообщений чатов
+type Bus interface {
+	Publisher
+	Subscriber
+	Broadcaster
+	// Завершение работы шины, ожидает отправки и подтверждения сообщений не дольше ctx
+	Close(ctx context.Context) error
+}
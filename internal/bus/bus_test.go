@@ -0,0 +1,393 @@
+package bus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/natsserver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const testSubject = "events.test"
+
+// Тема сигналов вне потока
+const testSignalSubject = "signals.test"
+
+// Время ожидания сообщений в тестах
+const waitTimeout = 5 * time.Second
+
+// Поток и получатель на встроенном NATS сервере
+func newTestJetStream(t *testing.T) (*nats.Conn, jetstream.JetStream, jetstream.Consumer) {
+	t.Helper()
+
+	srv, err := natsserver.New(zerolog.Nop(), "127.0.0.1", -1, "")
+	if err != nil {
+		t.Fatalf("failed to start nats server: %v", err)
+	}
+	t.Cleanup(srv.Shutdown)
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("failed to create jetstream: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:      "EVENTS",
+		Subjects:  []string{"events.>"},
+		Retention: jetstream.LimitsPolicy,
+		Storage:   jetstream.MemoryStorage,
+	})
+	if err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+
+	cons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:   "test",
+		AckPolicy: jetstream.AckExplicitPolicy,
+		AckWait:   time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create consumer: %v", err)
+	}
+
+	return nc, js, cons
+}
+
+// Шины для общих тестов
+func testBuses(t *testing.T) map[string]func(t *testing.T) Bus {
+	return map[string]func(t *testing.T) Bus{
+		"memory": func(t *testing.T) Bus {
+			return NewMemory(zerolog.Nop(), 16)
+		},
+		"jetstream": func(t *testing.T) Bus {
+			nc, js, cons := newTestJetStream(t)
+			return NewJetStream(zerolog.Nop(), nc, js, cons, testSubject, testSignalSubject)
+		},
+	}
+}
+
+// Получатель, складывающий сообщения в канал
+func collect(t *testing.T, b Bus, handler HandlerFunc) <-chan *models.SendMessage {
+	t.Helper()
+
+	received := make(chan *models.SendMessage, 16)
+	sub, err := b.Subscribe(func(ctx context.Context, msg *models.SendMessage) error {
+		if handler != nil {
+			if err := handler(ctx, msg); err != nil {
+				return err
+			}
+		}
+		received <- msg
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	t.Cleanup(sub.Stop)
+
+	return received
+}
+
+func receive(t *testing.T, received <-chan *models.SendMessage) *models.SendMessage {
+	t.Helper()
+
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(waitTimeout):
+		t.Fatal("message is not received")
+		return nil
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	for name, newBus := range testBuses(t) {
+		t.Run(name, func(t *testing.T) {
+			b := newBus(t)
+			received := collect(t, b, nil)
+
+			ctx := context.Background()
+			for seq := int64(1); seq <= 3; seq++ {
+				if err := b.Publish(ctx, &models.SendMessage{ChatId: 7, Seq: seq, Msg: "hi", Author: "Alice"}); err != nil {
+					t.Fatalf("Publish() error = %v", err)
+				}
+			}
+
+			for seq := int64(1); seq <= 3; seq++ {
+				msg := receive(t, received)
+				if msg.ChatId != 7 || msg.Seq != seq || msg.Msg != "hi" || msg.Author != "Alice" {
+					t.Errorf("received %+v, want seq %d", msg, seq)
+				}
+				if msg.PublishedAt.IsZero() {
+					t.Error("PublishedAt is not set")
+				}
+			}
+
+			closeCtx, cancel := context.WithTimeout(ctx, waitTimeout)
+			defer cancel()
+			if err := b.Close(closeCtx); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+		})
+	}
+}
+
+// Ошибка обработчика приводит к повторной доставке
+func TestRedeliveryOnHandlerError(t *testing.T) {
+	for name, newBus := range testBuses(t) {
+		t.Run(name, func(t *testing.T) {
+			b := newBus(t)
+
+			var mu sync.Mutex
+			attempts := 0
+			received := collect(t, b, func(context.Context, *models.SendMessage) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				attempts++
+				if attempts == 1 {
+					return errors.New("temporary failure")
+				}
+				return nil
+			})
+
+			if err := b.Publish(context.Background(), &models.SendMessage{ChatId: 1, Seq: 1}); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+
+			if msg := receive(t, received); msg.Seq != 1 {
+				t.Errorf("received seq %d, want 1", msg.Seq)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != 2 {
+				t.Errorf("handler called %d times, want 2", attempts)
+			}
+		})
+	}
+}
+
+// Шина в памяти повторяет обработку до следующих сообщений и пропускает сообщение после memoryMaxDeliver попыток
+func TestMemoryRetriesInPlace(t *testing.T) {
+	b := NewMemory(zerolog.Nop(), 16)
+
+	var mu sync.Mutex
+	attempts := map[int64]int{}
+	received := collect(t, b, func(_ context.Context, msg *models.SendMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts[msg.Seq]++
+		if msg.Seq == 1 && attempts[1] < 3 || msg.Seq == 2 {
+			return errors.New("failure")
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	for seq := int64(1); seq <= 3; seq++ {
+		if err := b.Publish(ctx, &models.SendMessage{ChatId: 1, Seq: seq}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+
+	for _, want := range []int64{1, 3} {
+		if msg := receive(t, received); msg.Seq != want {
+			t.Errorf("received seq %d, want %d", msg.Seq, want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts[1] != 3 || attempts[2] != memoryMaxDeliver {
+		t.Errorf("attempts = %v, want 3 for seq 1 and %d for seq 2", attempts, memoryMaxDeliver)
+	}
+}
+
+// Сообщение, которое не удалось декодировать, больше не доставляется
+func TestJetStreamTerminatesInvalidMessage(t *testing.T) {
+	nc, js, cons := newTestJetStream(t)
+	b := NewJetStream(zerolog.Nop(), nc, js, cons, testSubject, testSignalSubject)
+	received := collect(t, b, nil)
+
+	ctx := context.Background()
+	if _, err := js.Publish(ctx, testSubject, []byte("not json")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if err := b.Publish(ctx, &models.SendMessage{ChatId: 1, Seq: 1}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	if msg := receive(t, received); msg.Seq != 1 {
+		t.Errorf("received seq %d, want 1", msg.Seq)
+	}
+
+	// После AckWait неподтвержденное сообщение пришло бы повторно
+	select {
+	case msg := <-received:
+		t.Errorf("unexpected message %+v", msg)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	info, err := cons.Info(ctx)
+	if err != nil {
+		t.Fatalf("Info() error = %v", err)
+	}
+	if info.NumAckPending != 0 {
+		t.Errorf("NumAckPending = %d, want 0", info.NumAckPending)
+	}
+}
+
+// Сообщение JetStream остается неподтвержденным, пока обработчик не вызовет ack
+func TestJetStreamAcksOnAsyncAck(t *testing.T) {
+	nc, js, cons := newTestJetStream(t)
+	b := NewJetStream(zerolog.Nop(), nc, js, cons, testSubject, testSignalSubject)
+
+	acks := make(chan AckFunc, 1)
+	sub, err := b.SubscribeAsync(func(_ context.Context, _ *models.SendMessage, ack AckFunc) {
+		acks <- ack
+	})
+	if err != nil {
+		t.Fatalf("SubscribeAsync() error = %v", err)
+	}
+	t.Cleanup(sub.Stop)
+
+	ctx := context.Background()
+	if err = b.Publish(ctx, &models.SendMessage{ChatId: 1, Seq: 1}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	var ack AckFunc
+	select {
+	case ack = <-acks:
+	case <-time.After(waitTimeout):
+		t.Fatal("message is not received")
+	}
+
+	pending := func() int {
+		info, err := cons.Info(ctx)
+		if err != nil {
+			t.Fatalf("Info() error = %v", err)
+		}
+		return info.NumAckPending
+	}
+	if n := pending(); n != 1 {
+		t.Fatalf("NumAckPending before ack = %d, want 1", n)
+	}
+
+	ack(nil)
+	if n := pending(); n != 0 {
+		t.Errorf("NumAckPending after ack = %d, want 0", n)
+	}
+}
+
+// Получатель каждого экземпляра получает все сообщения, а сообщение общего получателя - один из экземпляров
+func TestJetStreamConsumers(t *testing.T) {
+	nc, js, _ := newTestJetStream(t)
+	ctx := context.Background()
+
+	newBus := func(name string) Bus {
+		cons, err := js.CreateOrUpdateConsumer(ctx, "EVENTS", jetstream.ConsumerConfig{
+			Durable:   name,
+			AckPolicy: jetstream.AckExplicitPolicy,
+		})
+		if err != nil {
+			t.Fatalf("failed to create consumer %s: %v", name, err)
+		}
+		return NewJetStream(zerolog.Nop(), nc, js, cons, testSubject, testSignalSubject)
+	}
+
+	first := collect(t, newBus("instance-1"), nil)
+	second := collect(t, newBus("instance-2"), nil)
+	sharedFirst := collect(t, newBus("shared"), nil)
+	sharedSecond := collect(t, newBus("shared"), nil)
+
+	const count = 4
+	for seq := int64(1); seq <= count; seq++ {
+		if err := newBus("publisher").Publish(ctx, &models.SendMessage{ChatId: 1, Seq: seq}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+
+	for _, received := range []<-chan *models.SendMessage{first, second} {
+		for seq := int64(1); seq <= count; seq++ {
+			if msg := receive(t, received); msg.Seq != seq {
+				t.Errorf("received seq %d, want %d", msg.Seq, seq)
+			}
+		}
+	}
+
+	seen := make(map[int64]bool)
+	for len(seen) < count {
+		select {
+		case msg := <-sharedFirst:
+			seen[msg.Seq] = true
+		case msg := <-sharedSecond:
+			seen[msg.Seq] = true
+		case <-time.After(waitTimeout):
+			t.Fatalf("shared consumer received seqs %v, want %d", seen, count)
+		}
+	}
+	select {
+	case msg := <-sharedFirst:
+		t.Errorf("shared message delivered twice: %+v", msg)
+	case msg := <-sharedSecond:
+		t.Errorf("shared message delivered twice: %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// Сигнал получают все подписчики на сигналы, в поток он не попадает
+func TestBroadcast(t *testing.T) {
+	for name, newBus := range testBuses(t) {
+		t.Run(name, func(t *testing.T) {
+			b := newBus(t)
+			queued := collect(t, b, nil)
+
+			var listeners []chan *models.SendMessage
+			for i := 0; i < 2; i++ {
+				received := make(chan *models.SendMessage, 16)
+				sub, err := b.SubscribeBroadcast(func(_ context.Context, msg *models.SendMessage) error {
+					received <- msg
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("SubscribeBroadcast() error = %v", err)
+				}
+				t.Cleanup(sub.Stop)
+				listeners = append(listeners, received)
+			}
+
+			signal := &models.SendMessage{ChatId: 3, Event: models.EventTypingStart, AuthorId: "1"}
+			if err := b.Broadcast(context.Background(), signal); err != nil {
+				t.Fatalf("Broadcast() error = %v", err)
+			}
+
+			for i, received := range listeners {
+				if msg := receive(t, received); msg.ChatId != 3 || msg.Event != models.EventTypingStart || msg.AuthorId != "1" {
+					t.Errorf("listener %d received %+v", i, msg)
+				}
+			}
+
+			select {
+			case msg := <-queued:
+				t.Errorf("signal delivered as a message: %+v", msg)
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/metrics"
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/tracing"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Шина на базе NATS JetStream
+type jetStreamBus struct {
+	logger   zerolog.Logger
+	nc       *nats.Conn
+	js       jetstream.JetStream
+	consumer jetstream.Consumer
+	subject  string
+	// Тема сигналов вне потока, сигналы идут через NATS без JetStream
+	signalSubject string
+}
+
+// Публикуем сообщение в тему потока
+// Контекст трассировки передается в заголовках сообщения
+func (b *jetStreamBus) Publish(ctx context.Context, msg *models.SendMessage) error {
+	ctx, span := tracing.Tracer().Start(ctx, "bus.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", b.subject),
+			attribute.Int("chat_id", msg.ChatId),
+		),
+	)
+	defer span.End()
+
+	msg.PublishedAt = time.Now()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal message")
+	}
+
+	m := nats.NewMsg(b.subject)
+	m.Data = data
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(m.Header))
+
+	if _, err = b.js.PublishMsg(ctx, m); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return errors.Wrap(err, "failed to publish message")
+	}
+	metrics.MessagesPublished.Inc()
+
+	return nil
+}
+
+// Получаем сообщения через consumer
+// Успешно обработанные сообщения подтверждаются, при ошибке обработчика - повторная доставка,
+// сообщения, которые не удалось декодировать, больше не доставляются
+func (b *jetStreamBus) Subscribe(handler HandlerFunc) (Subscription, error) {
+	return b.SubscribeAsync(func(ctx context.Context, msg *models.SendMessage, ack AckFunc) {
+		ack(handler(ctx, msg))
+	})
+}
+
+// Сообщение подтверждается, когда обработчик вызовет ack
+// До этого оно считается неподтвержденным, и после AckWait сервер доставит его повторно
+func (b *jetStreamBus) SubscribeAsync(handler AsyncHandlerFunc) (Subscription, error) {
+	cc, err := b.consumer.Consume(func(m jetstream.Msg) {
+		metrics.MessagesConsumed.Inc()
+
+		// Продолжаем трассировку отправителя
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(m.Headers()))
+		ctx, span := tracing.Tracer().Start(ctx, "bus.consume",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "nats"),
+				attribute.String("messaging.destination.name", m.Subject()),
+			),
+		)
+		defer span.End()
+
+		logger := b.logger
+		if meta, err := m.Metadata(); err == nil {
+			span.SetAttributes(attribute.Int64("nats_seq", int64(meta.Sequence.Stream)))
+			logger = logger.With().Uint64("nats_seq", meta.Sequence.Stream).Uint64("deliveries", meta.NumDelivered).Logger()
+		}
+
+		var msg = new(models.SendMessage)
+		if err := json.Unmarshal(m.Data(), msg); err != nil {
+			logger.Error().Err(err).Msg("failed to unmarshal message")
+			span.RecordError(err)
+			if err = m.Term(); err != nil {
+				logger.Error().Err(err).Msg("failed to terminate message")
+			}
+			return
+		}
+		span.SetAttributes(attribute.Int("chat_id", msg.ChatId))
+
+		// Логгер с nats_seq доступен обработчику через контекст
+		logger = logger.With().Int("chat_id", msg.ChatId).Int64("seq", msg.Seq).Logger()
+		ctx = logger.WithContext(ctx)
+
+		handler(ctx, msg, func(err error) {
+			if err != nil {
+				logger.Error().Err(err).Msg("failed to handle message")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				if err = m.Nak(); err != nil {
+					logger.Error().Err(err).Msg("failed to nak message")
+					return
+				}
+				metrics.MessagesNacked.Inc()
+				return
+			}
+
+			if err := m.DoubleAck(ctx); err != nil {
+				logger.Error().Err(err).Msg("failed to ack message")
+				return
+			}
+			metrics.MessagesAcked.Inc()
+		})
+	}, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		b.logger.Error().Err(err).Msg("consume error")
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to consume")
+	}
+
+	return cc, nil
+}
+
+// Публикуем сигнал в тему без сохранения
+func (b *jetStreamBus) Broadcast(_ context.Context, msg *models.SendMessage) error {
+	msg.PublishedAt = time.Now()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal signal")
+	}
+
+	if err = b.nc.Publish(b.signalSubject, data); err != nil {
+		return errors.Wrap(err, "failed to publish signal")
+	}
+
+	return nil
+}
+
+// Получаем сигналы всех экземпляров сервиса
+// Ошибка обработчика только логируется, сигналы повторно не доставляются
+func (b *jetStreamBus) SubscribeBroadcast(handler HandlerFunc) (Subscription, error) {
+	sub, err := b.nc.Subscribe(b.signalSubject, func(m *nats.Msg) {
+		var msg = new(models.SendMessage)
+		if err := json.Unmarshal(m.Data, msg); err != nil {
+			b.logger.Error().Err(err).Msg("failed to unmarshal signal")
+			return
+		}
+
+		logger := b.logger.With().Int("chat_id", msg.ChatId).Str("event", msg.Event).Logger()
+		if err := handler(logger.WithContext(context.Background()), msg); err != nil {
+			logger.Error().Err(err).Msg("failed to handle signal")
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to subscribe to signals")
+	}
+
+	return &natsSubscription{logger: b.logger, sub: sub}, nil
+}
+
+// Подписка на тему NATS без JetStream
+type natsSubscription struct {
+	logger zerolog.Logger
+	sub    *nats.Subscription
+}
+
+func (s *natsSubscription) Stop() {
+	if err := s.sub.Unsubscribe(); err != nil {
+		s.logger.Debug().Err(err).Msg("failed to unsubscribe from signals")
+	}
+}
+
+// Закрытие подключения к NATS
+// Drain дожидается подтверждения отправленных и полученных сообщений
+func (b *jetStreamBus) Close(ctx context.Context) error {
+	closed := make(chan struct{})
+	b.nc.SetClosedHandler(func(_ *nats.Conn) {
+		close(closed)
+	})
+
+	if err := b.nc.Drain(); err != nil {
+		return errors.Wrap(err, "failed to drain nats connection")
+	}
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		b.nc.Close()
+		return errors.Wrap(ctx.Err(), "nats connection drain timed out")
+	}
+}
+
+// signalSubject не должна входить в темы потока, иначе сигналы будут сохраняться
+func NewJetStream(logger zerolog.Logger, nc *nats.Conn, js jetstream.JetStream, consumer jetstream.Consumer, subject string, signalSubject string) Bus {
+	return &jetStreamBus{
+		logger:        logger,
+		nc:            nc,
+		js:            js,
+		consumer:      consumer,
+		subject:       subject,
+		signalSubject: signalSubject,
+	}
+}
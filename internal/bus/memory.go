@@ -0,0 +1,200 @@
+package bus
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/metrics"
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/tracing"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Число попыток обработки сообщения шиной в памяти и пауза между ними
+const (
+	memoryMaxDeliver = 5
+	memoryRetryDelay = 100 * time.Millisecond
+)
+
+// Шина в памяти процесса
+// Каждое сообщение получает один из подписчиков, как у общего получателя JetStream
+// Сообщения не переживают перезапуск, подходит для тестов и запуска без NATS
+type memoryBus struct {
+	logger zerolog.Logger
+	queue  chan envelope
+
+	mu sync.Mutex
+	// Подписчики на сигналы
+	listeners map[*memoryListener]HandlerFunc
+}
+
+// Сообщение в очереди вместе с контекстом трассировки отправителя
+type envelope struct {
+	ctx context.Context
+	msg *models.SendMessage
+}
+
+// Кладем сообщение в очередь, ждем свободного места не дольше ctx
+func (b *memoryBus) Publish(ctx context.Context, msg *models.SendMessage) error {
+	ctx, span := tracing.Tracer().Start(ctx, "bus.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "memory"),
+			attribute.Int("chat_id", msg.ChatId),
+		),
+	)
+	defer span.End()
+
+	msg.PublishedAt = time.Now()
+
+	select {
+	case b.queue <- envelope{ctx: tracing.Detach(ctx), msg: msg}:
+		metrics.MessagesPublished.Inc()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Запускаем получение сообщений в отдельной горутине
+// При ошибке обработчика сообщение обрабатывается повторно до следующих сообщений
+func (b *memoryBus) Subscribe(handler HandlerFunc) (Subscription, error) {
+	return b.SubscribeAsync(func(ctx context.Context, msg *models.SendMessage, ack AckFunc) {
+		ack(handler(ctx, msg))
+	})
+}
+
+// Следующее сообщение передается обработчику, не дожидаясь ack
+func (b *memoryBus) SubscribeAsync(handler AsyncHandlerFunc) (Subscription, error) {
+	sub := &memorySubscription{done: make(chan struct{})}
+
+	go func() {
+		for {
+			select {
+			case <-sub.done:
+				return
+			case env := <-b.queue:
+				b.handle(handler, env, sub.done)
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+// Обработка одного сообщения
+func (b *memoryBus) handle(handler AsyncHandlerFunc, env envelope, done <-chan struct{}) {
+	metrics.MessagesConsumed.Inc()
+
+	ctx, span := tracing.Tracer().Start(env.ctx, "bus.consume",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "memory"),
+			attribute.Int("chat_id", env.msg.ChatId),
+		),
+	)
+	defer span.End()
+
+	logger := b.logger.With().Int("chat_id", env.msg.ChatId).Int64("seq", env.msg.Seq).Logger()
+	ctx = logger.WithContext(ctx)
+
+	b.attempt(ctx, handler, env.msg, 1, done)
+}
+
+// Попытка обработки сообщения, повтор запускается из ack
+// Повтор выполняется на месте, а не через очередь: получатель пропускает сообщения чата с номером меньше уже разосланного,
+// поэтому сообщение, вернувшееся в очередь после следующих, было бы потеряно
+// Если обработчик вызывает ack сразу, повтор завершается до следующих сообщений
+func (b *memoryBus) attempt(ctx context.Context, handler AsyncHandlerFunc, msg *models.SendMessage, n int, done <-chan struct{}) {
+	handler(ctx, msg, func(err error) {
+		if err == nil {
+			metrics.MessagesAcked.Inc()
+			return
+		}
+		logger := zerolog.Ctx(ctx)
+		logger.Error().Err(err).Int("attempt", n).Msg("failed to handle message")
+		span := trace.SpanFromContext(ctx)
+		span.RecordError(err)
+		metrics.MessagesNacked.Inc()
+
+		if n == memoryMaxDeliver {
+			span.SetStatus(codes.Error, err.Error())
+			logger.Error().Msg("message dropped after failed attempts")
+			return
+		}
+
+		select {
+		case <-time.After(memoryRetryDelay):
+		case <-done:
+			return
+		}
+		b.attempt(ctx, handler, msg, n+1, done)
+	})
+}
+
+// Сигнал сразу передается всем подписчикам в горутине отправителя
+func (b *memoryBus) Broadcast(ctx context.Context, msg *models.SendMessage) error {
+	msg.PublishedAt = time.Now()
+
+	b.mu.Lock()
+	handlers := make([]HandlerFunc, 0, len(b.listeners))
+	for _, handler := range b.listeners {
+		handlers = append(handlers, handler)
+	}
+	b.mu.Unlock()
+
+	for _, handler := range handlers {
+		if err := handler(ctx, msg); err != nil {
+			b.logger.Error().Err(err).Int("chat_id", msg.ChatId).Str("event", msg.Event).Msg("failed to handle signal")
+		}
+	}
+
+	return nil
+}
+
+func (b *memoryBus) SubscribeBroadcast(handler HandlerFunc) (Subscription, error) {
+	listener := &memoryListener{bus: b}
+
+	b.mu.Lock()
+	b.listeners[listener] = handler
+	b.mu.Unlock()
+
+	return listener, nil
+}
+
+// Подписка на сигналы шины в памяти
+type memoryListener struct {
+	bus *memoryBus
+}
+
+func (l *memoryListener) Stop() {
+	l.bus.mu.Lock()
+	delete(l.bus.listeners, l)
+	l.bus.mu.Unlock()
+}
+
+// Шине в памяти нечего закрывать, неразосланные сообщения теряются
+func (b *memoryBus) Close(_ context.Context) error {
+	return nil
+}
+
+type memorySubscription struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func (s *memorySubscription) Stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func NewMemory(logger zerolog.Logger, size int) Bus {
+	return &memoryBus{
+		logger:    logger,
+		queue:     make(chan envelope, size),
+		listeners: make(map[*memoryListener]HandlerFunc),
+	}
+}
@@ -2,14 +2,21 @@ package config
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 
+	"github.com/Yury132/Golang-Task-3/internal/blob"
+	"github.com/Yury132/Golang-Task-3/internal/service"
+	"github.com/Yury132/Golang-Task-3/internal/tracing"
+	"github.com/Yury132/Golang-Task-3/internal/unfurl"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -20,16 +27,46 @@ import (
 )
 
 const (
-	formatJSON  = "json"
-	redirectURL = "http://localhost:8080/callback"
-	envFile     = "./internal/config/.env"
+	formatJSON = "json"
+	envFile    = "./internal/config/.env"
+
+	storageFile   = "file"
+	storageMemory = "memory"
+)
+
+// Хранилища вложений
+const (
+	AttachmentsLocal = "local"
+	AttachmentsS3    = "s3"
+)
+
+// Реализации шины сообщений
+const (
+	BusJetStream = "jetstream"
+	BusMemory    = "memory"
 )
 
 type Config struct {
 	Server struct {
-		Host        string `envconfig:"SERVER_HOST" default:":9000"`
+		Host        string `envconfig:"SERVER_HOST" default:":8080"`
 		MetricsBind string `envconfig:"BIND_METRICS" default:":9090"`
 		HealthHost  string `envconfig:"BIND_HEALTH" default:":9091"`
+
+		ReadTimeout       time.Duration `envconfig:"SERVER_READ_TIMEOUT" default:"15s"`
+		ReadHeaderTimeout time.Duration `envconfig:"SERVER_READ_HEADER_TIMEOUT" default:"5s"`
+		WriteTimeout      time.Duration `envconfig:"SERVER_WRITE_TIMEOUT" default:"15s"`
+		IdleTimeout       time.Duration `envconfig:"SERVER_IDLE_TIMEOUT" default:"60s"`
+		// Время на запись сообщения клиенту WebSocket, клиент, который не принимает сообщения, отключается
+		WSWriteTimeout time.Duration `envconfig:"SERVER_WS_WRITE_TIMEOUT" default:"10s"`
+
+		// TLS включается, если заданы оба файла
+		TLSCertFile string `envconfig:"SERVER_TLS_CERT_FILE"`
+		TLSKeyFile  string `envconfig:"SERVER_TLS_KEY_FILE"`
+		// Интервал проверки файлов сертификата на изменение, 0 - не перечитывать
+		TLSReloadInterval time.Duration `envconfig:"SERVER_TLS_RELOAD_INTERVAL" default:"0"`
+
+		// Максимальное время плавной остановки сервиса
+		ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
 	}
 
 	Service struct {
@@ -37,6 +74,16 @@ type Config struct {
 		LogFormat string `envconfig:"LOGGER_FORMAT" default:"console"`
 	}
 
+	Tracing struct {
+		// none, stdout или otlp
+		Exporter    string `envconfig:"TRACING_EXPORTER" default:"none"`
+		ServiceName string `envconfig:"TRACING_SERVICE_NAME" default:"chat-server"`
+		// Адрес OTLP/HTTP коллектора host:port, по умолчанию OTEL_EXPORTER_OTLP_ENDPOINT или localhost:4318
+		OTLPEndpoint string  `envconfig:"TRACING_OTLP_ENDPOINT"`
+		OTLPInsecure bool    `envconfig:"TRACING_OTLP_INSECURE" default:"true"`
+		SampleRatio  float64 `envconfig:"TRACING_SAMPLE_RATIO" default:"1"`
+	}
+
 	DB struct {
 		Address  string `envconfig:"DB_ADDRESS" default:"localhost"`
 		Name     string `envconfig:"DB_NAME" default:"mydb"`
@@ -49,10 +96,124 @@ type Config struct {
 	Auth struct {
 		ClientID     string `envconfig:"AUTH_CLIENT_ID"`
 		ClientSecret string `envconfig:"AUTH_CLIENT_SECRET"`
+		RedirectURL  string `envconfig:"AUTH_REDIRECT_URL" default:"http://localhost:8080/callback"`
+		// Токен входа без Google для нагрузочного тестирования, пустой - вход отключен
+		TestToken string `envconfig:"AUTH_TEST_TOKEN"`
+	}
+
+	Workers struct {
+		// Количество воркеров рассылки
+		Size int `envconfig:"WORKERS_SIZE" default:"3"`
+		// Размер очереди каждого воркера
+		QueueSize int `envconfig:"WORKERS_QUEUE_SIZE" default:"100"`
+	}
+
+	Search struct {
+		// Конфигурация полнотекстового поиска PostgreSQL
+		// russian разбирает и русские, и английские слова
+		Language string `envconfig:"SEARCH_LANGUAGE" default:"russian"`
+	}
+
+	Attachments struct {
+		// local или s3
+		Driver string `envconfig:"ATTACHMENTS_DRIVER" default:"local"`
+		// Каталог файлов для local
+		Dir string `envconfig:"ATTACHMENTS_DIR" default:"./data/attachments"`
+		// Максимальный размер файла в байтах
+		MaxSize int64 `envconfig:"ATTACHMENTS_MAX_SIZE" default:"10485760"`
+		// Разрешенные типы содержимого, допускаются маски вида image/*
+		AllowedTypes []string `envconfig:"ATTACHMENTS_ALLOWED_TYPES" default:"image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain,application/zip"`
+		// Сторона квадрата миниатюры изображения, 0 - без миниатюр
+		ThumbnailSize int `envconfig:"ATTACHMENTS_THUMBNAIL_SIZE" default:"320"`
+		// Изображения с большим числом пикселей остаются без миниатюры
+		MaxPixels int `envconfig:"ATTACHMENTS_MAX_PIXELS" default:"25000000"`
+		// Время на загрузку или скачивание одного файла вместо SERVER_READ_TIMEOUT и SERVER_WRITE_TIMEOUT
+		TransferTimeout time.Duration `envconfig:"ATTACHMENTS_TRANSFER_TIMEOUT" default:"5m"`
+		// Загруженные, но не отправленные за это время вложения удаляются, 0 - не удалять
+		UnsentTTL       time.Duration `envconfig:"ATTACHMENTS_UNSENT_TTL" default:"24h"`
+		CleanupInterval time.Duration `envconfig:"ATTACHMENTS_CLEANUP_INTERVAL" default:"1h"`
+	}
+
+	// S3-совместимое хранилище вложений
+	S3 struct {
+		Endpoint  string `envconfig:"S3_ENDPOINT" default:"https://s3.amazonaws.com"`
+		Region    string `envconfig:"S3_REGION" default:"us-east-1"`
+		Bucket    string `envconfig:"S3_BUCKET"`
+		AccessKey string `envconfig:"S3_ACCESS_KEY"`
+		SecretKey string `envconfig:"S3_SECRET_KEY"`
+		// Имя корзины в пути, а не в имени хоста, как требует MinIO
+		PathStyle bool `envconfig:"S3_PATH_STYLE" default:"false"`
+	}
+
+	// Превью ссылок в сообщениях
+	Previews struct {
+		Enabled bool `envconfig:"PREVIEWS_ENABLED" default:"true"`
+		// Число одновременно обрабатываемых сообщений и размер их очереди
+		Workers   int `envconfig:"PREVIEWS_WORKERS" default:"2"`
+		QueueSize int `envconfig:"PREVIEWS_QUEUE_SIZE" default:"100"`
+		// Общее время загрузки страницы вместе с перенаправлениями
+		Timeout time.Duration `envconfig:"PREVIEWS_TIMEOUT" default:"5s"`
+		// Сколько байт начала страницы читается в поисках метаданных
+		MaxBodySize  int64  `envconfig:"PREVIEWS_MAX_BODY_SIZE" default:"524288"`
+		MaxRedirects int    `envconfig:"PREVIEWS_MAX_REDIRECTS" default:"3"`
+		UserAgent    string `envconfig:"PREVIEWS_USER_AGENT" default:"Mozilla/5.0 (compatible; ChatLinkPreview/1.0)"`
+		// Время жизни превью в кеше и время, в течение которого не запрашивается страница, которую не удалось развернуть
+		CacheTTL   time.Duration `envconfig:"PREVIEWS_CACHE_TTL" default:"24h"`
+		FailureTTL time.Duration `envconfig:"PREVIEWS_FAILURE_TTL" default:"1h"`
+	}
+
+	Presence struct {
+		// Имя экземпляра в записях присутствия, по умолчанию - имя хоста со случайным суффиксом
+		Instance string `envconfig:"PRESENCE_INSTANCE"`
+		// Корзина NATS KV с записями присутствия и время их хранения
+		Bucket string        `envconfig:"PRESENCE_BUCKET" default:"presence"`
+		TTL    time.Duration `envconfig:"PRESENCE_TTL" default:"24h"`
+	}
+
+	Bus struct {
+		// jetstream или memory
+		Driver string `envconfig:"BUS_DRIVER" default:"jetstream"`
+		// Размер очереди шины в памяти
+		MemorySize int `envconfig:"BUS_MEMORY_SIZE" default:"1024"`
 	}
 
 	NATS struct {
 		URL string `envconfig:"NATS_URL" default:"nats://localhost:4222"`
+
+		// Встроенный сервер, при включении NATS_URL игнорируется
+		Embedded struct {
+			Enabled  bool   `envconfig:"NATS_EMBEDDED" default:"false"`
+			Host     string `envconfig:"NATS_EMBEDDED_HOST" default:"127.0.0.1"`
+			Port     int    `envconfig:"NATS_EMBEDDED_PORT" default:"4222"`
+			StoreDir string `envconfig:"NATS_EMBEDDED_STORE_DIR"`
+		}
+
+		// Тема, в которую публикуются сообщения чатов
+		Subject string `envconfig:"NATS_SUBJECT" default:"events.us.page_loaded"`
+		// Тема кратковременных сигналов (набор текста), не должна входить в темы потока
+		SignalSubject string `envconfig:"NATS_SIGNAL_SUBJECT" default:"signals.chat"`
+
+		Stream struct {
+			Name     string        `envconfig:"NATS_STREAM_NAME" default:"EVENTS"`
+			Subjects []string      `envconfig:"NATS_STREAM_SUBJECTS" default:"events.>"`
+			Storage  string        `envconfig:"NATS_STREAM_STORAGE" default:"file"`
+			Replicas int           `envconfig:"NATS_STREAM_REPLICAS" default:"1"`
+			MaxAge   time.Duration `envconfig:"NATS_STREAM_MAX_AGE" default:"24h"`
+			MaxBytes int64         `envconfig:"NATS_STREAM_MAX_BYTES" default:"-1"`
+			// Окно для отбрасывания дубликатов по заголовку Nats-Msg-Id
+			DuplicateWindow time.Duration `envconfig:"NATS_STREAM_DUPLICATE_WINDOW" default:"2m"`
+		}
+
+		// Каждый экземпляр читает поток своим временным получателем <Name>-<экземпляр>, чтобы разослать все сообщения своим подключениям,
+		// а превью ссылок строит общий получатель Name, сообщение из которого получает один экземпляр
+		Consumer struct {
+			Name          string        `envconfig:"NATS_CONSUMER_NAME" default:"processor-1"`
+			AckWait       time.Duration `envconfig:"NATS_CONSUMER_ACK_WAIT" default:"30s"`
+			MaxAckPending int           `envconfig:"NATS_CONSUMER_MAX_ACK_PENDING" default:"1000"`
+			MaxDeliver    int           `envconfig:"NATS_CONSUMER_MAX_DELIVER" default:"5"`
+			// Временный получатель остановленного экземпляра удаляется, если его не читали столько времени
+			InactiveThreshold time.Duration `envconfig:"NATS_CONSUMER_INACTIVE_THRESHOLD" default:"1m"`
+		}
 	}
 }
 
@@ -88,6 +249,73 @@ func (cfg Config) Logger() (logger zerolog.Logger) {
 	return zerolog.New(out).Level(level).With().Caller().Timestamp().Logger()
 }
 
+// Включен ли TLS на основном сервере
+func (cfg Config) TLSEnabled() bool {
+	return cfg.Server.TLSCertFile != "" && cfg.Server.TLSKeyFile != ""
+}
+
+// Настройки трассировки
+func (cfg Config) TracingOptions() tracing.Options {
+	return tracing.Options{
+		ServiceName:  cfg.Tracing.ServiceName,
+		Exporter:     cfg.Tracing.Exporter,
+		OTLPEndpoint: cfg.Tracing.OTLPEndpoint,
+		OTLPInsecure: cfg.Tracing.OTLPInsecure,
+		SampleRatio:  cfg.Tracing.SampleRatio,
+	}
+}
+
+// Хранилище содержимого вложений
+func (cfg Config) AttachmentStore() (blob.Store, error) {
+	switch cfg.Attachments.Driver {
+	case AttachmentsLocal:
+		return blob.NewLocal(cfg.Attachments.Dir)
+	case AttachmentsS3:
+		return blob.NewS3(blob.S3Options{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+			PathStyle: cfg.S3.PathStyle,
+		})
+	default:
+		return nil, errors.Errorf("unknown attachments driver %q", cfg.Attachments.Driver)
+	}
+}
+
+// Ограничения вложений
+func (cfg Config) AttachmentOptions() service.AttachmentOptions {
+	return service.AttachmentOptions{
+		MaxSize:         cfg.Attachments.MaxSize,
+		AllowedTypes:    cfg.Attachments.AllowedTypes,
+		ThumbnailSize:   cfg.Attachments.ThumbnailSize,
+		MaxPixels:       cfg.Attachments.MaxPixels,
+		UnsentTTL:       cfg.Attachments.UnsentTTL,
+		CleanupInterval: cfg.Attachments.CleanupInterval,
+	}
+}
+
+// Загрузка страниц для превью ссылок
+func (cfg Config) PreviewFetcher() unfurl.Fetcher {
+	return unfurl.New(unfurl.Options{
+		Timeout:      cfg.Previews.Timeout,
+		MaxBodySize:  cfg.Previews.MaxBodySize,
+		MaxRedirects: cfg.Previews.MaxRedirects,
+		UserAgent:    cfg.Previews.UserAgent,
+	})
+}
+
+// Параметры разворачивания ссылок
+func (cfg Config) PreviewOptions() service.PreviewOptions {
+	return service.PreviewOptions{
+		Workers:    cfg.Previews.Workers,
+		QueueSize:  cfg.Previews.QueueSize,
+		CacheTTL:   cfg.Previews.CacheTTL,
+		FailureTTL: cfg.Previews.FailureTTL,
+	}
+}
+
 // Получаем адрес в БД
 func (cfg Config) GetDBConnString() string {
 	return fmt.Sprintf(
@@ -102,13 +330,16 @@ func (cfg Config) PgPoolConfig() (*pgxpool.Config, error) {
 		return nil, err
 	}
 
+	// Спаны SQL запросов
+	poolCfg.ConnConfig.Tracer = tracing.PgxTracer{}
+
 	return poolCfg, nil
 }
 
 // Для Гугл аутентификации
 func (cfg Config) SetupConfig() *oauth2.Config {
 	conf := &oauth2.Config{
-		RedirectURL:  redirectURL,
+		RedirectURL:  cfg.Auth.RedirectURL,
 		ClientID:     cfg.Auth.ClientID,
 		ClientSecret: cfg.Auth.ClientSecret,
 		Scopes: []string{
@@ -120,28 +351,155 @@ func (cfg Config) SetupConfig() *oauth2.Config {
 	return conf
 }
 
-// Создание jetstream.Consumer
-func (cfg Config) NewJS(ctx context.Context, js jetstream.JetStream, logger zerolog.Logger) (jetstream.Consumer, error) {
+// Настройки потока JetStream
+func (cfg Config) StreamConfig() (jetstream.StreamConfig, error) {
+	var storage jetstream.StorageType
+	switch strings.ToLower(cfg.NATS.Stream.Storage) {
+	case storageFile:
+		storage = jetstream.FileStorage
+	case storageMemory:
+		storage = jetstream.MemoryStorage
+	default:
+		return jetstream.StreamConfig{}, errors.Errorf("unknown stream storage type %q", cfg.NATS.Stream.Storage)
+	}
+
+	return jetstream.StreamConfig{
+		Name:       cfg.NATS.Stream.Name,
+		Retention:  jetstream.LimitsPolicy,
+		Subjects:   cfg.NATS.Stream.Subjects,
+		Storage:    storage,
+		Replicas:   cfg.NATS.Stream.Replicas,
+		MaxAge:     cfg.NATS.Stream.MaxAge,
+		MaxBytes:   cfg.NATS.Stream.MaxBytes,
+		Duplicates: cfg.NATS.Stream.DuplicateWindow,
+	}, nil
+}
+
+// Настройки получателя JetStream экземпляра instance
+// Получатель временный: сообщения, опубликованные до запуска экземпляра, ему не нужны, его подключения получат историю из БД,
+// а получатель остановленного экземпляра сервер удаляет через InactiveThreshold
+func (cfg Config) ConsumerConfig(instance string) jetstream.ConsumerConfig {
+	consumer := cfg.SharedConsumerConfig()
+	consumer.Name = cfg.NATS.Consumer.Name + "-" + instance
+	consumer.Durable = ""
+	consumer.InactiveThreshold = cfg.NATS.Consumer.InactiveThreshold
+	return consumer
+}
 
-	streamCfg := jetstream.StreamConfig{
-		Name:      "EVENTS",
-		Retention: jetstream.WorkQueuePolicy,
-		Subjects:  []string{"events.>"},
+// Настройки общего для экземпляров получателя JetStream, каждое сообщение из него обрабатывает один экземпляр
+func (cfg Config) SharedConsumerConfig() jetstream.ConsumerConfig {
+	return jetstream.ConsumerConfig{
+		Name:          cfg.NATS.Consumer.Name,
+		Durable:       cfg.NATS.Consumer.Name,
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       cfg.NATS.Consumer.AckWait,
+		MaxAckPending: cfg.NATS.Consumer.MaxAckPending,
+		MaxDeliver:    cfg.NATS.Consumer.MaxDeliver,
 	}
+}
 
-	// Создаем поток
-	stream, err := js.CreateStream(ctx, streamCfg)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to create new stream")
+// Имя экземпляра сервиса из букв, цифр, - и _, как требуют ключи NATS KV
+func (cfg Config) PresenceInstance() string {
+	instance := cfg.Presence.Instance
+	if instance == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "chat"
+		}
+		suffix := make([]byte, 4)
+		_, _ = rand.Read(suffix)
+		instance = host + "-" + hex.EncodeToString(suffix)
 	}
 
-	// Создаем получателя
-	cons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Name: "processor-1",
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, instance)
+}
+
+// Корзина NATS KV для присутствия, создается при первом запуске
+func (cfg Config) PresenceKV(ctx context.Context, js jetstream.JetStream) (jetstream.KeyValue, error) {
+	kv, err := js.KeyValue(ctx, cfg.Presence.Bucket)
+	if err == nil {
+		return kv, nil
+	}
+	if !errors.Is(err, jetstream.ErrBucketNotFound) {
+		return nil, errors.Wrap(err, "failed to get presence bucket")
+	}
+
+	kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:  cfg.Presence.Bucket,
+		TTL:     cfg.Presence.TTL,
+		Storage: jetstream.MemoryStorage,
 	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create presence bucket")
+	}
+
+	return kv, nil
+}
+
+// Создание jetstream.Consumer экземпляра instance
+// Существующий поток приводится к текущим настройкам, поэтому перезапуск сервиса не падает
+func (cfg Config) NewJS(ctx context.Context, logger zerolog.Logger, js jetstream.JetStream, instance string) (jetstream.Consumer, error) {
+	streamCfg, err := cfg.StreamConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrateStream(ctx, logger, js, streamCfg); err != nil {
+		return nil, err
+	}
+
+	// Создаем или обновляем поток
+	stream, err := js.CreateOrUpdateStream(ctx, streamCfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create or update stream")
+	}
+
+	// Создаем или обновляем получателя
+	cons, err := stream.CreateOrUpdateConsumer(ctx, cfg.ConsumerConfig(instance))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create or update consumer")
+	}
+
+	return cons, nil
+}
+
+// Политику хранения существующего потока изменить нельзя, поэтому поток с другой политикой,
+// например work queue прежних версий, удаляется и создается заново
+// Сообщения чатов хранятся в БД, теряются только еще не разосланные
+func migrateStream(ctx context.Context, logger zerolog.Logger, js jetstream.JetStream, streamCfg jetstream.StreamConfig) error {
+	stream, err := js.Stream(ctx, streamCfg.Name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get stream")
+	}
+
+	retention := stream.CachedInfo().Config.Retention
+	if retention == streamCfg.Retention {
+		return nil
+	}
+
+	if err = js.DeleteStream(ctx, streamCfg.Name); err != nil {
+		return errors.Wrap(err, "failed to delete stream")
+	}
+	logger.Warn().Str("stream", streamCfg.Name).Str("from", retention.String()).Str("to", streamCfg.Retention.String()).
+		Msg("stream retention policy changed, stream recreated")
+
+	return nil
+}
 
+// Создание общего для экземпляров jetstream.Consumer, поток должен быть уже создан
+func (cfg Config) NewSharedConsumer(ctx context.Context, js jetstream.JetStream) (jetstream.Consumer, error) {
+	cons, err := js.CreateOrUpdateConsumer(ctx, cfg.NATS.Stream.Name, cfg.SharedConsumerConfig())
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to create new consumer")
+		return nil, errors.Wrap(err, "failed to create or update shared consumer")
 	}
 
 	return cons, nil
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/natsserver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Время ожидания операций NATS в тестах
+const waitTimeout = 5 * time.Second
+
+// JetStream на встроенном NATS сервере
+func newTestJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+
+	srv, err := natsserver.New(zerolog.Nop(), "127.0.0.1", -1, "")
+	if err != nil {
+		t.Fatalf("failed to start nats server: %v", err)
+	}
+	t.Cleanup(srv.Shutdown)
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("failed to create jetstream: %v", err)
+	}
+
+	return js
+}
+
+// Настройки потока и получателей для тестов
+func newTestConfig() Config {
+	var cfg Config
+	cfg.NATS.Stream.Name = "EVENTS"
+	cfg.NATS.Stream.Subjects = []string{"events.>"}
+	cfg.NATS.Stream.Storage = storageMemory
+	cfg.NATS.Stream.Replicas = 1
+	cfg.NATS.Consumer.Name = "processor-1"
+	cfg.NATS.Consumer.AckWait = time.Second
+	cfg.NATS.Consumer.MaxDeliver = 5
+	cfg.NATS.Consumer.InactiveThreshold = time.Minute
+	return cfg
+}
+
+func TestNewJSRecreatesWorkQueueStream(t *testing.T) {
+	js := newTestJetStream(t)
+	cfg := newTestConfig()
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	// Поток прежних версий
+	_, err := js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:      cfg.NATS.Stream.Name,
+		Subjects:  cfg.NATS.Stream.Subjects,
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.MemoryStorage,
+	})
+	if err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+
+	if _, err = cfg.NewJS(ctx, zerolog.Nop(), js, "a"); err != nil {
+		t.Fatalf("NewJS failed: %v", err)
+	}
+
+	stream, err := js.Stream(ctx, cfg.NATS.Stream.Name)
+	if err != nil {
+		t.Fatalf("failed to get stream: %v", err)
+	}
+	if retention := stream.CachedInfo().Config.Retention; retention != jetstream.LimitsPolicy {
+		t.Fatalf("expected limits retention, got %v", retention)
+	}
+
+	// Повторный запуск не пересоздает поток
+	if _, err = js.Publish(ctx, "events.test", []byte("{}")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if _, err = cfg.NewJS(ctx, zerolog.Nop(), js, "b"); err != nil {
+		t.Fatalf("NewJS failed on restart: %v", err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatalf("failed to get stream info: %v", err)
+	}
+	if info.State.Msgs != 1 {
+		t.Fatalf("expected stream to keep 1 message, got %d", info.State.Msgs)
+	}
+}
+
+func TestNewJSConsumerIsRemovedAfterStop(t *testing.T) {
+	js := newTestJetStream(t)
+	cfg := newTestConfig()
+	cfg.NATS.Consumer.InactiveThreshold = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	cons, err := cfg.NewJS(ctx, zerolog.Nop(), js, "a")
+	if err != nil {
+		t.Fatalf("NewJS failed: %v", err)
+	}
+	info, err := cons.Info(ctx)
+	if err != nil {
+		t.Fatalf("failed to get consumer info: %v", err)
+	}
+	if info.Name != "processor-1-a" || info.Config.Durable != "" {
+		t.Fatalf("expected ephemeral consumer processor-1-a, got %q durable %q", info.Name, info.Config.Durable)
+	}
+
+	// Получатель, который никто не читает, сервер удаляет сам
+	for {
+		_, err = js.Consumer(ctx, cfg.NATS.Stream.Name, info.Name)
+		if errors.Is(err, jetstream.ErrConsumerNotFound) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("failed to get consumer: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("consumer of stopped instance was not removed")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
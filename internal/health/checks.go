@@ -0,0 +1,67 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/pressly/goose/v3"
+)
+
+// Доступность PostgreSQL через пул подключений
+func Postgres(pool *pgxpool.Pool) CheckFunc {
+	return func(ctx context.Context) error {
+		return pool.Ping(ctx)
+	}
+}
+
+// Состояние подключения к NATS
+func NATS(nc *nats.Conn) CheckFunc {
+	return func(_ context.Context) error {
+		if status := nc.Status(); status != nats.CONNECTED {
+			return fmt.Errorf("nats connection is %s", status)
+		}
+		return nil
+	}
+}
+
+// Наличие потока и получателя JetStream
+func JetStream(consumer jetstream.Consumer) CheckFunc {
+	return func(ctx context.Context) error {
+		info, err := consumer.Info(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to get consumer info")
+		}
+		if info.Config.MaxAckPending > 0 && info.NumAckPending >= info.Config.MaxAckPending {
+			return fmt.Errorf("consumer %s has %d messages pending ack", info.Name, info.NumAckPending)
+		}
+		return nil
+	}
+}
+
+// Все миграции из каталога применены к БД
+func Migrations(db *sql.DB, dir string) CheckFunc {
+	return func(ctx context.Context) error {
+		migrations, err := goose.CollectMigrations(dir, 0, goose.MaxVersion)
+		if err != nil {
+			return errors.Wrap(err, "failed to collect migrations")
+		}
+		last, err := migrations.Last()
+		if err != nil {
+			return errors.Wrap(err, "failed to get last migration")
+		}
+
+		current, err := goose.GetDBVersionContext(ctx, db)
+		if err != nil {
+			return errors.Wrap(err, "failed to get db version")
+		}
+		if current < last.Version {
+			return fmt.Errorf("db version %d is behind migration %d", current, last.Version)
+		}
+		return nil
+	}
+}
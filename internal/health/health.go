@@ -0,0 +1,150 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+
+	// Время на выполнение всех проверок готовности
+	checkTimeout = 3 * time.Second
+)
+
+// Проверка одной зависимости, nil - зависимость доступна
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Результат проверки зависимости
+type CheckResult struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Ответ liveness и readiness
+type Response struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Проверки состояния сервиса для оркестратора
+type Health struct {
+	logger zerolog.Logger
+	checks []check
+	// Сервис останавливается и больше не принимает трафик
+	shuttingDown atomic.Bool
+}
+
+// Добавление проверки зависимости для readiness
+func (h *Health) Add(name string, fn CheckFunc) *Health {
+	h.checks = append(h.checks, check{name: name, fn: fn})
+	return h
+}
+
+// Перевод readiness в состояние fail при остановке сервиса
+func (h *Health) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// Маршруты
+func (h *Health) Router() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/health/live", h.Live).Methods(http.MethodGet)
+	r.HandleFunc("/health/ready", h.Ready).Methods(http.MethodGet)
+
+	return r
+}
+
+// Liveness - процесс жив и обрабатывает запросы
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	h.write(w, http.StatusOK, Response{Status: statusOK})
+}
+
+// Readiness - все зависимости доступны и сервис готов принимать трафик
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	if h.shuttingDown.Load() {
+		h.write(w, http.StatusServiceUnavailable, Response{Status: statusFail})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	resp := Response{Status: statusOK, Checks: h.run(ctx)}
+	code := http.StatusOK
+	for _, res := range resp.Checks {
+		if res.Status != statusOK {
+			resp.Status = statusFail
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	h.write(w, code, resp)
+}
+
+// Параллельный запуск всех проверок
+func (h *Health) run(ctx context.Context) map[string]CheckResult {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]CheckResult, len(h.checks))
+	)
+
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c check) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := c.fn(ctx)
+			res := CheckResult{Status: statusOK, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				res.Status = statusFail
+				res.Error = err.Error()
+				h.logger.Warn().Err(err).Str("check", c.name).Msg("readiness check failed")
+			}
+
+			mu.Lock()
+			results[c.name] = res
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (h *Health) write(w http.ResponseWriter, code int, resp Response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to marshal health response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func New(logger zerolog.Logger) *Health {
+	return &Health{
+		logger: logger,
+	}
+}
@@ -0,0 +1,355 @@
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Глубина вложенности выделений, глубже разметка выводится как текст
+const maxDepth = 5
+
+// Атрибуты ссылок: открываются в новой вкладке без доступа к странице чата
+const linkAttrs = ` target="_blank" rel="noopener noreferrer nofollow"`
+
+// Безопасный HTML текста сообщения с поддержкой подмножества Markdown:
+//
+//	**жирный**, *курсив* и _курсив_, `код`, блок кода между ```,
+//	[текст](https://адрес), ссылки http и https в тексте, упоминания @имя
+//
+// Весь текст экранируется, в результате бывают только теги strong, em, code, pre, a, span и br,
+// а из атрибутов - href со ссылкой http, https или mailto и постоянные class, target и rel
+// Разметка без пары, например одиночная *, выводится как есть
+func Render(text string) string {
+	text = strings.ToValidUTF8(text, "�")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var out strings.Builder
+	for text != "" {
+		start := strings.Index(text, "```")
+		if start < 0 {
+			renderInline(&out, text)
+			break
+		}
+		end := strings.Index(text[start+3:], "```")
+		if end < 0 {
+			renderInline(&out, text)
+			break
+		}
+		renderInline(&out, text[:start])
+		code := text[start+3 : start+3+end]
+		code = strings.TrimPrefix(code, "\n")
+		code = strings.TrimSuffix(code, "\n")
+		out.WriteString("<pre><code>")
+		out.WriteString(html.EscapeString(code))
+		out.WriteString("</code></pre>")
+		text = text[start+3+end+3:]
+	}
+
+	return out.String()
+}
+
+// Строчная разметка
+func renderInline(out *strings.Builder, text string) {
+	p := &parser{out: out, text: text, closers: make(map[string]int)}
+	p.parse(0, len(text), 0, true)
+}
+
+// Разбор строчной разметки
+// closers - позиция ближайшего подходящего закрывающего разделителя, найденная при прошлом поиске:
+// пригодность закрывающего разделителя не зависит от открывающего, поэтому поиск не повторяется
+// и разбор остается линейным даже на тексте из одних разделителей
+type parser struct {
+	out     *strings.Builder
+	text    string
+	closers map[string]int
+}
+
+// Разбор text[start:end]; links - разрешены ли ссылки, внутри текста ссылки их нет
+func (p *parser) parse(start, end int, depth int, links bool) {
+	text := p.text
+	i := start
+	for i < end {
+		switch c := text[i]; {
+		case c == '\\' && i+1 < end && isPunct(text[i+1]):
+			p.out.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '\n':
+			p.out.WriteString("<br>")
+			i++
+			continue
+		case c == '`':
+			if close := p.closer("`", i+1, end); close > i+1 {
+				p.out.WriteString("<code>")
+				p.out.WriteString(html.EscapeString(text[i+1 : close]))
+				p.out.WriteString("</code>")
+				i = close + 1
+				continue
+			}
+		case c == '*' && depth < maxDepth:
+			delim, tag := "*", "em"
+			if strings.HasPrefix(text[i:end], "**") {
+				delim, tag = "**", "strong"
+			}
+			if next, ok := p.emphasis(i, end, delim, tag, depth, links); ok {
+				i = next
+				continue
+			}
+			if delim == "**" {
+				// Две звездочки без пары выводятся как текст, вторая не открывает курсив
+				p.out.WriteString("**")
+				i += 2
+				continue
+			}
+		case c == '_' && depth < maxDepth && !wordBefore(text, i):
+			if next, ok := p.emphasis(i, end, "_", "em", depth, links); ok {
+				i = next
+				continue
+			}
+		case c == '[' && links && depth < maxDepth:
+			if next, ok := p.link(i, end, depth); ok {
+				i = next
+				continue
+			}
+		case c == '@' && !wordBefore(text, i):
+			if next, ok := p.mention(i, end); ok {
+				i = next
+				continue
+			}
+		case (c == 'h' || c == 'H') && links && !wordBefore(text, i):
+			if next, ok := p.autolink(i, end); ok {
+				i = next
+				continue
+			}
+		}
+
+		// Текст до следующего символа, с которого может начаться разметка
+		next := i + 1
+		for next < end && !special(text[next]) {
+			next++
+		}
+		p.out.WriteString(html.EscapeString(text[i:next]))
+		i = next
+	}
+}
+
+// Выделение между парными разделителями delim, начиная с text[i]
+// После открывающего разделителя и перед закрывающим не может быть пробела,
+// а _ внутри слова, как в snake_case, не считается разделителем
+func (p *parser) emphasis(i, end int, delim, tag string, depth int, links bool) (int, bool) {
+	inner := i + len(delim)
+	if inner >= end || unicode.IsSpace(firstRune(p.text[inner:end])) {
+		return 0, false
+	}
+	close := p.closer(delim, inner, end)
+	if close <= inner {
+		return 0, false
+	}
+
+	p.out.WriteString("<" + tag + ">")
+	p.parse(inner, close, depth+1, links)
+	p.out.WriteString("</" + tag + ">")
+
+	return close + len(delim), true
+}
+
+// Позиция ближайшего подходящего закрывающего разделителя delim в text[from:end], -1 если его нет
+func (p *parser) closer(delim string, from, end int) int {
+	if cached, ok := p.closers[delim]; ok && (cached < 0 || cached >= from) {
+		if cached < end {
+			return cached
+		}
+		return -1
+	}
+
+	found := -1
+	for k := from; k < len(p.text); {
+		idx := strings.Index(p.text[k:], delim)
+		if idx < 0 {
+			break
+		}
+		k += idx
+		if p.validCloser(delim, k) {
+			found = k
+			break
+		}
+		k++
+	}
+	p.closers[delim] = found
+
+	if found >= end {
+		return -1
+	}
+	return found
+}
+
+// Подходит ли разделитель delim в позиции k для закрытия выделения
+func (p *parser) validCloser(delim string, k int) bool {
+	text := p.text
+	if delim == "`" {
+		return true
+	}
+	if k == 0 || unicode.IsSpace(lastRune(text[:k])) {
+		return false
+	}
+	after := k + len(delim)
+	switch delim {
+	case "*":
+		// Одиночная звездочка рядом с другой относится к **
+		return text[k-1] != '*' && (after >= len(text) || text[after] != '*')
+	case "_":
+		return after >= len(text) || !isWordRune(firstRune(text[after:]))
+	}
+	return true
+}
+
+// Ссылка вида [текст](адрес), начиная с text[i]
+// Адрес без пробелов и только со схемой http, https или mailto, иначе разметка выводится как текст
+func (p *parser) link(i, end int, depth int) (int, bool) {
+	text := p.text
+	closeText := p.closer("]", i+1, end)
+	if closeText <= i+1 || closeText+1 >= end || text[closeText+1] != '(' {
+		return 0, false
+	}
+	closeURL := strings.IndexByte(text[closeText+2:end], ')')
+	if closeURL < 0 {
+		return 0, false
+	}
+	closeURL += closeText + 2
+	href, ok := safeURL(text[closeText+2 : closeURL])
+	if !ok {
+		return 0, false
+	}
+
+	p.out.WriteString(`<a href="` + html.EscapeString(href) + `"` + linkAttrs + ">")
+	p.parse(i+1, closeText, depth+1, false)
+	p.out.WriteString("</a>")
+
+	return closeURL + 1, true
+}
+
+// Упоминание @имя: буквы, цифры, точка, дефис и подчеркивание, точка и дефис в конце не входят в имя
+func (p *parser) mention(i, end int) (int, bool) {
+	text := p.text
+	next := i + 1
+	for next < end {
+		r, size := utf8.DecodeRuneInString(text[next:end])
+		if !isWordRune(r) && r != '.' && r != '-' {
+			break
+		}
+		next += size
+	}
+	for next > i+1 && (text[next-1] == '.' || text[next-1] == '-') {
+		next--
+	}
+	if next == i+1 {
+		return 0, false
+	}
+
+	p.out.WriteString(`<span class="mention">` + html.EscapeString(text[i:next]) + "</span>")
+
+	return next, true
+}
+
+// Ссылка http или https в тексте до пробела, кавычки или угловой скобки
+func (p *parser) autolink(i, end int) (int, bool) {
+	text := p.text
+	lower := strings.ToLower(text[i:min(end, i+len("https://"))])
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		return 0, false
+	}
+	next := i
+	for next < end {
+		r, size := utf8.DecodeRuneInString(text[next:end])
+		if unicode.IsSpace(r) || r == '<' || r == '>' || r == '"' || r == '`' {
+			break
+		}
+		next += size
+	}
+	link := TrimLink(text[i:next])
+	href, ok := safeURL(link)
+	if !ok {
+		return 0, false
+	}
+
+	p.out.WriteString(`<a href="` + html.EscapeString(href) + `"` + linkAttrs + ">" + html.EscapeString(link) + "</a>")
+
+	return i + len(link), true
+}
+
+// Знаки препинания в конце ссылки относятся к тексту,
+// закрывающая скобка - если в ссылке нет парной открывающей, как в (см. https://example.com)
+func TrimLink(link string) string {
+	for link != "" {
+		last := link[len(link)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'*", last) >= 0:
+		case last == ')' && strings.Count(link, "(") < strings.Count(link, ")"):
+		case last == ']' && strings.Count(link, "[") < strings.Count(link, "]"):
+		default:
+			return link
+		}
+		link = link[:len(link)-1]
+	}
+	return link
+}
+
+// Абсолютный адрес со схемой http, https или mailto
+func safeURL(raw string) (string, bool) {
+	if raw == "" || strings.ContainsFunc(raw, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) {
+		return "", false
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+		if parsed.Host == "" {
+			return "", false
+		}
+	case "mailto":
+		if parsed.Opaque == "" {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	return parsed.String(), true
+}
+
+// Символы, с которых может начаться разметка
+func special(c byte) bool {
+	switch c {
+	case '\\', '\n', '`', '*', '_', '[', '@', 'h', 'H':
+		return true
+	}
+	return false
+}
+
+// ASCII знак препинания, который можно экранировать обратной косой чертой
+func isPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || c == '`' || c == '^' || c == '|' || c == '~' || c == '<' || c == '>' || c == '+' || c == '=' || c == '$'
+}
+
+// Перед text[i] буква или цифра, то есть text[i] не в начале слова
+func wordBefore(text string, i int) bool {
+	return i > 0 && isWordRune(lastRune(text[:i]))
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func firstRune(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r
+}
+
+func lastRune(s string) rune {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return r
+}
@@ -0,0 +1,177 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const attrs = ` target="_blank" rel="noopener noreferrer nofollow"`
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"**bold** and *italic* and _italic_", "<strong>bold</strong> and <em>italic</em> and <em>italic</em>"},
+		{"*italic with **bold** inside*", "<em>italic with <strong>bold</strong> inside</em>"},
+		{"**bold with _italic_**", "<strong>bold with <em>italic</em></strong>"},
+		{"`code` and `**not bold**`", "<code>code</code> and <code>**not bold**</code>"},
+		{"```\nfunc main() {\n\t<b>\n}\n```", "<pre><code>func main() {\n\t&lt;b&gt;\n}</code></pre>"},
+		{"before\n```x```\nafter", "before<br><pre><code>x</code></pre><br>after"},
+		{"line 1\nline 2\r\nline 3", "line 1<br>line 2<br>line 3"},
+		{"[Go site](https://go.dev/doc?a=1&b=2)", `<a href="https://go.dev/doc?a=1&amp;b=2"` + attrs + ">Go site</a>"},
+		{"[**bold** link](http://example.com)", `<a href="http://example.com"` + attrs + "><strong>bold</strong> link</a>"},
+		{"[mail](mailto:alice@example.com)", `<a href="mailto:alice@example.com"` + attrs + ">mail</a>"},
+		{"see https://example.com/a_b_c.", `see <a href="https://example.com/a_b_c"` + attrs + ">https://example.com/a_b_c</a>."},
+		{"(https://example.com)", `(<a href="https://example.com"` + attrs + ">https://example.com</a>)"},
+		{"hi @alice and @bob.smith.", `hi <span class="mention">@alice</span> and <span class="mention">@bob.smith</span>.`},
+		{"@Иван привет", `<span class="mention">@Иван</span> привет`},
+		{"mail alice@example.com", "mail alice@example.com"},
+		// Разметка без пары и внутри слов остается текстом
+		{"2 * 3 * 4", "2 * 3 * 4"},
+		{"**not closed", "**not closed"},
+		{"* not italic*", "* not italic*"},
+		{"snake_case_name", "snake_case_name"},
+		{"a ``` b", "a ``` b"},
+		{"``", "``"},
+		{`\*not italic\* and \\`, `*not italic* and \`},
+		{"[text](relative/path)", "[text](relative/path)"},
+		{"[text](https://example.com", `[text](<a href="https://example.com"` + attrs + ">https://example.com</a>"},
+		{"[](https://example.com)", `[](<a href="https://example.com"` + attrs + ">https://example.com</a>)"},
+	}
+	for _, tt := range tests {
+		if got := Render(tt.text); got != tt.want {
+			t.Errorf("Render(%q) =\n%s\nwant\n%s", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRenderXSS(t *testing.T) {
+	tests := []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`"><svg onload=alert(1)>`,
+		`[click](javascript:alert(1))`,
+		`[click](JaVaScRiPt:alert(1))`,
+		`[click](data:text/html;base64,PHNjcmlwdD4=)`,
+		`[click](vbscript:msgbox)`,
+		`[click](//evil.example.com)`,
+		`[click](https://example.com" onmouseover="alert(1))`,
+		`[click](https://example.com/"><script>alert(1)</script>)`,
+		`[<img src=x onerror=alert(1)>](https://example.com)`,
+		`[x](https://example.com/'onmouseover='alert(1))`,
+		`https://example.com/"onmouseover="alert(1)`,
+		`https://example.com/<script>alert(1)</script>`,
+		"https://example.com/`onmouseover=alert(1)`",
+		`**<script>alert(1)</script>**`,
+		"`<script>alert(1)</script>`",
+		"```\n</code></pre><script>alert(1)</script>\n```",
+		`@<script>alert(1)</script>`,
+		"\\<script>alert(1)\\</script>",
+		"[a](https://example.com)[b](java\tscript:alert(1))",
+		"<a href=\"javascript:alert(1)\">x</a>",
+		"\x00<script>\xff\xfe</script>",
+		"[[nested](https://a.com)](https://b.com)",
+	}
+	for _, text := range tests {
+		got := Render(text)
+		checkSafe(t, text, got)
+		// Опасный текст остается только экранированным текстом
+		if strings.Contains(strings.ToLower(got), "<script") || strings.Contains(got, `"javascript:`) {
+			t.Errorf("Render(%q) = %s", text, got)
+		}
+	}
+}
+
+// Вложенность глубже maxDepth и текст из одних разделителей разбираются быстро
+func TestRenderLimits(t *testing.T) {
+	deep := strings.Repeat("*a _b **c [d", 200) + strings.Repeat("](https://example.com)** c_ b*", 200)
+	checkSafe(t, "deep nesting", Render(deep))
+
+	for _, text := range []string{
+		strings.Repeat("*", 100000),
+		strings.Repeat("_a", 50000),
+		strings.Repeat("**a ", 30000),
+		strings.Repeat("[", 100000),
+		strings.Repeat("[a](", 30000),
+		strings.Repeat("`", 100001),
+		strings.Repeat("```a", 30000),
+		strings.Repeat("@", 100000),
+		strings.Repeat("http://", 20000),
+	} {
+		start := time.Now()
+		got := Render(text)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Render(%.10q...) took %v", text, elapsed)
+		}
+		checkSafe(t, text[:10], got)
+	}
+}
+
+func TestTrimLink(t *testing.T) {
+	tests := map[string]string{
+		"https://example.com":          "https://example.com",
+		"https://example.com/a.":       "https://example.com/a",
+		"https://example.com/a?!":      "https://example.com/a",
+		"https://example.com/a)":       "https://example.com/a",
+		"https://example.com/Go_(x))":  "https://example.com/Go_(x)",
+		"https://example.com/[a]]":     "https://example.com/[a]",
+		"https://example.com/**bold**": "https://example.com/**bold",
+	}
+	for link, want := range tests {
+		if got := TrimLink(link); got != want {
+			t.Errorf("TrimLink(%q) = %q, want %q", link, got, want)
+		}
+	}
+}
+
+// Проверка, что в HTML только разрешенные теги и атрибуты, а ссылки ведут на http, https или mailto
+func checkSafe(t *testing.T, text, rendered string) {
+	t.Helper()
+
+	allowed := map[string][]string{
+		"strong": nil, "em": nil, "code": nil, "pre": nil, "br": nil,
+		"span": {"class"},
+		"a":    {"href", "target", "rel"},
+	}
+	tokenizer := html.NewTokenizer(strings.NewReader(rendered))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			names, ok := allowed[token.Data]
+			if !ok {
+				t.Errorf("Render(%q) has tag <%s>: %s", text, token.Data, rendered)
+				continue
+			}
+			for _, attr := range token.Attr {
+				if !containsAttr(names, attr.Key) {
+					t.Errorf("Render(%q) has attribute %s in <%s>: %s", text, attr.Key, token.Data, rendered)
+				}
+				if attr.Key == "href" && !strings.HasPrefix(attr.Val, "http://") &&
+					!strings.HasPrefix(attr.Val, "https://") && !strings.HasPrefix(attr.Val, "mailto:") {
+					t.Errorf("Render(%q) has link %q", text, attr.Val)
+				}
+			}
+		case html.EndTagToken:
+			if _, ok := allowed[tokenizer.Token().Data]; !ok {
+				t.Errorf("Render(%q) has end tag: %s", text, rendered)
+			}
+		}
+	}
+}
+
+func containsAttr(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chat"
+
+// Реестр всех метрик сервиса
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTP запросы по маршрутам
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// Открытые WebSocket подключения по чатам
+	WebsocketConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Active websocket connections per chat.",
+	}, []string{"chat_id"})
+
+	// Сообщения шины
+	MessagesPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_published_total",
+		Help:      "Messages published to the bus.",
+	})
+
+	MessagesConsumed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_consumed_total",
+		Help:      "Messages received from the bus.",
+	})
+
+	MessagesAcked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_acked_total",
+		Help:      "Messages acknowledged after successful handling.",
+	})
+
+	MessagesNacked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_nacked_total",
+		Help:      "Messages negatively acknowledged for redelivery.",
+	})
+
+	// Время от публикации сообщения до записи в сокет
+	DeliveryLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_latency_seconds",
+		Help:      "Latency from bus publish to websocket write.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+
+	// Результаты авторизации через Google
+	OAuthCallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oauth_callbacks_total",
+		Help:      "OAuth callback outcomes.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		WebsocketConnections,
+		MessagesPublished,
+		MessagesConsumed,
+		MessagesAcked,
+		MessagesNacked,
+		DeliveryLatency,
+		OAuthCallbacks,
+	)
+}
+
+// Глубина очереди воркеров рассылки
+func RegisterQueueDepth(depth func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_queue_depth",
+		Help:      "Messages waiting for delivery in worker queues.",
+	}, func() float64 {
+		return float64(depth())
+	}))
+}
+
+// Статистика пула подключений к PostgreSQL
+func RegisterPgxPool(pool *pgxpool.Pool) {
+	Registry.MustRegister(newPgxCollector(pool))
+}
+
+// Обработчик для сбора метрик Prometheus
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
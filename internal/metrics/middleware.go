@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Маршрут для запросов, не совпавших ни с одним шаблоном
+const unknownRoute = "unknown"
+
+// Подсчет HTTP запросов и их длительности по шаблону маршрута
+// httpsnoop сохраняет у ResponseWriter интерфейсы Flusher, Hijacker и ReaderFrom и метод Unwrap для http.ResponseController
+func HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := httpsnoop.CaptureMetrics(next, w, r)
+
+		// Ответ 101 при переходе на WebSocket пишется в перехваченное подключение мимо WriteHeader
+		status := m.Code
+		if status == http.StatusOK && m.Written == 0 && websocket.IsWebSocketUpgrade(r) {
+			status = http.StatusSwitchingProtocols
+		}
+
+		route := unknownRoute
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		HTTPRequestDuration.WithLabelValues(route, r.Method).Observe(m.Duration.Seconds())
+	})
+}
@@ -0,0 +1,21 @@
+-- +goose Up
+create table if not exists public.chat_sequence
+(
+    chat_id  integer not null primary key,
+    last_seq bigint  not null
+);
+
+create table if not exists public.chat_message
+(
+    id         bigserial    not null primary key,
+    chat_id    integer      not null,
+    seq        bigint       not null,
+    author     varchar(100) not null,
+    body       text         not null,
+    created_at timestamptz  not null default now(),
+    unique (chat_id, seq)
+);
+
+-- +goose Down
+drop table public.chat_message;
+drop table public.chat_sequence;
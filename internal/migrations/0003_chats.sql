@@ -0,0 +1,27 @@
+-- +goose Up
+create table if not exists public.chat
+(
+    id         serial       not null primary key,
+    name       varchar(100) not null,
+    created_at timestamptz  not null default now()
+);
+
+-- До этой миграции чаты хранились только в памяти, восстанавливаем те, в которых есть сообщения
+insert into public.chat (id, name)
+select chat_id, 'Чат ' || chat_id
+from public.chat_sequence
+on conflict (id) do nothing;
+
+select setval(pg_get_serial_sequence('public.chat', 'id'), coalesce(max(id), 0) + 1, false)
+from public.chat;
+
+alter table public.chat_sequence
+    add constraint chat_sequence_chat_id_fkey foreign key (chat_id) references public.chat (id) on delete cascade;
+
+alter table public.chat_message
+    add constraint chat_message_chat_id_fkey foreign key (chat_id) references public.chat (id) on delete cascade;
+
+-- +goose Down
+alter table public.chat_message drop constraint chat_message_chat_id_fkey;
+alter table public.chat_sequence drop constraint chat_sequence_chat_id_fkey;
+drop table public.chat;
@@ -0,0 +1,34 @@
+-- +goose Up
+-- Создатель чата - его администратор
+alter table public.chat
+    add column owner_id varchar(100);
+
+alter table public.chat_message
+    add column author_id  varchar(100),
+    add column version    integer not null default 1,
+    add column edited_at  timestamptz,
+    add column deleted_at timestamptz;
+
+-- Прежние версии измененных и удаленных сообщений
+create table if not exists public.chat_message_revision
+(
+    id          bigserial    not null primary key,
+    message_id  bigint       not null references public.chat_message (id) on delete cascade,
+    version     integer      not null,
+    body        text         not null,
+    replaced_by varchar(100) not null,
+    replaced_at timestamptz  not null default now(),
+    unique (message_id, version)
+);
+
+-- +goose Down
+drop table public.chat_message_revision;
+
+alter table public.chat_message
+    drop column deleted_at,
+    drop column edited_at,
+    drop column version,
+    drop column author_id;
+
+alter table public.chat
+    drop column owner_id;
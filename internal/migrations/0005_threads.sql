@@ -0,0 +1,18 @@
+-- +goose Up
+-- Ответы в треде ссылаются на номер корневого сообщения того же чата
+alter table public.chat_message
+    add column parent_seq  bigint,
+    add column reply_count integer not null default 0,
+    add constraint chat_message_parent_fkey foreign key (chat_id, parent_seq)
+        references public.chat_message (chat_id, seq) on delete cascade;
+
+create index if not exists chat_message_thread_idx
+    on public.chat_message (chat_id, parent_seq, seq) where parent_seq is not null;
+
+-- +goose Down
+drop index public.chat_message_thread_idx;
+
+alter table public.chat_message
+    drop constraint chat_message_parent_fkey,
+    drop column reply_count,
+    drop column parent_seq;
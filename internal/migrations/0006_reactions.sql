@@ -0,0 +1,16 @@
+-- +goose Up
+-- Реакция пользователя на сообщение, одна и та же реакция пользователя не повторяется
+create table if not exists public.chat_message_reaction
+(
+    message_id bigint       not null references public.chat_message (id) on delete cascade,
+    user_id    varchar(100) not null,
+    reaction   varchar(64)  not null,
+    created_at timestamptz  not null default now(),
+    primary key (message_id, user_id, reaction)
+);
+
+create index if not exists chat_message_reaction_message_idx
+    on public.chat_message_reaction (message_id, reaction);
+
+-- +goose Down
+drop table public.chat_message_reaction;
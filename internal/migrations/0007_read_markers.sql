@@ -0,0 +1,13 @@
+-- +goose Up
+-- Номер последнего прочитанного пользователем сообщения чата, сообщения после него считаются непрочитанными
+create table if not exists public.chat_read_marker
+(
+    chat_id       integer      not null references public.chat (id) on delete cascade,
+    user_id       varchar(100) not null,
+    last_read_seq bigint       not null,
+    updated_at    timestamptz  not null default now(),
+    primary key (chat_id, user_id)
+);
+
+-- +goose Down
+drop table public.chat_read_marker;
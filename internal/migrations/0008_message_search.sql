@@ -0,0 +1,19 @@
+-- +goose Up
+-- Поисковый вектор текста сообщения, заполняется приложением с языком SEARCH_LANGUAGE
+-- У удаленных сообщений вектора нет
+alter table public.chat_message
+    add column search_vector tsvector;
+
+-- Конфигурация russian разбирает русские слова русским стеммером, а латиницу - английским
+update public.chat_message
+set search_vector = to_tsvector('russian', body)
+where deleted_at is null;
+
+create index if not exists chat_message_search_idx
+    on public.chat_message using gin (search_vector);
+
+-- +goose Down
+drop index public.chat_message_search_idx;
+
+alter table public.chat_message
+    drop column search_vector;
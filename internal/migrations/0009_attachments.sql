@@ -0,0 +1,22 @@
+-- +goose Up
+-- Вложение: метаданные загруженного в чат файла, содержимое лежит в хранилище вложений
+-- message_id пуст, пока вложение не отправлено в сообщении
+create table if not exists public.chat_attachment
+(
+    id            varchar(32)  primary key,
+    chat_id       integer      not null references public.chat (id) on delete cascade,
+    message_id    bigint       references public.chat_message (id) on delete cascade,
+    uploader_id   varchar(100) not null,
+    name          varchar(255) not null,
+    size          bigint       not null,
+    mime_type     varchar(255) not null,
+    checksum      char(64)     not null,
+    has_thumbnail boolean      not null default false,
+    created_at    timestamptz  not null default now()
+);
+
+create index if not exists chat_attachment_message_idx
+    on public.chat_attachment (message_id);
+
+-- +goose Down
+drop table public.chat_attachment;
@@ -0,0 +1,26 @@
+-- +goose Up
+-- Кеш разворачивания ссылок: метаданные страницы по ее адресу
+-- failed - страницу не удалось развернуть, неудача тоже кешируется, чтобы не запрашивать страницу снова
+create table if not exists public.link_preview
+(
+    url         varchar(2048) primary key,
+    title       text          not null default '',
+    description text          not null default '',
+    image       varchar(2048) not null default '',
+    site_name   text          not null default '',
+    failed      boolean       not null default false,
+    fetched_at  timestamptz   not null default now()
+);
+
+-- Ссылки сообщения с превью в порядке их появления в тексте
+create table if not exists public.chat_message_preview
+(
+    message_id bigint        not null references public.chat_message (id) on delete cascade,
+    position   integer       not null,
+    url        varchar(2048) not null,
+    primary key (message_id, position)
+);
+
+-- +goose Down
+drop table public.chat_message_preview;
+drop table public.link_preview;
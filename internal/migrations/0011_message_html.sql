@@ -0,0 +1,9 @@
+-- +goose Up
+-- Безопасный HTML текста сообщения с разметкой Markdown, строится приложением при сохранении
+-- У сообщений, сохраненных до появления разметки, и у удаленных сообщений HTML пуст
+alter table public.chat_message
+    add column body_html text not null default '';
+
+-- +goose Down
+alter table public.chat_message
+    drop column body_html;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Язык, с которым построены поисковые векторы сообщений
+-- При запуске с другим SEARCH_LANGUAGE приложение переиндексирует сообщения и обновляет язык
+-- Миграция 0008 заполнила векторы с конфигурацией russian
+create table if not exists public.search_setting
+(
+    id       boolean primary key default true check (id),
+    language text    not null
+);
+
+insert into public.search_setting (language)
+values ('russian')
+on conflict (id) do nothing;
+
+-- +goose Down
+drop table public.search_setting;
@@ -1,6 +1,8 @@
 package models
 
-import "github.com/gorilla/websocket"
+import (
+	"time"
+)
 
 type User struct {
 	ID    uint64 `json:"id"`
@@ -28,10 +30,12 @@ type UserAndRoomStruct struct {
 	RoomName string `json:"room_name"`
 }
 
-// Комната
+// Комната - сохраненный в БД чат
+// OwnerId - ID создателя чата, он же администратор, пустой у чатов, созданных до появления владельцев
 type RoomStruct struct {
 	RoomId   int    `json:"room_id"`
 	RoomName string `json:"room_name"`
+	OwnerId  string `json:"owner_id,omitempty"`
 }
 
 // Пользователь
@@ -40,24 +44,242 @@ type UserStruct struct {
 	UserName string `json:"user_name"`
 }
 
-// Чат
+// Чат с подключенными сейчас участниками
+// Unread - число непрочитанных текущим пользователем сообщений
 type ChatStruct struct {
-	ChatId int               `json:"chat_id"`
-	Room   *RoomStruct       `json:"room"`
-	Ws     []*websocket.Conn `json:"ws"`
-	User   []*UserStruct     `json:"user"`
+	ChatId int          `json:"chat_id"`
+	Room   RoomStruct   `json:"room"`
+	User   []UserStruct `json:"user"`
+	Unread int          `json:"unread"`
+}
+
+// События сообщений в шине и в WebSocket
+// У нового сообщения событие не указывается
+const (
+	EventMessageEdited  = "message.edited"
+	EventMessageDeleted = "message.deleted"
+	// У сообщения версии Version появились превью ссылок, Previews - все превью сообщения
+	EventMessageUpdated = "message.updated"
+	// Новый ответ в треде для участников чата, не подписанных на тред: номер ответа и число ответов
+	EventThreadUpdated = "thread.updated"
+	// Реакция пользователя AuthorId добавлена или снята, ReactionCount - сколько таких реакций осталось
+	EventReactionAdded   = "reaction.added"
+	EventReactionRemoved = "reaction.removed"
+	// Пользователь AuthorId начал или закончил набирать сообщение, события не сохраняются
+	EventTypingStart = "typing.start"
+	EventTypingStop  = "typing.stop"
+	// Изменилось присутствие пользователя AuthorId в чате: Status и LastSeen
+	EventPresence = "presence.changed"
+	// Пользователь AuthorId прочитал сообщения чата до Seq включительно, события не сохраняются
+	EventMessageRead = "message.read"
+	// Чат удален, после события подключения участников закрываются, событие не сохраняется
+	EventChatDeleted = "chat.deleted"
+	// Ошибка обработки команды клиента, отправляется только этому клиенту
+	EventError = "error"
+)
+
+// Команды клиента по WebSocket
+const (
+	// Отправка сообщения, ответ в тред - с ParentSeq
+	CommandSendMessage = "message.send"
+	// Подписка на ответы в треде сообщения Seq и отписка от них
+	CommandSubscribeThread   = "thread.subscribe"
+	CommandUnsubscribeThread = "thread.unsubscribe"
+	// Начало и окончание набора сообщения, пока клиент набирает текст, он повторяет typing.start
+	CommandTypingStart = "typing.start"
+	CommandTypingStop  = "typing.stop"
+	// Пользователь отошел от подключения (вкладка скрыта) или вернулся к нему
+	CommandPresenceAway   = "presence.away"
+	CommandPresenceActive = "presence.active"
+	// Сообщения чата до Seq включительно прочитаны
+	CommandMarkRead = "message.read"
+)
+
+// Статусы присутствия
+// Пользователь в сети, если хотя бы одно его подключение активно, и отошел, если все подключения неактивны
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Присутствие пользователя в чате по подключениям к одному экземпляру сервиса
+// Экземпляры обмениваются этими записями через общее хранилище
+type PresenceState struct {
+	ChatId    int       `json:"chat_id"`
+	UserId    string    `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	Instance  string    `json:"instance"`
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Участник чата и его присутствие, LastSeen - время отключения для offline
+type Member struct {
+	UserId   string     `json:"user_id"`
+	UserName string     `json:"user_name"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Команда клиента, полученная по WebSocket в формате JSON
+// Текст, который не является командой, отправляется в чат как сообщение
+type ClientCommand struct {
+	Type      string `json:"type"`
+	Seq       int64  `json:"seq,omitempty"`
+	ParentSeq int64  `json:"parent_seq,omitempty"`
+	Msg       string `json:"msg,omitempty"`
+	// ID загруженных вложений отправляемого сообщения
+	Attachments []string `json:"attachments,omitempty"`
 }
 
 // Передаваемое сообщение в Nats
+// Id, Seq и CreatedAt заполняются при сохранении в БД, PublishedAt - при публикации в шину
+// Для событий изменения и удаления Seq - номер измененного сообщения, Version - номер его версии
+// У ответа в треде ParentSeq - номер корневого сообщения, ReplyCount - число ответов в треде
 type SendMessage struct {
-	Msg         string `json:"msg"`
-	Author      string `json:"author"`
-	MessageType int    `json:"messageType"`
-	ChatId      int    `json:"chatId"`
+	Id            int64      `json:"id"`
+	Seq           int64      `json:"seq"`
+	Event         string     `json:"event,omitempty"`
+	Version       int        `json:"version,omitempty"`
+	ParentSeq     int64      `json:"parentSeq,omitempty"`
+	ReplyCount    int        `json:"replyCount,omitempty"`
+	Reaction      string     `json:"reaction,omitempty"`
+	ReactionCount int        `json:"reactionCount,omitempty"`
+	Status        string     `json:"status,omitempty"`
+	LastSeen      *time.Time `json:"lastSeen,omitempty"`
+	Msg           string     `json:"msg"`
+	Author        string     `json:"author"`
+	AuthorId      string     `json:"authorId,omitempty"`
+	MessageType   int        `json:"messageType"`
+	ChatId        int        `json:"chatId"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	PublishedAt   time.Time  `json:"publishedAt"`
+	// Вложения нового сообщения, при отправке достаточно ID
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Превью ссылок для события message.updated
+	Previews []LinkPreview `json:"previews,omitempty"`
+	// Безопасный HTML текста с разметкой Markdown
+	Html string `json:"html,omitempty"`
 }
 
 // Передаваемое сообщение по WebSocket клиету для отображения на странице
+// Seq - порядковый номер сообщения в чате, по пропускам клиент догружает историю
+// Type - событие, по которому клиент обновляет уже показанное сообщение с номером Seq
 type MessageOnScreen struct {
-	Msg    string `json:"msg"`
-	Author string `json:"author"`
+	Type       string `json:"type,omitempty"`
+	Seq        int64  `json:"seq,omitempty"`
+	Version    int    `json:"version,omitempty"`
+	ParentSeq  int64  `json:"parent_seq,omitempty"`
+	ReplyCount int    `json:"reply_count,omitempty"`
+	Msg        string `json:"msg"`
+	Author     string `json:"author"`
+	// Для событий реакций: реакция, ID поставившего ее пользователя и число таких реакций
+	// Для событий набора текста и прочтения: ID набирающего или прочитавшего пользователя
+	Reaction string `json:"reaction,omitempty"`
+	UserId   string `json:"user_id,omitempty"`
+	Count    int    `json:"count,omitempty"`
+	// Для событий присутствия: ID пользователя, статус и время отключения
+	Status   string     `json:"status,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// Вложения нового сообщения
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Превью ссылок сообщения для события message.updated
+	Previews []LinkPreview `json:"previews,omitempty"`
+	// Безопасный HTML текста с разметкой Markdown, клиент показывает его вместо Msg
+	Html string `json:"html,omitempty"`
+}
+
+// Сохраненное сообщение из истории чата
+// Удаленное сообщение остается в истории без текста, с заполненным DeletedAt
+// ParentSeq заполнен у ответов в треде, ReplyCount - у корневых сообщений
+type Message struct {
+	Id         int64      `json:"id"`
+	ChatId     int        `json:"chat_id"`
+	Seq        int64      `json:"seq"`
+	ParentSeq  int64      `json:"parent_seq,omitempty"`
+	ReplyCount int        `json:"reply_count"`
+	Msg        string     `json:"msg"`
+	Author     string     `json:"author"`
+	AuthorId   string     `json:"author_id,omitempty"`
+	Version    int        `json:"version"`
+	CreatedAt  time.Time  `json:"created_at"`
+	EditedAt   *time.Time `json:"edited_at,omitempty"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	Reactions  []Reaction `json:"reactions,omitempty"`
+	// Вложения, у удаленного сообщения не показываются
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Превью ссылок из текста, у удаленного сообщения не показываются
+	Previews []LinkPreview `json:"previews,omitempty"`
+	// Безопасный HTML текста с разметкой Markdown, у удаленного сообщения пуст
+	Html string `json:"html,omitempty"`
+}
+
+// Вложение: загруженный в чат файл
+// MessageId пуст, пока вложение не отправлено в сообщении; такое вложение видит только загрузивший
+// MimeType определяется по содержимому файла, Checksum - SHA-256 содержимого в hex
+// URL и ThumbnailURL - адреса скачивания файла и миниатюры изображения, если она есть
+type Attachment struct {
+	Id           string    `json:"id"`
+	ChatId       int       `json:"chat_id"`
+	MessageId    int64     `json:"-"`
+	UploaderId   string    `json:"uploader_id"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	MimeType     string    `json:"mime_type"`
+	Checksum     string    `json:"checksum"`
+	HasThumbnail bool      `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+}
+
+// Превью ссылки: заголовок, описание и изображение страницы из OpenGraph или ее заголовка
+// Failed - страницу не удалось развернуть, такие превью только кешируются и клиентам не показываются
+type LinkPreview struct {
+	URL         string    `json:"url"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	SiteName    string    `json:"site_name,omitempty"`
+	Failed      bool      `json:"-"`
+	FetchedAt   time.Time `json:"-"`
+}
+
+// Параметры поиска сообщений
+// ChatId и Author необязательны, Author - ID или имя автора; From включительно, To - не включительно
+type SearchQuery struct {
+	Query  string
+	ChatId int
+	Author string
+	From   *time.Time
+	To     *time.Time
+	Limit  int
+	Offset int
+}
+
+// Найденное сообщение
+// Snippet - фрагменты текста, экранированные для HTML, найденные слова выделены <mark>
+type SearchResult struct {
+	ChatId    int       `json:"chat_id"`
+	ChatName  string    `json:"chat_name"`
+	Seq       int64     `json:"seq"`
+	ParentSeq int64     `json:"parent_seq,omitempty"`
+	Author    string    `json:"author"`
+	AuthorId  string    `json:"author_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Snippet   string    `json:"snippet"`
+}
+
+// Страница результатов поиска, NextOffset - смещение следующей страницы, если она есть
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	NextOffset int            `json:"next_offset,omitempty"`
+}
+
+// Реакция на сообщение: сколько пользователей ее поставили и кто именно
+type Reaction struct {
+	Reaction string   `json:"reaction"`
+	Count    int      `json:"count"`
+	UserIds  []string `json:"user_ids"`
 }
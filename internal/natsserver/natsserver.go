@@ -0,0 +1,119 @@
+package natsserver
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Время ожидания готовности встроенного сервера
+const readyTimeout = 10 * time.Second
+
+// Встроенный NATS сервер с JetStream
+// Позволяет запускать сервис одним бинарником, без отдельного контейнера nats
+type Server struct {
+	logger zerolog.Logger
+	srv    *server.Server
+	// Временный каталог хранилища, удаляется при остановке
+	tmpDir string
+}
+
+// Запуск встроенного сервера
+// Если storeDir пустой, хранилище JetStream создается во временном каталоге
+func New(logger zerolog.Logger, host string, port int, storeDir string) (*Server, error) {
+	s := &Server{
+		logger: logger.With().Str("component", "nats-server").Logger(),
+	}
+
+	if storeDir == "" {
+		dir, err := os.MkdirTemp("", "nats-js-*")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create jetstream store dir")
+		}
+		storeDir = dir
+		s.tmpDir = dir
+	}
+
+	opts := &server.Options{
+		ServerName: "embedded",
+		Host:       host,
+		Port:       port,
+		JetStream:  true,
+		StoreDir:   storeDir,
+		NoSigs:     true,
+	}
+
+	srv, err := server.NewServer(opts)
+	if err != nil {
+		s.cleanup()
+		return nil, errors.Wrap(err, "failed to create nats server")
+	}
+	srv.SetLoggerV2(&logAdapter{logger: s.logger}, false, false, false)
+
+	srv.Start()
+	if !srv.ReadyForConnections(readyTimeout) {
+		srv.Shutdown()
+		s.cleanup()
+		return nil, errors.New("nats server is not ready for connections")
+	}
+	s.srv = srv
+
+	s.logger.Info().Str("url", srv.ClientURL()).Str("store_dir", storeDir).Msg("embedded nats server started")
+
+	return s, nil
+}
+
+// Адрес для подключения клиентов
+func (s *Server) ClientURL() string {
+	return s.srv.ClientURL()
+}
+
+// Остановка сервера
+func (s *Server) Shutdown() {
+	s.srv.Shutdown()
+	s.srv.WaitForShutdown()
+	s.cleanup()
+}
+
+// Удаление временного каталога хранилища
+func (s *Server) cleanup() {
+	if s.tmpDir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.tmpDir); err != nil {
+		s.logger.Error().Err(err).Msg("failed to remove jetstream store dir")
+	}
+}
+
+// Перенаправление логов NATS сервера в zerolog
+type logAdapter struct {
+	logger zerolog.Logger
+}
+
+func (l *logAdapter) Noticef(format string, v ...interface{}) {
+	l.logger.Info().Msg(fmt.Sprintf(format, v...))
+}
+
+func (l *logAdapter) Warnf(format string, v ...interface{}) {
+	l.logger.Warn().Msg(fmt.Sprintf(format, v...))
+}
+
+func (l *logAdapter) Fatalf(format string, v ...interface{}) {
+	l.logger.Error().Msg(fmt.Sprintf(format, v...))
+}
+
+func (l *logAdapter) Errorf(format string, v ...interface{}) {
+	l.logger.Error().Msg(fmt.Sprintf(format, v...))
+}
+
+func (l *logAdapter) Debugf(format string, v ...interface{}) {
+	l.logger.Debug().Msg(fmt.Sprintf(format, v...))
+}
+
+func (l *logAdapter) Tracef(format string, v ...interface{}) {
+	l.logger.Trace().Msg(fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,94 @@
+package presence
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Хранилище присутствия в NATS KV
+// Ключ записи - chat.<ID чата>.<ID пользователя в base64>.<экземпляр>,
+// устаревшие записи удаляются по TTL корзины
+type kvStore struct {
+	logger   zerolog.Logger
+	kv       jetstream.KeyValue
+	instance string
+}
+
+func (s *kvStore) Instance() string {
+	return s.instance
+}
+
+func (s *kvStore) Put(ctx context.Context, state models.PresenceState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal presence")
+	}
+
+	if _, err = s.kv.Put(ctx, key(state), data); err != nil {
+		return errors.Wrap(err, "failed to put presence")
+	}
+
+	return nil
+}
+
+// Наблюдение за всей корзиной, сначала приходят текущие значения ключей
+func (s *kvStore) Watch(handler HandlerFunc) (Subscription, error) {
+	watcher, err := s.kv.WatchAll(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to watch presence")
+	}
+
+	go func() {
+		for entry := range watcher.Updates() {
+			// nil отделяет текущие значения от последующих изменений
+			if entry == nil || entry.Operation() != jetstream.KeyValuePut {
+				continue
+			}
+
+			var state models.PresenceState
+			if err := json.Unmarshal(entry.Value(), &state); err != nil {
+				s.logger.Error().Err(err).Str("key", entry.Key()).Msg("failed to unmarshal presence")
+				continue
+			}
+
+			logger := s.logger.With().Int("chat_id", state.ChatId).Str("user_id", state.UserId).Logger()
+			if err := handler(logger.WithContext(context.Background()), state); err != nil {
+				logger.Error().Err(err).Msg("failed to handle presence")
+			}
+		}
+	}()
+
+	return &kvWatcher{logger: s.logger, watcher: watcher}, nil
+}
+
+type kvWatcher struct {
+	logger  zerolog.Logger
+	watcher jetstream.KeyWatcher
+}
+
+func (w *kvWatcher) Stop() {
+	if err := w.watcher.Stop(); err != nil {
+		w.logger.Debug().Err(err).Msg("failed to stop presence watcher")
+	}
+}
+
+// Ключ записи, ID пользователя кодируется, так как ключи NATS допускают не все символы
+func key(state models.PresenceState) string {
+	return fmt.Sprintf("chat.%d.%s.%s", state.ChatId, base64.RawURLEncoding.EncodeToString([]byte(state.UserId)), state.Instance)
+}
+
+// instance должен состоять из букв, цифр, - и _
+func NewKV(logger zerolog.Logger, kv jetstream.KeyValue, instance string) Store {
+	return &kvStore{
+		logger:   logger,
+		kv:       kv,
+		instance: instance,
+	}
+}
@@ -0,0 +1,81 @@
+package presence
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// Хранилище присутствия в памяти процесса для запуска одного экземпляра без NATS
+type memoryStore struct {
+	logger   zerolog.Logger
+	instance string
+
+	mu       sync.Mutex
+	states   map[string]models.PresenceState
+	watchers map[*memoryWatcher]HandlerFunc
+}
+
+func (s *memoryStore) Instance() string {
+	return s.instance
+}
+
+// Запись сразу передается подписчикам в горутине вызывающего
+func (s *memoryStore) Put(ctx context.Context, state models.PresenceState) error {
+	s.mu.Lock()
+	s.states[key(state)] = state
+	handlers := make([]HandlerFunc, 0, len(s.watchers))
+	for _, handler := range s.watchers {
+		handlers = append(handlers, handler)
+	}
+	s.mu.Unlock()
+
+	for _, handler := range handlers {
+		if err := handler(ctx, state); err != nil {
+			s.logger.Error().Err(err).Int("chat_id", state.ChatId).Str("user_id", state.UserId).Msg("failed to handle presence")
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Watch(handler HandlerFunc) (Subscription, error) {
+	watcher := &memoryWatcher{store: s}
+
+	s.mu.Lock()
+	states := make([]models.PresenceState, 0, len(s.states))
+	for _, state := range s.states {
+		states = append(states, state)
+	}
+	s.watchers[watcher] = handler
+	s.mu.Unlock()
+
+	for _, state := range states {
+		if err := handler(context.Background(), state); err != nil {
+			s.logger.Error().Err(err).Int("chat_id", state.ChatId).Str("user_id", state.UserId).Msg("failed to handle presence")
+		}
+	}
+
+	return watcher, nil
+}
+
+type memoryWatcher struct {
+	store *memoryStore
+}
+
+func (w *memoryWatcher) Stop() {
+	w.store.mu.Lock()
+	delete(w.store.watchers, w)
+	w.store.mu.Unlock()
+}
+
+func NewMemory(logger zerolog.Logger, instance string) Store {
+	return &memoryStore{
+		logger:   logger,
+		instance: instance,
+		states:   make(map[string]models.PresenceState),
+		watchers: make(map[*memoryWatcher]HandlerFunc),
+	}
+}
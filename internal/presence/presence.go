@@ -0,0 +1,27 @@
+package presence
+
+import (
+	"context"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+)
+
+// Обработчик изменения присутствия
+type HandlerFunc func(ctx context.Context, state models.PresenceState) error
+
+// Активная подписка на изменения
+type Subscription interface {
+	// Прекращает получение изменений
+	Stop()
+}
+
+// Общее для экземпляров сервиса хранилище присутствия
+// Каждый экземпляр пишет только свои записи, а изменения получает от всех экземпляров, включая себя
+type Store interface {
+	// Имя этого экземпляра сервиса
+	Instance() string
+	// Сохранение присутствия пользователя в чате на этом экземпляре
+	Put(ctx context.Context, state models.PresenceState) error
+	// Получение уже сохраненных записей, а затем всех изменений
+	Watch(handler HandlerFunc) (Subscription, error)
+}
@@ -0,0 +1,156 @@
+package presence
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/natsserver"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog"
+)
+
+// Время ожидания изменений в тестах
+const waitTimeout = 5 * time.Second
+
+// Обработчик, запоминающий полученные записи
+type recorder struct {
+	mu     sync.Mutex
+	states []models.PresenceState
+}
+
+func (r *recorder) handle(_ context.Context, state models.PresenceState) error {
+	r.mu.Lock()
+	r.states = append(r.states, state)
+	r.mu.Unlock()
+	return nil
+}
+
+// Ожидание n записей
+func (r *recorder) wait(t *testing.T, n int) []models.PresenceState {
+	t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		r.mu.Lock()
+		states := append([]models.PresenceState(nil), r.states...)
+		r.mu.Unlock()
+		if len(states) >= n || time.Now().After(deadline) {
+			if len(states) != n {
+				t.Fatalf("received %d states, want %d", len(states), n)
+			}
+			return states
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Корзина на встроенном NATS сервере
+func newTestKV(t *testing.T) jetstream.KeyValue {
+	t.Helper()
+
+	srv, err := natsserver.New(zerolog.Nop(), "127.0.0.1", -1, "")
+	if err != nil {
+		t.Fatalf("failed to start nats server: %v", err)
+	}
+	t.Cleanup(srv.Shutdown)
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("failed to create jetstream: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	kv, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: "presence", Storage: jetstream.MemoryStorage})
+	if err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+
+	return kv
+}
+
+func testState(instance, status string) models.PresenceState {
+	return models.PresenceState{
+		ChatId:    1,
+		UserId:    "user@example.com",
+		UserName:  "Alice",
+		Instance:  instance,
+		Status:    status,
+		UpdatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+func TestMemory(t *testing.T) {
+	store := NewMemory(zerolog.Nop(), "a")
+	ctx := context.Background()
+
+	online := testState("a", models.PresenceOnline)
+	if err := store.Put(ctx, online); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	// Подписчик сначала получает сохраненные записи
+	rec := &recorder{}
+	sub, err := store.Watch(rec.handle)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	away := testState("a", models.PresenceAway)
+	if err = store.Put(ctx, away); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got := rec.wait(t, 2); got[0].Status != online.Status || got[1].Status != away.Status {
+		t.Errorf("received %+v", got)
+	}
+
+	sub.Stop()
+	if err = store.Put(ctx, online); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	rec.wait(t, 2)
+}
+
+// Экземпляры видят записи друг друга
+func TestKV(t *testing.T) {
+	kv := newTestKV(t)
+	a := NewKV(zerolog.Nop(), kv, "a")
+	b := NewKV(zerolog.Nop(), kv, "b")
+	ctx := context.Background()
+
+	first := testState("a", models.PresenceOnline)
+	if err := a.Put(ctx, first); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	rec := &recorder{}
+	sub, err := b.Watch(rec.handle)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	defer sub.Stop()
+
+	second := testState("b", models.PresenceAway)
+	if err = b.Put(ctx, second); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	got := rec.wait(t, 2)
+	if got[0] != first || got[1] != second {
+		t.Errorf("received %+v, want %+v and %+v", got, first, second)
+	}
+	if a.Instance() != "a" || b.Instance() != "b" {
+		t.Errorf("Instance() = %q, %q", a.Instance(), b.Instance())
+	}
+}
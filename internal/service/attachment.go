@@ -0,0 +1,440 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/thumbnail"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Максимальное число вложений в одном сообщении
+const maxMessageAttachments = 10
+
+// Максимальная длина имени вложения в символах, совпадает с размером колонки в БД
+const maxAttachmentNameLength = 255
+
+// Сколько байт начала файла смотрит http.DetectContentType
+const sniffLength = 512
+
+// Число неотправленных вложений, удаляемых одним запросом к БД
+const cleanupBatchSize = 100
+
+// Изображения, для которых строится миниатюра
+var thumbnailTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// Загрузка и скачивание вложений
+type AttachmentService interface {
+	// Загрузка файла в чат, вложение прикрепляется к сообщению при его отправке
+	Upload(ctx context.Context, user models.UserStruct, chatId int, name string, r io.Reader) (models.Attachment, error)
+	// Содержимое вложения или миниатюры изображения
+	// У миниатюры MimeType - image/jpeg, а Size неизвестен и равен 0
+	Open(ctx context.Context, user models.UserStruct, id string, thumbnail bool) (models.Attachment, io.ReadCloser, error)
+	// Удаление вложений, не отправленных за UnsentTTL после загрузки, возвращается их число
+	DeleteUnsent(ctx context.Context) (int, error)
+	// Периодическое удаление неотправленных вложений до отмены ctx
+	KeepClean(ctx context.Context)
+}
+
+// Хранилище содержимого вложений и миниатюр
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type AttachmentStorage interface {
+	// Сохранение метаданных вложения, false если чата нет
+	CreateAttachment(ctx context.Context, attachment *models.Attachment) (bool, error)
+	// Вложение по ID, false если его нет или его сообщение удалено
+	GetAttachment(ctx context.Context, id string) (models.Attachment, bool, error)
+	// Удаление не больше limit неотправленных вложений, загруженных раньше before, возвращаются удаленные
+	DeleteUnsentAttachments(ctx context.Context, before time.Time, limit int) ([]models.Attachment, error)
+}
+
+// Ограничения вложений
+type AttachmentOptions struct {
+	// Максимальный размер файла в байтах
+	MaxSize int64
+	// Разрешенные типы содержимого, например image/png или image/*
+	AllowedTypes []string
+	// Сторона квадрата, в который вписывается миниатюра, 0 - без миниатюр
+	ThumbnailSize int
+	// Изображения с большим числом пикселей не декодируются
+	MaxPixels int
+	// Срок, после которого неотправленное вложение удаляется, 0 - не удалять
+	UnsentTTL time.Duration
+	// Период проверки неотправленных вложений
+	CleanupInterval time.Duration
+}
+
+type attachmentService struct {
+	logger  zerolog.Logger
+	storage AttachmentStorage
+	blobs   BlobStore
+	opts    AttachmentOptions
+}
+
+// Загрузка вложения
+// Файл сначала пишется во временный файл: так считаются размер и контрольная сумма,
+// а тип определяется по содержимому, а не по имени или заголовку клиента
+func (s *attachmentService) Upload(ctx context.Context, user models.UserStruct, chatId int, name string, r io.Reader) (models.Attachment, error) {
+	if user.UserId == "" {
+		return models.Attachment{}, Unauthorized("user is not identified")
+	}
+	if chatId < 1 {
+		return models.Attachment{}, NotFound("chat not found")
+	}
+
+	tmp, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		return models.Attachment{}, errors.Wrap(err, "failed to create temporary file")
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, s.opts.MaxSize+1))
+	if err != nil {
+		return models.Attachment{}, errors.Wrap(err, "failed to read attachment")
+	}
+	switch {
+	case size == 0:
+		return models.Attachment{}, Validation("attachment is empty")
+	case size > s.opts.MaxSize:
+		return models.Attachment{}, Validation("attachment is too large")
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := tmp.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return models.Attachment{}, errors.Wrap(err, "failed to read attachment")
+	}
+	mimeType := http.DetectContentType(head[:n])
+	if !s.allowed(mimeType) {
+		return models.Attachment{}, Validation("attachment type " + mediaType(mimeType) + " is not allowed")
+	}
+
+	id, err := newAttachmentId()
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	attachment := models.Attachment{
+		Id:         id,
+		ChatId:     chatId,
+		UploaderId: user.UserId,
+		Name:       attachmentName(name),
+		Size:       size,
+		MimeType:   mimeType,
+		Checksum:   hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	logger := s.loggerFrom(ctx).With().Str("attachment_id", id).Int("chat_id", chatId).Logger()
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return models.Attachment{}, errors.Wrap(err, "failed to rewind attachment")
+	}
+	if err = s.blobs.Put(ctx, attachmentKey(id), tmp, size, mimeType); err != nil {
+		return models.Attachment{}, errors.Wrap(err, "failed to store attachment")
+	}
+
+	// Без миниатюры вложение остается обычным файлом
+	attachment.HasThumbnail, err = s.putThumbnail(ctx, id, mimeType, tmp)
+	switch {
+	case errors.Is(err, thumbnail.ErrUnsupported), errors.Is(err, thumbnail.ErrTooLarge):
+		logger.Debug().Err(err).Msg("thumbnail skipped")
+	case err != nil:
+		logger.Warn().Err(err).Msg("failed to make thumbnail")
+	}
+
+	ok, err := s.storage.CreateAttachment(ctx, &attachment)
+	if err != nil || !ok {
+		s.deleteBlobs(ctx, logger, attachment)
+		if err != nil {
+			return models.Attachment{}, errors.Wrap(err, "failed to save attachment")
+		}
+		return models.Attachment{}, NotFound("chat not found")
+	}
+
+	logger.Info().Int64("size", size).Str("mime_type", mimeType).Msg("attachment uploaded")
+
+	return withURLs(attachment), nil
+}
+
+// Миниатюра изображения, false если тип не поддерживается или миниатюры отключены
+func (s *attachmentService) putThumbnail(ctx context.Context, id string, mimeType string, file io.ReadSeeker) (bool, error) {
+	if s.opts.ThumbnailSize < 1 || !thumbnailTypes[mediaType(mimeType)] {
+		return false, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, errors.Wrap(err, "failed to rewind attachment")
+	}
+	data, err := thumbnail.Make(file, s.opts.ThumbnailSize, s.opts.MaxPixels)
+	if err != nil {
+		return false, err
+	}
+
+	if err = s.blobs.Put(ctx, thumbnailKey(id), bytes.NewReader(data), int64(len(data)), "image/jpeg"); err != nil {
+		return false, errors.Wrap(err, "failed to store thumbnail")
+	}
+
+	return true, nil
+}
+
+// Удаление содержимого вложения, метаданные которого не сохранились или удалены
+func (s *attachmentService) deleteBlobs(ctx context.Context, logger zerolog.Logger, attachment models.Attachment) {
+	keys := []string{attachmentKey(attachment.Id)}
+	if attachment.HasThumbnail {
+		keys = append(keys, thumbnailKey(attachment.Id))
+	}
+
+	for _, key := range keys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			logger.Warn().Err(err).Str("key", key).Msg("failed to delete blob")
+		}
+	}
+}
+
+// Содержимое вложения
+// Неотправленное вложение видит только загрузивший, остальным оно не показывается, как несуществующее
+func (s *attachmentService) Open(ctx context.Context, user models.UserStruct, id string, wantThumbnail bool) (models.Attachment, io.ReadCloser, error) {
+	if user.UserId == "" {
+		return models.Attachment{}, nil, Unauthorized("user is not identified")
+	}
+
+	attachment, ok, err := s.storage.GetAttachment(ctx, id)
+	if err != nil {
+		return models.Attachment{}, nil, errors.Wrap(err, "failed to get attachment")
+	}
+	if !ok || attachment.MessageId == 0 && attachment.UploaderId != user.UserId {
+		return models.Attachment{}, nil, NotFound("attachment not found")
+	}
+
+	key := attachmentKey(id)
+	if wantThumbnail {
+		if !attachment.HasThumbnail {
+			return models.Attachment{}, nil, NotFound("thumbnail not found")
+		}
+		key = thumbnailKey(id)
+		attachment.MimeType = "image/jpeg"
+		attachment.Size = 0
+	}
+
+	body, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		return models.Attachment{}, nil, errors.Wrap(err, "failed to open attachment")
+	}
+
+	return withURLs(attachment), body, nil
+}
+
+// Удаление неотправленных вложений пачками по cleanupBatchSize
+// Строки удаляются раньше содержимого: вложение без строки уже нельзя прикрепить к сообщению
+func (s *attachmentService) DeleteUnsent(ctx context.Context) (int, error) {
+	if s.opts.UnsentTTL <= 0 {
+		return 0, nil
+	}
+
+	before := time.Now().Add(-s.opts.UnsentTTL)
+	total := 0
+	for {
+		deleted, err := s.storage.DeleteUnsentAttachments(ctx, before, cleanupBatchSize)
+		if err != nil {
+			return total, errors.Wrap(err, "failed to delete unsent attachments")
+		}
+		for _, attachment := range deleted {
+			s.deleteBlobs(ctx, s.logger.With().Str("attachment_id", attachment.Id).Logger(), attachment)
+		}
+		total += len(deleted)
+
+		if len(deleted) < cleanupBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// Удаление неотправленных вложений раз в CleanupInterval до отмены ctx
+func (s *attachmentService) KeepClean(ctx context.Context) {
+	if s.opts.UnsentTTL <= 0 || s.opts.CleanupInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.opts.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.DeleteUnsent(ctx)
+			if err != nil {
+				s.logger.Error().Err(err).Msg("failed to clean attachments")
+			}
+			if deleted > 0 {
+				s.logger.Info().Int("count", deleted).Msg("unsent attachments deleted")
+			}
+		}
+	}
+}
+
+// Тип разрешен целиком или по маске вида image/*
+func (s *attachmentService) allowed(mimeType string) bool {
+	mimeType = mediaType(mimeType)
+	for _, allowed := range s.opts.AllowedTypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == mimeType || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Логгер запроса из контекста, если его нет - логгер сервиса
+func (s *attachmentService) loggerFrom(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &s.logger
+}
+
+// Проверка вложений отправляемого сообщения
+// Прикрепить можно только свои неотправленные вложения из того же чата; msg.Attachments заменяются метаданными
+func (s *chatService) checkAttachments(ctx context.Context, msg *models.SendMessage) error {
+	if len(msg.Attachments) == 0 {
+		return nil
+	}
+	if len(msg.Attachments) > maxMessageAttachments {
+		return Validation("too many attachments")
+	}
+
+	ids := make([]string, 0, len(msg.Attachments))
+	seen := make(map[string]bool, len(msg.Attachments))
+	for _, attachment := range msg.Attachments {
+		if seen[attachment.Id] {
+			return Validation("duplicate attachment")
+		}
+		seen[attachment.Id] = true
+		ids = append(ids, attachment.Id)
+	}
+
+	found, err := s.storage.GetAttachments(ctx, ids)
+	if err != nil {
+		return errors.Wrap(err, "failed to get attachments")
+	}
+	byId := make(map[string]models.Attachment, len(found))
+	for _, attachment := range found {
+		byId[attachment.Id] = attachment
+	}
+
+	attachments := make([]models.Attachment, 0, len(ids))
+	for _, id := range ids {
+		attachment, ok := byId[id]
+		if !ok || msg.AuthorId == "" || attachment.UploaderId != msg.AuthorId || attachment.ChatId != msg.ChatId {
+			return NotFound("attachment not found")
+		}
+		if attachment.MessageId != 0 {
+			return Conflict("attachment is already sent")
+		}
+		attachments = append(attachments, withURLs(attachment))
+	}
+	msg.Attachments = attachments
+
+	return nil
+}
+
+// Адреса скачивания вложений сообщений
+func messagesWithURLs(messages []models.Message) {
+	for i := range messages {
+		for j := range messages[i].Attachments {
+			messages[i].Attachments[j] = withURLs(messages[i].Attachments[j])
+		}
+	}
+}
+
+// Адреса скачивания вложения и его миниатюры
+func withURLs(attachment models.Attachment) models.Attachment {
+	attachment.URL = "/api/v1/attachments/" + attachment.Id
+	attachment.ThumbnailURL = ""
+	if attachment.HasThumbnail {
+		attachment.ThumbnailURL = attachment.URL + "/thumbnail"
+	}
+	return attachment
+}
+
+// Тип содержимого без параметров
+func mediaType(mimeType string) string {
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return parsed
+	}
+	return strings.ToLower(mimeType)
+}
+
+// Имя файла без пути и управляющих символов, не длиннее maxAttachmentNameLength
+func attachmentName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name))
+
+	if utf8.RuneCountInString(name) > maxAttachmentNameLength {
+		name = string([]rune(name)[:maxAttachmentNameLength])
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+
+	return name
+}
+
+func attachmentKey(id string) string {
+	return "attachments/" + id
+}
+
+func thumbnailKey(id string) string {
+	return "thumbnails/" + id
+}
+
+// Случайный ID вложения, по нему нельзя угадать чужие вложения
+func newAttachmentId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate attachment id")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func NewAttachments(logger zerolog.Logger, storage AttachmentStorage, blobs BlobStore, opts AttachmentOptions) AttachmentService {
+	return &attachmentService{
+		logger:  logger,
+		storage: storage,
+		blobs:   blobs,
+		opts:    opts,
+	}
+}
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/service/servicetest"
+	"github.com/rs/zerolog"
+)
+
+var testAttachmentOptions = AttachmentOptions{
+	MaxSize:       1 << 20,
+	AllowedTypes:  []string{"image/*", "text/plain"},
+	ThumbnailSize: 64,
+	MaxPixels:     1 << 20,
+}
+
+func newTestAttachments(t *testing.T) (AttachmentService, ChatService, *servicetest.ChatStorage, *servicetest.Blobs) {
+	t.Helper()
+
+	chats, storage, _ := newTestChats(t)
+	blobs := &servicetest.Blobs{}
+	return NewAttachments(zerolog.Nop(), storage, blobs, testAttachmentOptions), chats, storage, blobs
+}
+
+// PNG размером width x height
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func mustUpload(t *testing.T, attachments AttachmentService, user models.UserStruct, chatId int, name string, data []byte) models.Attachment {
+	t.Helper()
+
+	attachment, err := attachments.Upload(context.Background(), user, chatId, name, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload(%q) error = %v", name, err)
+	}
+	return attachment
+}
+
+func TestUploadAttachment(t *testing.T) {
+	attachments, chats, _, blobs := newTestAttachments(t)
+	chat := mustCreateChat(t, chats, "general")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+
+	// Тип определяется по содержимому, имя очищается от пути
+	data := testPNG(t, 200, 100)
+	photo := mustUpload(t, attachments, alice, chat.RoomId, `C:\photos\cat.txt`, data)
+	sum := sha256.Sum256(data)
+	if photo.Name != "cat.txt" || photo.MimeType != "image/png" || photo.Size != int64(len(data)) ||
+		photo.Checksum != hex.EncodeToString(sum[:]) || photo.UploaderId != alice.UserId || photo.ChatId != chat.RoomId {
+		t.Errorf("Upload() = %+v", photo)
+	}
+	if photo.URL != "/api/v1/attachments/"+photo.Id || photo.ThumbnailURL != photo.URL+"/thumbnail" {
+		t.Errorf("urls = %q, %q", photo.URL, photo.ThumbnailURL)
+	}
+
+	text := mustUpload(t, attachments, alice, chat.RoomId, "notes.txt", []byte("hello"))
+	if text.MimeType != "text/plain; charset=utf-8" || text.ThumbnailURL != "" {
+		t.Errorf("Upload() text = %+v", text)
+	}
+
+	want := []string{"attachments/" + photo.Id, "attachments/" + text.Id, "thumbnails/" + photo.Id}
+	sort.Strings(want)
+	if got := blobs.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("blobs = %v, want %v", got, want)
+	}
+}
+
+func TestUploadAttachmentErrors(t *testing.T) {
+	attachments, chats, _, blobs := newTestAttachments(t)
+	chat := mustCreateChat(t, chats, "general")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		user   models.UserStruct
+		chatId int
+		data   []byte
+		want   error
+	}{
+		{name: "anonymous", chatId: chat.RoomId, data: []byte("hi"), want: ErrUnauthorized},
+		{name: "missing chat", user: alice, chatId: 999, data: []byte("hi"), want: ErrNotFound},
+		{name: "empty", user: alice, chatId: chat.RoomId, want: ErrValidation},
+		{name: "too large", user: alice, chatId: chat.RoomId, data: bytes.Repeat([]byte("a"), 1<<20+1), want: ErrValidation},
+		{name: "not allowed", user: alice, chatId: chat.RoomId, data: []byte("%PDF-1.4 document"), want: ErrValidation},
+		{name: "html", user: alice, chatId: chat.RoomId, data: []byte("<html><script>alert(1)</script>"), want: ErrValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := attachments.Upload(ctx, tt.user, tt.chatId, "file", bytes.NewReader(tt.data))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Upload() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Содержимое вложения в несуществующий чат удаляется
+	if keys := blobs.Keys(); len(keys) != 0 {
+		t.Errorf("blobs = %v, want none", keys)
+	}
+}
+
+func TestOpenAttachment(t *testing.T) {
+	attachments, chats, _, _ := newTestAttachments(t)
+	chat := mustCreateChat(t, chats, "general")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	bob := models.UserStruct{UserId: "2", UserName: "Bob"}
+	ctx := context.Background()
+
+	uploaded := mustUpload(t, attachments, alice, chat.RoomId, "cat.png", testPNG(t, 10, 10))
+
+	open := func(user models.UserStruct, thumbnail bool) (models.Attachment, string, error) {
+		attachment, body, err := attachments.Open(ctx, user, uploaded.Id, thumbnail)
+		if err != nil {
+			return attachment, "", err
+		}
+		defer body.Close()
+		data, _ := io.ReadAll(body)
+		return attachment, string(data), nil
+	}
+
+	// До отправки вложение видит только загрузивший
+	if _, _, err := open(bob, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open() by other user before send error = %v, want ErrNotFound", err)
+	}
+	if _, _, err := open(models.UserStruct{}, false); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Open() anonymous error = %v, want ErrUnauthorized", err)
+	}
+	attachment, data, err := open(alice, false)
+	if err != nil || attachment.MimeType != "image/png" || data != string(testPNG(t, 10, 10)) {
+		t.Errorf("Open() by uploader = %+v, %v", attachment, err)
+	}
+
+	msg := &models.SendMessage{ChatId: chat.RoomId, Author: alice.UserName, AuthorId: alice.UserId,
+		Attachments: []models.Attachment{{Id: uploaded.Id}}}
+	if err = chats.SendMessage(ctx, msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	thumb, data, err := open(bob, true)
+	if err != nil || thumb.MimeType != "image/jpeg" || !strings.HasPrefix(data, "\xff\xd8") {
+		t.Errorf("Open() thumbnail = %+v, %v", thumb, err)
+	}
+
+	if _, err = chats.DeleteMessage(ctx, chat.RoomId, msg.Seq, alice); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	if _, _, err = open(alice, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open() of deleted message error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSendMessageWithAttachments(t *testing.T) {
+	attachments, chats, _, _ := newTestAttachments(t)
+	general := mustCreateChat(t, chats, "general")
+	random := mustCreateChat(t, chats, "random")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	bob := models.UserStruct{UserId: "2", UserName: "Bob"}
+	ctx := context.Background()
+
+	own := mustUpload(t, attachments, alice, general.RoomId, "a.txt", []byte("a"))
+	foreign := mustUpload(t, attachments, bob, general.RoomId, "b.txt", []byte("b"))
+	elsewhere := mustUpload(t, attachments, alice, random.RoomId, "c.txt", []byte("c"))
+
+	send := func(ids ...string) (*models.SendMessage, error) {
+		msg := &models.SendMessage{ChatId: general.RoomId, Author: alice.UserName, AuthorId: alice.UserId}
+		for _, id := range ids {
+			msg.Attachments = append(msg.Attachments, models.Attachment{Id: id})
+		}
+		return msg, chats.SendMessage(ctx, msg)
+	}
+
+	for _, tt := range []struct {
+		name string
+		ids  []string
+		want error
+	}{
+		{name: "no text and attachments", want: ErrValidation},
+		{name: "foreign", ids: []string{foreign.Id}, want: ErrNotFound},
+		{name: "other chat", ids: []string{elsewhere.Id}, want: ErrNotFound},
+		{name: "missing", ids: []string{"missing"}, want: ErrNotFound},
+		{name: "duplicate", ids: []string{own.Id, own.Id}, want: ErrValidation},
+		{name: "too many", ids: strings.Split(strings.Repeat("x,", maxMessageAttachments+1), ",")[:maxMessageAttachments+1], want: ErrValidation},
+	} {
+		if _, err := send(tt.ids...); !errors.Is(err, tt.want) {
+			t.Errorf("SendMessage() %s error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Сообщение без текста, но с вложением
+	msg, err := send(own.Id)
+	if err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Name != "a.txt" || msg.Attachments[0].URL != own.URL {
+		t.Errorf("sent attachments = %+v", msg.Attachments)
+	}
+
+	if _, err = send(own.Id); !errors.Is(err, ErrConflict) {
+		t.Errorf("SendMessage() already sent error = %v, want ErrConflict", err)
+	}
+
+	messages, err := chats.GetMessages(ctx, general.RoomId, 0, 0)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(messages) != 1 || len(messages[0].Attachments) != 1 || messages[0].Attachments[0].URL != own.URL {
+		t.Errorf("GetMessages() = %+v", messages)
+	}
+}
+
+func TestDeleteUnsentAttachments(t *testing.T) {
+	chats, storage, _ := newTestChats(t)
+	blobs := &servicetest.Blobs{}
+	opts := testAttachmentOptions
+	opts.UnsentTTL = time.Millisecond
+	attachments := NewAttachments(zerolog.Nop(), storage, blobs, opts)
+	chat := mustCreateChat(t, chats, "general")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	ctx := context.Background()
+
+	sent := mustUpload(t, attachments, alice, chat.RoomId, "a.txt", []byte("a"))
+	unsent := mustUpload(t, attachments, alice, chat.RoomId, "image.png", testPNG(t, 100, 50))
+	if err := chats.SendMessage(ctx, &models.SendMessage{ChatId: chat.RoomId, Author: alice.UserName, AuthorId: alice.UserId,
+		Attachments: []models.Attachment{{Id: sent.Id}}}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Без срока хранения вложения не удаляются
+	if deleted, err := NewAttachments(zerolog.Nop(), storage, blobs, testAttachmentOptions).DeleteUnsent(ctx); err != nil || deleted != 0 {
+		t.Errorf("DeleteUnsent() without ttl = %d, %v, want 0", deleted, err)
+	}
+
+	if deleted, err := attachments.DeleteUnsent(ctx); err != nil || deleted != 1 {
+		t.Errorf("DeleteUnsent() = %d, %v, want 1", deleted, err)
+	}
+	if keys, want := blobs.Keys(), []string{attachmentKey(sent.Id)}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("blobs = %v, want %v", keys, want)
+	}
+	if _, _, err := attachments.Open(ctx, alice, unsent.Id, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open() of deleted error = %v, want ErrNotFound", err)
+	}
+	if _, body, err := attachments.Open(ctx, alice, sent.Id, false); err != nil {
+		t.Errorf("Open() of sent error = %v", err)
+	} else {
+		body.Close()
+	}
+
+	storage.Err = errors.New("db is down")
+	if _, err := attachments.DeleteUnsent(ctx); err == nil {
+		t.Error("DeleteUnsent() error = nil, want storage error")
+	}
+}
+
+func TestAttachmentName(t *testing.T) {
+	tests := map[string]string{
+		"report.pdf":             "report.pdf",
+		"../../etc/passwd":       "passwd",
+		`C:\Users\me\photo.jpg`:  "photo.jpg",
+		"  spaced.txt  ":         "spaced.txt",
+		"line\nbreak\x00.txt":    "linebreak.txt",
+		"":                       "file",
+		"dir/":                   "file",
+		"..":                     "file",
+		strings.Repeat("я", 300): strings.Repeat("я", maxAttachmentNameLength),
+	}
+	for name, want := range tests {
+		if got := attachmentName(name); got != want {
+			t.Errorf("attachmentName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,1085 @@
+package service
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Yury132/Golang-Task-3/internal/markdown"
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Максимальное количество сообщений истории за один запрос
+const maxMessagesLimit = 200
+
+// Максимальная длина названия чата, совпадает с размером колонки в БД
+const maxChatNameLength = 100
+
+// Максимальный размер реакции в байтах, совпадает с размером колонки в БД
+const maxReactionSize = 64
+
+// Набор текста: typing.start одного подключения рассылается не чаще typingThrottle,
+// без повторения typing.start в течение typingTimeout рассылается typing.stop
+const (
+	typingThrottle = 2 * time.Second
+	typingTimeout  = 5 * time.Second
+)
+
+// Короткий код реакции вида :thumbsup:
+var reactionCode = regexp.MustCompile(`^:[a-z0-9_+-]{1,30}:$`)
+
+// Чаты: создание, изменение, удаление, участники и рассылка сообщений
+type ChatService interface {
+	// Создание чата, создатель становится его администратором
+	CreateChat(ctx context.Context, name string, owner models.UserStruct) (models.RoomStruct, error)
+	GetChat(ctx context.Context, chatId int) (models.RoomStruct, error)
+	GetChats(ctx context.Context) ([]models.RoomStruct, error)
+	// Чаты вместе с подключенными сейчас участниками и числом непрочитанных пользователем сообщений
+	// Для пользователя без ID непрочитанные не считаются
+	GetChatsWithMembers(ctx context.Context, user models.UserStruct) ([]models.ChatStruct, error)
+	RenameChat(ctx context.Context, chatId int, user models.UserStruct, name string) error
+	DeleteChat(ctx context.Context, chatId int, user models.UserStruct) error
+	// Подключение клиента к чату и его отключение
+	Join(ctx context.Context, chatId int, client Client) error
+	Leave(chatId int, client Client)
+	// Пользователи, заходившие на сервер
+	RegisterUser(user models.UserStruct)
+	GetUsers() []models.UserStruct
+	SendMessage(ctx context.Context, msg *models.SendMessage) error
+	GetMessages(ctx context.Context, chatId int, afterSeq int64, limit int) ([]models.Message, error)
+	// Ответы в треде сообщения parentSeq
+	GetReplies(ctx context.Context, chatId int, parentSeq int64, afterSeq int64, limit int) ([]models.Message, error)
+	// Подписка клиента на ответы в треде и отписка от них
+	SubscribeThread(ctx context.Context, chatId int, parentSeq int64, client Client) error
+	UnsubscribeThread(chatId int, parentSeq int64, client Client)
+	// Изменение и удаление сообщения его автором или администратором чата
+	EditMessage(ctx context.Context, chatId int, seq int64, user models.UserStruct, text string) (models.Message, error)
+	DeleteMessage(ctx context.Context, chatId int, seq int64, user models.UserStruct) (models.Message, error)
+	// Реакции пользователя на сообщение, повторное добавление и удаление отсутствующей реакции ничего не меняют
+	AddReaction(ctx context.Context, chatId int, seq int64, user models.UserStruct, reaction string) error
+	RemoveReaction(ctx context.Context, chatId int, seq int64, user models.UserStruct, reaction string) error
+	// Отметка сообщений чата до seq включительно прочитанными пользователем
+	MarkRead(ctx context.Context, chatId int, seq int64, user models.UserStruct) error
+	// Полнотекстовый поиск сообщений в доступных пользователю чатах
+	SearchMessages(ctx context.Context, user models.UserStruct, query models.SearchQuery) (models.SearchPage, error)
+	// Сигнал набора текста клиентом для остальных участников чата, не сохраняется
+	SetTyping(ctx context.Context, chatId int, client Client, typing bool) error
+	// Отметка подключения как неактивного (вкладка скрыта) или снова активного
+	SetAway(ctx context.Context, chatId int, client Client, away bool) error
+	// Участники чата с присутствием по всем экземплярам сервиса
+	Members(ctx context.Context, chatId int) ([]models.Member, error)
+	// Изменение присутствия из общего хранилища
+	ApplyPresence(ctx context.Context, state models.PresenceState) error
+	// Продление записей присутствия этого экземпляра, работает до отмены ctx
+	KeepPresence(ctx context.Context)
+	// Рассылка сообщения из шины всем участникам чата
+	Deliver(ctx context.Context, msg *models.SendMessage) error
+}
+
+// Подключение участника чата, в транспортном слое это WebSocket
+type Client interface {
+	User() models.UserStruct
+	Send(ctx context.Context, msg *models.SendMessage) error
+	// Закрытие подключения с указанием причины
+	Close(reason string)
+}
+
+// Отправка сообщений в шину для рассылки
+type Publisher interface {
+	Publish(ctx context.Context, msg *models.SendMessage) error
+	// Рассылка кратковременного сигнала без сохранения, сигнал получают все экземпляры сервиса
+	Broadcast(ctx context.Context, msg *models.SendMessage) error
+}
+
+type ChatStorage interface {
+	// Создание чата, ownerId - ID создателя
+	CreateChat(ctx context.Context, name string, ownerId string) (models.RoomStruct, error)
+	// Чат по ID, false если его нет
+	GetChat(ctx context.Context, chatId int) (models.RoomStruct, bool, error)
+	// Все чаты
+	GetChats(ctx context.Context) ([]models.RoomStruct, error)
+	// Изменение названия чата, false если его нет
+	RenameChat(ctx context.Context, chatId int, name string) (bool, error)
+	// Удаление чата вместе с сообщениями, false если его нет
+	DeleteChat(ctx context.Context, chatId int) (bool, error)
+	// Сохранение сообщения с присвоением порядкового номера в чате, false если чата нет
+	// У ответа в треде увеличивается число ответов корневого сообщения
+	// Вложения из msg.Attachments прикрепляются к сообщению, в msg.Attachments остаются только прикрепленные
+	CreateMessage(ctx context.Context, msg *models.SendMessage) (bool, error)
+	// Сообщения чата вне тредов с номерами больше afterSeq
+	GetMessages(ctx context.Context, chatId int, afterSeq int64, limit int) ([]models.Message, error)
+	// Ответы в треде сообщения parentSeq с номерами больше afterSeq
+	GetReplies(ctx context.Context, chatId int, parentSeq int64, afterSeq int64, limit int) ([]models.Message, error)
+	// Сообщение чата по номеру, false если его нет
+	GetMessage(ctx context.Context, chatId int, seq int64) (models.Message, bool, error)
+	// Изменение текста сообщения с сохранением прежней версии, false если сообщения нет или оно удалено
+	// bodyHTML - безопасный HTML нового текста
+	EditMessage(ctx context.Context, chatId int, seq int64, editorId string, body string, bodyHTML string) (models.Message, bool, error)
+	// Удаление текста сообщения с сохранением прежней версии, false если сообщения нет или оно уже удалено
+	DeleteMessage(ctx context.Context, chatId int, seq int64, editorId string) (models.Message, bool, error)
+	// Добавление реакции пользователя, false если она уже была; возвращает число таких реакций
+	AddReaction(ctx context.Context, messageId int64, userId string, reaction string) (int, bool, error)
+	// Удаление реакции пользователя, false если ее не было; возвращает число оставшихся таких реакций
+	RemoveReaction(ctx context.Context, messageId int64, userId string, reaction string) (int, bool, error)
+	// Отметка сообщений чата до seq включительно прочитанными, false если отметка не сдвинулась вперед
+	MarkRead(ctx context.Context, chatId int, userId string, seq int64) (bool, error)
+	// Число непрочитанных пользователем сообщений других участников по ID чата
+	GetUnreadCounts(ctx context.Context, userId string) (map[int]int, error)
+	// Поиск неудаленных сообщений по тексту, не больше query.Limit со смещением query.Offset
+	SearchMessages(ctx context.Context, query models.SearchQuery) ([]models.SearchResult, error)
+	// Вложения по ID, отсутствующие пропускаются
+	GetAttachments(ctx context.Context, ids []string) ([]models.Attachment, error)
+}
+
+type chatService struct {
+	logger    zerolog.Logger
+	storage   ChatStorage
+	publisher Publisher
+
+	// Блокировки чатов *sync.Mutex, сохраняют порядок публикации сообщений
+	chatLocks sync.Map
+
+	mu sync.Mutex
+	// Подключенные клиенты каждого чата
+	clients map[int][]Client
+	// Подписчики тредов каждого чата по номеру корневого сообщения
+	threads map[int]map[int64][]Client
+	// Номер последнего разосланного сообщения в каждом чате
+	// Повторно доставленные и устаревшие сообщения не рассылаются
+	lastSeq map[int]int64
+	// Пользователи по ID Google
+	users map[string]models.UserStruct
+	// Набор текста подключениями
+	typing map[Client]*typingState
+
+	typingThrottle time.Duration
+	typingTimeout  time.Duration
+
+	presence PresenceStore
+	// Сериализует запись присутствия этого экземпляра
+	presenceMu sync.Mutex
+	// Записи присутствия этого экземпляра со статусом в сети или отошел, под presenceMu
+	published map[presenceKey]models.PresenceState
+	// Неактивные подключения, под mu
+	away map[Client]bool
+	// Записи присутствия всех экземпляров: чат, пользователь, экземпляр; под mu
+	states map[int]map[string]map[string]models.PresenceState
+	// Последний разосланный статус пользователя в чате, под mu
+	announced map[presenceKey]string
+
+	presenceTTL     time.Duration
+	presenceRefresh time.Duration
+}
+
+// Набор текста одним подключением
+type typingState struct {
+	chatId int
+	// Разослан typing.start без последующего typing.stop
+	active bool
+	// Время последнего разосланного typing.start
+	sentAt time.Time
+	// Таймер окончания набора и номер его запуска, сработавший устаревший таймер ничего не делает
+	timer *time.Timer
+	gen   int
+}
+
+// Создание чата
+func (s *chatService) CreateChat(ctx context.Context, name string, owner models.UserStruct) (models.RoomStruct, error) {
+	name, err := validateChatName(name)
+	if err != nil {
+		return models.RoomStruct{}, err
+	}
+
+	chat, err := s.storage.CreateChat(ctx, name, owner.UserId)
+	if err != nil {
+		return models.RoomStruct{}, errors.Wrap(err, "failed to create chat")
+	}
+
+	return chat, nil
+}
+
+// Чат по ID
+func (s *chatService) GetChat(ctx context.Context, chatId int) (models.RoomStruct, error) {
+	chat, ok, err := s.storage.GetChat(ctx, chatId)
+	if err != nil {
+		return models.RoomStruct{}, errors.Wrap(err, "failed to get chat")
+	}
+	if !ok {
+		return models.RoomStruct{}, NotFound("chat not found")
+	}
+
+	return chat, nil
+}
+
+// Все чаты
+func (s *chatService) GetChats(ctx context.Context) ([]models.RoomStruct, error) {
+	chats, err := s.storage.GetChats(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get chats")
+	}
+
+	return chats, nil
+}
+
+// Все чаты с подключенными сейчас участниками и непрочитанными сообщениями
+func (s *chatService) GetChatsWithMembers(ctx context.Context, user models.UserStruct) ([]models.ChatStruct, error) {
+	rooms, err := s.GetChats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var unread map[int]int
+	if user.UserId != "" {
+		if unread, err = s.storage.GetUnreadCounts(ctx, user.UserId); err != nil {
+			return nil, errors.Wrap(err, "failed to get unread counts")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Пользователь с несколькими подключениями к любым экземплярам указывается один раз
+	now := time.Now()
+	chats := make([]models.ChatStruct, 0, len(rooms))
+	for _, room := range rooms {
+		users := make([]models.UserStruct, 0)
+		for _, member := range s.membersLocked(room.RoomId, now) {
+			if member.Status != models.PresenceOffline {
+				users = append(users, models.UserStruct{UserId: member.UserId, UserName: member.UserName})
+			}
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].UserName < users[j].UserName })
+		chats = append(chats, models.ChatStruct{ChatId: room.RoomId, Room: room, User: users, Unread: unread[room.RoomId]})
+	}
+
+	return chats, nil
+}
+
+// Изменение названия чата, доступно только администратору чата
+// Участники узнают о новом названии из сообщения в чате
+func (s *chatService) RenameChat(ctx context.Context, chatId int, user models.UserStruct, name string) error {
+	name, err := validateChatName(name)
+	if err != nil {
+		return err
+	}
+	if err = s.checkManage(ctx, chatId, user); err != nil {
+		return err
+	}
+
+	ok, err := s.storage.RenameChat(ctx, chatId, name)
+	if err != nil {
+		return errors.Wrap(err, "failed to rename chat")
+	}
+	if !ok {
+		return NotFound("chat not found")
+	}
+
+	msg := &models.SendMessage{
+		Msg:         "Новое название чата - " + name,
+		Author:      user.UserName,
+		AuthorId:    user.UserId,
+		MessageType: 1,
+		ChatId:      chatId,
+	}
+
+	return s.SendMessage(ctx, msg)
+}
+
+// Удаление чата вместе с историей, доступно только администратору чата
+// Подключения участников закрываются
+func (s *chatService) DeleteChat(ctx context.Context, chatId int, user models.UserStruct) error {
+	if err := s.checkManage(ctx, chatId, user); err != nil {
+		return err
+	}
+
+	ok, err := s.storage.DeleteChat(ctx, chatId)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete chat")
+	}
+	if !ok {
+		return NotFound("chat not found")
+	}
+
+	// Подключения этого экземпляра закрываются сразу, остальных - по сигналу
+	event := &models.SendMessage{Event: models.EventChatDeleted, MessageType: 1, ChatId: chatId}
+	s.closeChat(ctx, event)
+	if err = s.publisher.Broadcast(ctx, event); err != nil {
+		s.loggerFrom(ctx).Warn().Err(err).Int("chat_id", chatId).Msg("failed to broadcast chat deletion")
+	}
+
+	return nil
+}
+
+// Закрытие подключений удаленного чата после рассылки им события chat.deleted
+// Повторный вызов для того же чата ничего не делает
+func (s *chatService) closeChat(ctx context.Context, event *models.SendMessage) {
+	s.mu.Lock()
+	clients := s.clients[event.ChatId]
+	delete(s.clients, event.ChatId)
+	delete(s.threads, event.ChatId)
+	delete(s.lastSeq, event.ChatId)
+	s.mu.Unlock()
+
+	s.chatLocks.Delete(event.ChatId)
+
+	s.send(ctx, clients, event)
+	for _, client := range clients {
+		client.Close("chat deleted")
+	}
+}
+
+// Проверка, что пользователь может управлять чатом
+func (s *chatService) checkManage(ctx context.Context, chatId int, user models.UserStruct) error {
+	chat, err := s.GetChat(ctx, chatId)
+	if err != nil {
+		return err
+	}
+	if !canManage(chat, user) {
+		return Forbidden("only the chat admin can change the chat")
+	}
+
+	return nil
+}
+
+// Подключение клиента к существующему чату
+func (s *chatService) Join(ctx context.Context, chatId int, client Client) error {
+	if _, err := s.GetChat(ctx, chatId); err != nil {
+		return err
+	}
+
+	s.RegisterUser(client.User())
+
+	s.mu.Lock()
+	s.clients[chatId] = append(s.clients[chatId], client)
+	s.mu.Unlock()
+
+	s.updatePresence(ctx, chatId, client.User())
+
+	return nil
+}
+
+// Отключение клиента от чата и его тредов
+// Если клиент набирал текст, остальные участники получают typing.stop
+func (s *chatService) Leave(chatId int, client Client) {
+	s.mu.Lock()
+	s.clients[chatId] = removeClient(s.clients[chatId], client)
+	if len(s.clients[chatId]) == 0 {
+		delete(s.clients, chatId)
+	}
+
+	for parentSeq := range s.threads[chatId] {
+		s.unsubscribe(chatId, parentSeq, client)
+	}
+
+	stopped := s.stopTyping(client)
+	delete(s.typing, client)
+	delete(s.away, client)
+	s.mu.Unlock()
+
+	if stopped {
+		s.broadcastTyping(context.Background(), chatId, client.User(), false)
+	}
+	s.updatePresence(context.Background(), chatId, client.User())
+}
+
+// Подписка клиента на ответы в треде
+// Клиент должен быть подключен к чату, тред открывается только у корневого сообщения
+func (s *chatService) SubscribeThread(ctx context.Context, chatId int, parentSeq int64, client Client) error {
+	if _, err := s.threadRoot(ctx, chatId, parentSeq); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !containsClient(s.clients[chatId], client) {
+		return Forbidden("client is not connected to the chat")
+	}
+	if containsClient(s.threads[chatId][parentSeq], client) {
+		return nil
+	}
+	if s.threads[chatId] == nil {
+		s.threads[chatId] = make(map[int64][]Client)
+	}
+	s.threads[chatId][parentSeq] = append(s.threads[chatId][parentSeq], client)
+
+	return nil
+}
+
+// Отписка клиента от ответов в треде
+func (s *chatService) UnsubscribeThread(chatId int, parentSeq int64, client Client) {
+	s.mu.Lock()
+	s.unsubscribe(chatId, parentSeq, client)
+	s.mu.Unlock()
+}
+
+// Удаление подписки, вызывается под s.mu
+func (s *chatService) unsubscribe(chatId int, parentSeq int64, client Client) {
+	threads := s.threads[chatId]
+	if threads == nil {
+		return
+	}
+	threads[parentSeq] = removeClient(threads[parentSeq], client)
+	if len(threads[parentSeq]) == 0 {
+		delete(threads, parentSeq)
+	}
+	if len(threads) == 0 {
+		delete(s.threads, chatId)
+	}
+}
+
+// Запоминаем пользователя
+func (s *chatService) RegisterUser(user models.UserStruct) {
+	s.mu.Lock()
+	s.users[user.UserId] = user
+	s.mu.Unlock()
+}
+
+// Все пользователи, заходившие на сервер
+func (s *chatService) GetUsers() []models.UserStruct {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]models.UserStruct, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+
+	return users
+}
+
+// Сохранение сообщения и его публикация для рассылки
+// Сохранение и публикация в одном чате выполняются под блокировкой,
+// поэтому сообщения попадают в шину в порядке их номеров
+// Сообщение с вложениями может быть без текста
+// Текст сохраняется вместе с его безопасным HTML по разметке Markdown
+func (s *chatService) SendMessage(ctx context.Context, msg *models.SendMessage) error {
+	if msg.ChatId < 1 {
+		return NotFound("chat not found")
+	}
+	if strings.TrimSpace(msg.Msg) == "" && len(msg.Attachments) == 0 {
+		return Validation("empty message")
+	}
+	if msg.ParentSeq != 0 {
+		if _, err := s.threadRoot(ctx, msg.ChatId, msg.ParentSeq); err != nil {
+			return err
+		}
+	}
+
+	lock := s.chatLock(msg.ChatId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Под блокировкой чата одно вложение не уйдет в двух сообщениях этого экземпляра
+	if err := s.checkAttachments(ctx, msg); err != nil {
+		return err
+	}
+	requested := len(msg.Attachments)
+	msg.Html = markdown.Render(msg.Msg)
+
+	ok, err := s.storage.CreateMessage(ctx, msg)
+	if err != nil {
+		return errors.Wrap(err, "failed to save message")
+	}
+	if !ok {
+		return NotFound("chat not found")
+	}
+	if len(msg.Attachments) != requested {
+		// Вложение успели отправить через другой экземпляр сервиса
+		s.loggerFrom(ctx).Warn().Int("chat_id", msg.ChatId).Int64("seq", msg.Seq).
+			Int("requested", requested).Int("attached", len(msg.Attachments)).Msg("some attachments were not attached")
+	}
+
+	if err = s.publisher.Publish(ctx, msg); err != nil {
+		return errors.Wrap(err, "failed to publish message")
+	}
+
+	return nil
+}
+
+// История сообщений чата после номера afterSeq
+func (s *chatService) GetMessages(ctx context.Context, chatId int, afterSeq int64, limit int) ([]models.Message, error) {
+	if chatId < 1 {
+		return nil, NotFound("chat not found")
+	}
+	if afterSeq < 0 {
+		return nil, Validation("after_seq must not be negative")
+	}
+	if limit < 1 || limit > maxMessagesLimit {
+		limit = maxMessagesLimit
+	}
+
+	messages, err := s.storage.GetMessages(ctx, chatId, afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	messagesWithURLs(messages)
+	messagesWithHTML(messages)
+
+	return messages, nil
+}
+
+// Ответы в треде сообщения parentSeq после номера afterSeq
+func (s *chatService) GetReplies(ctx context.Context, chatId int, parentSeq int64, afterSeq int64, limit int) ([]models.Message, error) {
+	if afterSeq < 0 {
+		return nil, Validation("after_seq must not be negative")
+	}
+	if limit < 1 || limit > maxMessagesLimit {
+		limit = maxMessagesLimit
+	}
+	if _, err := s.threadRoot(ctx, chatId, parentSeq); err != nil {
+		return nil, err
+	}
+
+	replies, err := s.storage.GetReplies(ctx, chatId, parentSeq, afterSeq, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get replies")
+	}
+	messagesWithURLs(replies)
+	messagesWithHTML(replies)
+
+	return replies, nil
+}
+
+// HTML сообщений, сохраненных до появления разметки, строится при чтении
+func messagesWithHTML(messages []models.Message) {
+	for i := range messages {
+		if messages[i].Html == "" && messages[i].DeletedAt == nil {
+			messages[i].Html = markdown.Render(messages[i].Msg)
+		}
+	}
+}
+
+// Корневое сообщение треда
+// Треды одноуровневые: ответить в тред можно только на сообщение, которое само не является ответом
+func (s *chatService) threadRoot(ctx context.Context, chatId int, parentSeq int64) (models.Message, error) {
+	if chatId < 1 {
+		return models.Message{}, NotFound("chat not found")
+	}
+	if parentSeq < 1 {
+		return models.Message{}, NotFound("parent message not found")
+	}
+
+	parent, ok, err := s.storage.GetMessage(ctx, chatId, parentSeq)
+	if err != nil {
+		return models.Message{}, errors.Wrap(err, "failed to get parent message")
+	}
+	if !ok {
+		return models.Message{}, NotFound("parent message not found")
+	}
+	if parent.ParentSeq != 0 {
+		return models.Message{}, Validation("cannot reply to a thread reply")
+	}
+	if parent.DeletedAt != nil {
+		return models.Message{}, Conflict("parent message is deleted")
+	}
+
+	return parent, nil
+}
+
+// Изменение текста сообщения
+func (s *chatService) EditMessage(ctx context.Context, chatId int, seq int64, user models.UserStruct, text string) (models.Message, error) {
+	if strings.TrimSpace(text) == "" {
+		return models.Message{}, Validation("empty message")
+	}
+
+	return s.modifyMessage(ctx, chatId, seq, user, models.EventMessageEdited, func() (models.Message, bool, error) {
+		return s.storage.EditMessage(ctx, chatId, seq, user.UserId, text, markdown.Render(text))
+	})
+}
+
+// Удаление сообщения, в истории остается отметка об удалении без текста
+func (s *chatService) DeleteMessage(ctx context.Context, chatId int, seq int64, user models.UserStruct) (models.Message, error) {
+	return s.modifyMessage(ctx, chatId, seq, user, models.EventMessageDeleted, func() (models.Message, bool, error) {
+		return s.storage.DeleteMessage(ctx, chatId, seq, user.UserId)
+	})
+}
+
+// Проверка прав на сообщение, его изменение через modify и публикация события event
+// Изменять сообщение может его автор или администратор чата, удаленное сообщение не изменяется
+func (s *chatService) modifyMessage(ctx context.Context, chatId int, seq int64, user models.UserStruct, event string, modify func() (models.Message, bool, error)) (models.Message, error) {
+	chat, err := s.GetChat(ctx, chatId)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	msg, ok, err := s.storage.GetMessage(ctx, chatId, seq)
+	if err != nil {
+		return models.Message{}, errors.Wrap(err, "failed to get message")
+	}
+	if !ok {
+		return models.Message{}, NotFound("message not found")
+	}
+	if !canModify(chat, msg, user) {
+		return models.Message{}, Forbidden("only the author or the chat admin can change the message")
+	}
+	if msg.DeletedAt != nil {
+		return models.Message{}, Conflict("message is deleted")
+	}
+
+	// Событие публикуется под блокировкой чата, как и новые сообщения
+	lock := s.chatLock(chatId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	msg, ok, err = modify()
+	if err != nil {
+		return models.Message{}, errors.Wrap(err, "failed to update message")
+	}
+	if !ok {
+		// Сообщение удалили между проверкой и изменением
+		return models.Message{}, Conflict("message is deleted")
+	}
+
+	err = s.publisher.Publish(ctx, &models.SendMessage{
+		Id:          msg.Id,
+		Seq:         msg.Seq,
+		Event:       event,
+		Version:     msg.Version,
+		Msg:         msg.Msg,
+		Html:        msg.Html,
+		ParentSeq:   msg.ParentSeq,
+		Author:      msg.Author,
+		AuthorId:    msg.AuthorId,
+		MessageType: 1,
+		ChatId:      msg.ChatId,
+		CreatedAt:   msg.CreatedAt,
+	})
+	if err != nil {
+		return models.Message{}, errors.Wrap(err, "failed to publish message event")
+	}
+
+	return msg, nil
+}
+
+// Добавление реакции на сообщение
+func (s *chatService) AddReaction(ctx context.Context, chatId int, seq int64, user models.UserStruct, reaction string) error {
+	return s.react(ctx, chatId, seq, user, reaction, models.EventReactionAdded, s.storage.AddReaction)
+}
+
+// Удаление реакции с сообщения
+func (s *chatService) RemoveReaction(ctx context.Context, chatId int, seq int64, user models.UserStruct, reaction string) error {
+	return s.react(ctx, chatId, seq, user, reaction, models.EventReactionRemoved, s.storage.RemoveReaction)
+}
+
+// Изменение реакций через change и публикация события event, если реакции изменились
+// Реагировать может любой пользователь, на удаленные сообщения реакции не ставятся
+func (s *chatService) react(ctx context.Context, chatId int, seq int64, user models.UserStruct, reaction string, event string,
+	change func(ctx context.Context, messageId int64, userId string, reaction string) (int, bool, error)) error {
+	if user.UserId == "" {
+		return Unauthorized("user is not identified")
+	}
+	if err := validateReaction(reaction); err != nil {
+		return err
+	}
+	if _, err := s.GetChat(ctx, chatId); err != nil {
+		return err
+	}
+
+	msg, ok, err := s.storage.GetMessage(ctx, chatId, seq)
+	if err != nil {
+		return errors.Wrap(err, "failed to get message")
+	}
+	if !ok {
+		return NotFound("message not found")
+	}
+	if msg.DeletedAt != nil {
+		return Conflict("message is deleted")
+	}
+
+	// Под блокировкой чата события реакций публикуются в порядке изменения счетчиков
+	lock := s.chatLock(chatId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, changed, err := change(ctx, msg.Id, user.UserId, reaction)
+	if err != nil {
+		return errors.Wrap(err, "failed to update reactions")
+	}
+	if !changed {
+		return nil
+	}
+
+	err = s.publisher.Publish(ctx, &models.SendMessage{
+		Id:            msg.Id,
+		Seq:           msg.Seq,
+		Event:         event,
+		ParentSeq:     msg.ParentSeq,
+		Reaction:      reaction,
+		ReactionCount: count,
+		Author:        user.UserName,
+		AuthorId:      user.UserId,
+		MessageType:   1,
+		ChatId:        msg.ChatId,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to publish reaction event")
+	}
+
+	return nil
+}
+
+// Отметка прочитанного
+// Отметка только сдвигается вперед; если она сдвинулась, участники чата получают message.read
+func (s *chatService) MarkRead(ctx context.Context, chatId int, seq int64, user models.UserStruct) error {
+	if user.UserId == "" {
+		return Unauthorized("user is not identified")
+	}
+	if seq < 1 {
+		return Validation("seq must be positive")
+	}
+	if _, err := s.GetChat(ctx, chatId); err != nil {
+		return err
+	}
+
+	if _, ok, err := s.storage.GetMessage(ctx, chatId, seq); err != nil {
+		return errors.Wrap(err, "failed to get message")
+	} else if !ok {
+		return NotFound("message not found")
+	}
+
+	changed, err := s.storage.MarkRead(ctx, chatId, user.UserId, seq)
+	if err != nil {
+		return errors.Wrap(err, "failed to mark messages read")
+	}
+	if !changed {
+		return nil
+	}
+
+	// Отметка уже сохранена, потерянное событие только задержит обновление у остальных участников
+	err = s.publisher.Broadcast(ctx, &models.SendMessage{
+		Seq:         seq,
+		Event:       models.EventMessageRead,
+		Author:      user.UserName,
+		AuthorId:    user.UserId,
+		MessageType: 1,
+		ChatId:      chatId,
+	})
+	if err != nil {
+		s.loggerFrom(ctx).Warn().Err(err).Int("chat_id", chatId).Int64("seq", seq).Msg("failed to broadcast read receipt")
+	}
+
+	return nil
+}
+
+// Сигнал набора текста
+// Частые typing.start отбрасываются, typing.stop рассылается, только если был разослан typing.start
+// Если клиент перестал повторять typing.start, typing.stop рассылается по таймеру
+func (s *chatService) SetTyping(ctx context.Context, chatId int, client Client, typing bool) error {
+	s.mu.Lock()
+	if !containsClient(s.clients[chatId], client) {
+		s.mu.Unlock()
+		return Forbidden("client is not connected to the chat")
+	}
+	var changed bool
+	if typing {
+		changed = s.startTyping(chatId, client)
+	} else {
+		changed = s.stopTyping(client)
+	}
+	s.mu.Unlock()
+
+	if changed {
+		s.broadcastTyping(ctx, chatId, client.User(), typing)
+	}
+
+	return nil
+}
+
+// Продление набора текста, true если typing.start нужно разослать
+// Вызывается под s.mu
+func (s *chatService) startTyping(chatId int, client Client) bool {
+	state, ok := s.typing[client]
+	if !ok {
+		state = &typingState{chatId: chatId}
+		s.typing[client] = state
+	}
+
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+	state.gen++
+	gen := state.gen
+	state.timer = time.AfterFunc(s.typingTimeout, func() {
+		s.expireTyping(client, state, gen)
+	})
+
+	if time.Since(state.sentAt) < s.typingThrottle {
+		return false
+	}
+	state.active = true
+	state.sentAt = time.Now()
+
+	return true
+}
+
+// Окончание набора текста, true если typing.stop нужно разослать
+// Состояние остается до отключения клиента, чтобы ограничение частоты действовало и после typing.stop
+// Вызывается под s.mu
+func (s *chatService) stopTyping(client Client) bool {
+	state, ok := s.typing[client]
+	if !ok {
+		return false
+	}
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	if !state.active {
+		return false
+	}
+	state.active = false
+
+	return true
+}
+
+// Клиент не повторил typing.start вовремя
+func (s *chatService) expireTyping(client Client, state *typingState, gen int) {
+	s.mu.Lock()
+	if s.typing[client] != state || state.gen != gen || !s.stopTyping(client) {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	s.broadcastTyping(context.Background(), state.chatId, client.User(), false)
+}
+
+// Рассылка сигнала набора текста через шину
+// Потерянный сигнал не критичен: у получателей индикатор набора тоже гаснет по таймеру
+func (s *chatService) broadcastTyping(ctx context.Context, chatId int, user models.UserStruct, typing bool) {
+	event := models.EventTypingStop
+	if typing {
+		event = models.EventTypingStart
+	}
+
+	err := s.publisher.Broadcast(ctx, &models.SendMessage{
+		Event:       event,
+		Author:      user.UserName,
+		AuthorId:    user.UserId,
+		MessageType: 1,
+		ChatId:      chatId,
+	})
+	if err != nil {
+		s.loggerFrom(ctx).Warn().Err(err).Int("chat_id", chatId).Str("event", event).Msg("failed to broadcast typing")
+	}
+}
+
+// Рассылка сообщения всем участникам чата
+// Вызывается воркерами пула рассылки, сообщения одного чата рассылаются строго по возрастанию номера
+// События изменения относятся к уже разосланным сообщениям и рассылаются всегда,
+// клиент сравнивает версию с показанной
+// Сообщения треда получают только его подписчики, остальные участники чата
+// узнают о новом ответе из события thread.updated
+// Сигналы набора текста получают все участники чата, кроме самого набирающего
+// Отметки прочтения получают все участники чата, в том числе другие подключения прочитавшего
+// По сигналу удаления чата его подключения закрываются
+// Ошибка записи одному клиенту не мешает рассылке остальным
+func (s *chatService) Deliver(ctx context.Context, msg *models.SendMessage) error {
+	if msg.Event == models.EventChatDeleted {
+		s.closeChat(ctx, msg)
+		return nil
+	}
+	if msg.Event == models.EventTypingStart || msg.Event == models.EventTypingStop {
+		s.mu.Lock()
+		var others []Client
+		for _, client := range s.clients[msg.ChatId] {
+			if client.User().UserId != msg.AuthorId {
+				others = append(others, client)
+			}
+		}
+		s.mu.Unlock()
+
+		s.send(ctx, others, msg)
+		return nil
+	}
+
+	s.mu.Lock()
+	if msg.Event == "" {
+		if msg.Seq <= s.lastSeq[msg.ChatId] {
+			s.mu.Unlock()
+			return nil
+		}
+		s.lastSeq[msg.ChatId] = msg.Seq
+	}
+	var clients, subscribers []Client
+	if msg.ParentSeq == 0 {
+		clients = append(clients, s.clients[msg.ChatId]...)
+	} else {
+		subscribers = append(subscribers, s.threads[msg.ChatId][msg.ParentSeq]...)
+		if msg.Event == "" {
+			for _, client := range s.clients[msg.ChatId] {
+				if !containsClient(subscribers, client) {
+					clients = append(clients, client)
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if msg.ParentSeq == 0 {
+		s.send(ctx, clients, msg)
+		return nil
+	}
+
+	s.send(ctx, subscribers, msg)
+	if len(clients) > 0 {
+		s.send(ctx, clients, &models.SendMessage{
+			Seq:         msg.Seq,
+			Event:       models.EventThreadUpdated,
+			ParentSeq:   msg.ParentSeq,
+			ReplyCount:  msg.ReplyCount,
+			Msg:         msg.Msg,
+			Html:        msg.Html,
+			Author:      msg.Author,
+			MessageType: msg.MessageType,
+			ChatId:      msg.ChatId,
+			PublishedAt: msg.PublishedAt,
+		})
+	}
+
+	return nil
+}
+
+// Отправка сообщения клиентам
+func (s *chatService) send(ctx context.Context, clients []Client, msg *models.SendMessage) {
+	for _, client := range clients {
+		if err := client.Send(ctx, msg); err != nil {
+			s.loggerFrom(ctx).Warn().Err(err).
+				Int("chat_id", msg.ChatId).
+				Int64("seq", msg.Seq).
+				Str("user_id", client.User().UserId).
+				Msg("failed to deliver message")
+		}
+	}
+}
+
+// Блокировка конкретного чата
+func (s *chatService) chatLock(chatId int) *sync.Mutex {
+	lock, _ := s.chatLocks.LoadOrStore(chatId, new(sync.Mutex))
+	return lock.(*sync.Mutex)
+}
+
+// Логгер запроса из контекста, если его нет - логгер сервиса
+func (s *chatService) loggerFrom(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &s.logger
+}
+
+// Список клиентов без client
+func removeClient(clients []Client, client Client) []Client {
+	for i, c := range clients {
+		if c == client {
+			return append(clients[:i:i], clients[i+1:]...)
+		}
+	}
+	return clients
+}
+
+func containsClient(clients []Client, client Client) bool {
+	for _, c := range clients {
+		if c == client {
+			return true
+		}
+	}
+	return false
+}
+
+// Автор сообщения или администратор чата
+// У сообщений и чатов, созданных до появления ID автора и владельца, изменять некому
+func canModify(chat models.RoomStruct, msg models.Message, user models.UserStruct) bool {
+	if user.UserId == "" {
+		return false
+	}
+
+	return msg.AuthorId == user.UserId || chat.OwnerId == user.UserId
+}
+
+// Переименовать и удалить чат может только его администратор
+// У чатов, созданных до появления владельцев, администратора нет
+func canManage(chat models.RoomStruct, user models.UserStruct) bool {
+	return user.UserId != "" && chat.OwnerId == user.UserId
+}
+
+// Реакция - короткий код вида :thumbsup: или один эмодзи,
+// в том числе составной: с оттенком кожи, вариантом начертания или через ZWJ
+func validateReaction(reaction string) error {
+	if reaction == "" {
+		return Validation("empty reaction")
+	}
+	if len(reaction) > maxReactionSize {
+		return Validation("reaction is too long")
+	}
+	if reactionCode.MatchString(reaction) {
+		return nil
+	}
+
+	symbols := 0
+	for _, r := range reaction {
+		switch {
+		case unicode.Is(unicode.So, r), r == 0x20E3:
+			// Символ или рамка клавиши, как в 1️⃣
+			symbols++
+		case r == 0x200D, r == 0xFE0E, r == 0xFE0F:
+			// Соединитель и вариант начертания
+		case r >= 0x1F3FB && r <= 0x1F3FF:
+			// Оттенок кожи
+		case r >= '0' && r <= '9', r == '#', r == '*':
+			// Основа эмодзи клавиш
+		default:
+			return Validation("reaction must be an emoji or a :code:")
+		}
+	}
+	if symbols == 0 {
+		return Validation("reaction must be an emoji or a :code:")
+	}
+
+	return nil
+}
+
+// Название чата без пробелов по краям
+func validateChatName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", Validation("empty chat name")
+	}
+	if utf8.RuneCountInString(name) > maxChatNameLength {
+		return "", Validation("chat name is too long")
+	}
+
+	return name, nil
+}
+
+func NewChats(logger zerolog.Logger, storage ChatStorage, publisher Publisher, presence PresenceStore) ChatService {
+	return &chatService{
+		logger:    logger,
+		storage:   storage,
+		publisher: publisher,
+		clients:   make(map[int][]Client),
+		threads:   make(map[int]map[int64][]Client),
+		lastSeq:   make(map[int]int64),
+		users:     make(map[string]models.UserStruct),
+		typing:    make(map[Client]*typingState),
+
+		typingThrottle: typingThrottle,
+		typingTimeout:  typingTimeout,
+
+		presence:  presence,
+		published: make(map[presenceKey]models.PresenceState),
+		away:      make(map[Client]bool),
+		states:    make(map[int]map[string]map[string]models.PresenceState),
+		announced: make(map[presenceKey]string),
+
+		presenceTTL:     presenceTTL,
+		presenceRefresh: presenceRefresh,
+	}
+}
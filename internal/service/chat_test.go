@@ -0,0 +1,1111 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/presence"
+	"github.com/Yury132/Golang-Task-3/internal/service/servicetest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Клиент, запоминающий полученные сообщения
+// События присутствия запоминаются отдельно, их проверяет TestPresence
+type fakeClient struct {
+	user models.UserStruct
+	err  error
+
+	mu       sync.Mutex
+	received []models.SendMessage
+	presence []models.SendMessage
+	closed   string
+}
+
+func (c *fakeClient) User() models.UserStruct {
+	return c.user
+}
+
+func (c *fakeClient) Send(_ context.Context, msg *models.SendMessage) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.mu.Lock()
+	if msg.Event == models.EventPresence {
+		c.presence = append(c.presence, *msg)
+	} else {
+		c.received = append(c.received, *msg)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Полученные события присутствия: имя пользователя и статус
+func (c *fakeClient) presenceChanges() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changes := make([]string, 0, len(c.presence))
+	for _, msg := range c.presence {
+		changes = append(changes, msg.Author+" "+msg.Status)
+	}
+	return changes
+}
+
+func (c *fakeClient) Close(reason string) {
+	c.mu.Lock()
+	c.closed = reason
+	c.mu.Unlock()
+}
+
+func (c *fakeClient) seqs() []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seqs := make([]int64, 0, len(c.received))
+	for _, msg := range c.received {
+		seqs = append(seqs, msg.Seq)
+	}
+	return seqs
+}
+
+// События полученных сообщений, пустая строка - новое сообщение
+func (c *fakeClient) events() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	events := make([]string, 0, len(c.received))
+	for _, msg := range c.received {
+		events = append(events, msg.Event)
+	}
+	return events
+}
+
+func (c *fakeClient) last() models.SendMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.received) == 0 {
+		return models.SendMessage{}
+	}
+	return c.received[len(c.received)-1]
+}
+
+func newTestChats(t *testing.T) (ChatService, *servicetest.ChatStorage, *servicetest.Publisher) {
+	t.Helper()
+
+	storage := servicetest.NewChatStorage()
+	publisher := &servicetest.Publisher{}
+	store := presence.NewMemory(zerolog.Nop(), "test")
+	chats := NewChats(zerolog.Nop(), storage, publisher, store)
+
+	watch, err := store.Watch(chats.ApplyPresence)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	t.Cleanup(watch.Stop)
+
+	return chats, storage, publisher
+}
+
+// Создатель чатов в тестах, администратор чата
+var owner = models.UserStruct{UserId: "owner", UserName: "Owner"}
+
+func mustCreateChat(t *testing.T, chats ChatService, name string) models.RoomStruct {
+	t.Helper()
+
+	chat, err := chats.CreateChat(context.Background(), name, owner)
+	if err != nil {
+		t.Fatalf("CreateChat(%q) error = %v", name, err)
+	}
+	return chat
+}
+
+func TestCreateChat(t *testing.T) {
+	tests := []struct {
+		name     string
+		chatName string
+		want     string
+		wantErr  error
+	}{
+		{name: "trimmed", chatName: "  general ", want: "general"},
+		{name: "empty", chatName: "   ", wantErr: ErrValidation},
+		{name: "max length", chatName: strings.Repeat("я", maxChatNameLength), want: strings.Repeat("я", maxChatNameLength)},
+		{name: "too long", chatName: strings.Repeat("я", maxChatNameLength+1), wantErr: ErrValidation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chats, _, _ := newTestChats(t)
+
+			chat, err := chats.CreateChat(context.Background(), tt.chatName, owner)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("CreateChat() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateChat() error = %v", err)
+			}
+			if chat.RoomName != tt.want || chat.RoomId < 1 || chat.OwnerId != owner.UserId {
+				t.Errorf("CreateChat() = %+v, want name %q", chat, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetChatNotFound(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+
+	if _, err := chats.GetChat(context.Background(), 42); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetChat() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRenameChat(t *testing.T) {
+	chats, _, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "old")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+
+	// Переименовать чат может только его администратор
+	for _, user := range []models.UserStruct{alice, {UserName: "Anonymous"}} {
+		if err := chats.RenameChat(ctx, chat.RoomId, user, "hacked"); !errors.Is(err, ErrForbidden) {
+			t.Errorf("RenameChat() by %+v error = %v, want ErrForbidden", user, err)
+		}
+	}
+
+	if err := chats.RenameChat(ctx, chat.RoomId, owner, " new "); err != nil {
+		t.Fatalf("RenameChat() error = %v", err)
+	}
+
+	got, err := chats.GetChat(ctx, chat.RoomId)
+	if err != nil {
+		t.Fatalf("GetChat() error = %v", err)
+	}
+	if got.RoomName != "new" {
+		t.Errorf("chat name = %q, want %q", got.RoomName, "new")
+	}
+
+	// Участники узнают о переименовании из сообщения в чате
+	published := publisher.Messages()
+	if len(published) != 1 {
+		t.Fatalf("published %d messages, want 1", len(published))
+	}
+	if msg := published[0]; msg.ChatId != chat.RoomId || msg.Author != owner.UserName || msg.Msg != "Новое название чата - new" || msg.Seq != 1 {
+		t.Errorf("published message = %+v", msg)
+	}
+
+	if err = chats.RenameChat(ctx, chat.RoomId+1, owner, "new"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RenameChat() of missing chat error = %v, want ErrNotFound", err)
+	}
+	if err = chats.RenameChat(ctx, chat.RoomId, owner, ""); !errors.Is(err, ErrValidation) {
+		t.Errorf("RenameChat() with empty name error = %v, want ErrValidation", err)
+	}
+}
+
+func TestDeleteChatClosesClients(t *testing.T) {
+	chats, storage, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+	other := mustCreateChat(t, chats, "other")
+
+	// Второй экземпляр сервиса с той же базой
+	remote := NewChats(zerolog.Nop(), storage, &servicetest.Publisher{}, presence.NewMemory(zerolog.Nop(), "remote"))
+	carol := &fakeClient{user: models.UserStruct{UserId: "3", UserName: "Carol"}}
+	if err := remote.Join(ctx, chat.RoomId, carol); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+
+	alice := &fakeClient{user: models.UserStruct{UserId: "1", UserName: "Alice"}}
+	bob := &fakeClient{user: models.UserStruct{UserId: "2", UserName: "Bob"}}
+	if err := chats.Join(ctx, chat.RoomId, alice); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	if err := chats.Join(ctx, other.RoomId, bob); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+
+	// Удалить чат может только его администратор
+	for _, user := range []models.UserStruct{alice.user, {UserName: "Anonymous"}} {
+		if err := chats.DeleteChat(ctx, chat.RoomId, user); !errors.Is(err, ErrForbidden) {
+			t.Errorf("DeleteChat() by %+v error = %v, want ErrForbidden", user, err)
+		}
+	}
+	if alice.closed != "" {
+		t.Error("client is closed after forbidden delete")
+	}
+
+	if err := chats.DeleteChat(ctx, chat.RoomId, owner); err != nil {
+		t.Fatalf("DeleteChat() error = %v", err)
+	}
+
+	if alice.closed == "" {
+		t.Error("client of deleted chat is not closed")
+	}
+	if bob.closed != "" {
+		t.Error("client of other chat is closed")
+	}
+	if last := alice.last(); last.Event != models.EventChatDeleted || last.ChatId != chat.RoomId {
+		t.Errorf("alice last received %+v, want chat.deleted", last)
+	}
+
+	// Остальные экземпляры закрывают подключения по сигналу
+	signals := publisher.Signals()
+	if len(signals) == 0 || signals[len(signals)-1].Event != models.EventChatDeleted || signals[len(signals)-1].ChatId != chat.RoomId {
+		t.Fatalf("signals = %+v, want chat.deleted", signals)
+	}
+	if carol.closed != "" {
+		t.Error("remote client is closed before the signal")
+	}
+	deleted := signals[len(signals)-1]
+	if err := remote.Deliver(ctx, &deleted); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if carol.closed == "" {
+		t.Error("remote client of deleted chat is not closed")
+	}
+	if last := carol.last(); last.Event != models.EventChatDeleted || last.ChatId != chat.RoomId {
+		t.Errorf("carol last received %+v, want chat.deleted", last)
+	}
+	if _, err := chats.GetChat(ctx, chat.RoomId); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetChat() after delete error = %v, want ErrNotFound", err)
+	}
+	if err := chats.DeleteChat(ctx, chat.RoomId, owner); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second DeleteChat() error = %v, want ErrNotFound", err)
+	}
+	if err := chats.Join(ctx, chat.RoomId, alice); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Join() to deleted chat error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestJoinAndLeave(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	alice := &fakeClient{user: models.UserStruct{UserId: "1", UserName: "Alice"}}
+	bob := &fakeClient{user: models.UserStruct{UserId: "2", UserName: "Bob"}}
+	for _, client := range []*fakeClient{alice, bob} {
+		if err := chats.Join(ctx, chat.RoomId, client); err != nil {
+			t.Fatalf("Join() error = %v", err)
+		}
+	}
+	chats.Leave(chat.RoomId, alice)
+
+	list, err := chats.GetChatsWithMembers(ctx, models.UserStruct{})
+	if err != nil {
+		t.Fatalf("GetChatsWithMembers() error = %v", err)
+	}
+	if len(list) != 1 || len(list[0].User) != 1 || list[0].User[0].UserId != "2" {
+		t.Errorf("GetChatsWithMembers() = %+v, want only Bob in chat", list)
+	}
+
+	// Участники запоминаются как пользователи сервера
+	if users := chats.GetUsers(); len(users) != 2 {
+		t.Errorf("GetUsers() = %+v, want 2 users", users)
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	chats, _, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	for _, text := range []string{"first", "second", "third"} {
+		if err := chats.SendMessage(ctx, &models.SendMessage{Msg: text, Author: "Alice", ChatId: chat.RoomId}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+
+	published := publisher.Messages()
+	if len(published) != 3 {
+		t.Fatalf("published %d messages, want 3", len(published))
+	}
+	for i, msg := range published {
+		if msg.Seq != int64(i+1) || msg.Id == 0 || msg.CreatedAt.IsZero() || msg.PublishedAt.IsZero() {
+			t.Errorf("published message %d = %+v", i, msg)
+		}
+	}
+
+	history, err := chats.GetMessages(ctx, chat.RoomId, 1, 0)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(history) != 2 || history[0].Msg != "second" || history[1].Msg != "third" {
+		t.Errorf("GetMessages() = %+v", history)
+	}
+}
+
+func TestSendMessageErrors(t *testing.T) {
+	chats, storage, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	if err := chats.SendMessage(ctx, &models.SendMessage{Msg: " ", ChatId: chat.RoomId}); !errors.Is(err, ErrValidation) {
+		t.Errorf("SendMessage() of empty message error = %v, want ErrValidation", err)
+	}
+	if err := chats.SendMessage(ctx, &models.SendMessage{Msg: "hi", ChatId: chat.RoomId + 1}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SendMessage() to missing chat error = %v, want ErrNotFound", err)
+	}
+
+	publishErr := errors.New("nats is down")
+	publisher.Err = publishErr
+	if err := chats.SendMessage(ctx, &models.SendMessage{Msg: "hi", ChatId: chat.RoomId}); !errors.Is(err, publishErr) {
+		t.Errorf("SendMessage() error = %v, want %v", err, publishErr)
+	}
+
+	storageErr := errors.New("connection refused")
+	storage.Err = storageErr
+	if err := chats.SendMessage(ctx, &models.SendMessage{Msg: "hi", ChatId: chat.RoomId}); !errors.Is(err, storageErr) {
+		t.Errorf("SendMessage() error = %v, want %v", err, storageErr)
+	}
+}
+
+// Сообщения одного чата публикуются в порядке номеров и при конкурентной отправке
+func TestSendMessageConcurrentOrder(t *testing.T) {
+	chats, _, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	const senders, perSender = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				if err := chats.SendMessage(ctx, &models.SendMessage{Msg: "hi", ChatId: chat.RoomId}); err != nil {
+					t.Errorf("SendMessage() error = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	published := publisher.Messages()
+	if len(published) != senders*perSender {
+		t.Fatalf("published %d messages, want %d", len(published), senders*perSender)
+	}
+	for i, msg := range published {
+		if msg.Seq != int64(i+1) {
+			t.Fatalf("message %d published with seq %d", i, msg.Seq)
+		}
+	}
+}
+
+func TestGetMessagesValidation(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+
+	if _, err := chats.GetMessages(ctx, 0, 0, 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetMessages() with chat 0 error = %v, want ErrNotFound", err)
+	}
+	if _, err := chats.GetMessages(ctx, 1, -1, 10); !errors.Is(err, ErrValidation) {
+		t.Errorf("GetMessages() with negative after_seq error = %v, want ErrValidation", err)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+	other := mustCreateChat(t, chats, "other")
+
+	alice := &fakeClient{user: models.UserStruct{UserId: "1"}}
+	broken := &fakeClient{user: models.UserStruct{UserId: "2"}, err: errors.New("broken pipe")}
+	bob := &fakeClient{user: models.UserStruct{UserId: "3"}}
+	stranger := &fakeClient{user: models.UserStruct{UserId: "4"}}
+	for _, client := range []*fakeClient{alice, broken, bob} {
+		if err := chats.Join(ctx, chat.RoomId, client); err != nil {
+			t.Fatalf("Join() error = %v", err)
+		}
+	}
+	if err := chats.Join(ctx, other.RoomId, stranger); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+
+	// Повторы и устаревшие номера отбрасываются
+	for _, seq := range []int64{1, 2, 2, 1, 4, 3} {
+		if err := chats.Deliver(ctx, &models.SendMessage{Seq: seq, Msg: "hi", ChatId: chat.RoomId}); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+
+	want := []int64{1, 2, 4}
+	for _, client := range []*fakeClient{alice, bob} {
+		if got := client.seqs(); !equalSeqs(got, want) {
+			t.Errorf("client %s received %v, want %v", client.user.UserId, got, want)
+		}
+	}
+	if got := stranger.seqs(); len(got) != 0 {
+		t.Errorf("client of other chat received %v", got)
+	}
+}
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	chats, storage, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	bob := models.UserStruct{UserId: "2", UserName: "Bob"}
+
+	msg := &models.SendMessage{Msg: "helo", Author: alice.UserName, AuthorId: alice.UserId, ChatId: chat.RoomId}
+	if err := chats.SendMessage(ctx, msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	// Изменять сообщение может только автор или администратор чата
+	if _, err := chats.EditMessage(ctx, chat.RoomId, msg.Seq, bob, "hacked"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("EditMessage() by other user error = %v, want ErrForbidden", err)
+	}
+	if _, err := chats.EditMessage(ctx, chat.RoomId, msg.Seq, alice, " "); !errors.Is(err, ErrValidation) {
+		t.Errorf("EditMessage() with empty text error = %v, want ErrValidation", err)
+	}
+	if _, err := chats.EditMessage(ctx, chat.RoomId, msg.Seq+1, alice, "hello"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("EditMessage() of missing message error = %v, want ErrNotFound", err)
+	}
+
+	edited, err := chats.EditMessage(ctx, chat.RoomId, msg.Seq, alice, "hello")
+	if err != nil {
+		t.Fatalf("EditMessage() error = %v", err)
+	}
+	if edited.Msg != "hello" || edited.Version != 2 || edited.EditedAt == nil {
+		t.Errorf("EditMessage() = %+v", edited)
+	}
+
+	// Администратор чата может удалить чужое сообщение
+	deleted, err := chats.DeleteMessage(ctx, chat.RoomId, msg.Seq, owner)
+	if err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	if deleted.Msg != "" || deleted.Version != 3 || deleted.DeletedAt == nil {
+		t.Errorf("DeleteMessage() = %+v", deleted)
+	}
+	if _, err = chats.DeleteMessage(ctx, chat.RoomId, msg.Seq, alice); !errors.Is(err, ErrConflict) {
+		t.Errorf("second DeleteMessage() error = %v, want ErrConflict", err)
+	}
+	if _, err = chats.EditMessage(ctx, chat.RoomId, msg.Seq, alice, "again"); !errors.Is(err, ErrConflict) {
+		t.Errorf("EditMessage() of deleted message error = %v, want ErrConflict", err)
+	}
+
+	// Прежние версии сохраняются
+	if got := storage.Revisions(msg.Id); len(got) != 2 || got[0] != "helo" || got[1] != "hello" {
+		t.Errorf("revisions = %q", got)
+	}
+
+	// Номер сообщения остается прежним, события различаются типом и версией
+	published := publisher.Messages()
+	if len(published) != 3 {
+		t.Fatalf("published %d messages, want 3", len(published))
+	}
+	if e := published[1]; e.Event != models.EventMessageEdited || e.Seq != msg.Seq || e.Version != 2 || e.Msg != "hello" {
+		t.Errorf("edit event = %+v", e)
+	}
+	if e := published[2]; e.Event != models.EventMessageDeleted || e.Seq != msg.Seq || e.Version != 3 || e.Msg != "" {
+		t.Errorf("delete event = %+v", e)
+	}
+}
+
+func TestMessageFormatting(t *testing.T) {
+	chats, storage, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+
+	msg := &models.SendMessage{Msg: "**hi** <b>", Author: alice.UserName, AuthorId: alice.UserId, ChatId: chat.RoomId}
+	if err := chats.SendMessage(ctx, msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if _, err := chats.EditMessage(ctx, chat.RoomId, msg.Seq, alice, "_bye_"); err != nil {
+		t.Fatalf("EditMessage() error = %v", err)
+	}
+
+	// Исходный текст передается вместе с HTML, в том числе в событии изменения
+	published := publisher.Messages()
+	if e := published[0]; e.Msg != "**hi** <b>" || e.Html != "<strong>hi</strong> &lt;b&gt;" {
+		t.Errorf("published message = %+v", e)
+	}
+	if e := published[1]; e.Msg != "_bye_" || e.Html != "<em>bye</em>" {
+		t.Errorf("edit event = %+v", e)
+	}
+
+	// HTML сообщения, сохраненного без него, строится при чтении
+	if _, err := storage.CreateMessage(ctx, &models.SendMessage{Msg: "`old`", Author: "Bob", ChatId: chat.RoomId}); err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+	history, err := chats.GetMessages(ctx, chat.RoomId, 0, 0)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(history) != 2 || history[0].Html != "<em>bye</em>" || history[1].Html != "<code>old</code>" {
+		t.Errorf("GetMessages() = %+v", history)
+	}
+
+	if _, err = chats.DeleteMessage(ctx, chat.RoomId, msg.Seq, alice); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	if history, err = chats.GetMessages(ctx, chat.RoomId, 0, 0); err != nil || history[0].Html != "" {
+		t.Errorf("GetMessages() after delete = %+v, %v", history, err)
+	}
+}
+
+// Сообщения, созданные до появления ID автора, изменить нельзя
+func TestEditMessageWithoutAuthor(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	msg := &models.SendMessage{Msg: "old", Author: "Alice", ChatId: chat.RoomId}
+	if err := chats.SendMessage(ctx, msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if _, err := chats.EditMessage(ctx, chat.RoomId, msg.Seq, models.UserStruct{UserName: "Alice"}, "new"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("EditMessage() error = %v, want ErrForbidden", err)
+	}
+}
+
+// События изменения относятся к уже разосланным номерам и не отбрасываются
+func TestDeliverEvents(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	alice := &fakeClient{user: models.UserStruct{UserId: "1"}}
+	if err := chats.Join(ctx, chat.RoomId, alice); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+
+	msgs := []*models.SendMessage{
+		{Seq: 1, Msg: "hi", ChatId: chat.RoomId},
+		{Seq: 2, Msg: "there", ChatId: chat.RoomId},
+		{Seq: 1, Event: models.EventMessageEdited, Version: 2, Msg: "hello", ChatId: chat.RoomId},
+		{Seq: 2, Event: models.EventMessageDeleted, Version: 2, ChatId: chat.RoomId},
+	}
+	for _, msg := range msgs {
+		if err := chats.Deliver(ctx, msg); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+
+	if got := alice.seqs(); !equalSeqs(got, []int64{1, 2, 1, 2}) {
+		t.Errorf("client received %v", got)
+	}
+}
+
+func TestThreadReplies(t *testing.T) {
+	chats, _, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	root := &models.SendMessage{Msg: "question", Author: "Alice", ChatId: chat.RoomId}
+	if err := chats.SendMessage(ctx, root); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	for i, text := range []string{"answer", "another answer"} {
+		reply := &models.SendMessage{Msg: text, Author: "Bob", ChatId: chat.RoomId, ParentSeq: root.Seq}
+		if err := chats.SendMessage(ctx, reply); err != nil {
+			t.Fatalf("SendMessage() of reply error = %v", err)
+		}
+		if reply.ReplyCount != i+1 {
+			t.Errorf("reply %d has reply count %d", i, reply.ReplyCount)
+		}
+	}
+
+	// Ответить на ответ или на отсутствующее сообщение нельзя
+	reply := publisher.Messages()[1]
+	if err := chats.SendMessage(ctx, &models.SendMessage{Msg: "x", ChatId: chat.RoomId, ParentSeq: reply.Seq}); !errors.Is(err, ErrValidation) {
+		t.Errorf("SendMessage() to reply error = %v, want ErrValidation", err)
+	}
+	if err := chats.SendMessage(ctx, &models.SendMessage{Msg: "x", ChatId: chat.RoomId, ParentSeq: 42}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SendMessage() to missing parent error = %v, want ErrNotFound", err)
+	}
+
+	// История чата без ответов, ответы - отдельно с постраничной выдачей
+	history, err := chats.GetMessages(ctx, chat.RoomId, 0, 0)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(history) != 1 || history[0].Seq != root.Seq || history[0].ReplyCount != 2 {
+		t.Errorf("GetMessages() = %+v", history)
+	}
+
+	replies, err := chats.GetReplies(ctx, chat.RoomId, root.Seq, 0, 1)
+	if err != nil {
+		t.Fatalf("GetReplies() error = %v", err)
+	}
+	if len(replies) != 1 || replies[0].Msg != "answer" || replies[0].ParentSeq != root.Seq {
+		t.Errorf("GetReplies(limit 1) = %+v", replies)
+	}
+	if replies, err = chats.GetReplies(ctx, chat.RoomId, root.Seq, replies[0].Seq, 0); err != nil || len(replies) != 1 || replies[0].Msg != "another answer" {
+		t.Errorf("GetReplies(next page) = %+v, %v", replies, err)
+	}
+	if _, err = chats.GetReplies(ctx, chat.RoomId, reply.Seq, 0, 0); !errors.Is(err, ErrValidation) {
+		t.Errorf("GetReplies() of reply error = %v, want ErrValidation", err)
+	}
+}
+
+// Ответы получают подписчики треда, остальные участники - событие thread.updated
+func TestDeliverThread(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	root := &models.SendMessage{Msg: "question", ChatId: chat.RoomId}
+	if err := chats.SendMessage(ctx, root); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	alice := &fakeClient{user: models.UserStruct{UserId: "1"}}
+	bob := &fakeClient{user: models.UserStruct{UserId: "2"}}
+	stranger := &fakeClient{user: models.UserStruct{UserId: "3"}}
+	for _, client := range []*fakeClient{alice, bob} {
+		if err := chats.Join(ctx, chat.RoomId, client); err != nil {
+			t.Fatalf("Join() error = %v", err)
+		}
+	}
+
+	if err := chats.SubscribeThread(ctx, chat.RoomId, root.Seq, alice); err != nil {
+		t.Fatalf("SubscribeThread() error = %v", err)
+	}
+	if err := chats.SubscribeThread(ctx, chat.RoomId, root.Seq, stranger); !errors.Is(err, ErrForbidden) {
+		t.Errorf("SubscribeThread() of client outside chat error = %v, want ErrForbidden", err)
+	}
+	if err := chats.SubscribeThread(ctx, chat.RoomId, root.Seq+1, bob); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SubscribeThread() to missing message error = %v, want ErrNotFound", err)
+	}
+
+	reply := &models.SendMessage{Seq: 2, ParentSeq: root.Seq, ReplyCount: 1, Msg: "answer", ChatId: chat.RoomId}
+	if err := chats.Deliver(ctx, reply); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+
+	if got := alice.events(); len(got) != 1 || got[0] != "" {
+		t.Errorf("subscriber received %q, want the reply", got)
+	}
+	if got := bob.events(); len(got) != 1 || got[0] != models.EventThreadUpdated {
+		t.Errorf("chat member received %q, want thread.updated", got)
+	}
+	if summary := bob.last(); summary.Seq != 2 || summary.ParentSeq != root.Seq || summary.ReplyCount != 1 {
+		t.Errorf("thread.updated = %+v", summary)
+	}
+
+	// Изменения ответов получают только подписчики треда
+	edit := &models.SendMessage{Seq: 2, ParentSeq: root.Seq, Event: models.EventMessageEdited, Version: 2, ChatId: chat.RoomId}
+	if err := chats.Deliver(ctx, edit); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if len(alice.events()) != 2 || len(bob.events()) != 1 {
+		t.Errorf("edit of reply delivered to alice %q, bob %q", alice.events(), bob.events())
+	}
+
+	// После отключения от чата подписка на тред снимается
+	chats.Leave(chat.RoomId, alice)
+	if err := chats.Deliver(ctx, &models.SendMessage{Seq: 3, ParentSeq: root.Seq, Msg: "more", ChatId: chat.RoomId}); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if len(alice.events()) != 2 {
+		t.Errorf("client received %q after leaving chat", alice.events())
+	}
+}
+
+func TestReactions(t *testing.T) {
+	chats, _, publisher := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	bob := models.UserStruct{UserId: "2", UserName: "Bob"}
+
+	msg := &models.SendMessage{Msg: "hello", Author: alice.UserName, AuthorId: alice.UserId, ChatId: chat.RoomId}
+	if err := chats.SendMessage(ctx, msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	// Повторная реакция того же пользователя не учитывается
+	for _, add := range []struct {
+		user     models.UserStruct
+		reaction string
+	}{{alice, "👍"}, {bob, "👍"}, {bob, "👍"}, {bob, ":tada:"}} {
+		if err := chats.AddReaction(ctx, chat.RoomId, msg.Seq, add.user, add.reaction); err != nil {
+			t.Fatalf("AddReaction(%s, %q) error = %v", add.user.UserId, add.reaction, err)
+		}
+	}
+	if err := chats.RemoveReaction(ctx, chat.RoomId, msg.Seq, alice, ":tada:"); err != nil {
+		t.Fatalf("RemoveReaction() of missing reaction error = %v", err)
+	}
+	if err := chats.RemoveReaction(ctx, chat.RoomId, msg.Seq, alice, "👍"); err != nil {
+		t.Fatalf("RemoveReaction() error = %v", err)
+	}
+
+	history, err := chats.GetMessages(ctx, chat.RoomId, 0, 0)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	reactions := history[0].Reactions
+	if len(reactions) != 2 ||
+		reactions[0].Reaction != "👍" || reactions[0].Count != 1 || reactions[0].UserIds[0] != bob.UserId ||
+		reactions[1].Reaction != ":tada:" || reactions[1].Count != 1 {
+		t.Errorf("reactions = %+v", reactions)
+	}
+
+	// События публикуются только при изменении реакций
+	var events []models.SendMessage
+	for _, e := range publisher.Messages() {
+		if e.Reaction != "" {
+			events = append(events, e)
+		}
+	}
+	if len(events) != 4 {
+		t.Fatalf("published %d reaction events, want 4: %+v", len(events), events)
+	}
+	if e := events[1]; e.Event != models.EventReactionAdded || e.Seq != msg.Seq || e.AuthorId != bob.UserId || e.ReactionCount != 2 {
+		t.Errorf("add event = %+v", e)
+	}
+	if e := events[3]; e.Event != models.EventReactionRemoved || e.AuthorId != alice.UserId || e.ReactionCount != 1 {
+		t.Errorf("remove event = %+v", e)
+	}
+}
+
+func TestReactionErrors(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+
+	msg := &models.SendMessage{Msg: "hello", AuthorId: alice.UserId, ChatId: chat.RoomId}
+	if err := chats.SendMessage(ctx, msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		chatId   int
+		seq      int64
+		user     models.UserStruct
+		reaction string
+		want     error
+	}{
+		{"skin tone", chat.RoomId, msg.Seq, alice, "👍🏽", nil},
+		{"zwj sequence", chat.RoomId, msg.Seq, alice, "👩‍💻", nil},
+		{"keycap", chat.RoomId, msg.Seq, alice, "1️⃣", nil},
+		{"text", chat.RoomId, msg.Seq, alice, "like", ErrValidation},
+		{"emoji with text", chat.RoomId, msg.Seq, alice, "👍 nice", ErrValidation},
+		{"bad code", chat.RoomId, msg.Seq, alice, ":Thumbs Up:", ErrValidation},
+		{"too long", chat.RoomId, msg.Seq, alice, strings.Repeat("👍", 17), ErrValidation},
+		{"anonymous", chat.RoomId, msg.Seq, models.UserStruct{}, "👍", ErrUnauthorized},
+		{"missing message", chat.RoomId, msg.Seq + 1, alice, "👍", ErrNotFound},
+		{"missing chat", chat.RoomId + 1, msg.Seq, alice, "👍", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := chats.AddReaction(ctx, tt.chatId, tt.seq, tt.user, tt.reaction)
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("AddReaction() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// На удаленное сообщение реагировать нельзя
+	if _, err := chats.DeleteMessage(ctx, chat.RoomId, msg.Seq, alice); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	if err := chats.AddReaction(ctx, chat.RoomId, msg.Seq, alice, "👍"); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddReaction() to deleted message error = %v, want ErrConflict", err)
+	}
+}
+
+func TestReadMarkers(t *testing.T) {
+	chats, _, publisher := newTestChats(t)
+	ctx := context.Background()
+	general := mustCreateChat(t, chats, "general")
+	mustCreateChat(t, chats, "random")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	bob := models.UserStruct{UserId: "2", UserName: "Bob"}
+
+	// Свои сообщения непрочитанными не считаются
+	for _, author := range []models.UserStruct{bob, bob, alice, bob} {
+		msg := &models.SendMessage{Msg: "hello", Author: author.UserName, AuthorId: author.UserId, ChatId: general.RoomId}
+		if err := chats.SendMessage(ctx, msg); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+
+	unread := func(user models.UserStruct) []int {
+		t.Helper()
+		list, err := chats.GetChatsWithMembers(ctx, user)
+		if err != nil {
+			t.Fatalf("GetChatsWithMembers() error = %v", err)
+		}
+		counts := make([]int, 0, len(list))
+		for _, chat := range list {
+			counts = append(counts, chat.Unread)
+		}
+		return counts
+	}
+	if got := unread(alice); !reflect.DeepEqual(got, []int{3, 0}) {
+		t.Errorf("unread before read = %v, want [3 0]", got)
+	}
+
+	// Отметка не сдвигается назад, событие рассылается только при ее изменении
+	for _, seq := range []int64{2, 1, 2, 3} {
+		if err := chats.MarkRead(ctx, general.RoomId, seq, alice); err != nil {
+			t.Fatalf("MarkRead(%d) error = %v", seq, err)
+		}
+	}
+	if got := unread(alice); !reflect.DeepEqual(got, []int{1, 0}) {
+		t.Errorf("unread after read = %v, want [1 0]", got)
+	}
+	if got := unread(models.UserStruct{}); !reflect.DeepEqual(got, []int{0, 0}) {
+		t.Errorf("unread without user = %v, want zeros", got)
+	}
+
+	var seqs []int64
+	for _, e := range publisher.Signals() {
+		if e.Event != models.EventMessageRead || e.AuthorId != alice.UserId || e.ChatId != general.RoomId {
+			t.Errorf("read receipt = %+v", e)
+		}
+		seqs = append(seqs, e.Seq)
+	}
+	if !equalSeqs(seqs, []int64{2, 3}) {
+		t.Errorf("read receipts for %v, want [2 3]", seqs)
+	}
+
+	tests := []struct {
+		name   string
+		chatId int
+		seq    int64
+		user   models.UserStruct
+		want   error
+	}{
+		{"anonymous", general.RoomId, 1, models.UserStruct{}, ErrUnauthorized},
+		{"zero seq", general.RoomId, 0, alice, ErrValidation},
+		{"missing chat", 100, 1, alice, ErrNotFound},
+		{"missing message", general.RoomId, 100, alice, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := chats.MarkRead(ctx, tt.chatId, tt.seq, tt.user); !errors.Is(err, tt.want) {
+				t.Errorf("MarkRead() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// Сервис, в котором сигналы сразу рассылаются участникам, с короткими интервалами набора текста
+func newTypingChats(t *testing.T, throttle, timeout time.Duration) (ChatService, models.RoomStruct, *fakeClient, *fakeClient) {
+	t.Helper()
+
+	chats, _, publisher := newTestChats(t)
+	publisher.Deliver = chats.Deliver
+	chats.(*chatService).typingThrottle = throttle
+	chats.(*chatService).typingTimeout = timeout
+
+	chat := mustCreateChat(t, chats, "general")
+	alice := &fakeClient{user: models.UserStruct{UserId: "1", UserName: "Alice"}}
+	bob := &fakeClient{user: models.UserStruct{UserId: "2", UserName: "Bob"}}
+	for _, client := range []*fakeClient{alice, bob} {
+		if err := chats.Join(context.Background(), chat.RoomId, client); err != nil {
+			t.Fatalf("Join() error = %v", err)
+		}
+	}
+	return chats, chat, alice, bob
+}
+
+func TestTyping(t *testing.T) {
+	chats, chat, alice, bob := newTypingChats(t, time.Hour, time.Hour)
+	ctx := context.Background()
+
+	// Частые typing.start и лишние typing.stop не рассылаются
+	for _, typing := range []bool{true, true, false, false, true} {
+		if err := chats.SetTyping(ctx, chat.RoomId, alice, typing); err != nil {
+			t.Fatalf("SetTyping(%v) error = %v", typing, err)
+		}
+	}
+
+	if got := bob.events(); len(got) != 2 || got[0] != models.EventTypingStart || got[1] != models.EventTypingStop {
+		t.Errorf("other member received %q, want typing.start and typing.stop", got)
+	}
+	if e := bob.last(); e.AuthorId != "1" || e.Author != "Alice" || e.ChatId != chat.RoomId {
+		t.Errorf("typing event = %+v", e)
+	}
+	if got := alice.events(); len(got) != 0 {
+		t.Errorf("typing user received own events %q", got)
+	}
+
+	stranger := &fakeClient{user: models.UserStruct{UserId: "3"}}
+	if err := chats.SetTyping(ctx, chat.RoomId, stranger, true); !errors.Is(err, ErrForbidden) {
+		t.Errorf("SetTyping() of client outside chat error = %v, want ErrForbidden", err)
+	}
+}
+
+// Набор текста заканчивается сам, если клиент перестал его продлевать или отключился
+func TestTypingExpiry(t *testing.T) {
+	chats, chat, alice, bob := newTypingChats(t, 0, 50*time.Millisecond)
+	ctx := context.Background()
+
+	if err := chats.SetTyping(ctx, chat.RoomId, alice, true); err != nil {
+		t.Fatalf("SetTyping() error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(bob.events()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := bob.events(); len(got) != 2 || got[1] != models.EventTypingStop {
+		t.Errorf("after timeout member received %q, want typing.stop", got)
+	}
+
+	if err := chats.SetTyping(ctx, chat.RoomId, bob, true); err != nil {
+		t.Fatalf("SetTyping() error = %v", err)
+	}
+	chats.Leave(chat.RoomId, bob)
+	if got := alice.events(); len(got) != 2 || got[1] != models.EventTypingStop {
+		t.Errorf("after leave member received %q, want typing.stop", got)
+	}
+
+	// Таймер отключившегося клиента ничего не рассылает
+	time.Sleep(100 * time.Millisecond)
+	if got := alice.events(); len(got) != 2 {
+		t.Errorf("member received %q after typing client left", got)
+	}
+}
+
+// Статусы участников в формате "имя статус"
+func memberStatuses(members []models.Member) []string {
+	statuses := make([]string, 0, len(members))
+	for _, member := range members {
+		statuses = append(statuses, member.UserName+" "+member.Status)
+	}
+	return statuses
+}
+
+func TestPresence(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	// У Alice две вкладки
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	tab1 := &fakeClient{user: alice}
+	tab2 := &fakeClient{user: alice}
+	bob := &fakeClient{user: models.UserStruct{UserId: "2", UserName: "Bob"}}
+	for _, client := range []*fakeClient{bob, tab1, tab2} {
+		if err := chats.Join(ctx, chat.RoomId, client); err != nil {
+			t.Fatalf("Join() error = %v", err)
+		}
+	}
+
+	members, err := chats.Members(ctx, chat.RoomId)
+	if err != nil {
+		t.Fatalf("Members() error = %v", err)
+	}
+	if got := memberStatuses(members); !reflect.DeepEqual(got, []string{"Alice online", "Bob online"}) {
+		t.Errorf("Members() = %q", got)
+	}
+
+	rooms, err := chats.GetChatsWithMembers(ctx, models.UserStruct{})
+	if err != nil {
+		t.Fatalf("GetChatsWithMembers() error = %v", err)
+	}
+	if len(rooms) != 1 || len(rooms[0].User) != 2 {
+		t.Errorf("GetChatsWithMembers() = %+v, want each user once", rooms)
+	}
+
+	// Пользователь отошел, только когда неактивны все его подключения
+	if err = chats.SetAway(ctx, chat.RoomId, tab1, true); err != nil {
+		t.Fatalf("SetAway() error = %v", err)
+	}
+	if err = chats.SetAway(ctx, chat.RoomId, tab2, true); err != nil {
+		t.Fatalf("SetAway() error = %v", err)
+	}
+	members, _ = chats.Members(ctx, chat.RoomId)
+	if got := memberStatuses(members); !reflect.DeepEqual(got, []string{"Bob online", "Alice away"}) {
+		t.Errorf("Members() after away = %q", got)
+	}
+
+	chats.Leave(chat.RoomId, tab1)
+	chats.Leave(chat.RoomId, tab2)
+	members, _ = chats.Members(ctx, chat.RoomId)
+	if got := memberStatuses(members); !reflect.DeepEqual(got, []string{"Bob online", "Alice offline"}) {
+		t.Errorf("Members() after leave = %q", got)
+	}
+	if members[1].LastSeen == nil || members[0].LastSeen != nil {
+		t.Errorf("LastSeen = %v, %v, want only offline member", members[0].LastSeen, members[1].LastSeen)
+	}
+
+	want := []string{"Bob online", "Alice online", "Alice away", "Alice offline"}
+	if got := bob.presenceChanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("member received presence %q, want %q", got, want)
+	}
+
+	stranger := &fakeClient{user: models.UserStruct{UserId: "3"}}
+	if err = chats.SetAway(ctx, chat.RoomId, stranger, true); !errors.Is(err, ErrForbidden) {
+		t.Errorf("SetAway() of client outside chat error = %v, want ErrForbidden", err)
+	}
+	if _, err = chats.Members(ctx, chat.RoomId+100); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Members() of missing chat error = %v, want ErrNotFound", err)
+	}
+}
+
+// Записи другого экземпляра: поздно пришедшие старые записи не учитываются,
+// а не продленные вовремя считаются записями остановленного экземпляра
+func TestPresenceOtherInstance(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	chat := mustCreateChat(t, chats, "general")
+
+	bob := &fakeClient{user: models.UserStruct{UserId: "2", UserName: "Bob"}}
+	if err := chats.Join(ctx, chat.RoomId, bob); err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+
+	now := time.Now()
+	carol := models.PresenceState{ChatId: chat.RoomId, UserId: "3", UserName: "Carol", Instance: "other", Status: models.PresenceOnline, UpdatedAt: now}
+	stale := carol
+	stale.Status = models.PresenceOffline
+	stale.UpdatedAt = now.Add(-time.Second)
+	for _, state := range []models.PresenceState{carol, stale} {
+		if err := chats.ApplyPresence(ctx, state); err != nil {
+			t.Fatalf("ApplyPresence() error = %v", err)
+		}
+	}
+
+	members, _ := chats.Members(ctx, chat.RoomId)
+	if got := memberStatuses(members); !reflect.DeepEqual(got, []string{"Bob online", "Carol online"}) {
+		t.Errorf("Members() = %q", got)
+	}
+
+	service := chats.(*chatService)
+	service.presenceTTL = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	// Записи этого экземпляра продлеваются, а другой экземпляр молчит
+	service.refreshPresence(ctx)
+	service.sweepPresence(ctx)
+
+	members, _ = chats.Members(ctx, chat.RoomId)
+	if got := memberStatuses(members); !reflect.DeepEqual(got, []string{"Bob online", "Carol offline"}) {
+		t.Errorf("Members() after ttl = %q", got)
+	}
+	want := []string{"Bob online", "Carol online", "Carol offline"}
+	if got := bob.presenceChanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("member received presence %q, want %q", got, want)
+	}
+}
+
+func equalSeqs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"errors"
+)
+
+// Виды ошибок бизнес-логики
+// Проверяются через errors.Is, транспортный слой по ним выбирает код ответа
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrForbidden    = errors.New("forbidden")
+	ErrConflict     = errors.New("conflict")
+	ErrValidation   = errors.New("validation failed")
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// Ошибка бизнес-логики с сообщением для пользователя
+type Error struct {
+	// Один из ErrNotFound, ErrForbidden, ErrConflict, ErrValidation, ErrUnauthorized
+	Kind error
+	// Сообщение, которое можно показать клиенту
+	Message string
+	// Исходная ошибка, если есть
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// errors.Is(err, ErrNotFound) и т.д.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func NotFound(message string) error {
+	return &Error{Kind: ErrNotFound, Message: message}
+}
+
+func Forbidden(message string) error {
+	return &Error{Kind: ErrForbidden, Message: message}
+}
+
+func Conflict(message string) error {
+	return &Error{Kind: ErrConflict, Message: message}
+}
+
+func Validation(message string) error {
+	return &Error{Kind: ErrValidation, Message: message}
+}
+
+func Unauthorized(message string) error {
+	return &Error{Kind: ErrUnauthorized, Message: message}
+}
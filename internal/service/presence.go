@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+)
+
+// Записи присутствия этого экземпляра продлеваются каждые presenceRefresh
+// Запись в сети, не продленная за presenceTTL, считается записью остановленного экземпляра
+// Отключившиеся участники показываются в списке участников чата presenceForget
+const (
+	presenceRefresh = 30 * time.Second
+	presenceTTL     = 90 * time.Second
+	presenceForget  = 24 * time.Hour
+)
+
+// Общее для экземпляров сервиса хранилище присутствия
+// Изменения всех экземпляров, включая этот, передаются в ChatService.ApplyPresence
+type PresenceStore interface {
+	// Имя этого экземпляра сервиса
+	Instance() string
+	Put(ctx context.Context, state models.PresenceState) error
+}
+
+// Пользователь в чате
+type presenceKey struct {
+	chatId int
+	userId string
+}
+
+// Отметка подключения как неактивного или снова активного
+func (s *chatService) SetAway(ctx context.Context, chatId int, client Client, away bool) error {
+	s.mu.Lock()
+	if !containsClient(s.clients[chatId], client) {
+		s.mu.Unlock()
+		return Forbidden("client is not connected to the chat")
+	}
+	if away {
+		s.away[client] = true
+	} else {
+		delete(s.away, client)
+	}
+	s.mu.Unlock()
+
+	s.updatePresence(ctx, chatId, client.User())
+
+	return nil
+}
+
+// Участники чата: подключенные сейчас к любому экземпляру и недавно отключившиеся
+// Сначала в сети, затем отошедшие и отключившиеся, внутри статуса - по имени
+func (s *chatService) Members(ctx context.Context, chatId int) ([]models.Member, error) {
+	if _, err := s.GetChat(ctx, chatId); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	members := s.membersLocked(chatId, time.Now())
+	s.mu.Unlock()
+
+	order := map[string]int{models.PresenceOnline: 0, models.PresenceAway: 1, models.PresenceOffline: 2}
+	sort.Slice(members, func(i, j int) bool {
+		if order[members[i].Status] != order[members[j].Status] {
+			return order[members[i].Status] < order[members[j].Status]
+		}
+		if members[i].UserName != members[j].UserName {
+			return members[i].UserName < members[j].UserName
+		}
+		return members[i].UserId < members[j].UserId
+	})
+
+	return members, nil
+}
+
+// Запись присутствия из хранилища
+// Если статус пользователя в чате изменился, подключенные к чату клиенты получают presence.changed
+func (s *chatService) ApplyPresence(ctx context.Context, state models.PresenceState) error {
+	s.mu.Lock()
+	users, ok := s.states[state.ChatId]
+	if !ok {
+		users = make(map[string]map[string]models.PresenceState)
+		s.states[state.ChatId] = users
+	}
+	instances, ok := users[state.UserId]
+	if !ok {
+		instances = make(map[string]models.PresenceState)
+		users[state.UserId] = instances
+	}
+	// Записи одного экземпляра могут прийти не по порядку
+	if old, ok := instances[state.Instance]; ok && old.UpdatedAt.After(state.UpdatedAt) {
+		s.mu.Unlock()
+		return nil
+	}
+	instances[state.Instance] = state
+
+	event, clients := s.announceLocked(presenceKey{chatId: state.ChatId, userId: state.UserId}, time.Now())
+	s.mu.Unlock()
+
+	if event != nil {
+		s.send(ctx, clients, event)
+	}
+
+	return nil
+}
+
+// Поддержание присутствия до отмены ctx
+// Записи этого экземпляра продлеваются, по устаревшим записям других экземпляров рассылается offline
+func (s *chatService) KeepPresence(ctx context.Context) {
+	ticker := time.NewTicker(s.presenceRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshPresence(ctx)
+			s.sweepPresence(ctx)
+		}
+	}
+}
+
+// Запись статуса пользователя в чате по подключениям этого экземпляра, если он изменился
+func (s *chatService) updatePresence(ctx context.Context, chatId int, user models.UserStruct) {
+	// Записи одного экземпляра сохраняются в порядке изменений
+	s.presenceMu.Lock()
+	defer s.presenceMu.Unlock()
+
+	status := s.localStatus(chatId, user.UserId)
+	key := presenceKey{chatId: chatId, userId: user.UserId}
+	prev, ok := s.published[key]
+	if ok && prev.Status == status || !ok && status == models.PresenceOffline {
+		return
+	}
+
+	state := models.PresenceState{
+		ChatId:    chatId,
+		UserId:    user.UserId,
+		UserName:  user.UserName,
+		Instance:  s.presence.Instance(),
+		Status:    status,
+		UpdatedAt: time.Now(),
+	}
+	if status == models.PresenceOffline {
+		delete(s.published, key)
+	} else {
+		s.published[key] = state
+	}
+
+	if err := s.presence.Put(ctx, state); err != nil {
+		s.loggerFrom(ctx).Warn().Err(err).Int("chat_id", chatId).Str("user_id", user.UserId).Msg("failed to update presence")
+	}
+}
+
+// Продление записей подключенных к этому экземпляру пользователей
+func (s *chatService) refreshPresence(ctx context.Context) {
+	s.presenceMu.Lock()
+	defer s.presenceMu.Unlock()
+
+	now := time.Now()
+	for key, state := range s.published {
+		state.UpdatedAt = now
+		s.published[key] = state
+		if err := s.presence.Put(ctx, state); err != nil {
+			s.loggerFrom(ctx).Warn().Err(err).Int("chat_id", state.ChatId).Str("user_id", state.UserId).Msg("failed to refresh presence")
+		}
+	}
+}
+
+// Рассылка изменений статусов из-за устаревания записей и удаление давно отключившихся
+func (s *chatService) sweepPresence(ctx context.Context) {
+	type announcement struct {
+		event   *models.SendMessage
+		clients []Client
+	}
+	var announcements []announcement
+
+	now := time.Now()
+	s.mu.Lock()
+	for chatId, users := range s.states {
+		for userId, instances := range users {
+			for instance, state := range instances {
+				if now.Sub(state.UpdatedAt) > presenceForget {
+					delete(instances, instance)
+				}
+			}
+			key := presenceKey{chatId: chatId, userId: userId}
+			if len(instances) == 0 {
+				delete(users, userId)
+				delete(s.announced, key)
+				continue
+			}
+			if event, clients := s.announceLocked(key, now); event != nil {
+				announcements = append(announcements, announcement{event: event, clients: clients})
+			}
+		}
+		if len(users) == 0 {
+			delete(s.states, chatId)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, a := range announcements {
+		s.send(ctx, a.clients, a.event)
+	}
+}
+
+// Статус пользователя по подключениям к чату на этом экземпляре
+func (s *chatService) localStatus(chatId int, userId string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := models.PresenceOffline
+	for _, client := range s.clients[chatId] {
+		if client.User().UserId != userId {
+			continue
+		}
+		if !s.away[client] {
+			return models.PresenceOnline
+		}
+		status = models.PresenceAway
+	}
+
+	return status
+}
+
+// Событие об изменении статуса пользователя в чате и получатели, nil если статус прежний
+// Вызывается под s.mu
+func (s *chatService) announceLocked(key presenceKey, now time.Time) (*models.SendMessage, []Client) {
+	member := s.memberLocked(key, now)
+	prev, ok := s.announced[key]
+	s.announced[key] = member.Status
+	// Об отключившихся до запуска этого экземпляра не сообщаем
+	if prev == member.Status || !ok && member.Status == models.PresenceOffline {
+		return nil, nil
+	}
+
+	event := &models.SendMessage{
+		Event:       models.EventPresence,
+		Status:      member.Status,
+		LastSeen:    member.LastSeen,
+		Author:      member.UserName,
+		AuthorId:    member.UserId,
+		MessageType: 1,
+		ChatId:      key.chatId,
+	}
+
+	return event, append([]Client(nil), s.clients[key.chatId]...)
+}
+
+// Участники чата
+// Вызывается под s.mu
+func (s *chatService) membersLocked(chatId int, now time.Time) []models.Member {
+	members := make([]models.Member, 0, len(s.states[chatId]))
+	for userId := range s.states[chatId] {
+		members = append(members, s.memberLocked(presenceKey{chatId: chatId, userId: userId}, now))
+	}
+
+	return members
+}
+
+// Статус пользователя в чате по записям всех экземпляров
+// В сети, если в сети хотя бы на одном экземпляре, отошел - если на остальных отошел или отключен
+// Вызывается под s.mu
+func (s *chatService) memberLocked(key presenceKey, now time.Time) models.Member {
+	member := models.Member{UserId: key.userId, Status: models.PresenceOffline}
+	var updatedAt time.Time
+	var lastSeen *time.Time
+	for _, state := range s.states[key.chatId][key.userId] {
+		if state.UpdatedAt.After(updatedAt) {
+			updatedAt = state.UpdatedAt
+			member.UserName = state.UserName
+		}
+
+		live := state.Status != models.PresenceOffline && now.Sub(state.UpdatedAt) < s.presenceTTL
+		switch {
+		case live && state.Status == models.PresenceOnline:
+			member.Status = models.PresenceOnline
+		case live && member.Status != models.PresenceOnline:
+			member.Status = models.PresenceAway
+		case !live && (lastSeen == nil || state.UpdatedAt.After(*lastSeen)):
+			seen := state.UpdatedAt
+			lastSeen = &seen
+		}
+	}
+	if member.Status == models.PresenceOffline {
+		member.LastSeen = lastSeen
+	}
+
+	return member
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/markdown"
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Максимальное число ссылок одного сообщения, для которых строятся превью
+const maxMessagePreviews = 3
+
+// Максимальная длина ссылки, совпадает с размером колонки в БД
+const maxLinkLength = 2048
+
+// Ссылка в тексте сообщения: http или https до пробела, кавычки или угловой скобки
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+
+// Превью ссылок в сообщениях
+type PreviewService interface {
+	// Постановка сообщения из шины в очередь разворачивания ссылок, не блокируется
+	// Обрабатываются новые и измененные сообщения; если очередь заполнена, сообщение пропускается
+	HandleMessage(ctx context.Context, msg *models.SendMessage)
+	// Запуск обработчиков очереди
+	Start()
+	// Остановка: новые сообщения не принимаются, начатые загрузки прерываются
+	Stop()
+}
+
+// Загрузка метаданных страницы по ссылке
+type LinkFetcher interface {
+	Fetch(ctx context.Context, rawURL string) (models.LinkPreview, error)
+}
+
+type PreviewStorage interface {
+	// Превью ссылки из кеша по адресу, false если его нет
+	GetLinkPreview(ctx context.Context, url string) (models.LinkPreview, bool, error)
+	// Сохранение превью ссылки в кеш с заменой прежнего
+	SaveLinkPreview(ctx context.Context, preview *models.LinkPreview) error
+	// Замена ссылок с превью у сообщения версии version, false если сообщение изменено или удалено
+	SetMessagePreviews(ctx context.Context, messageId int64, version int, urls []string) (bool, error)
+}
+
+// Параметры разворачивания ссылок
+type PreviewOptions struct {
+	// Число одновременно обрабатываемых сообщений
+	Workers int
+	// Размер очереди сообщений
+	QueueSize int
+	// Время жизни превью в кеше
+	CacheTTL time.Duration
+	// Страница, которую не удалось развернуть, не запрашивается снова в течение FailureTTL
+	FailureTTL time.Duration
+}
+
+type previewService struct {
+	logger    zerolog.Logger
+	storage   PreviewStorage
+	fetcher   LinkFetcher
+	publisher Publisher
+	opts      PreviewOptions
+	queue     chan *models.SendMessage
+
+	// Отменяется при остановке, прерывает загрузки страниц
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.RWMutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// Сообщение ставится в очередь, если у него могут появиться или пропасть превью
+// У измененного сообщения прежние превью сбрасываются, даже если ссылок в тексте не осталось
+func (s *previewService) HandleMessage(ctx context.Context, msg *models.SendMessage) {
+	switch msg.Event {
+	case "":
+		if len(extractLinks(msg.Msg)) == 0 {
+			return
+		}
+	case models.EventMessageEdited:
+	default:
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.stopped {
+		return
+	}
+
+	// Копия, чтобы не зависеть от рассылки того же сообщения воркерами
+	queued := *msg
+	select {
+	case s.queue <- &queued:
+	default:
+		s.loggerFrom(ctx).Warn().Int("chat_id", msg.ChatId).Int64("seq", msg.Seq).Msg("link preview queue is full")
+	}
+}
+
+// Запуск обработчиков
+func (s *previewService) Start() {
+	for i := 0; i < s.opts.Workers; i++ {
+		s.wg.Add(1)
+		go s.run()
+	}
+}
+
+// Остановка обработчиков, сообщения из очереди отбрасываются
+func (s *previewService) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *previewService) run() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg := <-s.queue:
+			s.process(msg)
+		}
+	}
+}
+
+// Разворачивание ссылок сообщения
+// Превью сохраняются только для той версии сообщения, из текста которой взяты ссылки,
+// и рассылаются событием message.updated, если хотя бы одна ссылка развернулась
+// Ссылки, которые не удалось развернуть, пропускаются
+func (s *previewService) process(msg *models.SendMessage) {
+	logger := s.logger.With().Int("chat_id", msg.ChatId).Int64("seq", msg.Seq).Int("version", msg.Version).Logger()
+	ctx := logger.WithContext(s.ctx)
+
+	var previews []models.LinkPreview
+	urls := make([]string, 0, maxMessagePreviews)
+	for _, link := range extractLinks(msg.Msg) {
+		preview, err := s.preview(ctx, link)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error().Err(err).Str("url", link).Msg("failed to get link preview")
+			}
+			continue
+		}
+		if !preview.Failed {
+			previews = append(previews, preview)
+			urls = append(urls, link)
+		}
+	}
+
+	ok, err := s.storage.SetMessagePreviews(ctx, msg.Id, msg.Version, urls)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error().Err(err).Msg("failed to save message previews")
+		}
+		return
+	}
+	if !ok || len(previews) == 0 {
+		return
+	}
+
+	err = s.publisher.Publish(ctx, &models.SendMessage{
+		Id:          msg.Id,
+		Seq:         msg.Seq,
+		Event:       models.EventMessageUpdated,
+		Version:     msg.Version,
+		ParentSeq:   msg.ParentSeq,
+		Author:      msg.Author,
+		AuthorId:    msg.AuthorId,
+		MessageType: 1,
+		ChatId:      msg.ChatId,
+		Previews:    previews,
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to publish link previews")
+	}
+}
+
+// Превью ссылки из кеша, а если его нет или оно устарело - загруженное заново
+// Неудачная загрузка тоже кешируется, но не при остановке сервиса
+func (s *previewService) preview(ctx context.Context, link string) (models.LinkPreview, error) {
+	cached, ok, err := s.storage.GetLinkPreview(ctx, link)
+	if err != nil {
+		return models.LinkPreview{}, errors.Wrap(err, "failed to get cached preview")
+	}
+	ttl := s.opts.CacheTTL
+	if cached.Failed {
+		ttl = s.opts.FailureTTL
+	}
+	if ok && time.Since(cached.FetchedAt) < ttl {
+		return cached, nil
+	}
+
+	preview, err := s.fetcher.Fetch(ctx, link)
+	if err != nil {
+		if ctx.Err() != nil {
+			return models.LinkPreview{}, ctx.Err()
+		}
+		zerolog.Ctx(ctx).Debug().Err(err).Str("url", link).Msg("failed to unfurl link")
+		preview = models.LinkPreview{URL: link, Failed: true}
+	}
+
+	if err = s.storage.SaveLinkPreview(ctx, &preview); err != nil {
+		return models.LinkPreview{}, errors.Wrap(err, "failed to cache preview")
+	}
+
+	return preview, nil
+}
+
+// Логгер запроса из контекста, если его нет - логгер сервиса
+func (s *previewService) loggerFrom(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &s.logger
+}
+
+// Первые maxMessagePreviews различных ссылок текста
+func extractLinks(text string) []string {
+	var links []string
+	for _, match := range linkPattern.FindAllString(text, -1) {
+		link := markdown.TrimLink(match)
+		if len(link) > maxLinkLength {
+			continue
+		}
+		if parsed, err := url.Parse(link); err != nil || parsed.Hostname() == "" {
+			continue
+		}
+		if containsString(links, link) {
+			continue
+		}
+		links = append(links, link)
+		if len(links) == maxMessagePreviews {
+			break
+		}
+	}
+	return links
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func NewPreviews(logger zerolog.Logger, storage PreviewStorage, fetcher LinkFetcher, publisher Publisher, opts PreviewOptions) PreviewService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &previewService{
+		logger:    logger,
+		storage:   storage,
+		fetcher:   fetcher,
+		publisher: publisher,
+		opts:      opts,
+		queue:     make(chan *models.SendMessage, opts.QueueSize),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
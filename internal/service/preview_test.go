@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/service/servicetest"
+	"github.com/rs/zerolog"
+)
+
+var testPreviewOptions = PreviewOptions{
+	Workers:    1,
+	QueueSize:  4,
+	CacheTTL:   time.Hour,
+	FailureTTL: time.Minute,
+}
+
+var testPages = map[string]models.LinkPreview{
+	"https://example.com/a": {Title: "Page A", Description: "First page"},
+	"https://example.com/b": {Title: "Page B", Image: "https://example.com/b.png"},
+}
+
+func newTestPreviews(t *testing.T) (*previewService, ChatService, *servicetest.ChatStorage, *servicetest.Publisher, *servicetest.Fetcher) {
+	t.Helper()
+
+	chats, storage, publisher := newTestChats(t)
+	fetcher := &servicetest.Fetcher{Pages: testPages}
+	previews := NewPreviews(zerolog.Nop(), storage, fetcher, publisher, testPreviewOptions).(*previewService)
+	return previews, chats, storage, publisher, fetcher
+}
+
+// Отправка сообщения, возвращается то же сообщение, что получила шина
+func mustSend(t *testing.T, chats ChatService, chatId int, text string) *models.SendMessage {
+	t.Helper()
+
+	msg := &models.SendMessage{ChatId: chatId, Msg: text, Author: "Alice", AuthorId: "1", MessageType: 1}
+	if err := chats.SendMessage(context.Background(), msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	return msg
+}
+
+// Опубликованные события message.updated
+func updates(publisher *servicetest.Publisher) []models.SendMessage {
+	var events []models.SendMessage
+	for _, msg := range publisher.Messages() {
+		if msg.Event == models.EventMessageUpdated {
+			events = append(events, msg)
+		}
+	}
+	return events
+}
+
+func TestPreviews(t *testing.T) {
+	previews, chats, storage, publisher, fetcher := newTestPreviews(t)
+	chat := mustCreateChat(t, chats, "general")
+	ctx := context.Background()
+
+	// Неразвернутая ссылка пропускается, повторная ссылка не загружается второй раз
+	msg := mustSend(t, chats, chat.RoomId,
+		"see https://example.com/a, https://example.com/missing and (https://example.com/b) https://example.com/a")
+	previews.process(msg)
+
+	wantRequests := []string{"https://example.com/a", "https://example.com/missing", "https://example.com/b"}
+	if got := fetcher.Requests(); !reflect.DeepEqual(got, wantRequests) {
+		t.Errorf("requests = %v, want %v", got, wantRequests)
+	}
+	events := updates(publisher)
+	if len(events) != 1 {
+		t.Fatalf("message.updated events = %+v, want 1", events)
+	}
+	if got := events[0]; got.Seq != msg.Seq || got.Version != msg.Version || len(got.Previews) != 2 ||
+		got.Previews[0].Title != "Page A" || got.Previews[1].URL != "https://example.com/b" {
+		t.Errorf("message.updated = %+v", got)
+	}
+
+	messages, err := chats.GetMessages(ctx, chat.RoomId, 0, 0)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(messages) != 1 || len(messages[0].Previews) != 2 {
+		t.Errorf("GetMessages() = %+v", messages)
+	}
+
+	// Кеш, в том числе неудачных загрузок
+	other := mustSend(t, chats, chat.RoomId, "again https://example.com/a https://example.com/missing")
+	previews.process(other)
+	if got := fetcher.Requests(); len(got) != 3 {
+		t.Errorf("requests with cache = %v", got)
+	}
+
+	// Устаревшие записи загружаются заново
+	storage.AgeLinkPreview("https://example.com/a", 2*time.Hour)
+	storage.AgeLinkPreview("https://example.com/missing", 2*time.Minute)
+	previews.process(other)
+	if got := fetcher.Requests(); len(got) != 5 {
+		t.Errorf("requests after expiry = %v", got)
+	}
+}
+
+func TestPreviewsOfEditedMessage(t *testing.T) {
+	previews, chats, _, publisher, _ := newTestPreviews(t)
+	chat := mustCreateChat(t, chats, "general")
+	ctx := context.Background()
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+
+	msg := mustSend(t, chats, chat.RoomId, "https://example.com/a")
+	if _, err := chats.EditMessage(ctx, chat.RoomId, msg.Seq, alice, "https://example.com/b"); err != nil {
+		t.Fatalf("EditMessage() error = %v", err)
+	}
+
+	// Превью прежней версии не сохраняются и не рассылаются
+	previews.process(msg)
+	if events := updates(publisher); len(events) != 0 {
+		t.Errorf("message.updated of old version = %+v", events)
+	}
+
+	edited := publisher.Messages()[len(publisher.Messages())-1]
+	previews.process(&edited)
+	events := updates(publisher)
+	if len(events) != 1 || events[0].Version != 2 || events[0].Previews[0].Title != "Page B" {
+		t.Fatalf("message.updated = %+v", events)
+	}
+
+	// Без ссылок в новом тексте превью сбрасываются без события
+	if _, err := chats.EditMessage(ctx, chat.RoomId, msg.Seq, alice, "no links"); err != nil {
+		t.Fatalf("EditMessage() error = %v", err)
+	}
+	edited = publisher.Messages()[len(publisher.Messages())-1]
+	previews.process(&edited)
+	if events = updates(publisher); len(events) != 1 {
+		t.Errorf("message.updated without links = %+v", events)
+	}
+	messages, err := chats.GetMessages(ctx, chat.RoomId, 0, 0)
+	if err != nil || len(messages[0].Previews) != 0 {
+		t.Errorf("GetMessages() = %+v, %v", messages, err)
+	}
+}
+
+func TestPreviewsQueue(t *testing.T) {
+	previews, chats, _, publisher, fetcher := newTestPreviews(t)
+	chat := mustCreateChat(t, chats, "general")
+	ctx := context.Background()
+
+	// Сообщения без ссылок и прочие события в очередь не попадают
+	previews.HandleMessage(ctx, mustSend(t, chats, chat.RoomId, "no links"))
+	previews.HandleMessage(ctx, &models.SendMessage{Event: models.EventReactionAdded, Msg: "https://example.com/a"})
+	if len(previews.queue) != 0 {
+		t.Errorf("queue length = %d, want 0", len(previews.queue))
+	}
+
+	previews.Start()
+	previews.HandleMessage(ctx, mustSend(t, chats, chat.RoomId, "https://example.com/a"))
+	deadline := time.Now().Add(time.Second)
+	for len(updates(publisher)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if events := updates(publisher); len(events) != 1 {
+		t.Errorf("message.updated events = %+v, want 1", events)
+	}
+
+	// После остановки сообщения не принимаются
+	previews.Stop()
+	previews.HandleMessage(ctx, mustSend(t, chats, chat.RoomId, "https://example.com/b"))
+	if len(previews.queue) != 0 || len(fetcher.Requests()) != 1 {
+		t.Errorf("after Stop() queue = %d, requests = %v", len(previews.queue), fetcher.Requests())
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	tests := map[string][]string{
+		"no links here":                        nil,
+		"https://example.com":                  {"https://example.com"},
+		"See HTTP://Example.com/path?q=1#top.": {"HTTP://Example.com/path?q=1#top"},
+		"(see https://en.wikipedia.org/wiki/Go_(programming_language))": {"https://en.wikipedia.org/wiki/Go_(programming_language)"},
+		"(https://example.com/a)":                                               {"https://example.com/a"},
+		`<a href="https://example.com/x">`:                                      {"https://example.com/x"},
+		"ftp://example.com mailto:a@b.c http://":                                nil,
+		"https://a.com https://b.com https://a.com https://c.com https://d.com": {"https://a.com", "https://b.com", "https://c.com"},
+		"https://example.com/" + strings.Repeat("a", maxLinkLength):             nil,
+	}
+	for text, want := range tests {
+		if got := extractLinks(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("extractLinks(%.40q) = %v, want %v", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/pkg/errors"
+)
+
+// Ограничения поиска: длина запроса в символах, размер страницы и глубина листания
+const (
+	maxSearchQueryLength = 256
+	defaultSearchLimit   = 20
+	maxSearchLimit       = 100
+	maxSearchOffset      = 1000
+)
+
+// Поиск сообщений по тексту
+// Чаты открыты всем вошедшим пользователям, поэтому поиск идет по всем существующим чатам
+// или по одному чату ChatId; пользователь без ID ничего не ищет
+func (s *chatService) SearchMessages(ctx context.Context, user models.UserStruct, query models.SearchQuery) (models.SearchPage, error) {
+	if user.UserId == "" {
+		return models.SearchPage{}, Unauthorized("user is not identified")
+	}
+
+	query.Query = strings.TrimSpace(query.Query)
+	query.Author = strings.TrimSpace(query.Author)
+	switch {
+	case query.Query == "":
+		return models.SearchPage{}, Validation("search query is empty")
+	case utf8.RuneCountInString(query.Query) > maxSearchQueryLength:
+		return models.SearchPage{}, Validation("search query is too long")
+	case query.ChatId < 0:
+		return models.SearchPage{}, Validation("chat_id must be positive")
+	case query.Offset < 0 || query.Offset > maxSearchOffset:
+		return models.SearchPage{}, Validation("offset is out of range")
+	case query.From != nil && query.To != nil && !query.From.Before(*query.To):
+		return models.SearchPage{}, Validation("from must be before to")
+	}
+	if query.Limit < 1 || query.Limit > maxSearchLimit {
+		query.Limit = defaultSearchLimit
+	}
+
+	if query.ChatId != 0 {
+		if _, err := s.GetChat(ctx, query.ChatId); err != nil {
+			return models.SearchPage{}, err
+		}
+	}
+
+	// Лишний результат показывает, что есть следующая страница
+	limit := query.Limit
+	query.Limit++
+	results, err := s.storage.SearchMessages(ctx, query)
+	if err != nil {
+		return models.SearchPage{}, errors.Wrap(err, "failed to search messages")
+	}
+
+	page := models.SearchPage{Results: results}
+	if len(results) > limit {
+		page.Results = results[:limit]
+		page.NextOffset = query.Offset + limit
+	}
+
+	return page, nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+)
+
+func TestSearchMessages(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	general := mustCreateChat(t, chats, "general")
+	random := mustCreateChat(t, chats, "random")
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	bob := models.UserStruct{UserId: "2", UserName: "Bob"}
+
+	for _, m := range []struct {
+		chat   models.RoomStruct
+		author models.UserStruct
+		text   string
+	}{
+		{general, alice, "release notes"},
+		{general, bob, "Release is ready"},
+		{random, bob, "release party"},
+		{general, alice, "lunch"},
+		{general, bob, "next release"},
+	} {
+		msg := &models.SendMessage{Msg: m.text, Author: m.author.UserName, AuthorId: m.author.UserId, ChatId: m.chat.RoomId}
+		if err := chats.SendMessage(ctx, msg); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+
+	texts := func(page models.SearchPage) string {
+		var snippets []string
+		for _, r := range page.Results {
+			snippets = append(snippets, r.Snippet)
+		}
+		return strings.Join(snippets, "|")
+	}
+
+	tests := []struct {
+		name       string
+		query      models.SearchQuery
+		want       string
+		nextOffset int
+	}{
+		{"all chats", models.SearchQuery{Query: " release "}, "next release|release party|Release is ready|release notes", 0},
+		{"one chat", models.SearchQuery{Query: "release", ChatId: general.RoomId}, "next release|Release is ready|release notes", 0},
+		{"author id", models.SearchQuery{Query: "release", Author: "1"}, "release notes", 0},
+		{"author name", models.SearchQuery{Query: "release", Author: "bob"}, "next release|release party|Release is ready", 0},
+		{"first page", models.SearchQuery{Query: "release", Limit: 3}, "next release|release party|Release is ready", 3},
+		{"last page", models.SearchQuery{Query: "release", Limit: 3, Offset: 3}, "release notes", 0},
+		{"nothing found", models.SearchQuery{Query: "dinner"}, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := chats.SearchMessages(ctx, alice, tt.query)
+			if err != nil {
+				t.Fatalf("SearchMessages() error = %v", err)
+			}
+			if got := texts(page); got != tt.want || page.NextOffset != tt.nextOffset {
+				t.Errorf("SearchMessages() = %q, next %d; want %q, next %d", got, page.NextOffset, tt.want, tt.nextOffset)
+			}
+		})
+	}
+
+	page, err := chats.SearchMessages(ctx, alice, models.SearchQuery{Query: "party"})
+	if err != nil || len(page.Results) != 1 {
+		t.Fatalf("SearchMessages() = %+v, %v", page, err)
+	}
+	if r := page.Results[0]; r.ChatId != random.RoomId || r.ChatName != "random" || r.Seq != 1 || r.AuthorId != bob.UserId {
+		t.Errorf("result = %+v", r)
+	}
+}
+
+func TestSearchMessagesErrors(t *testing.T) {
+	chats, _, _ := newTestChats(t)
+	ctx := context.Background()
+	alice := models.UserStruct{UserId: "1", UserName: "Alice"}
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+
+	tests := []struct {
+		name  string
+		user  models.UserStruct
+		query models.SearchQuery
+		want  error
+	}{
+		{"anonymous", models.UserStruct{}, models.SearchQuery{Query: "hello"}, ErrUnauthorized},
+		{"empty query", alice, models.SearchQuery{Query: "  "}, ErrValidation},
+		{"long query", alice, models.SearchQuery{Query: strings.Repeat("я", maxSearchQueryLength+1)}, ErrValidation},
+		{"deep offset", alice, models.SearchQuery{Query: "hello", Offset: maxSearchOffset + 1}, ErrValidation},
+		{"reversed period", alice, models.SearchQuery{Query: "hello", From: &now, To: &earlier}, ErrValidation},
+		{"missing chat", alice, models.SearchQuery{Query: "hello", ChatId: 100}, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := chats.SearchMessages(ctx, tt.user, tt.query); !errors.Is(err, tt.want) {
+				t.Errorf("SearchMessages() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package service
 
 import (
 	"context"
-	"fmt"
 
 	"golang.org/x/oauth2"
 
@@ -43,12 +42,12 @@ type service struct {
 // Получаем данные о пользователи из Гугл
 func (s *service) GetUserInfo(state string, code string) ([]byte, error) {
 	if state != oauthStateString {
-		return nil, fmt.Errorf("invalid oauth state")
+		return nil, Unauthorized("invalid oauth state")
 	}
 
 	token, err := s.oauthConfig.Exchange(context.Background(), code)
 	if err != nil {
-		return nil, fmt.Errorf("code exchange failed: %s", err.Error())
+		return nil, &Error{Kind: ErrUnauthorized, Message: "code exchange failed", Err: err}
 	}
 
 	contents, err := s.googleAPI.GetUserInfo(token)
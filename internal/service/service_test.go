@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/Yury132/Golang-Task-3/internal/service/servicetest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// OAuth сервер, выдающий токен на любой код, кроме "bad"
+func newTokenServer(t *testing.T) *oauth2.Config {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("code") == "bad" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token-` + r.Form.Get("code") + `","token_type":"Bearer"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	return &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"},
+	}
+}
+
+func TestGetUserInfo(t *testing.T) {
+	googleAPI := &servicetest.GoogleAPI{Content: []byte(`{"id":"1"}`)}
+	svc := New(zerolog.Nop(), newTokenServer(t), googleAPI, &servicetest.Storage{})
+
+	content, err := svc.GetUserInfo(oauthStateString, "code")
+	if err != nil {
+		t.Fatalf("GetUserInfo() error = %v", err)
+	}
+	if string(content) != `{"id":"1"}` {
+		t.Errorf("GetUserInfo() = %s", content)
+	}
+	if tokens := googleAPI.Tokens(); len(tokens) != 1 || tokens[0] != "token-code" {
+		t.Errorf("google called with tokens %v, want [token-code]", tokens)
+	}
+}
+
+func TestGetUserInfoErrors(t *testing.T) {
+	googleErr := errors.New("google is down")
+
+	tests := []struct {
+		name      string
+		state     string
+		code      string
+		googleErr error
+		want      error
+	}{
+		{name: "invalid state", state: "other", code: "code", want: ErrUnauthorized},
+		{name: "exchange failed", state: oauthStateString, code: "bad", want: ErrUnauthorized},
+		{name: "google failed", state: oauthStateString, code: "code", googleErr: googleErr, want: googleErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			googleAPI := &servicetest.GoogleAPI{Err: tt.googleErr}
+			svc := New(zerolog.Nop(), newTokenServer(t), googleAPI, &servicetest.Storage{})
+
+			_, err := svc.GetUserInfo(tt.state, tt.code)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("GetUserInfo() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleUser(t *testing.T) {
+	storage := &servicetest.Storage{}
+	svc := New(zerolog.Nop(), nil, nil, storage)
+	ctx := context.Background()
+
+	// Повторный вход не создает пользователя заново
+	for i := 0; i < 2; i++ {
+		if err := svc.HandleUser(ctx, "Alice", "alice@example.com"); err != nil {
+			t.Fatalf("HandleUser() error = %v", err)
+		}
+	}
+	if err := svc.HandleUser(ctx, "Bob", "bob@example.com"); err != nil {
+		t.Fatalf("HandleUser() error = %v", err)
+	}
+
+	users, err := svc.GetUsersList(ctx)
+	if err != nil {
+		t.Fatalf("GetUsersList() error = %v", err)
+	}
+	if len(users) != 2 || users[0].Email != "alice@example.com" || users[1].Email != "bob@example.com" {
+		t.Errorf("GetUsersList() = %+v", users)
+	}
+}
+
+func TestHandleUserStorageError(t *testing.T) {
+	storageErr := errors.New("connection refused")
+	svc := New(zerolog.Nop(), nil, nil, &servicetest.Storage{Err: storageErr})
+
+	err := svc.HandleUser(context.Background(), "Alice", "alice@example.com")
+	if !errors.Is(err, storageErr) {
+		t.Errorf("HandleUser() error = %v, want %v", err, storageErr)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{NotFound("chat not found"), ErrNotFound},
+		{Forbidden("forbidden"), ErrForbidden},
+		{Conflict("conflict"), ErrConflict},
+		{Validation("empty"), ErrValidation},
+		{Unauthorized("login"), ErrUnauthorized},
+	}
+
+	for _, tt := range tests {
+		wrapped := errors.Wrap(tt.err, "context")
+		if !errors.Is(wrapped, tt.kind) {
+			t.Errorf("errors.Is(%v, %v) = false", wrapped, tt.kind)
+		}
+		if errors.Is(wrapped, ErrConflict) && tt.kind != ErrConflict {
+			t.Errorf("errors.Is(%v, ErrConflict) = true", wrapped)
+		}
+	}
+}
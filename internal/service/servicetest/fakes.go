@@ -0,0 +1,823 @@
+// Заглушки зависимостей сервисов для тестов
+// Хранят данные в памяти и позволяют подставить ошибку через поле Err
+package servicetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"golang.org/x/oauth2"
+)
+
+// Хранилище пользователей (service.Storage)
+type Storage struct {
+	mu    sync.Mutex
+	users []models.User
+	Err   error
+}
+
+func (s *Storage) GetUsers(_ context.Context) ([]models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return append([]models.User(nil), s.users...), nil
+}
+
+func (s *Storage) CheckUser(_ context.Context, email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return false, s.Err
+	}
+	for _, user := range s.users {
+		if user.Email == email {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Storage) CreateUser(_ context.Context, name string, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return s.Err
+	}
+	s.users = append(s.users, models.User{ID: uint64(len(s.users) + 1), Name: name, Email: email})
+	return nil
+}
+
+// Клиент Google (service.GoogleAPI)
+// Возвращает данные пользователя из ByToken по токену доступа, для остальных токенов - Content
+type GoogleAPI struct {
+	Content []byte
+	ByToken map[string][]byte
+	Err     error
+
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (g *GoogleAPI) GetUserInfo(token *oauth2.Token) ([]byte, error) {
+	g.mu.Lock()
+	g.tokens = append(g.tokens, token.AccessToken)
+	g.mu.Unlock()
+
+	if g.Err != nil {
+		return nil, g.Err
+	}
+	if content, ok := g.ByToken[token.AccessToken]; ok {
+		return content, nil
+	}
+	return g.Content, nil
+}
+
+// Токены, с которыми запрашивались данные пользователя
+func (g *GoogleAPI) Tokens() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]string(nil), g.tokens...)
+}
+
+// Хранилище чатов и сообщений (service.ChatStorage)
+type ChatStorage struct {
+	Err error
+
+	mu       sync.Mutex
+	lastId   int
+	chats    map[int]models.RoomStruct
+	lastSeq  map[int]int64
+	messages []models.Message
+	// Прежние тексты сообщений по ID
+	revisions map[int64][]string
+	// Реакции сообщений по ID в порядке постановки
+	reactions map[int64][]reaction
+	// Номер последнего прочитанного сообщения по чату и ID пользователя
+	read map[int]map[string]int64
+	// Вложения в порядке загрузки
+	attachments []models.Attachment
+	// Кеш превью по адресу и ссылки с превью по ID сообщения
+	linkPreviews    map[string]models.LinkPreview
+	messagePreviews map[int64][]string
+}
+
+type reaction struct {
+	userId   string
+	reaction string
+}
+
+func NewChatStorage() *ChatStorage {
+	return &ChatStorage{
+		chats:     make(map[int]models.RoomStruct),
+		lastSeq:   make(map[int]int64),
+		revisions: make(map[int64][]string),
+		reactions: make(map[int64][]reaction),
+		read:      make(map[int]map[string]int64),
+
+		linkPreviews:    make(map[string]models.LinkPreview),
+		messagePreviews: make(map[int64][]string),
+	}
+}
+
+func (s *ChatStorage) CreateChat(_ context.Context, name string, ownerId string) (models.RoomStruct, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return models.RoomStruct{}, s.Err
+	}
+	s.lastId++
+	chat := models.RoomStruct{RoomId: s.lastId, RoomName: name, OwnerId: ownerId}
+	s.chats[chat.RoomId] = chat
+	return chat, nil
+}
+
+func (s *ChatStorage) GetChat(_ context.Context, chatId int) (models.RoomStruct, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return models.RoomStruct{}, false, s.Err
+	}
+	chat, ok := s.chats[chatId]
+	return chat, ok, nil
+}
+
+func (s *ChatStorage) GetChats(_ context.Context) ([]models.RoomStruct, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	chats := make([]models.RoomStruct, 0, len(s.chats))
+	for id := 1; id <= s.lastId; id++ {
+		if chat, ok := s.chats[id]; ok {
+			chats = append(chats, chat)
+		}
+	}
+	return chats, nil
+}
+
+func (s *ChatStorage) RenameChat(_ context.Context, chatId int, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return false, s.Err
+	}
+	chat, ok := s.chats[chatId]
+	if !ok {
+		return false, nil
+	}
+	chat.RoomName = name
+	s.chats[chatId] = chat
+	return true, nil
+}
+
+func (s *ChatStorage) DeleteChat(_ context.Context, chatId int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return false, s.Err
+	}
+	if _, ok := s.chats[chatId]; !ok {
+		return false, nil
+	}
+	delete(s.chats, chatId)
+	delete(s.lastSeq, chatId)
+	delete(s.read, chatId)
+
+	messages := s.messages[:0]
+	for _, msg := range s.messages {
+		if msg.ChatId != chatId {
+			messages = append(messages, msg)
+		}
+	}
+	s.messages = messages
+	return true, nil
+}
+
+func (s *ChatStorage) CreateMessage(_ context.Context, msg *models.SendMessage) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return false, s.Err
+	}
+	if _, ok := s.chats[msg.ChatId]; !ok {
+		return false, nil
+	}
+	parent := -1
+	if msg.ParentSeq != 0 {
+		if parent = s.find(msg.ChatId, msg.ParentSeq); parent < 0 {
+			return false, errors.New("parent message not found")
+		}
+	}
+	s.lastSeq[msg.ChatId]++
+	msg.Id = int64(len(s.messages) + 1)
+	msg.Seq = s.lastSeq[msg.ChatId]
+	msg.Attachments = s.attach(msg)
+	msg.Version = 1
+	msg.CreatedAt = time.Now()
+	if parent >= 0 {
+		s.messages[parent].ReplyCount++
+		msg.ReplyCount = s.messages[parent].ReplyCount
+	}
+	s.messages = append(s.messages, models.Message{
+		Id:        msg.Id,
+		ChatId:    msg.ChatId,
+		Seq:       msg.Seq,
+		ParentSeq: msg.ParentSeq,
+		Msg:       msg.Msg,
+		Html:      msg.Html,
+		Author:    msg.Author,
+		AuthorId:  msg.AuthorId,
+		Version:   msg.Version,
+		CreatedAt: msg.CreatedAt,
+	})
+	return true, nil
+}
+
+func (s *ChatStorage) GetMessages(_ context.Context, chatId int, afterSeq int64, limit int) ([]models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return s.list(chatId, 0, afterSeq, limit), nil
+}
+
+func (s *ChatStorage) GetReplies(_ context.Context, chatId int, parentSeq int64, afterSeq int64, limit int) ([]models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return s.list(chatId, parentSeq, afterSeq, limit), nil
+}
+
+// Сообщения чата с родителем parentSeq, 0 - вне тредов
+func (s *ChatStorage) list(chatId int, parentSeq int64, afterSeq int64, limit int) []models.Message {
+	messages := make([]models.Message, 0)
+	for _, msg := range s.messages {
+		if len(messages) == limit {
+			break
+		}
+		if msg.ChatId == chatId && msg.ParentSeq == parentSeq && msg.Seq > afterSeq {
+			msg.Reactions = s.aggregate(msg.Id)
+			if msg.DeletedAt == nil {
+				msg.Attachments = s.attachmentsOf(msg.Id)
+				msg.Previews = s.previewsOf(msg.Id)
+			}
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// Прикрепление к новому сообщению неотправленных вложений автора из того же чата
+func (s *ChatStorage) attach(msg *models.SendMessage) []models.Attachment {
+	var attached []models.Attachment
+	for _, requested := range msg.Attachments {
+		for i := range s.attachments {
+			a := &s.attachments[i]
+			if a.Id == requested.Id && a.ChatId == msg.ChatId && a.UploaderId == msg.AuthorId && a.MessageId == 0 {
+				a.MessageId = msg.Id
+				requested.MessageId = msg.Id
+				attached = append(attached, requested)
+			}
+		}
+	}
+	return attached
+}
+
+// Вложения сообщения в порядке загрузки
+func (s *ChatStorage) attachmentsOf(messageId int64) []models.Attachment {
+	var attachments []models.Attachment
+	for _, a := range s.attachments {
+		if a.MessageId == messageId {
+			attachments = append(attachments, a)
+		}
+	}
+	return attachments
+}
+
+func (s *ChatStorage) CreateAttachment(_ context.Context, attachment *models.Attachment) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return false, s.Err
+	}
+	if _, ok := s.chats[attachment.ChatId]; !ok {
+		return false, nil
+	}
+	attachment.CreatedAt = time.Now()
+	s.attachments = append(s.attachments, *attachment)
+	return true, nil
+}
+
+func (s *ChatStorage) GetAttachment(_ context.Context, id string) (models.Attachment, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return models.Attachment{}, false, s.Err
+	}
+	for _, a := range s.attachments {
+		if a.Id != id {
+			continue
+		}
+		for _, msg := range s.messages {
+			if msg.Id == a.MessageId && msg.DeletedAt != nil {
+				return models.Attachment{}, false, nil
+			}
+		}
+		return a, true, nil
+	}
+	return models.Attachment{}, false, nil
+}
+
+func (s *ChatStorage) GetAttachments(_ context.Context, ids []string) ([]models.Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	attachments := make([]models.Attachment, 0)
+	for _, a := range s.attachments {
+		for _, id := range ids {
+			if a.Id == id {
+				attachments = append(attachments, a)
+			}
+		}
+	}
+	return attachments, nil
+}
+
+func (s *ChatStorage) DeleteUnsentAttachments(_ context.Context, before time.Time, limit int) ([]models.Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	var deleted []models.Attachment
+	kept := s.attachments[:0]
+	for _, a := range s.attachments {
+		if a.MessageId == 0 && a.CreatedAt.Before(before) && len(deleted) < limit {
+			deleted = append(deleted, a)
+			continue
+		}
+		kept = append(kept, a)
+	}
+	s.attachments = kept
+	return deleted, nil
+}
+
+// Развернутые ссылки сообщения в порядке появления в тексте
+func (s *ChatStorage) previewsOf(messageId int64) []models.LinkPreview {
+	var previews []models.LinkPreview
+	for _, url := range s.messagePreviews[messageId] {
+		if preview, ok := s.linkPreviews[url]; ok && !preview.Failed {
+			previews = append(previews, preview)
+		}
+	}
+	return previews
+}
+
+func (s *ChatStorage) GetLinkPreview(_ context.Context, url string) (models.LinkPreview, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return models.LinkPreview{}, false, s.Err
+	}
+	preview, ok := s.linkPreviews[url]
+	return preview, ok, nil
+}
+
+func (s *ChatStorage) SaveLinkPreview(_ context.Context, preview *models.LinkPreview) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return s.Err
+	}
+	preview.FetchedAt = time.Now()
+	s.linkPreviews[preview.URL] = *preview
+	return nil
+}
+
+// Изменение времени загрузки превью в кеше, чтобы проверить его устаревание
+func (s *ChatStorage) AgeLinkPreview(url string, age time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	preview := s.linkPreviews[url]
+	preview.FetchedAt = preview.FetchedAt.Add(-age)
+	s.linkPreviews[url] = preview
+}
+
+func (s *ChatStorage) SetMessagePreviews(_ context.Context, messageId int64, version int, urls []string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return false, s.Err
+	}
+	for _, msg := range s.messages {
+		if msg.Id == messageId {
+			if msg.Version != version || msg.DeletedAt != nil {
+				return false, nil
+			}
+			s.messagePreviews[messageId] = append([]string(nil), urls...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Реакции сообщения, сгруппированные в порядке первой постановки
+func (s *ChatStorage) aggregate(messageId int64) []models.Reaction {
+	var reactions []models.Reaction
+	index := make(map[string]int)
+	for _, r := range s.reactions[messageId] {
+		i, ok := index[r.reaction]
+		if !ok {
+			i = len(reactions)
+			index[r.reaction] = i
+			reactions = append(reactions, models.Reaction{Reaction: r.reaction})
+		}
+		reactions[i].Count++
+		reactions[i].UserIds = append(reactions[i].UserIds, r.userId)
+	}
+	return reactions
+}
+
+func (s *ChatStorage) AddReaction(_ context.Context, messageId int64, userId string, value string) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return 0, false, s.Err
+	}
+	added := s.reactionIndex(messageId, userId, value) < 0
+	if added {
+		s.reactions[messageId] = append(s.reactions[messageId], reaction{userId: userId, reaction: value})
+	}
+	return s.reactionCount(messageId, value), added, nil
+}
+
+func (s *ChatStorage) RemoveReaction(_ context.Context, messageId int64, userId string, value string) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return 0, false, s.Err
+	}
+	i := s.reactionIndex(messageId, userId, value)
+	if i >= 0 {
+		reactions := s.reactions[messageId]
+		s.reactions[messageId] = append(reactions[:i:i], reactions[i+1:]...)
+	}
+	return s.reactionCount(messageId, value), i >= 0, nil
+}
+
+func (s *ChatStorage) reactionIndex(messageId int64, userId string, value string) int {
+	for i, r := range s.reactions[messageId] {
+		if r.userId == userId && r.reaction == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *ChatStorage) reactionCount(messageId int64, value string) int {
+	count := 0
+	for _, r := range s.reactions[messageId] {
+		if r.reaction == value {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *ChatStorage) MarkRead(_ context.Context, chatId int, userId string, seq int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return false, s.Err
+	}
+	if s.read[chatId] == nil {
+		s.read[chatId] = make(map[string]int64)
+	}
+	if s.read[chatId][userId] >= seq {
+		return false, nil
+	}
+	s.read[chatId][userId] = seq
+	return true, nil
+}
+
+func (s *ChatStorage) GetUnreadCounts(_ context.Context, userId string) (map[int]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	counts := make(map[int]int)
+	for _, msg := range s.messages {
+		if msg.AuthorId != userId && msg.DeletedAt == nil && msg.Seq > s.read[msg.ChatId][userId] {
+			counts[msg.ChatId]++
+		}
+	}
+	return counts, nil
+}
+
+// Поиск сообщений, содержащих все слова запроса без учета регистра, от новых к старым
+// Фрагмент - весь текст сообщения без подсветки
+func (s *ChatStorage) SearchMessages(_ context.Context, query models.SearchQuery) ([]models.SearchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	words := strings.Fields(strings.ToLower(query.Query))
+	results := make([]models.SearchResult, 0)
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		msg := s.messages[i]
+		if msg.DeletedAt != nil || !containsAll(strings.ToLower(msg.Msg), words) ||
+			query.ChatId != 0 && msg.ChatId != query.ChatId ||
+			query.Author != "" && msg.AuthorId != query.Author && !strings.EqualFold(msg.Author, query.Author) ||
+			query.From != nil && msg.CreatedAt.Before(*query.From) ||
+			query.To != nil && !msg.CreatedAt.Before(*query.To) {
+			continue
+		}
+		results = append(results, models.SearchResult{
+			ChatId:    msg.ChatId,
+			ChatName:  s.chats[msg.ChatId].RoomName,
+			Seq:       msg.Seq,
+			ParentSeq: msg.ParentSeq,
+			Author:    msg.Author,
+			AuthorId:  msg.AuthorId,
+			CreatedAt: msg.CreatedAt,
+			Snippet:   msg.Msg,
+		})
+	}
+	if query.Offset >= len(results) {
+		return results[:0], nil
+	}
+	results = results[query.Offset:]
+	if len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results, nil
+}
+
+func containsAll(text string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ChatStorage) GetMessage(_ context.Context, chatId int, seq int64) (models.Message, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return models.Message{}, false, s.Err
+	}
+	if i := s.find(chatId, seq); i >= 0 {
+		return s.messages[i], true, nil
+	}
+	return models.Message{}, false, nil
+}
+
+func (s *ChatStorage) EditMessage(_ context.Context, chatId int, seq int64, _ string, body string, bodyHTML string) (models.Message, bool, error) {
+	return s.update(chatId, seq, func(msg *models.Message, now time.Time) {
+		msg.Msg = body
+		msg.Html = bodyHTML
+		msg.EditedAt = &now
+	})
+}
+
+func (s *ChatStorage) DeleteMessage(_ context.Context, chatId int, seq int64, _ string) (models.Message, bool, error) {
+	return s.update(chatId, seq, func(msg *models.Message, now time.Time) {
+		msg.Msg = ""
+		msg.Html = ""
+		msg.DeletedAt = &now
+	})
+}
+
+// Прежние тексты сообщения в порядке изменения
+func (s *ChatStorage) Revisions(messageId int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.revisions[messageId]...)
+}
+
+// Изменение неудаленного сообщения с сохранением прежнего текста
+func (s *ChatStorage) update(chatId int, seq int64, change func(msg *models.Message, now time.Time)) (models.Message, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return models.Message{}, false, s.Err
+	}
+	i := s.find(chatId, seq)
+	if i < 0 || s.messages[i].DeletedAt != nil {
+		return models.Message{}, false, nil
+	}
+	msg := &s.messages[i]
+	s.revisions[msg.Id] = append(s.revisions[msg.Id], msg.Msg)
+	change(msg, time.Now())
+	msg.Version++
+	return *msg, true, nil
+}
+
+// Индекс сообщения в s.messages, -1 если его нет
+func (s *ChatStorage) find(chatId int, seq int64) int {
+	for i, msg := range s.messages {
+		if msg.ChatId == chatId && msg.Seq == seq {
+			return i
+		}
+	}
+	return -1
+}
+
+// Хранилище содержимого вложений (service.BlobStore)
+type Blobs struct {
+	Err error
+
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (b *Blobs) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	if b.Err != nil {
+		return b.Err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.blobs == nil {
+		b.blobs = make(map[string][]byte)
+	}
+	b.blobs[key] = data
+	return nil
+}
+
+func (b *Blobs) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	data, ok := b.blobs[key]
+	if !ok {
+		return nil, errors.New("blob not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *Blobs) Delete(_ context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.blobs, key)
+	return nil
+}
+
+// Ключи сохраненного содержимого
+func (b *Blobs) Keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := make([]string, 0, len(b.blobs))
+	for key := range b.blobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Загрузка страниц по ссылкам (service.LinkFetcher)
+// Страницы берутся из Pages, для остальных адресов - ошибка
+type Fetcher struct {
+	Pages map[string]models.LinkPreview
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *Fetcher) Fetch(_ context.Context, rawURL string) (models.LinkPreview, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, rawURL)
+	preview, ok := f.Pages[rawURL]
+	if !ok {
+		return models.LinkPreview{URL: rawURL}, errors.New("page not found")
+	}
+	preview.URL = rawURL
+	return preview, nil
+}
+
+// Запрошенные адреса в порядке запросов
+func (f *Fetcher) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.requests...)
+}
+
+// Шина (service.Publisher), запоминает опубликованные сообщения
+// Если задан Deliver, сообщение сразу передается ему, как после получения из шины
+type Publisher struct {
+	Err     error
+	Deliver func(ctx context.Context, msg *models.SendMessage) error
+
+	mu       sync.Mutex
+	messages []models.SendMessage
+	signals  []models.SendMessage
+}
+
+func (p *Publisher) Publish(ctx context.Context, msg *models.SendMessage) error {
+	if p.Err != nil {
+		return p.Err
+	}
+
+	msg.PublishedAt = time.Now()
+
+	p.mu.Lock()
+	p.messages = append(p.messages, *msg)
+	p.mu.Unlock()
+
+	if p.Deliver != nil {
+		return p.Deliver(ctx, msg)
+	}
+	return nil
+}
+
+func (p *Publisher) Broadcast(ctx context.Context, msg *models.SendMessage) error {
+	if p.Err != nil {
+		return p.Err
+	}
+
+	msg.PublishedAt = time.Now()
+
+	p.mu.Lock()
+	p.signals = append(p.signals, *msg)
+	p.mu.Unlock()
+
+	if p.Deliver != nil {
+		return p.Deliver(ctx, msg)
+	}
+	return nil
+}
+
+// Разосланные сигналы в порядке отправки
+func (p *Publisher) Signals() []models.SendMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]models.SendMessage(nil), p.signals...)
+}
+
+// Опубликованные сообщения в порядке публикации
+func (p *Publisher) Messages() []models.SendMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]models.SendMessage(nil), p.messages...)
+}
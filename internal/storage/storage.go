@@ -2,8 +2,14 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
 
 	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -13,10 +19,74 @@ type Storage interface {
 	CheckUser(ctx context.Context, email string) (bool, error)
 	// Создание нового пользователя
 	CreateUser(ctx context.Context, name string, email string) error
+	// Создание чата, ownerId - ID создателя
+	CreateChat(ctx context.Context, name string, ownerId string) (models.RoomStruct, error)
+	// Чат по ID, false если его нет
+	GetChat(ctx context.Context, chatId int) (models.RoomStruct, bool, error)
+	// Все чаты
+	GetChats(ctx context.Context) ([]models.RoomStruct, error)
+	// Изменение названия чата, false если его нет
+	RenameChat(ctx context.Context, chatId int, name string) (bool, error)
+	// Удаление чата вместе с сообщениями, false если его нет
+	DeleteChat(ctx context.Context, chatId int) (bool, error)
+	// Сохранение сообщения с присвоением порядкового номера в чате, false если чата нет
+	// У ответа в треде увеличивается число ответов корневого сообщения
+	// Вложения из msg.Attachments прикрепляются к сообщению, в msg.Attachments остаются только прикрепленные
+	CreateMessage(ctx context.Context, msg *models.SendMessage) (bool, error)
+	// Сообщения чата вне тредов с номерами больше afterSeq
+	GetMessages(ctx context.Context, chatId int, afterSeq int64, limit int) ([]models.Message, error)
+	// Ответы в треде сообщения parentSeq с номерами больше afterSeq
+	GetReplies(ctx context.Context, chatId int, parentSeq int64, afterSeq int64, limit int) ([]models.Message, error)
+	// Сообщение чата по номеру, false если его нет
+	GetMessage(ctx context.Context, chatId int, seq int64) (models.Message, bool, error)
+	// Изменение текста сообщения с сохранением прежней версии, false если сообщения нет или оно удалено
+	// bodyHTML - безопасный HTML нового текста
+	EditMessage(ctx context.Context, chatId int, seq int64, editorId string, body string, bodyHTML string) (models.Message, bool, error)
+	// Удаление текста сообщения с сохранением прежней версии, false если сообщения нет или оно уже удалено
+	DeleteMessage(ctx context.Context, chatId int, seq int64, editorId string) (models.Message, bool, error)
+	// Добавление реакции пользователя, false если она уже была; возвращает число таких реакций
+	AddReaction(ctx context.Context, messageId int64, userId string, reaction string) (int, bool, error)
+	// Удаление реакции пользователя, false если ее не было; возвращает число оставшихся таких реакций
+	RemoveReaction(ctx context.Context, messageId int64, userId string, reaction string) (int, bool, error)
+	// Отметка сообщений чата до seq включительно прочитанными, false если отметка не сдвинулась вперед
+	MarkRead(ctx context.Context, chatId int, userId string, seq int64) (bool, error)
+	// Число непрочитанных пользователем сообщений других участников по ID чата, чаты без таких сообщений не включаются
+	GetUnreadCounts(ctx context.Context, userId string) (map[int]int, error)
+	// Поиск неудаленных сообщений по тексту, сначала наиболее подходящие
+	SearchMessages(ctx context.Context, query models.SearchQuery) ([]models.SearchResult, error)
+	// Сохранение метаданных вложения, false если чата нет
+	CreateAttachment(ctx context.Context, attachment *models.Attachment) (bool, error)
+	// Вложение по ID, false если его нет или его сообщение удалено
+	GetAttachment(ctx context.Context, id string) (models.Attachment, bool, error)
+	// Вложения по ID, отсутствующие пропускаются
+	GetAttachments(ctx context.Context, ids []string) ([]models.Attachment, error)
+	// Удаление не больше limit неотправленных вложений, загруженных раньше before, возвращаются удаленные
+	DeleteUnsentAttachments(ctx context.Context, before time.Time, limit int) ([]models.Attachment, error)
+	// Превью ссылки из кеша по адресу, false если его нет
+	GetLinkPreview(ctx context.Context, url string) (models.LinkPreview, bool, error)
+	// Сохранение превью ссылки в кеш с заменой прежнего
+	SaveLinkPreview(ctx context.Context, preview *models.LinkPreview) error
+	// Замена ссылок с превью у сообщения версии version, false если сообщение изменено или удалено
+	SetMessagePreviews(ctx context.Context, messageId int64, version int, urls []string) (bool, error)
 }
 
+// Колонки вложения в порядке scanAttachment
+const attachmentColumns = "id, chat_id, coalesce(message_id, 0), uploader_id, name, size, mime_type, checksum, has_thumbnail, created_at"
+
+// Колонки сообщения в порядке scanMessage
+const messageColumns = "id, chat_id, seq, coalesce(parent_seq, 0), reply_count, body, body_html, author, coalesce(author_id, ''), version, created_at, edited_at, deleted_at"
+
+// Границы подсветки в ts_headline, перед экранированием HTML заменяются на <mark> и </mark>
+// Символы из области для частного использования удаляются из текста до подсветки
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
 type storage struct {
 	conn *pgxpool.Pool
+	// Конфигурация полнотекстового поиска PostgreSQL, например russian
+	searchLanguage string
 }
 
 // Все пользователи в БД
@@ -85,8 +155,693 @@ func (s *storage) CreateUser(ctx context.Context, name string, email string) err
 	return nil
 }
 
-func New(conn *pgxpool.Pool) Storage {
+// Создание чата
+func (s *storage) CreateChat(ctx context.Context, name string, ownerId string) (models.RoomStruct, error) {
+	query := "INSERT INTO public.chat (name, owner_id) VALUES ($1, nullif($2, '')) RETURNING id, name, coalesce(owner_id, '')"
+
+	var chat models.RoomStruct
+	err := s.conn.QueryRow(ctx, query, name, ownerId).Scan(&chat.RoomId, &chat.RoomName, &chat.OwnerId)
+	return chat, err
+}
+
+// Чат по ID
+func (s *storage) GetChat(ctx context.Context, chatId int) (models.RoomStruct, bool, error) {
+	query := "SELECT id, name, coalesce(owner_id, '') FROM public.chat WHERE id=$1"
+
+	var chat models.RoomStruct
+	err := s.conn.QueryRow(ctx, query, chatId).Scan(&chat.RoomId, &chat.RoomName, &chat.OwnerId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return chat, false, nil
+	}
+	if err != nil {
+		return chat, false, err
+	}
+
+	return chat, true, nil
+}
+
+// Все чаты в порядке создания
+func (s *storage) GetChats(ctx context.Context) ([]models.RoomStruct, error) {
+	query := "SELECT id, name, coalesce(owner_id, '') FROM public.chat ORDER BY id"
+
+	rows, err := s.conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats = make([]models.RoomStruct, 0)
+	for rows.Next() {
+		var chat models.RoomStruct
+		if err = rows.Scan(&chat.RoomId, &chat.RoomName, &chat.OwnerId); err != nil {
+			return nil, err
+		}
+
+		chats = append(chats, chat)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return chats, nil
+}
+
+// Изменение названия чата
+func (s *storage) RenameChat(ctx context.Context, chatId int, name string) (bool, error) {
+	query := "UPDATE public.chat SET name=$2 WHERE id=$1"
+
+	tag, err := s.conn.Exec(ctx, query, chatId, name)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// Удаление чата, сообщения и счетчик номеров удаляются каскадно
+func (s *storage) DeleteChat(ctx context.Context, chatId int) (bool, error) {
+	query := "DELETE FROM public.chat WHERE id=$1"
+
+	tag, err := s.conn.Exec(ctx, query, chatId)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// Сохранение сообщения с присвоением порядкового номера в чате
+// Номер выдается строкой chat_sequence, которая блокируется до конца запроса,
+// поэтому номера в одном чате идут строго по возрастанию без повторов
+// Строка чата блокируется от удаления, если чата нет - ничего не сохраняется
+// Ответ в треде увеличивает reply_count корневого сообщения в том же запросе
+// Прикрепляются только неотправленные вложения автора из того же чата
+func (s *storage) CreateMessage(ctx context.Context, msg *models.SendMessage) (bool, error) {
+	query := `WITH chat AS (
+		SELECT id FROM public.chat WHERE id = $1 FOR KEY SHARE
+	), next AS (
+		INSERT INTO public.chat_sequence (chat_id, last_seq) SELECT id, 1 FROM chat
+		ON CONFLICT (chat_id) DO UPDATE SET last_seq = chat_sequence.last_seq + 1
+		RETURNING last_seq
+	), created AS (
+		INSERT INTO public.chat_message (chat_id, seq, parent_seq, author, author_id, body, body_html, search_vector)
+		SELECT $1, last_seq, nullif($5::bigint, 0), $2, nullif($3, ''), $4, $8, to_tsvector($6::regconfig, $4) FROM next
+		RETURNING id, seq, version, created_at
+	), parent AS (
+		UPDATE public.chat_message SET reply_count = reply_count + 1
+		WHERE chat_id = $1 AND seq = $5 AND EXISTS (SELECT 1 FROM created)
+		RETURNING reply_count
+	), attached AS (
+		UPDATE public.chat_attachment SET message_id = created.id FROM created
+		WHERE chat_attachment.id = ANY($7) AND chat_attachment.chat_id = $1
+			AND chat_attachment.uploader_id = $3 AND chat_attachment.message_id IS NULL
+		RETURNING chat_attachment.id
+	)
+	SELECT id, seq, version, created_at, coalesce((SELECT reply_count FROM parent), 0),
+		array(SELECT attached.id FROM attached) FROM created`
+
+	ids := make([]string, 0, len(msg.Attachments))
+	for _, attachment := range msg.Attachments {
+		ids = append(ids, attachment.Id)
+	}
+
+	var attachedIds []string
+	err := s.conn.QueryRow(ctx, query, msg.ChatId, msg.Author, msg.AuthorId, msg.Msg, msg.ParentSeq, s.searchLanguage, ids, msg.Html).
+		Scan(&msg.Id, &msg.Seq, &msg.Version, &msg.CreatedAt, &msg.ReplyCount, &attachedIds)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	attached := make(map[string]bool, len(attachedIds))
+	for _, id := range attachedIds {
+		attached[id] = true
+	}
+	var attachments []models.Attachment
+	for _, attachment := range msg.Attachments {
+		if attached[attachment.Id] {
+			attachment.MessageId = msg.Id
+			attachments = append(attachments, attachment)
+		}
+	}
+	msg.Attachments = attachments
+
+	return true, nil
+}
+
+// Сообщения чата вне тредов с номерами больше afterSeq по возрастанию номера
+func (s *storage) GetMessages(ctx context.Context, chatId int, afterSeq int64, limit int) ([]models.Message, error) {
+	query := "SELECT " + messageColumns + ` FROM public.chat_message
+	WHERE chat_id=$1 AND parent_seq IS NULL AND seq>$2 ORDER BY seq LIMIT $3`
+
+	return s.queryMessages(ctx, query, chatId, afterSeq, limit)
+}
+
+// Ответы в треде с номерами больше afterSeq по возрастанию номера
+func (s *storage) GetReplies(ctx context.Context, chatId int, parentSeq int64, afterSeq int64, limit int) ([]models.Message, error) {
+	query := "SELECT " + messageColumns + ` FROM public.chat_message
+	WHERE chat_id=$1 AND parent_seq=$2 AND seq>$3 ORDER BY seq LIMIT $4`
+
+	return s.queryMessages(ctx, query, chatId, parentSeq, afterSeq, limit)
+}
+
+// Запрос списка сообщений
+func (s *storage) queryMessages(ctx context.Context, query string, args ...any) ([]models.Message, error) {
+	rows, err := s.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages = make([]models.Message, 0)
+	for rows.Next() {
+		var msg models.Message
+		if err = scanMessage(rows, &msg); err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = s.attachReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	if err = s.attachFiles(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	if err = s.attachPreviews(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Реакции сообщений в порядке первой постановки
+func (s *storage) attachReactions(ctx context.Context, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(messages))
+	byId := make(map[int64]*models.Message, len(messages))
+	for i := range messages {
+		ids = append(ids, messages[i].Id)
+		byId[messages[i].Id] = &messages[i]
+	}
+
+	query := `SELECT message_id, reaction, count(*), array_agg(user_id ORDER BY created_at)
+	FROM public.chat_message_reaction WHERE message_id = ANY($1)
+	GROUP BY message_id, reaction ORDER BY message_id, min(created_at)`
+
+	rows, err := s.conn.Query(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageId int64
+		var reaction models.Reaction
+		if err = rows.Scan(&messageId, &reaction.Reaction, &reaction.Count, &reaction.UserIds); err != nil {
+			return err
+		}
+
+		msg := byId[messageId]
+		msg.Reactions = append(msg.Reactions, reaction)
+	}
+
+	return rows.Err()
+}
+
+// Вложения неудаленных сообщений в порядке загрузки
+func (s *storage) attachFiles(ctx context.Context, messages []models.Message) error {
+	ids := make([]int64, 0, len(messages))
+	byId := make(map[int64]*models.Message, len(messages))
+	for i := range messages {
+		if messages[i].DeletedAt == nil {
+			ids = append(ids, messages[i].Id)
+			byId[messages[i].Id] = &messages[i]
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := "SELECT " + attachmentColumns + ` FROM public.chat_attachment
+	WHERE message_id = ANY($1) ORDER BY message_id, created_at, id`
+
+	attachments, err := s.queryAttachments(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		msg := byId[attachment.MessageId]
+		msg.Attachments = append(msg.Attachments, attachment)
+	}
+
+	return nil
+}
+
+// Превью ссылок неудаленных сообщений в порядке ссылок в тексте
+// Ссылки, которые не удалось развернуть, пропускаются
+func (s *storage) attachPreviews(ctx context.Context, messages []models.Message) error {
+	ids := make([]int64, 0, len(messages))
+	byId := make(map[int64]*models.Message, len(messages))
+	for i := range messages {
+		if messages[i].DeletedAt == nil {
+			ids = append(ids, messages[i].Id)
+			byId[messages[i].Id] = &messages[i]
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := `SELECT chat_message_preview.message_id, link_preview.url, title, description, image, site_name
+	FROM public.chat_message_preview JOIN public.link_preview ON link_preview.url = chat_message_preview.url
+	WHERE chat_message_preview.message_id = ANY($1) AND NOT link_preview.failed
+	ORDER BY chat_message_preview.message_id, chat_message_preview.position`
+
+	rows, err := s.conn.Query(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageId int64
+		var preview models.LinkPreview
+		if err = rows.Scan(&messageId, &preview.URL, &preview.Title, &preview.Description, &preview.Image, &preview.SiteName); err != nil {
+			return err
+		}
+
+		msg := byId[messageId]
+		msg.Previews = append(msg.Previews, preview)
+	}
+
+	return rows.Err()
+}
+
+// Добавление реакции
+// Повторная реакция не добавляется благодаря первичному ключу (message_id, user_id, reaction)
+// Запрос не видит добавленную им строку, поэтому она прибавляется к числу реакций отдельно
+func (s *storage) AddReaction(ctx context.Context, messageId int64, userId string, reaction string) (int, bool, error) {
+	query := `WITH added AS (
+		INSERT INTO public.chat_message_reaction (message_id, user_id, reaction) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		RETURNING 1
+	)
+	SELECT (SELECT count(*) FROM added),
+		(SELECT count(*) FROM public.chat_message_reaction WHERE message_id = $1 AND reaction = $3)`
+
+	var added, count int
+	if err := s.conn.QueryRow(ctx, query, messageId, userId, reaction).Scan(&added, &count); err != nil {
+		return 0, false, err
+	}
+
+	return count + added, added > 0, nil
+}
+
+// Удаление реакции
+func (s *storage) RemoveReaction(ctx context.Context, messageId int64, userId string, reaction string) (int, bool, error) {
+	query := `WITH removed AS (
+		DELETE FROM public.chat_message_reaction WHERE message_id = $1 AND user_id = $2 AND reaction = $3
+		RETURNING 1
+	)
+	SELECT (SELECT count(*) FROM removed),
+		(SELECT count(*) FROM public.chat_message_reaction WHERE message_id = $1 AND reaction = $3)`
+
+	var removed, count int
+	if err := s.conn.QueryRow(ctx, query, messageId, userId, reaction).Scan(&removed, &count); err != nil {
+		return 0, false, err
+	}
+
+	return count - removed, removed > 0, nil
+}
+
+// Отметка прочитанного
+// Отметка только сдвигается вперед, запрос с меньшим номером ничего не меняет
+func (s *storage) MarkRead(ctx context.Context, chatId int, userId string, seq int64) (bool, error) {
+	query := `INSERT INTO public.chat_read_marker (chat_id, user_id, last_read_seq) VALUES ($1, $2, $3)
+		ON CONFLICT (chat_id, user_id) DO UPDATE SET last_read_seq = excluded.last_read_seq, updated_at = now()
+		WHERE chat_read_marker.last_read_seq < excluded.last_read_seq`
+
+	tag, err := s.conn.Exec(ctx, query, chatId, userId, seq)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// Непрочитанные сообщения, включая ответы в тредах
+// Свои и удаленные сообщения не считаются, в чате без отметки непрочитаны все сообщения
+func (s *storage) GetUnreadCounts(ctx context.Context, userId string) (map[int]int, error) {
+	query := `SELECT m.chat_id, count(*)
+		FROM public.chat_message m
+		LEFT JOIN public.chat_read_marker r ON r.chat_id = m.chat_id AND r.user_id = $1
+		WHERE m.seq > coalesce(r.last_read_seq, 0)
+			AND coalesce(m.author_id, '') <> $1
+			AND m.deleted_at IS NULL
+		GROUP BY m.chat_id`
+
+	rows, err := s.conn.Query(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var chatId, count int
+		if err = rows.Scan(&chatId, &count); err != nil {
+			return nil, err
+		}
+		counts[chatId] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// Поиск сообщений
+// Запрос разбирается websearch_to_tsquery: слова, "фразы", or и -исключения
+// Фрагменты текста с найденными словами экранируются, найденные слова выделяются <mark>
+func (s *storage) SearchMessages(ctx context.Context, query models.SearchQuery) ([]models.SearchResult, error) {
+	sql := `SELECT m.chat_id, c.name, m.seq, coalesce(m.parent_seq, 0), m.author, coalesce(m.author_id, ''), m.created_at,
+		ts_headline($1::regconfig, translate(m.body, $9, ''), q, $10)
+	FROM public.chat_message m
+	JOIN public.chat c ON c.id = m.chat_id
+	CROSS JOIN websearch_to_tsquery($1::regconfig, $2) q
+	WHERE m.search_vector @@ q
+		AND ($3::integer = 0 OR m.chat_id = $3)
+		AND ($4::text = '' OR m.author_id = $4 OR lower(m.author) = lower($4))
+		AND ($5::timestamptz IS NULL OR m.created_at >= $5)
+		AND ($6::timestamptz IS NULL OR m.created_at < $6)
+	ORDER BY ts_rank(m.search_vector, q) DESC, m.id DESC
+	LIMIT $7 OFFSET $8`
+
+	options := fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxFragments=2, MaxWords=20, MinWords=5, FragmentDelimiter=" … "`,
+		highlightStart, highlightStop)
+
+	rows, err := s.conn.Query(ctx, sql, s.searchLanguage, query.Query, query.ChatId, query.Author, query.From, query.To,
+		query.Limit, query.Offset, highlightStart+highlightStop, options)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]models.SearchResult, 0)
+	for rows.Next() {
+		var r models.SearchResult
+		if err = rows.Scan(&r.ChatId, &r.ChatName, &r.Seq, &r.ParentSeq, &r.Author, &r.AuthorId, &r.CreatedAt, &r.Snippet); err != nil {
+			return nil, err
+		}
+		r.Snippet = highlight(r.Snippet)
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
+
+// Экранирование фрагмента и замена границ подсветки на <mark>
+func highlight(snippet string) string {
+	return strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>").Replace(html.EscapeString(snippet))
+}
+
+// Проверка, что в базе есть конфигурация полнотекстового поиска language
+func CheckSearchLanguage(ctx context.Context, conn *pgxpool.Pool, language string) error {
+	var name string
+	if err := conn.QueryRow(ctx, "SELECT $1::regconfig::text", language).Scan(&name); err != nil {
+		return fmt.Errorf("unknown text search configuration %q: %w", language, err)
+	}
+
+	return nil
+}
+
+// Переиндексация сообщений, если их поисковые векторы построены не с конфигурацией language
+// Строка настроек блокируется до конца транзакции, поэтому одновременно запущенные экземпляры переиндексируют базу один раз
+// Возвращает true, если сообщения переиндексированы
+func SyncSearchLanguage(ctx context.Context, conn *pgxpool.Pool, language string) (bool, error) {
+	var reindexed bool
+	err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var same bool
+		query := "SELECT language = $1::regconfig::text FROM public.search_setting FOR UPDATE"
+		if err := tx.QueryRow(ctx, query, language).Scan(&same); err != nil {
+			return err
+		}
+		if same {
+			return nil
+		}
+
+		query = `UPDATE public.chat_message SET search_vector = to_tsvector($1::regconfig, body)
+		WHERE deleted_at IS NULL`
+		if _, err := tx.Exec(ctx, query, language); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE public.search_setting SET language = $1::regconfig::text", language); err != nil {
+			return err
+		}
+
+		reindexed = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to reindex messages: %w", err)
+	}
+
+	return reindexed, nil
+}
+
+// Сообщение чата по номеру
+func (s *storage) GetMessage(ctx context.Context, chatId int, seq int64) (models.Message, bool, error) {
+	query := "SELECT " + messageColumns + " FROM public.chat_message WHERE chat_id=$1 AND seq=$2"
+
+	return s.queryMessage(ctx, query, chatId, seq)
+}
+
+// Изменение текста сообщения
+// Прежний текст сохраняется в chat_message_revision, версия сообщения увеличивается
+func (s *storage) EditMessage(ctx context.Context, chatId int, seq int64, editorId string, body string, bodyHTML string) (models.Message, bool, error) {
+	query := `WITH old AS (
+		SELECT id AS old_id, version AS old_version, body AS old_body FROM public.chat_message
+		WHERE chat_id = $1 AND seq = $2 AND deleted_at IS NULL FOR UPDATE
+	), revision AS (
+		INSERT INTO public.chat_message_revision (message_id, version, body, replaced_by)
+		SELECT old_id, old_version, old_body, $3 FROM old
+	)
+	UPDATE public.chat_message
+	SET body = $4, body_html = $6, search_vector = to_tsvector($5::regconfig, $4), version = old_version + 1, edited_at = now()
+	FROM old WHERE id = old_id
+	RETURNING ` + messageColumns
+
+	return s.queryMessage(ctx, query, chatId, seq, editorId, body, s.searchLanguage, bodyHTML)
+}
+
+// Удаление сообщения: строка остается без текста с отметкой deleted_at
+// Прежний текст сохраняется в chat_message_revision
+func (s *storage) DeleteMessage(ctx context.Context, chatId int, seq int64, editorId string) (models.Message, bool, error) {
+	query := `WITH old AS (
+		SELECT id AS old_id, version AS old_version, body AS old_body FROM public.chat_message
+		WHERE chat_id = $1 AND seq = $2 AND deleted_at IS NULL FOR UPDATE
+	), revision AS (
+		INSERT INTO public.chat_message_revision (message_id, version, body, replaced_by)
+		SELECT old_id, old_version, old_body, $3 FROM old
+	)
+	UPDATE public.chat_message SET body = '', body_html = '', search_vector = NULL, version = old_version + 1, deleted_at = now()
+	FROM old WHERE id = old_id
+	RETURNING ` + messageColumns
+
+	return s.queryMessage(ctx, query, chatId, seq, editorId)
+}
+
+// Запрос одного сообщения, false если строки нет
+func (s *storage) queryMessage(ctx context.Context, query string, args ...any) (models.Message, bool, error) {
+	var msg models.Message
+	err := scanMessage(s.conn.QueryRow(ctx, query, args...), &msg)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return msg, false, nil
+	}
+	if err != nil {
+		return msg, false, err
+	}
+
+	return msg, true, nil
+}
+
+// Сохранение вложения, если чат существует
+func (s *storage) CreateAttachment(ctx context.Context, attachment *models.Attachment) (bool, error) {
+	query := `INSERT INTO public.chat_attachment (id, chat_id, uploader_id, name, size, mime_type, checksum, has_thumbnail)
+	SELECT $1, id, $3, $4, $5, $6, $7, $8 FROM public.chat WHERE id = $2
+	RETURNING created_at`
+
+	err := s.conn.QueryRow(ctx, query, attachment.Id, attachment.ChatId, attachment.UploaderId, attachment.Name,
+		attachment.Size, attachment.MimeType, attachment.Checksum, attachment.HasThumbnail).Scan(&attachment.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Вложение по ID
+// Вложения удаленных сообщений не возвращаются
+func (s *storage) GetAttachment(ctx context.Context, id string) (models.Attachment, bool, error) {
+	query := "SELECT " + attachmentColumns + ` FROM public.chat_attachment
+	WHERE id = $1 AND NOT EXISTS (
+		SELECT 1 FROM public.chat_message
+		WHERE chat_message.id = chat_attachment.message_id AND chat_message.deleted_at IS NOT NULL
+	)`
+
+	var attachment models.Attachment
+	err := scanAttachment(s.conn.QueryRow(ctx, query, id), &attachment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return attachment, false, nil
+	}
+	if err != nil {
+		return attachment, false, err
+	}
+
+	return attachment, true, nil
+}
+
+// Вложения по ID в порядке загрузки
+func (s *storage) GetAttachments(ctx context.Context, ids []string) ([]models.Attachment, error) {
+	query := "SELECT " + attachmentColumns + " FROM public.chat_attachment WHERE id = ANY($1) ORDER BY created_at, id"
+
+	return s.queryAttachments(ctx, query, ids)
+}
+
+// Удаление неотправленных вложений, загруженных раньше before
+// Строки, которые сейчас прикрепляются к сообщению, пропускаются, а прикрепление после удаления не найдет вложение
+func (s *storage) DeleteUnsentAttachments(ctx context.Context, before time.Time, limit int) ([]models.Attachment, error) {
+	query := `DELETE FROM public.chat_attachment WHERE id IN (
+		SELECT id FROM public.chat_attachment
+		WHERE message_id IS NULL AND created_at < $1
+		ORDER BY created_at LIMIT $2 FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ` + attachmentColumns
+
+	return s.queryAttachments(ctx, query, before, limit)
+}
+
+// Запрос списка вложений
+func (s *storage) queryAttachments(ctx context.Context, query string, args ...any) ([]models.Attachment, error) {
+	rows, err := s.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments = make([]models.Attachment, 0)
+	for rows.Next() {
+		var attachment models.Attachment
+		if err = scanAttachment(rows, &attachment); err != nil {
+			return nil, err
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+// Превью ссылки из кеша
+func (s *storage) GetLinkPreview(ctx context.Context, url string) (models.LinkPreview, bool, error) {
+	query := `SELECT url, title, description, image, site_name, failed, fetched_at
+	FROM public.link_preview WHERE url = $1`
+
+	var preview models.LinkPreview
+	err := s.conn.QueryRow(ctx, query, url).Scan(&preview.URL, &preview.Title, &preview.Description,
+		&preview.Image, &preview.SiteName, &preview.Failed, &preview.FetchedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return preview, false, nil
+	}
+	if err != nil {
+		return preview, false, err
+	}
+
+	return preview, true, nil
+}
+
+// Сохранение превью ссылки, время загрузки выставляет БД
+func (s *storage) SaveLinkPreview(ctx context.Context, preview *models.LinkPreview) error {
+	query := `INSERT INTO public.link_preview (url, title, description, image, site_name, failed)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (url) DO UPDATE SET title = EXCLUDED.title, description = EXCLUDED.description,
+		image = EXCLUDED.image, site_name = EXCLUDED.site_name, failed = EXCLUDED.failed, fetched_at = now()
+	RETURNING fetched_at`
+
+	return s.conn.QueryRow(ctx, query, preview.URL, preview.Title, preview.Description, preview.Image,
+		preview.SiteName, preview.Failed).Scan(&preview.FetchedAt)
+}
+
+// Замена ссылок с превью сообщения
+// Строка сообщения блокируется до конца транзакции, поэтому изменение текста
+// не проскочит между проверкой версии и записью ссылок
+func (s *storage) SetMessagePreviews(ctx context.Context, messageId int64, version int, urls []string) (bool, error) {
+	var ok bool
+	err := pgx.BeginFunc(ctx, s.conn, func(tx pgx.Tx) error {
+		query := `SELECT 1 FROM public.chat_message
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL FOR UPDATE`
+
+		var found int
+		err := tx.QueryRow(ctx, query, messageId, version).Scan(&found)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM public.chat_message_preview WHERE message_id = $1", messageId); err != nil {
+			return err
+		}
+
+		query = `INSERT INTO public.chat_message_preview (message_id, position, url)
+		SELECT $1, position, url FROM unnest($2::text[]) WITH ORDINALITY AS link(url, position)`
+		if _, err = tx.Exec(ctx, query, messageId, urls); err != nil {
+			return err
+		}
+
+		ok = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// Чтение колонок attachmentColumns
+func scanAttachment(row pgx.Row, attachment *models.Attachment) error {
+	return row.Scan(&attachment.Id, &attachment.ChatId, &attachment.MessageId, &attachment.UploaderId, &attachment.Name,
+		&attachment.Size, &attachment.MimeType, &attachment.Checksum, &attachment.HasThumbnail, &attachment.CreatedAt)
+}
+
+// Чтение колонок messageColumns
+func scanMessage(row pgx.Row, msg *models.Message) error {
+	return row.Scan(&msg.Id, &msg.ChatId, &msg.Seq, &msg.ParentSeq, &msg.ReplyCount, &msg.Msg, &msg.Html, &msg.Author,
+		&msg.AuthorId, &msg.Version, &msg.CreatedAt, &msg.EditedAt, &msg.DeletedAt)
+}
+
+// searchLanguage - конфигурация полнотекстового поиска PostgreSQL, например russian или english
+func New(conn *pgxpool.Pool, searchLanguage string) Storage {
 	return &storage{
-		conn: conn,
+		conn:           conn,
+		searchLanguage: searchLanguage,
 	}
 }
@@ -0,0 +1,697 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+)
+
+// Интеграционные тесты выполняются, если задан TEST_DATABASE_URL
+// Все таблицы базы очищаются, поэтому нужна отдельная тестовая база
+func newTestStorage(t *testing.T) Storage {
+	t.Helper()
+
+	return New(newTestPool(t), "russian")
+}
+
+// Подключение к тестовой базе с примененными миграциями и пустыми таблицами
+func newTestPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := goose.OpenDBWithDriver("pgx", dsn)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err = goose.Up(db, "../migrations"); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+
+	query := "TRUNCATE public.chat, public.chat_sequence, public.chat_message, public.service_user, public.link_preview RESTART IDENTITY CASCADE"
+	if _, err = pool.Exec(context.Background(), query); err != nil {
+		t.Fatalf("failed to truncate tables: %v", err)
+	}
+
+	return pool
+}
+
+func TestUsers(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	if err := s.CreateUser(ctx, "Alice", "alice@example.com"); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	ok, err := s.CheckUser(ctx, "alice@example.com")
+	if err != nil || !ok {
+		t.Errorf("CheckUser(alice) = %v, %v, want true", ok, err)
+	}
+	ok, err = s.CheckUser(ctx, "bob@example.com")
+	if err != nil || ok {
+		t.Errorf("CheckUser(bob) = %v, %v, want false", ok, err)
+	}
+
+	users, err := s.GetUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetUsers() error = %v", err)
+	}
+	if len(users) != 1 || users[0].Name != "Alice" {
+		t.Errorf("GetUsers() = %+v", users)
+	}
+}
+
+func TestChats(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	general, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+	other, err := s.CreateChat(ctx, "other", "")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+
+	if ok, err := s.RenameChat(ctx, general.RoomId, "renamed"); err != nil || !ok {
+		t.Fatalf("RenameChat() = %v, %v", ok, err)
+	}
+	chat, ok, err := s.GetChat(ctx, general.RoomId)
+	if err != nil || !ok || chat.RoomName != "renamed" {
+		t.Errorf("GetChat() = %+v, %v, %v", chat, ok, err)
+	}
+
+	chats, err := s.GetChats(ctx)
+	if err != nil {
+		t.Fatalf("GetChats() error = %v", err)
+	}
+	if len(chats) != 2 || chats[0].RoomId != general.RoomId || chats[1].RoomId != other.RoomId {
+		t.Errorf("GetChats() = %+v", chats)
+	}
+
+	if ok, err = s.DeleteChat(ctx, general.RoomId); err != nil || !ok {
+		t.Fatalf("DeleteChat() = %v, %v", ok, err)
+	}
+	if _, ok, err = s.GetChat(ctx, general.RoomId); err != nil || ok {
+		t.Errorf("GetChat() after delete = %v, %v, want false", ok, err)
+	}
+
+	// Операции с отсутствующим чатом
+	if ok, err = s.RenameChat(ctx, general.RoomId, "x"); err != nil || ok {
+		t.Errorf("RenameChat() of deleted chat = %v, %v, want false", ok, err)
+	}
+	if ok, err = s.DeleteChat(ctx, general.RoomId); err != nil || ok {
+		t.Errorf("DeleteChat() of deleted chat = %v, %v, want false", ok, err)
+	}
+	if ok, err = s.CreateMessage(ctx, &models.SendMessage{ChatId: general.RoomId, Msg: "hi", Author: "Alice"}); err != nil || ok {
+		t.Errorf("CreateMessage() in deleted chat = %v, %v, want false", ok, err)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	chat, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+
+	// Номера в чате выдаются без пропусков и повторов при конкурентной записи
+	const writers, perWriter = 8, 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				msg := &models.SendMessage{ChatId: chat.RoomId, Msg: "hi", Author: "Alice"}
+				if ok, err := s.CreateMessage(ctx, msg); err != nil || !ok {
+					t.Errorf("CreateMessage() = %v, %v", ok, err)
+					return
+				}
+				if msg.Id == 0 || msg.Seq == 0 || msg.CreatedAt.IsZero() {
+					t.Errorf("CreateMessage() did not fill %+v", msg)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	messages, err := s.GetMessages(ctx, chat.RoomId, 0, 1000)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(messages) != writers*perWriter {
+		t.Fatalf("GetMessages() returned %d messages, want %d", len(messages), writers*perWriter)
+	}
+	for i, msg := range messages {
+		if msg.Seq != int64(i+1) {
+			t.Fatalf("message %d has seq %d", i, msg.Seq)
+		}
+	}
+
+	page, err := s.GetMessages(ctx, chat.RoomId, 10, 5)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(page) != 5 || page[0].Seq != 11 || page[4].Seq != 15 {
+		t.Errorf("GetMessages(after 10, limit 5) = %+v", page)
+	}
+
+	// Сообщения удаляются вместе с чатом
+	if _, err = s.DeleteChat(ctx, chat.RoomId); err != nil {
+		t.Fatalf("DeleteChat() error = %v", err)
+	}
+	if messages, err = s.GetMessages(ctx, chat.RoomId, 0, 1000); err != nil || len(messages) != 0 {
+		t.Errorf("GetMessages() after delete = %d messages, %v", len(messages), err)
+	}
+}
+
+func TestMessageEdits(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	chat, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+	if chat.OwnerId != "owner" {
+		t.Errorf("CreateChat() owner = %q", chat.OwnerId)
+	}
+
+	msg := &models.SendMessage{ChatId: chat.RoomId, Msg: "*helo*", Html: "<em>helo</em>", Author: "Alice", AuthorId: "1"}
+	if ok, err := s.CreateMessage(ctx, msg); err != nil || !ok {
+		t.Fatalf("CreateMessage() = %v, %v", ok, err)
+	}
+	if got, _, err := s.GetMessage(ctx, chat.RoomId, msg.Seq); err != nil || got.Html != "<em>helo</em>" {
+		t.Errorf("GetMessage() = %+v, %v", got, err)
+	}
+
+	edited, ok, err := s.EditMessage(ctx, chat.RoomId, msg.Seq, "1", "*hello*", "<em>hello</em>")
+	if err != nil || !ok {
+		t.Fatalf("EditMessage() = %v, %v", ok, err)
+	}
+	if edited.Msg != "*hello*" || edited.Html != "<em>hello</em>" || edited.Version != 2 || edited.EditedAt == nil || edited.AuthorId != "1" {
+		t.Errorf("EditMessage() = %+v", edited)
+	}
+
+	deleted, ok, err := s.DeleteMessage(ctx, chat.RoomId, msg.Seq, "owner")
+	if err != nil || !ok {
+		t.Fatalf("DeleteMessage() = %v, %v", ok, err)
+	}
+	if deleted.Msg != "" || deleted.Html != "" || deleted.Version != 3 || deleted.DeletedAt == nil {
+		t.Errorf("DeleteMessage() = %+v", deleted)
+	}
+
+	// Удаленное сообщение больше не изменяется
+	if _, ok, err = s.EditMessage(ctx, chat.RoomId, msg.Seq, "1", "again", "again"); err != nil || ok {
+		t.Errorf("EditMessage() of deleted message = %v, %v, want false", ok, err)
+	}
+	if _, ok, err = s.DeleteMessage(ctx, chat.RoomId, msg.Seq, "1"); err != nil || ok {
+		t.Errorf("DeleteMessage() of deleted message = %v, %v, want false", ok, err)
+	}
+
+	got, ok, err := s.GetMessage(ctx, chat.RoomId, msg.Seq)
+	if err != nil || !ok || got.DeletedAt == nil || got.Version != 3 {
+		t.Errorf("GetMessage() = %+v, %v, %v", got, ok, err)
+	}
+
+	var revisions []string
+	rows, err := s.(*storage).conn.Query(ctx, "SELECT body FROM public.chat_message_revision WHERE message_id=$1 ORDER BY version", msg.Id)
+	if err != nil {
+		t.Fatalf("failed to query revisions: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var body string
+		if err = rows.Scan(&body); err != nil {
+			t.Fatal(err)
+		}
+		revisions = append(revisions, body)
+	}
+	if len(revisions) != 2 || revisions[0] != "*helo*" || revisions[1] != "*hello*" {
+		t.Errorf("revisions = %q", revisions)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	chat, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+
+	root := &models.SendMessage{ChatId: chat.RoomId, Msg: "question", Author: "Alice"}
+	if ok, err := s.CreateMessage(ctx, root); err != nil || !ok {
+		t.Fatalf("CreateMessage() = %v, %v", ok, err)
+	}
+	for i := 1; i <= 3; i++ {
+		reply := &models.SendMessage{ChatId: chat.RoomId, ParentSeq: root.Seq, Msg: "answer", Author: "Bob"}
+		if ok, err := s.CreateMessage(ctx, reply); err != nil || !ok {
+			t.Fatalf("CreateMessage() of reply = %v, %v", ok, err)
+		}
+		if reply.ReplyCount != i {
+			t.Errorf("reply %d has reply count %d", i, reply.ReplyCount)
+		}
+	}
+
+	// Ответ на отсутствующее сообщение нарушает внешний ключ
+	if _, err = s.CreateMessage(ctx, &models.SendMessage{ChatId: chat.RoomId, ParentSeq: 100, Msg: "x", Author: "Bob"}); err == nil {
+		t.Error("CreateMessage() with missing parent succeeded")
+	}
+
+	messages, err := s.GetMessages(ctx, chat.RoomId, 0, 100)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(messages) != 1 || messages[0].ReplyCount != 3 {
+		t.Errorf("GetMessages() = %+v", messages)
+	}
+
+	replies, err := s.GetReplies(ctx, chat.RoomId, root.Seq, 2, 1)
+	if err != nil {
+		t.Fatalf("GetReplies() error = %v", err)
+	}
+	if len(replies) != 1 || replies[0].Seq != 3 || replies[0].ParentSeq != root.Seq {
+		t.Errorf("GetReplies(after 2, limit 1) = %+v", replies)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	chat, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+	msg := &models.SendMessage{ChatId: chat.RoomId, Msg: "hello", Author: "Alice"}
+	if ok, err := s.CreateMessage(ctx, msg); err != nil || !ok {
+		t.Fatalf("CreateMessage() = %v, %v", ok, err)
+	}
+
+	steps := []struct {
+		add       bool
+		userId    string
+		reaction  string
+		wantCount int
+		wantOk    bool
+	}{
+		{true, "1", "👍", 1, true},
+		{true, "2", "👍", 2, true},
+		{true, "2", "👍", 2, false},
+		{true, "2", ":tada:", 1, true},
+		{false, "1", "👍", 1, true},
+		{false, "1", "👍", 1, false},
+	}
+	for i, step := range steps {
+		change := s.RemoveReaction
+		if step.add {
+			change = s.AddReaction
+		}
+		count, ok, err := change(ctx, msg.Id, step.userId, step.reaction)
+		if err != nil || count != step.wantCount || ok != step.wantOk {
+			t.Errorf("step %d = %d, %v, %v; want %d, %v", i, count, ok, err, step.wantCount, step.wantOk)
+		}
+	}
+
+	messages, err := s.GetMessages(ctx, chat.RoomId, 0, 100)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	want := []models.Reaction{
+		{Reaction: "👍", Count: 1, UserIds: []string{"2"}},
+		{Reaction: ":tada:", Count: 1, UserIds: []string{"2"}},
+	}
+	if len(messages) != 1 || !reflect.DeepEqual(messages[0].Reactions, want) {
+		t.Errorf("GetMessages() = %+v", messages)
+	}
+}
+
+func TestReadMarkers(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	general, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+	random, err := s.CreateChat(ctx, "random", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+
+	// В general три сообщения Bob и одно Alice, в random одно сообщение Alice
+	for _, msg := range []*models.SendMessage{
+		{ChatId: general.RoomId, Msg: "1", Author: "Bob", AuthorId: "2"},
+		{ChatId: general.RoomId, Msg: "2", Author: "Bob", AuthorId: "2"},
+		{ChatId: general.RoomId, Msg: "3", Author: "Alice", AuthorId: "1"},
+		{ChatId: general.RoomId, Msg: "4", Author: "Bob", AuthorId: "2"},
+		{ChatId: random.RoomId, Msg: "5", Author: "Alice", AuthorId: "1"},
+	} {
+		if ok, err := s.CreateMessage(ctx, msg); err != nil || !ok {
+			t.Fatalf("CreateMessage() = %v, %v", ok, err)
+		}
+	}
+
+	counts, err := s.GetUnreadCounts(ctx, "1")
+	if err != nil {
+		t.Fatalf("GetUnreadCounts() error = %v", err)
+	}
+	if !reflect.DeepEqual(counts, map[int]int{general.RoomId: 3}) {
+		t.Errorf("GetUnreadCounts() before read = %v", counts)
+	}
+
+	steps := []struct {
+		seq    int64
+		wantOk bool
+	}{
+		{2, true},
+		{1, false},
+		{2, false},
+	}
+	for _, step := range steps {
+		if ok, err := s.MarkRead(ctx, general.RoomId, "1", step.seq); err != nil || ok != step.wantOk {
+			t.Errorf("MarkRead(%d) = %v, %v; want %v", step.seq, ok, err, step.wantOk)
+		}
+	}
+
+	if counts, err = s.GetUnreadCounts(ctx, "1"); err != nil || !reflect.DeepEqual(counts, map[int]int{general.RoomId: 1}) {
+		t.Errorf("GetUnreadCounts() after read = %v, %v", counts, err)
+	}
+	if counts, err = s.GetUnreadCounts(ctx, "2"); err != nil || !reflect.DeepEqual(counts, map[int]int{general.RoomId: 1, random.RoomId: 1}) {
+		t.Errorf("GetUnreadCounts() of other user = %v, %v", counts, err)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	general, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+	random, err := s.CreateChat(ctx, "random", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+
+	newAttachment := func(id string, chatId int, uploaderId string) models.Attachment {
+		attachment := models.Attachment{
+			Id:         id,
+			ChatId:     chatId,
+			UploaderId: uploaderId,
+			Name:       id + ".png",
+			Size:       10,
+			MimeType:   "image/png",
+			Checksum:   strings.Repeat("a", 64),
+		}
+		if ok, err := s.CreateAttachment(ctx, &attachment); err != nil || !ok {
+			t.Fatalf("CreateAttachment(%s) = %v, %v", id, ok, err)
+		}
+		return attachment
+	}
+	newAttachment("own", general.RoomId, "1")
+	newAttachment("foreign", general.RoomId, "2")
+	newAttachment("other-chat", random.RoomId, "1")
+
+	if ok, err := s.CreateAttachment(ctx, &models.Attachment{Id: "none", ChatId: 999, Checksum: strings.Repeat("a", 64)}); err != nil || ok {
+		t.Errorf("CreateAttachment() in missing chat = %v, %v, want false", ok, err)
+	}
+
+	// Прикрепляется только свое вложение из того же чата
+	msg := &models.SendMessage{
+		ChatId:      general.RoomId,
+		Msg:         "files",
+		Author:      "Alice",
+		AuthorId:    "1",
+		Attachments: []models.Attachment{{Id: "own"}, {Id: "foreign"}, {Id: "other-chat"}, {Id: "missing"}},
+	}
+	if ok, err := s.CreateMessage(ctx, msg); err != nil || !ok {
+		t.Fatalf("CreateMessage() = %v, %v", ok, err)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Id != "own" || msg.Attachments[0].MessageId != msg.Id {
+		t.Errorf("attached = %+v, want own", msg.Attachments)
+	}
+
+	// Отправленное вложение не прикрепляется второй раз
+	again := &models.SendMessage{ChatId: general.RoomId, Msg: "again", Author: "Alice", AuthorId: "1",
+		Attachments: []models.Attachment{{Id: "own"}}}
+	if ok, err := s.CreateMessage(ctx, again); err != nil || !ok || len(again.Attachments) != 0 {
+		t.Errorf("CreateMessage() again = %v, %v, attached %+v", ok, err, again.Attachments)
+	}
+
+	messages, err := s.GetMessages(ctx, general.RoomId, 0, 10)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(messages) != 2 || len(messages[0].Attachments) != 1 || messages[0].Attachments[0].Name != "own.png" ||
+		len(messages[1].Attachments) != 0 {
+		t.Errorf("GetMessages() = %+v", messages)
+	}
+
+	attachments, err := s.GetAttachments(ctx, []string{"own", "foreign", "missing"})
+	if err != nil || len(attachments) != 2 {
+		t.Errorf("GetAttachments() = %+v, %v", attachments, err)
+	}
+
+	// Вложения удаленного сообщения скрываются
+	if _, ok, err := s.GetAttachment(ctx, "own"); err != nil || !ok {
+		t.Errorf("GetAttachment() = %v, %v", ok, err)
+	}
+	if _, ok, err := s.DeleteMessage(ctx, general.RoomId, msg.Seq, "1"); err != nil || !ok {
+		t.Fatalf("DeleteMessage() = %v, %v", ok, err)
+	}
+	if _, ok, err := s.GetAttachment(ctx, "own"); err != nil || ok {
+		t.Errorf("GetAttachment() of deleted message = %v, %v, want false", ok, err)
+	}
+	if messages, err = s.GetMessages(ctx, general.RoomId, 0, 10); err != nil || len(messages[0].Attachments) != 0 {
+		t.Errorf("GetMessages() after delete = %+v, %v", messages, err)
+	}
+
+	// Удаляются только старые неотправленные вложения
+	if deleted, err := s.DeleteUnsentAttachments(ctx, time.Now().Add(-time.Hour), 10); err != nil || len(deleted) != 0 {
+		t.Errorf("DeleteUnsentAttachments() of recent = %+v, %v, want none", deleted, err)
+	}
+	deleted, err := s.DeleteUnsentAttachments(ctx, time.Now().Add(time.Minute), 1)
+	if err != nil || len(deleted) != 1 || deleted[0].MessageId != 0 {
+		t.Errorf("DeleteUnsentAttachments() limit 1 = %+v, %v", deleted, err)
+	}
+	if deleted, err = s.DeleteUnsentAttachments(ctx, time.Now().Add(time.Minute), 10); err != nil || len(deleted) != 1 {
+		t.Errorf("DeleteUnsentAttachments() = %+v, %v, want the second unsent", deleted, err)
+	}
+	if attachments, err = s.GetAttachments(ctx, []string{"own", "foreign", "other-chat"}); err != nil ||
+		len(attachments) != 1 || attachments[0].Id != "own" {
+		t.Errorf("GetAttachments() after cleanup = %+v, %v, want own", attachments, err)
+	}
+}
+
+func TestLinkPreviews(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	if _, ok, err := s.GetLinkPreview(ctx, "https://example.com/"); err != nil || ok {
+		t.Errorf("GetLinkPreview() of missing = %v, %v, want false", ok, err)
+	}
+
+	page := &models.LinkPreview{URL: "https://example.com/", Title: "Example", Description: "Page", Image: "https://example.com/a.png"}
+	broken := &models.LinkPreview{URL: "https://broken.example.com/", Failed: true}
+	for _, preview := range []*models.LinkPreview{page, broken} {
+		if err := s.SaveLinkPreview(ctx, preview); err != nil || preview.FetchedAt.IsZero() {
+			t.Fatalf("SaveLinkPreview(%s) error = %v", preview.URL, err)
+		}
+	}
+	// Повторное сохранение заменяет превью
+	page.Title = "Example Domain"
+	if err := s.SaveLinkPreview(ctx, page); err != nil {
+		t.Fatalf("SaveLinkPreview() again error = %v", err)
+	}
+	got, ok, err := s.GetLinkPreview(ctx, page.URL)
+	if err != nil || !ok || got.Title != "Example Domain" || got.Image != page.Image || got.Failed {
+		t.Errorf("GetLinkPreview() = %+v, %v, %v", got, ok, err)
+	}
+
+	chat, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+	msg := &models.SendMessage{ChatId: chat.RoomId, Msg: page.URL + " " + broken.URL, Author: "Alice", AuthorId: "1"}
+	if ok, err := s.CreateMessage(ctx, msg); err != nil || !ok {
+		t.Fatalf("CreateMessage() = %v, %v", ok, err)
+	}
+
+	// Превью устаревшей версии не сохраняются
+	if ok, err := s.SetMessagePreviews(ctx, msg.Id, msg.Version+1, []string{page.URL}); err != nil || ok {
+		t.Errorf("SetMessagePreviews() of other version = %v, %v, want false", ok, err)
+	}
+	// Неразвернутая ссылка в истории не показывается
+	if ok, err := s.SetMessagePreviews(ctx, msg.Id, msg.Version, []string{broken.URL, page.URL}); err != nil || !ok {
+		t.Fatalf("SetMessagePreviews() = %v, %v", ok, err)
+	}
+	messages, err := s.GetMessages(ctx, chat.RoomId, 0, 10)
+	if err != nil {
+		t.Fatalf("GetMessages() error = %v", err)
+	}
+	if len(messages) != 1 || len(messages[0].Previews) != 1 || messages[0].Previews[0].Title != "Example Domain" {
+		t.Errorf("GetMessages() = %+v", messages)
+	}
+
+	// Замена ссылок, в том числе на пустой список
+	if ok, err := s.SetMessagePreviews(ctx, msg.Id, msg.Version, nil); err != nil || !ok {
+		t.Fatalf("SetMessagePreviews() empty = %v, %v", ok, err)
+	}
+	if messages, err = s.GetMessages(ctx, chat.RoomId, 0, 10); err != nil || len(messages[0].Previews) != 0 {
+		t.Errorf("GetMessages() after reset = %+v, %v", messages, err)
+	}
+
+	if _, ok, err := s.DeleteMessage(ctx, chat.RoomId, msg.Seq, "1"); err != nil || !ok {
+		t.Fatalf("DeleteMessage() = %v, %v", ok, err)
+	}
+	if ok, err := s.SetMessagePreviews(ctx, msg.Id, msg.Version+1, []string{page.URL}); err != nil || ok {
+		t.Errorf("SetMessagePreviews() of deleted = %v, %v, want false", ok, err)
+	}
+}
+
+func TestSyncSearchLanguage(t *testing.T) {
+	pool := newTestPool(t)
+	ctx := context.Background()
+	s := New(pool, "russian")
+
+	chat, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+	if ok, err := s.CreateMessage(ctx, &models.SendMessage{ChatId: chat.RoomId, Msg: "Выпустили релизы", Author: "Alice"}); err != nil || !ok {
+		t.Fatalf("CreateMessage() = %v, %v", ok, err)
+	}
+	t.Cleanup(func() {
+		if _, err := SyncSearchLanguage(ctx, pool, "russian"); err != nil {
+			t.Errorf("SyncSearchLanguage() restore error = %v", err)
+		}
+	})
+
+	for _, tt := range []struct {
+		language string
+		want     bool
+	}{
+		{"russian", false},
+		{"simple", true},
+		{"pg_catalog.simple", false},
+	} {
+		if reindexed, err := SyncSearchLanguage(ctx, pool, tt.language); err != nil || reindexed != tt.want {
+			t.Errorf("SyncSearchLanguage(%s) = %v, %v, want %v", tt.language, reindexed, err, tt.want)
+		}
+	}
+
+	var same bool
+	query := "SELECT search_vector = to_tsvector('simple', body) FROM public.chat_message WHERE chat_id = $1"
+	if err = pool.QueryRow(ctx, query, chat.RoomId).Scan(&same); err != nil || !same {
+		t.Errorf("search_vector is built with simple = %v, %v", same, err)
+	}
+	if _, err = SyncSearchLanguage(ctx, pool, "missing"); err == nil {
+		t.Error("SyncSearchLanguage(missing) error = nil")
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	general, err := s.CreateChat(ctx, "general", "owner")
+	if err != nil {
+		t.Fatalf("CreateChat() error = %v", err)
+	}
+	messages := []*models.SendMessage{
+		{ChatId: general.RoomId, Msg: "Выпустили новые релизы <b>сегодня</b>", Author: "Alice", AuthorId: "1"},
+		{ChatId: general.RoomId, Msg: "The releases are ready", Author: "Bob", AuthorId: "2"},
+		{ChatId: general.RoomId, Msg: "обед", Author: "Bob", AuthorId: "2"},
+	}
+	for _, msg := range messages {
+		if ok, err := s.CreateMessage(ctx, msg); err != nil || !ok {
+			t.Fatalf("CreateMessage() = %v, %v", ok, err)
+		}
+	}
+
+	search := func(query models.SearchQuery) []models.SearchResult {
+		t.Helper()
+		query.Limit = 10
+		results, err := s.SearchMessages(ctx, query)
+		if err != nil {
+			t.Fatalf("SearchMessages(%q) error = %v", query.Query, err)
+		}
+		return results
+	}
+
+	// Слова находятся в других формах, текст экранируется, найденные слова выделяются
+	results := search(models.SearchQuery{Query: "релиз"})
+	if len(results) != 1 || results[0].Seq != 1 || results[0].ChatName != "general" {
+		t.Fatalf("SearchMessages(релиз) = %+v", results)
+	}
+	if snippet := results[0].Snippet; !strings.Contains(snippet, "<mark>релизы</mark>") || strings.Contains(snippet, "<b>") {
+		t.Errorf("snippet = %q, want highlighted and escaped text", snippet)
+	}
+	if results = search(models.SearchQuery{Query: "release"}); len(results) != 1 || results[0].Seq != 2 {
+		t.Errorf("SearchMessages(release) = %+v", results)
+	}
+	if results = search(models.SearchQuery{Query: "release", Author: "alice"}); len(results) != 0 {
+		t.Errorf("SearchMessages() by other author = %+v", results)
+	}
+	if results = search(models.SearchQuery{Query: "release", Author: "bob", ChatId: general.RoomId}); len(results) != 1 {
+		t.Errorf("SearchMessages() by author name = %+v", results)
+	}
+	future := time.Now().Add(time.Hour)
+	if results = search(models.SearchQuery{Query: "обед", From: &future}); len(results) != 0 {
+		t.Errorf("SearchMessages() from future = %+v", results)
+	}
+
+	// Измененный текст ищется по-новому, удаленное сообщение не находится
+	if _, ok, err := s.EditMessage(ctx, general.RoomId, 3, "2", "ужин", "ужин"); err != nil || !ok {
+		t.Fatalf("EditMessage() = %v, %v", ok, err)
+	}
+	if results = search(models.SearchQuery{Query: "обед"}); len(results) != 0 {
+		t.Errorf("SearchMessages() of old text = %+v", results)
+	}
+	if results = search(models.SearchQuery{Query: "ужин"}); len(results) != 1 {
+		t.Errorf("SearchMessages() of new text = %+v", results)
+	}
+	if _, ok, err := s.DeleteMessage(ctx, general.RoomId, 1, "1"); err != nil || !ok {
+		t.Fatalf("DeleteMessage() = %v, %v", ok, err)
+	}
+	if results = search(models.SearchQuery{Query: "релиз"}); len(results) != 0 {
+		t.Errorf("SearchMessages() of deleted message = %+v", results)
+	}
+}
+
+// Подсветка не требует базы
+func TestHighlight(t *testing.T) {
+	got := highlight("a <script> " + highlightStart + "release" + highlightStop + " & b")
+	if want := "a &lt;script&gt; <mark>release</mark> &amp; b"; got != want {
+		t.Errorf("highlight() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Качество JPEG миниатюр
+const jpegQuality = 80
+
+var (
+	// Формат изображения не поддерживается: поддерживаются PNG, JPEG и GIF
+	ErrUnsupported = errors.New("unsupported image format")
+	// В изображении больше пикселей, чем разрешено декодировать
+	ErrTooLarge = errors.New("image is too large")
+)
+
+// Миниатюра изображения в формате JPEG, вписанная в квадрат size x size с сохранением пропорций
+// Изображения меньше квадрата не увеличиваются
+// Размер изображения проверяется по заголовку до декодирования, поэтому
+// изображение с огромными размерами не занимает память
+// Прозрачные области заливаются белым
+func Make(r io.ReadSeeker, size int, maxPixels int) ([]byte, error) {
+	if size < 1 {
+		return nil, errors.New("invalid thumbnail size")
+	}
+
+	config, _, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode image config")
+	}
+	if config.Width < 1 || config.Height < 1 {
+		return nil, errors.New("empty image")
+	}
+	if int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+		return nil, ErrTooLarge
+	}
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "failed to rewind image")
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode image")
+	}
+
+	width, height := fit(src.Bounds().Dx(), src.Bounds().Dy(), size)
+	dst := resize(src, width, height)
+
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, errors.Wrap(err, "failed to encode thumbnail")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Размеры, вписанные в квадрат size x size
+func fit(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
+
+// Уменьшение усреднением: каждый пиксель результата - среднее покрываемых им пикселей источника
+func resize(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcHeight/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcHeight/height)
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcWidth/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcWidth/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			// Цвета с premultiplied alpha, белый фон добавляется к непрозрачной части
+			white := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r/n + white) >> 8),
+				G: uint8((g/n + white) >> 8),
+				B: uint8((b/n + white) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+
+	return dst
+}
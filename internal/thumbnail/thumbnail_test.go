@@ -0,0 +1,91 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// PNG заданного размера, залитый цветом c
+func testPNG(t *testing.T, width, height int, c color.Color) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		wantW, wantH  int
+	}{
+		{name: "landscape", width: 400, height: 200, wantW: 100, wantH: 50},
+		{name: "portrait", width: 30, height: 300, wantW: 10, wantH: 100},
+		{name: "small", width: 50, height: 20, wantW: 50, wantH: 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testPNG(t, tt.width, tt.height, color.NRGBA{R: 200, A: 255})
+
+			thumb, err := Make(bytes.NewReader(data), 100, 1<<20)
+			if err != nil {
+				t.Fatalf("Make() error = %v", err)
+			}
+
+			img, err := jpeg.Decode(bytes.NewReader(thumb))
+			if err != nil {
+				t.Fatalf("jpeg.Decode() error = %v", err)
+			}
+			if img.Bounds().Dx() != tt.wantW || img.Bounds().Dy() != tt.wantH {
+				t.Errorf("size = %v, want %dx%d", img.Bounds().Size(), tt.wantW, tt.wantH)
+			}
+			if r, g, _, _ := img.At(0, 0).RGBA(); r>>8 < 180 || g>>8 > 30 {
+				t.Errorf("color = %v, want red", img.At(0, 0))
+			}
+		})
+	}
+}
+
+// Прозрачный фон становится белым
+func TestMakeTransparent(t *testing.T) {
+	data := testPNG(t, 10, 10, color.NRGBA{})
+
+	thumb, err := Make(bytes.NewReader(data), 100, 1<<20)
+	if err != nil {
+		t.Fatalf("Make() error = %v", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatalf("jpeg.Decode() error = %v", err)
+	}
+	if r, g, b, _ := img.At(5, 5).RGBA(); r>>8 < 250 || g>>8 < 250 || b>>8 < 250 {
+		t.Errorf("color = %v, want white", img.At(5, 5))
+	}
+}
+
+func TestMakeErrors(t *testing.T) {
+	if _, err := Make(bytes.NewReader([]byte("%PDF-1.4")), 100, 1<<20); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Make() not an image error = %v, want ErrUnsupported", err)
+	}
+
+	data := testPNG(t, 100, 100, color.White)
+	if _, err := Make(bytes.NewReader(data), 10, 9999); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Make() too many pixels error = %v, want ErrTooLarge", err)
+	}
+}
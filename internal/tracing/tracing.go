@@ -0,0 +1,99 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Имя трассировщика сервиса
+const instrumentationName = "github.com/Yury132/Golang-Task-3"
+
+// Экспортеры спанов
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Настройки трассировки
+type Options struct {
+	ServiceName string
+	// none, stdout или otlp
+	Exporter string
+	// Адрес OTLP/HTTP коллектора host:port, пустой - из OTEL_EXPORTER_OTLP_ENDPOINT
+	OTLPEndpoint string
+	OTLPInsecure bool
+	// Доля трассируемых запросов от 0 до 1
+	SampleRatio float64
+}
+
+// Трассировщик для спанов сервиса
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Настройка глобального TracerProvider и распространения контекста W3C Trace Context
+// Возвращает функцию, отправляющую оставшиеся спаны при остановке
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch opts.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create stdout exporter")
+		}
+		exporter = exp
+	case ExporterOTLP:
+		var clientOpts []otlptracehttp.Option
+		if opts.OTLPEndpoint != "" {
+			clientOpts = append(clientOpts, otlptracehttp.WithEndpoint(opts.OTLPEndpoint))
+		}
+		if opts.OTLPInsecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(ctx, clientOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create otlp exporter")
+		}
+		exporter = exp
+	default:
+		return nil, errors.Errorf("unknown tracing exporter %q", opts.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(opts.ServiceName),
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create resource")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// Контекст без отмены и дедлайна, но с текущим спаном
+// Нужен, когда обработка продолжается после завершения исходного запроса
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/service"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Вложения сообщений
+type Attachments interface {
+	Upload(ctx context.Context, user models.UserStruct, chatId int, name string, r io.Reader) (models.Attachment, error)
+	Open(ctx context.Context, user models.UserStruct, id string, thumbnail bool) (models.Attachment, io.ReadCloser, error)
+}
+
+// Запас на заголовки и границы multipart сверх размера файла
+const multipartOverhead = 64 << 10
+
+// Поле формы с файлом
+const attachmentField = "file"
+
+// Типы, которые браузер показывает сам, остальные файлы только скачиваются
+var inlineTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Загрузка вложения в чат
+// Тело запроса multipart/form-data с файлом в поле file, в ответе - метаданные вложения
+// Файл читается из тела потоком, без сохранения всей формы в памяти
+func (h *Handler) UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	if h.attachments == nil {
+		h.renderError(w, r, service.NotFound("attachments are disabled"))
+		return
+	}
+
+	chatId, err := strconv.Atoi(mux.Vars(r)["chatId"])
+	if err != nil {
+		h.renderError(w, r, service.NotFound("chat not found"))
+		return
+	}
+
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	h.extendDeadlines(w, r)
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxAttachmentSize+multipartOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		h.renderError(w, r, &service.Error{Kind: service.ErrValidation, Message: "multipart form expected", Err: err})
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			h.renderError(w, r, service.Validation("file is required"))
+			return
+		}
+		if err != nil {
+			h.renderError(w, r, uploadError(err))
+			return
+		}
+		if part.FormName() != attachmentField {
+			part.Close()
+			continue
+		}
+
+		attachment, err := h.attachments.Upload(r.Context(), user, chatId, part.FileName(), part)
+		part.Close()
+		if err != nil {
+			h.renderError(w, r, uploadError(err))
+			return
+		}
+
+		h.writeJSON(w, r, http.StatusCreated, attachment)
+		return
+	}
+}
+
+// Продление сроков чтения и записи подключения на transferTimeout
+// Большой файл по медленной сети передается дольше таймаутов сервера, рассчитанных на короткие запросы,
+// а по истечении срока чтения сервер отменяет контекст запроса и во время скачивания
+func (h *Handler) extendDeadlines(w http.ResponseWriter, r *http.Request) {
+	if h.transferTimeout <= 0 {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(h.transferTimeout)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		h.logger(r.Context()).Warn().Err(err).Msg("failed to extend read deadline")
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		h.logger(r.Context()).Warn().Err(err).Msg("failed to extend write deadline")
+	}
+}
+
+// Ошибка чтения тела загрузки: превышение размера и обрыв формы - ошибки клиента
+func uploadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &service.Error{Kind: service.ErrValidation, Message: "attachment is too large", Err: err}
+	}
+	var appErr *service.Error
+	if !errors.As(err, &appErr) && errors.Is(err, io.ErrUnexpectedEOF) {
+		return &service.Error{Kind: service.ErrValidation, Message: "malformed multipart form", Err: err}
+	}
+	return err
+}
+
+// Скачивание вложения
+func (h *Handler) GetAttachment(w http.ResponseWriter, r *http.Request) {
+	h.serveAttachment(w, r, false)
+}
+
+// Скачивание миниатюры изображения
+func (h *Handler) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	h.serveAttachment(w, r, true)
+}
+
+// Отдача содержимого вложения вошедшему пользователю
+// Содержимое не меняется, поэтому кешируется браузером, а ETag - контрольная сумма
+// Тип не угадывается браузером, а сам файл открывается в песочнице без скриптов
+func (h *Handler) serveAttachment(w http.ResponseWriter, r *http.Request, thumbnail bool) {
+	if h.attachments == nil {
+		h.renderError(w, r, service.NotFound("attachments are disabled"))
+		return
+	}
+
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	h.extendDeadlines(w, r)
+	attachment, body, err := h.attachments.Open(r.Context(), user, mux.Vars(r)["attachmentId"], thumbnail)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+	defer body.Close()
+
+	etag := `"` + attachment.Checksum + `"`
+	if thumbnail {
+		etag = `"` + attachment.Checksum + `-thumbnail"`
+	}
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", "private, max-age=31536000, immutable")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	disposition := "attachment"
+	if mediaType, _, _ := mime.ParseMediaType(attachment.MimeType); inlineTypes[mediaType] {
+		disposition = "inline"
+	}
+	if !thumbnail {
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name})
+	}
+	header.Set("Content-Disposition", disposition)
+	header.Set("Content-Type", attachment.MimeType)
+	if attachment.Size > 0 {
+		header.Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, body); err != nil {
+		h.logger(r.Context()).Warn().Err(err).Str("attachment_id", attachment.Id).Msg("failed to send attachment")
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/Yury132/Golang-Task-3/internal/service"
+	"github.com/pkg/errors"
+)
+
+// Ответ с ошибкой для API клиентов
+type errorResponse struct {
+	Error     errorBody `json:"error"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Данные для страницы error.html
+type errorPage struct {
+	Status  int
+	Message string
+	// Предложить авторизоваться
+	Login bool
+}
+
+// Единая точка перевода ошибок в ответ HTTP
+// Ошибки бизнес-логики выбирают код ответа, остальные считаются внутренними и только логируются
+// API клиентам отдается JSON, браузерам - страница error.html
+func (h *Handler) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, message := classifyError(err)
+
+	logger := h.logger(r.Context())
+	if status >= http.StatusInternalServerError {
+		logger.Error().Err(err).Int("status", status).Msg("request failed")
+	} else {
+		logger.Debug().Err(err).Int("status", status).Msg("request rejected")
+	}
+
+	if wantsJSON(r) {
+		h.writeJSON(w, r, status, errorResponse{
+			Error:     errorBody{Code: code, Message: message},
+			RequestID: RequestID(r.Context()),
+		})
+		return
+	}
+
+	page := errorPage{Status: status, Message: message, Login: status == http.StatusUnauthorized}
+	if err := h.execute(w, "error.html", status, page); err != nil {
+		logger.Error().Err(err).Msg("failed to show error page")
+		http.Error(w, message, status)
+	}
+}
+
+// Код ответа, код ошибки и сообщение для клиента
+func classifyError(err error) (int, string, string) {
+	var status int
+	var code string
+	switch {
+	case errors.Is(err, service.ErrValidation):
+		status, code = http.StatusBadRequest, "validation"
+	case errors.Is(err, service.ErrUnauthorized):
+		status, code = http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, service.ErrForbidden):
+		status, code = http.StatusForbidden, "forbidden"
+	case errors.Is(err, service.ErrNotFound):
+		status, code = http.StatusNotFound, "not_found"
+	case errors.Is(err, service.ErrConflict):
+		status, code = http.StatusConflict, "conflict"
+	default:
+		// Подробности внутренних ошибок клиенту не показываем
+		return http.StatusInternalServerError, "internal", "internal server error"
+	}
+
+	var appErr *service.Error
+	if errors.As(err, &appErr) && appErr.Message != "" {
+		return status, code, appErr.Message
+	}
+	return status, code, http.StatusText(status)
+}
+
+// Клиент ждет JSON: запросы к /api/ или Accept, в котором application/json предпочтительнее text/html
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+
+	accept := r.Header.Get("Accept")
+	jsonIdx := strings.Index(accept, "application/json")
+	if jsonIdx < 0 {
+		return false
+	}
+	htmlIdx := strings.Index(accept, "text/html")
+	return htmlIdx < 0 || jsonIdx < htmlIdx
+}
+
+// Ответ JSON с кодом status
+func (h *Handler) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		h.logger(r.Context()).Error().Err(err).Msg("failed to marshal response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Страница из internal/templates с кодом 200
+// Ошибки шаблона превращаются в ответ 500
+func (h *Handler) render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	if err := h.execute(w, name, http.StatusOK, data); err != nil {
+		h.renderError(w, r, errors.Wrapf(err, "failed to render %s", name))
+	}
+}
+
+// Шаблон выполняется в буфер, поэтому при ошибке клиенту еще ничего не отправлено
+func (h *Handler) execute(w http.ResponseWriter, name string, status int, data interface{}) error {
+	tmpl, err := template.ParseFiles("./internal/templates/" + name)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+	return nil
+}
@@ -2,22 +2,23 @@ package handlers
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
-	"html/template"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 
+	"github.com/Yury132/Golang-Task-3/internal/metrics"
 	"github.com/Yury132/Golang-Task-3/internal/models"
-	"github.com/Yury132/Golang-Task-3/internal/utils"
+	"github.com/Yury132/Golang-Task-3/internal/service"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
-	"github.com/gorilla/websocket"
-	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
@@ -27,51 +28,71 @@ type Service interface {
 	HandleUser(ctx context.Context, name string, email string) error
 }
 
+// Чаты и их участники
+type Chats interface {
+	CreateChat(ctx context.Context, name string, owner models.UserStruct) (models.RoomStruct, error)
+	GetChat(ctx context.Context, chatId int) (models.RoomStruct, error)
+	GetChats(ctx context.Context) ([]models.RoomStruct, error)
+	GetChatsWithMembers(ctx context.Context, user models.UserStruct) ([]models.ChatStruct, error)
+	RenameChat(ctx context.Context, chatId int, user models.UserStruct, name string) error
+	DeleteChat(ctx context.Context, chatId int, user models.UserStruct) error
+	Join(ctx context.Context, chatId int, client service.Client) error
+	Leave(chatId int, client service.Client)
+	RegisterUser(user models.UserStruct)
+	GetUsers() []models.UserStruct
+	SendMessage(ctx context.Context, msg *models.SendMessage) error
+	GetMessages(ctx context.Context, chatId int, afterSeq int64, limit int) ([]models.Message, error)
+	GetReplies(ctx context.Context, chatId int, parentSeq int64, afterSeq int64, limit int) ([]models.Message, error)
+	SubscribeThread(ctx context.Context, chatId int, parentSeq int64, client service.Client) error
+	UnsubscribeThread(chatId int, parentSeq int64, client service.Client)
+	EditMessage(ctx context.Context, chatId int, seq int64, user models.UserStruct, text string) (models.Message, error)
+	DeleteMessage(ctx context.Context, chatId int, seq int64, user models.UserStruct) (models.Message, error)
+	AddReaction(ctx context.Context, chatId int, seq int64, user models.UserStruct, reaction string) error
+	RemoveReaction(ctx context.Context, chatId int, seq int64, user models.UserStruct, reaction string) error
+	MarkRead(ctx context.Context, chatId int, seq int64, user models.UserStruct) error
+	SearchMessages(ctx context.Context, user models.UserStruct, query models.SearchQuery) (models.SearchPage, error)
+	SetTyping(ctx context.Context, chatId int, client service.Client, typing bool) error
+	SetAway(ctx context.Context, chatId int, client service.Client, away bool) error
+	Members(ctx context.Context, chatId int) ([]models.Member, error)
+}
+
+// Максимальный размер тела запроса на изменение сообщения
+const maxMessageBodySize = 64 << 10
+
 type Handler struct {
 	log         zerolog.Logger
 	oauthConfig *oauth2.Config
 	service     Service
-	js          jetstream.JetStream
+	chats       Chats
+	// Токен входа без Google, пустой - вход отключен
+	testToken string
+	// Вложения, nil - загрузка и скачивание отключены
+	attachments Attachments
+	// Максимальный размер загружаемого файла
+	maxAttachmentSize int64
+	// Время на загрузку или скачивание файла вместо таймаутов сервера, 0 - таймауты сервера
+	transferTimeout time.Duration
+	// Время на запись сообщения клиенту WebSocket
+	writeWait time.Duration
+
+	// Открытые WebSocket подключения *wsClient, закрываются при остановке сервера
+	clients sync.Map
+	// Число подключений по ID чата для метрики, чатов без подключений нет
+	connMu    sync.Mutex
+	chatConns map[int]int
 }
 
 // Для Google
 var (
 	// Любая строка
 	oauthStateString = "pseudo-random"
-	info             models.Content
 	// Сессия
 	store = sessions.NewCookieStore([]byte("super-secret-key"))
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// Разрешение открытия WebSocket подключения всем клиентам
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-// Hub всех пользователей
-var usersHub = make(map[string]*models.UserStruct, 0)
-
-// Hub всех комнат
-var roomsHub = make(map[int]*models.RoomStruct, 0)
-
-// Hub всех чатов
-var chatsHub = make(map[int]*models.ChatStruct, 0)
-
-// Уникальный ID автоинкремент для чатов и комнат
-var globalId = 1
-
 // Стартовая страница
 func (h *Handler) Home(w http.ResponseWriter, r *http.Request) {
-
-	tmpl, err := template.ParseFiles("./internal/templates/home_page.html")
-	if err != nil {
-		h.log.Error().Err(err).Msg("filed to show home page")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	tmpl.Execute(w, nil)
+	h.render(w, r, "home_page.html", nil)
 }
 
 // Авторизация через Гугл
@@ -85,22 +106,23 @@ func (h *Handler) Callback(w http.ResponseWriter, r *http.Request) {
 	// Получаем данные из гугла
 	content, err := h.service.GetUserInfo(r.FormValue("state"), r.FormValue("code"))
 	if err != nil {
-		h.log.Error().Err(err).Msg("callback...")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		metrics.OAuthCallbacks.WithLabelValues("exchange_failed").Inc()
+		h.renderError(w, r, errors.Wrap(err, "failed to get user info from google"))
 		return
 	}
 
-	// Заполняем info, но не передаем ее на страницу
+	// Данные пользователя сохраняются в сессию, на страницу не передаются
+	var info models.Content
 	if err = json.Unmarshal(content, &info); err != nil {
-		h.log.Error().Err(err).Msg("filed to unmarshal struct")
-		w.WriteHeader(http.StatusInternalServerError)
+		metrics.OAuthCallbacks.WithLabelValues("decode_failed").Inc()
+		h.renderError(w, r, errors.Wrap(err, "failed to unmarshal user info"))
 		return
 	}
 
 	// Проверка существования пользователя в БД и его создание при необходимости
 	if err = h.service.HandleUser(r.Context(), info.Name, info.Email); err != nil {
-		h.log.Error().Err(err).Msg("filed to handle user")
-		w.WriteHeader(http.StatusInternalServerError)
+		metrics.OAuthCallbacks.WithLabelValues("user_failed").Inc()
+		h.renderError(w, r, errors.Wrap(err, "failed to handle user"))
 		return
 	}
 
@@ -112,7 +134,7 @@ func (h *Handler) Callback(w http.ResponseWriter, r *http.Request) {
 	// Создаем сессию
 	session, err := store.Get(r, "session-name")
 	if err != nil {
-		h.log.Error().Err(err).Msg("session create failed")
+		h.logger(r.Context()).Error().Err(err).Msg("session create failed")
 	}
 	// Устанавливаем значения в сессию
 	// Сохраняем данные пользователя
@@ -120,65 +142,76 @@ func (h *Handler) Callback(w http.ResponseWriter, r *http.Request) {
 	session.Values["Name"] = info.Name
 	session.Values["Email"] = info.Email
 	session.Values["ID"] = info.ID
-	fmt.Println(info.ID, "First!!!")
 	if err = session.Save(r, w); err != nil {
-		h.log.Error().Err(err).Msg("filed to save session")
-		w.WriteHeader(http.StatusInternalServerError)
+		metrics.OAuthCallbacks.WithLabelValues("session_failed").Inc()
+		h.renderError(w, r, errors.Wrap(err, "failed to save session"))
 		return
 	}
 
-	tmpl, err := template.ParseFiles("./internal/templates/auth_page.html")
+	metrics.OAuthCallbacks.WithLabelValues("success").Inc()
+
+	h.render(w, r, "auth_page.html", nil)
+}
+
+// Вход без Google для нагрузочного тестирования
+// Доступен, только если задан токен, он передается в заголовке Authorization: Bearer <token>
+func (h *Handler) TestLogin(w http.ResponseWriter, r *http.Request) {
+	if h.testToken == "" {
+		h.renderError(w, r, service.NotFound("not found"))
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.testToken)) != 1 {
+		h.renderError(w, r, service.Unauthorized("invalid test token"))
+		return
+	}
+
+	id, name := r.FormValue("id"), r.FormValue("name")
+	if id == "" || name == "" {
+		h.renderError(w, r, service.Validation("id and name are required"))
+		return
+	}
+
+	session, err := store.Get(r, "session-name")
 	if err != nil {
-		h.log.Error().Err(err).Msg("filed to show home page")
-		w.WriteHeader(http.StatusInternalServerError)
+		h.logger(r.Context()).Debug().Err(err).Msg("session failed")
+	}
+	session.Values["authenticated"] = true
+	session.Values["Name"] = name
+	session.Values["Email"] = id + "@test.local"
+	session.Values["ID"] = id
+	if err = session.Save(r, w); err != nil {
+		h.renderError(w, r, errors.Wrap(err, "failed to save session"))
 		return
 	}
-	tmpl.Execute(w, nil)
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Информация о пользователе
 func (h *Handler) Me(w http.ResponseWriter, r *http.Request) {
 
-	// Получаем сессию
-	session, err := store.Get(r, "session-name")
+	// Получаем сессию и проверяем, что пользователь залогинен
+	session, err := authSession(r)
 	if err != nil {
-		h.log.Error().Err(err).Msg("session failed")
-		//w.WriteHeader(http.StatusInternalServerError)
-		//return
+		h.renderError(w, r, err)
+		return
 	}
 
-	// Проверяем, что пользователь залогинен
-	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
-		// Если нет
-		tmpl, err := template.ParseFiles("./internal/templates/error.html")
-		w.WriteHeader(http.StatusUnauthorized)
-		if err != nil {
-			h.log.Error().Err(err).Msg("filed to show error page")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		tmpl.Execute(w, nil)
-	} else {
-		// Если да
-		// Читаем данные из сессии
-		info.Name = session.Values["Name"].(string)
-		info.Email = session.Values["Email"].(string)
-
-		tmpl, err := template.ParseFiles("./internal/templates/auth_page.html")
-		if err != nil {
-			h.log.Error().Err(err).Msg("filed to show home page")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		tmpl.Execute(w, info)
-	}
+	// Читаем данные из сессии
+	var info models.Content
+	info.Name, _ = session.Values["Name"].(string)
+	info.Email, _ = session.Values["Email"].(string)
+
+	h.render(w, r, "auth_page.html", info)
 }
 
 // Выход из системы, удаление сессии
 func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 	session, err := store.Get(r, "session-name")
 	if err != nil {
-		h.log.Error().Err(err).Msg("session failed")
+		h.logger(r.Context()).Error().Err(err).Msg("session failed")
 	}
 	// Удаляем сессию
 	session.Options.MaxAge = -1
@@ -189,140 +222,56 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 
 // Все пользователи в БД
 func (h *Handler) GetUsersList(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
 	users, err := h.service.GetUsersList(r.Context())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		h.log.Error().Err(err).Msg("failed to get users list")
-		return
-	}
-
-	data, err := json.Marshal(users)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		h.log.Error().Err(err).Msg("failed to marshal users list")
+		h.renderError(w, r, errors.Wrap(err, "failed to get users list"))
 		return
 	}
 
-	w.Write(data)
+	h.writeJSON(w, r, http.StatusOK, users)
 }
 
 // Для разных пользователей нужно открывать разные браузеры
 // Страница после прохождения авторизации
 func (h *Handler) Start(w http.ResponseWriter, r *http.Request) {
 
-	// ID и Name пользователя
-	var userId string
-	var userName string
-
-	// Получаем сессию
-	session, err := store.Get(r, "session-name")
+	// Пользователь из сессии
+	user, err := sessionUser(r)
 	if err != nil {
-		h.log.Error().Err(err).Msg("session failed")
-		w.WriteHeader(http.StatusInternalServerError)
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Проверяем, что пользователь залогинен
-	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
-		// Если нет
-		tmpl, err := template.ParseFiles("./internal/templates/error.html")
-		w.WriteHeader(http.StatusUnauthorized)
-		if err != nil {
-			h.log.Error().Err(err).Msg("filed to show error page")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		tmpl.Execute(w, nil)
-		return
-	} else {
-		// Если да
-		// Читаем данные из сессии
-		userName = session.Values["Name"].(string)
-		fmt.Println("From Google", userName)
-		userId = session.Values["ID"].(string)
-		fmt.Println("From Google", userId)
-	}
-
-	// ID пользователя
-	// userId, err := strconv.Atoi(r.URL.Query().Get("userId"))
-	// if err != nil {
-	// 	w.WriteHeader(http.StatusInternalServerError)
-	// 	fmt.Println("failed to get id from string")
-	// 	return
-	// }
-
-	// Проверка на то, что данного пользователя не было в карте
-	_, userExist := usersHub[userId]
-
-	// Если пользователя раньше не существовало
-	if !userExist {
-		// Создаем нового пользователя
-		newUser := &models.UserStruct{UserId: userId, UserName: userName}
-
-		// Добавляем нового пользователя в карту
-		// Ключ карты - уникальный ID пользователя
-		usersHub[userId] = newUser
-
-		// // Создаем сессию
-		// session, err := store.Get(r, "session-name")
-		// if err != nil {
-		// 	fmt.Println("session create failed")
-		// }
+	// Запоминаем пользователя
+	h.chats.RegisterUser(user)
 
-		// // Сохраняем данные пользователя
-		// // Будем получать userId и userName из гугл авторизации!!!!!!!!!!!!!!!!!!!!!!!!!!!Следить чтобы не пересохранялись пустые значения......
-		// session.Values["userId"] = r.URL.Query().Get("userId")
-		// session.Values["userName"] = r.URL.Query().Get("userName")
-		// if err = session.Save(r, w); err != nil {
-		// 	fmt.Println("filed to save session")
-		// 	w.WriteHeader(http.StatusInternalServerError)
-		// 	return
-		// }
-	}
-
-	tmpl, err := template.ParseFiles("./internal/templates/start.html")
+	chats, err := h.chats.GetChatsWithMembers(r.Context(), user)
 	if err != nil {
-		fmt.Println("filed to show start page")
-		w.WriteHeader(http.StatusInternalServerError)
+		h.renderError(w, r, err)
 		return
 	}
-	// Передаем на страницу карту всех чатов
-	tmpl.Execute(w, roomsHub)
+
+	// Передаем на страницу список всех чатов с числом непрочитанных сообщений
+	h.render(w, r, "start.html", chats)
 }
 
 // Создание чата
 func (h *Handler) CreateChat(w http.ResponseWriter, r *http.Request) {
 
-	// Название чата из формы POST запрос
-	getRoomName := r.FormValue("chatName")
-	if getRoomName == "" {
-		fmt.Println("Название чата пустое")
-		// Переадресуем пользователя на ту же страницу
-		// Костыль userId == -1
-		http.Redirect(w, r, "/start", http.StatusSeeOther)
+	// Создатель чата - пользователь из сессии, он становится администратором чата
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
 		return
 	}
-	// http.Redirect(w, r, "/start?userId=-1&userName=xxx", http.StatusSeeOther) &&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&&
-	// Создаем новую комнату
-	newRoom := &models.RoomStruct{RoomId: globalId, RoomName: getRoomName}
-
-	// Добавляем новую комнату в карту
-	roomsHub[globalId] = newRoom
-
-	// Создаем новый чат
-	newChat := &models.ChatStruct{ChatId: globalId, Room: newRoom, Ws: make([]*websocket.Conn, 0), User: make([]*models.UserStruct, 0)}
 
-	// Добавляем новый чат в карту
-	chatsHub[globalId] = newChat
-
-	// Счетчик - уникальный автоинкремент - ID чатов и комнат
-	// Кол-во существующих комнат и чатов совпадает
-	globalId++
+	// Название чата из формы POST запрос
+	if _, err = h.chats.CreateChat(r.Context(), r.FormValue("chatName"), user); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
 	// Переадресуем пользователя на ту же страницу
-	// Костыль userId == -1
 	http.Redirect(w, r, "/start", http.StatusSeeOther)
 }
 
@@ -333,374 +282,436 @@ func (h *Handler) GoChat(w http.ResponseWriter, r *http.Request) {
 
 	// ID чата
 	chatId, err := strconv.Atoi(vars["chatId"])
-	if err != nil || chatId < 1 {
-		http.NotFound(w, r)
+	if err != nil {
+		h.renderError(w, r, service.NotFound("chat not found"))
+		return
+	}
+
+	// Пользователь из сессии
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Проверка на переход в уже удаленный чат
-	if _, chatExist := chatsHub[chatId]; !chatExist {
-		/// Переадресуем пользователя на ту же страницу
-		// Костыль userId == -1
+	room, err := h.chats.GetChat(r.Context(), chatId)
+	if errors.Is(err, service.ErrNotFound) {
+		// Переход в уже удаленный чат - переадресуем пользователя к списку чатов
 		http.Redirect(w, r, "/start", http.StatusSeeOther)
 		return
 	}
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-	// Получаем сессию
-	session, err := store.Get(r, "session-name")
+	// Формируем структуру
+	data := models.UserAndRoomStruct{UserId: user.UserId, UserName: user.UserName, RoomId: room.RoomId, RoomName: room.RoomName}
+
+	// Передаем данные
+	h.render(w, r, "chat.html", data)
+}
+
+// Удаление конкретного чата
+func (h *Handler) DeleteChat(w http.ResponseWriter, r *http.Request) {
+
+	// Удалить чат может только его администратор
+	user, err := sessionUser(r)
 	if err != nil {
-		fmt.Println("session failed")
-		w.WriteHeader(http.StatusInternalServerError)
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Из сессии читаем ID пользователя
-	userId := session.Values["ID"].(string)
-	// Переводим в int
-	// userIdInt, err := strconv.Atoi(userIdString)
-	// if err != nil || userIdInt < 1 {
-	// 	http.NotFound(w, r)
-	// 	return
-	// }
+	vars := mux.Vars(r)
+
+	// ID чата
+	chatId, err := strconv.Atoi(vars["chatId"])
+	if err != nil {
+		h.renderError(w, r, service.NotFound("chat not found"))
+		return
+	}
 
-	fmt.Println("ID пользователя из Сессии: ", userId)
+	h.logger(r.Context()).Info().Int("chat_id", chatId).Msg("deleting chat")
 
-	// Из сессии читаем Name пользователя
-	userName := session.Values["Name"].(string)
+	// Удаляем чат, подключения участников закрываются
+	if err = h.chats.DeleteChat(r.Context(), chatId, user); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-	// Формируем структуру
-	data := models.UserAndRoomStruct{UserId: userId, UserName: userName, RoomId: chatId, RoomName: chatsHub[chatId].Room.RoomName}
+	// Переадресуем пользователя на ту же страницу
+	http.Redirect(w, r, "/start", http.StatusSeeOther)
+}
+
+// Изменение названия чата
+func (h *Handler) EditChat(w http.ResponseWriter, r *http.Request) {
 
-	tmpl, err := template.ParseFiles("./internal/templates/chat.html")
+	// Автор сообщения о переименовании - пользователь из сессии
+	user, err := sessionUser(r)
 	if err != nil {
-		fmt.Println("filed to show home page")
-		w.WriteHeader(http.StatusInternalServerError)
+		h.renderError(w, r, err)
 		return
 	}
-	// Передаем данные
-	tmpl.Execute(w, data)
+
+	// ID чата из формы POST запрос
+	chatId, err := strconv.Atoi(r.FormValue("chatID"))
+	if err != nil {
+		h.renderError(w, r, service.Validation("invalid chat id"))
+		return
+	}
+
+	// Название чата из формы POST запрос
+	if err = h.chats.RenameChat(r.Context(), chatId, user, r.FormValue("chatName")); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	// Перезаходим в чат
+	http.Redirect(w, r, "/go-chat/"+strconv.Itoa(chatId), http.StatusSeeOther)
 }
 
-// Подключение через WebSocket
-// Сюда приходят все клиенты
-func (h *Handler) WsEndpoint(w http.ResponseWriter, r *http.Request) {
+// История сообщений чата без ответов в тредах
+// after_seq - номер, после которого нужны сообщения, limit - их количество
+// Клиент догружает отсюда сообщения, пропущенные при рассылке
+func (h *Handler) GetMessages(w http.ResponseWriter, r *http.Request) {
+	if _, err := sessionUser(r); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-	// ID пользователя
-	// getUserId, err := strconv.Atoi(r.URL.Query().Get("userId"))
-	// if err != nil || getUserId < 1 {
-	// 	http.NotFound(w, r)
-	// 	return
-	// }
-	getUserId := r.URL.Query().Get("userId")
+	chatId, err := strconv.Atoi(mux.Vars(r)["chatId"])
+	if err != nil {
+		h.renderError(w, r, service.NotFound("chat not found"))
+		return
+	}
 
-	// ID комнаты (чата)
-	getRoomId, err := strconv.Atoi(r.URL.Query().Get("roomId"))
-	if err != nil || getRoomId < 1 {
-		http.NotFound(w, r)
+	afterSeq, limit, err := pageParams(r)
+	if err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Уникальное подключение *websocket.Conn
-	conn, err := upgrader.Upgrade(w, r, nil)
+	messages, err := h.chats.GetMessages(r.Context(), chatId, afterSeq, limit)
 	if err != nil {
-		log.Println(err)
+		h.renderError(w, r, errors.Wrap(err, "failed to get messages"))
+		return
 	}
 
-	log.Println("Подключился новый пользователь, userId - ", getUserId, "roomId - ", getRoomId)
+	h.writeJSON(w, r, http.StatusOK, messages)
+}
 
-	// Проверка на существование пользователя в карте
-	if _, ok := usersHub[getUserId]; !ok {
-		fmt.Println("invalid userId")
+// Участники чата с присутствием: online, away или offline с временем отключения
+func (h *Handler) GetMembers(w http.ResponseWriter, r *http.Request) {
+	chatId, err := strconv.Atoi(mux.Vars(r)["chatId"])
+	if err != nil {
+		h.renderError(w, r, service.NotFound("chat not found"))
 		return
 	}
 
-	// Проверка на существование чата в карте
-	if _, ok := chatsHub[getRoomId]; !ok {
-		fmt.Println("invalid chatID")
+	if _, err = sessionUser(r); err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Добавляем пользователя к конкретному чату
-	chatsHub[getRoomId].User = append(chatsHub[getRoomId].User, usersHub[getUserId])
-	// Добавляем подключение к конкретному чату
-	chatsHub[getRoomId].Ws = append(chatsHub[getRoomId].Ws, conn)
+	members, err := h.chats.Members(r.Context(), chatId)
+	if err != nil {
+		h.renderError(w, r, errors.Wrap(err, "failed to get members"))
+		return
+	}
 
-	fmt.Println("Вывод структуры конкретного чата:")
-	fmt.Printf("%+v\n", chatsHub[getRoomId])
-	fmt.Println("Присоединились к чату ID: ", chatsHub[getRoomId].Room.RoomId, " - ", chatsHub[getRoomId].Room.RoomName)
+	h.writeJSON(w, r, http.StatusOK, members)
+}
 
-	fmt.Printf("Количество подключений в данном чате: %v\n", len(chatsHub[getRoomId].Ws))
+// Ответы в треде сообщения, параметры страницы как у истории чата
+func (h *Handler) GetReplies(w http.ResponseWriter, r *http.Request) {
+	chatId, seq, err := messageRef(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-	// Готовим сообщение JSON для отправки
-	msg := models.MessageOnScreen{
-		Msg:    "Добро пожаловать в чат!",
-		Author: usersHub[getUserId].UserName,
+	if _, err = sessionUser(r); err != nil {
+		h.renderError(w, r, err)
+		return
 	}
 
-	// Кодируем
-	b, err := json.Marshal(msg)
+	afterSeq, limit, err := pageParams(r)
 	if err != nil {
-		fmt.Println("js message marshal err")
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Сообщение клиенту
-	err = conn.WriteMessage(1, b)
+	replies, err := h.chats.GetReplies(r.Context(), chatId, seq, afterSeq, limit)
 	if err != nil {
-		log.Println(err)
+		h.renderError(w, r, err)
+		return
 	}
 
-	// В бесконечном цикле прослушиваем входящие сообщения от каждого подключенного клиента
-	// Передаем ID пользователя, ID комнаты (ID чата)
-	h.reader(conn, getUserId, getRoomId)
+	h.writeJSON(w, r, http.StatusOK, replies)
 }
 
-// В бесконечном цикле прослушиваем входящие сообщения от каждого подключенного клиента
-// Передаем ID пользователя, ID комнаты (ID чата) - Уникальные данные для каждого клиента, чьи сообщения мы прослушиваем
-// Это и есть уникальные ключи к картам
-// Имеем соответствие *websocket.Conn с конкретными комнатми (чатами)
-func (h *Handler) reader(conn *websocket.Conn, userId string, chatId int) {
-	// Этот бесконечный цикл запускаетя для каждого клиента с открытым WebSocket подключением
-	for {
-		// Ждем сообщение от клиента
-		messageType, p, err := conn.ReadMessage()
+// Параметры страницы сообщений after_seq и limit, 0 если не заданы
+func pageParams(r *http.Request) (int64, int, error) {
+	var (
+		afterSeq int64
+		limit    int
+		err      error
+	)
+
+	if v := r.URL.Query().Get("after_seq"); v != "" {
+		if afterSeq, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, 0, service.Validation("after_seq must be a number")
+		}
+	}
 
-		// При ошибке закрываем соединение - удаляем подключение и клиента из массива
-		if err != nil {
-			log.Println("Ошибка при чтении: ", err)
-
-			// Если в DeleteChat уже закрыли все подключения тут необходимо проверять, закрыто ли оно... чтобы повторно не вызывать err = conn.Close()
-			// Проверяем тип ошибки
-			// if err, ok := err.(*websocket.CloseError); ok {
-			// 	log.Printf("connection closed, code: %d, text: %q", err.Code, err.Text)
-			// 	break
-			// }
-
-			// Или так
-			// if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-			// 	log.Printf("WWWWWWWerror: %v", err)
-			// }
-
-			err = conn.Close()
-			if err != nil {
-				log.Println("Ошибка при закрытии соединения: ", err)
-				return
-			}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, service.Validation("limit must be a positive number")
+		}
+	}
 
-			// Проверка на существование чата (вдруг кто-то удалил)
-			if _, chatExist := chatsHub[chatId]; !chatExist {
-				return
-			}
+	return afterSeq, limit, nil
+}
 
-			// Вычисляем индекс удаляемого подключения из чата
-			indexConn := utils.IndexOfConn(conn, chatsHub[chatId].Ws)
-			// Удаляем подключение из массива по индексу
-			chatsHub[chatId].Ws = append(chatsHub[chatId].Ws[:indexConn], chatsHub[chatId].Ws[indexConn+1:]...)
-			fmt.Println("Удалили одно подключение из чата")
-
-			// Вычисляем индекс удаляемого пользователя из чата
-			indexUser := utils.IndexOfUser(usersHub[userId], chatsHub[chatId].User)
-			// Удаляем пользователя из чата по индексу
-			chatsHub[chatId].User = append(chatsHub[chatId].User[:indexUser], chatsHub[chatId].User[indexUser+1:]...)
-			fmt.Println("Удалили одного пользователя из чата")
-
-			// Выводим структуру
-			fmt.Println("Структура чата после удаления:")
-			fmt.Printf("%+v\n", chatsHub[chatId])
-			fmt.Printf("Количество подключений в данном чате: %v\n", len(chatsHub[chatId].Ws))
-			return
-		}
+// Поиск сообщений: q - запрос, необязательные chat_id, author (ID или имя автора),
+// from и to (RFC 3339 или дата 2006-01-02, to включает весь день), limit и offset
+func (h *Handler) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-		log.Println("Пришло сообщение: ", string(p), " от пользователя ID ", usersHub[userId].UserId, " - ", usersHub[userId].UserName)
+	query, err := searchParams(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-		// Готовим сообщение для отправки
-		msg := models.SendMessage{
-			Msg:         string(p),
-			Author:      usersHub[userId].UserName,
-			MessageType: messageType,
-			ChatId:      chatId,
-		}
+	page, err := h.chats.SearchMessages(r.Context(), user, query)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-		// Кодируем
-		b, err := json.Marshal(msg)
-		if err != nil {
-			fmt.Println("js message marshal err")
-			return
-		}
+	h.writeJSON(w, r, http.StatusOK, page)
+}
 
-		// Отправляем полученное сообщение в Nats------------------------------------------------------------------------------------------------
-		if _, err = h.js.Publish(context.Background(), "events.us.page_loaded", b); err != nil {
-			fmt.Println("failed to publish message", err)
-			return
+// Параметры поиска из строки запроса
+func searchParams(r *http.Request) (models.SearchQuery, error) {
+	values := r.URL.Query()
+	query := models.SearchQuery{Query: values.Get("q"), Author: values.Get("author")}
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{{"chat_id", &query.ChatId}, {"limit", &query.Limit}, {"offset", &query.Offset}}
+	for _, p := range ints {
+		if v := values.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return query, service.Validation(p.name + " must be a non-negative number")
+			}
+			*p.dst = n
 		}
-		//
-		// Без Nats
-		//
-		// // Готовим сообщение JSON для отправки
-		// msg := models.MessageOnScreen{
-		// 	Msg:    string(p),
-		// 	Author: usersHub[userId].UserName,
-		// }
-
-		// // Кодируем
-		// b, err := json.Marshal(msg)
-		// if err != nil {
-		// 	fmt.Println("js message marshal err")
-		// 	return
-		// }
-		// // Рассылка сообщения всем участникам чата---------------------------------------------------------------------------------------------
-		// for i, conn := range chatsHub[chatId].Ws {
-		// 	if err := conn.WriteMessage(messageType, b); err != nil {
-		// 		log.Println("Ошибка при рассылке, ID подключения - ", i, " Ошибка:  ", err)
-		// 		return
-		// 	}
-		// }
+	}
 
+	var err error
+	if query.From, err = searchTime(values.Get("from"), false); err != nil {
+		return query, service.Validation("from must be a date or RFC 3339 time")
+	}
+	if query.To, err = searchTime(values.Get("to"), true); err != nil {
+		return query, service.Validation("to must be a date or RFC 3339 time")
 	}
+
+	return query, nil
 }
 
-// Удаление конкретного чата
-func (h *Handler) DeleteChat(w http.ResponseWriter, r *http.Request) {
+// Время из RFC 3339 или даты; дата в конце периода означает конец этого дня
+func searchTime(v string, end bool) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
 
-	vars := mux.Vars(r)
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return nil, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
 
-	// ID чата
-	chatId, err := strconv.Atoi(vars["chatId"])
-	if err != nil || chatId < 1 {
-		http.NotFound(w, r)
+	return &t, nil
+}
+
+// Изменение текста сообщения
+// Тело запроса JSON {"msg": "новый текст"}, в ответе - измененное сообщение
+// Участники чата получают событие message.edited
+func (h *Handler) EditMessage(w http.ResponseWriter, r *http.Request) {
+	chatId, seq, err := messageRef(r)
+	if err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	fmt.Println("Удаляем чат", chatId)
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-	// // Необходимо закрыть все подключения в удаляемом чате
-	// for i, conn := range chatsHub[chatId].Ws {
-	// 	err = conn.Close()
-	// 	if err != nil {
-	// 		log.Println(i, " - Ошибка при закрытии соединения: ", err)
-	// 	}
-	// }
+	var body struct {
+		Msg string `json:"msg"`
+	}
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageBodySize)).Decode(&body); err != nil {
+		h.renderError(w, r, &service.Error{Kind: service.ErrValidation, Message: "invalid json", Err: err})
+		return
+	}
 
-	// Удаляем чат и комнату из карты
-	delete(chatsHub, chatId)
-	delete(roomsHub, chatId)
+	msg, err := h.chats.EditMessage(r.Context(), chatId, seq, user, body.Msg)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-	// Переадресуем пользователя на ту же страницу
-	// Костыль userId == -1
-	http.Redirect(w, r, "/start", http.StatusSeeOther)
+	h.writeJSON(w, r, http.StatusOK, msg)
 }
 
-// Изменение названия чата
-func (h *Handler) EditChat(w http.ResponseWriter, r *http.Request) {
+// Удаление сообщения
+// Участники чата получают событие message.deleted
+func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	chatId, seq, err := messageRef(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-	// ID пользователя из формы POST запрос
-	// getUserID, err := strconv.Atoi(r.FormValue("userID"))
-	// if err != nil {
-	// 	w.WriteHeader(http.StatusInternalServerError)
-	// 	fmt.Println("failed to get getUserID from string")
-	// 	http.Redirect(w, r, "/start", http.StatusSeeOther)
-	// 	return
-	// }
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	if _, err = h.chats.DeleteMessage(r.Context(), chatId, seq, user); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
 
-	getUserID := r.FormValue("userID")
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// ID чата из формы POST запрос
-	getRoomID, err := strconv.Atoi(r.FormValue("chatID"))
+// Добавление реакции текущего пользователя на сообщение
+// Реакция - эмодзи или короткий код вида :thumbsup: в пути запроса, повторное добавление ничего не меняет
+// Участники чата получают событие reaction.added
+func (h *Handler) AddReaction(w http.ResponseWriter, r *http.Request) {
+	h.react(w, r, h.chats.AddReaction)
+}
+
+// Удаление реакции текущего пользователя с сообщения
+// Участники чата получают событие reaction.removed
+func (h *Handler) RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	h.react(w, r, h.chats.RemoveReaction)
+}
+
+func (h *Handler) react(w http.ResponseWriter, r *http.Request,
+	change func(ctx context.Context, chatId int, seq int64, user models.UserStruct, reaction string) error) {
+	chatId, seq, err := messageRef(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Println("failed to get getRoomID from string")
-		http.Redirect(w, r, "/start", http.StatusSeeOther)
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Название чата из формы POST запрос
-	getRoomName := r.FormValue("chatName")
-	if getRoomName == "" {
-		fmt.Println("Название чата пустое")
-		// Переадресуем пользователя на ту же страницу
-		// Костыль userId == -1
-		http.Redirect(w, r, "/start", http.StatusSeeOther)
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Проверка на существование чата (вдруг кто-то удалил)
-	if _, chatExist := chatsHub[getRoomID]; !chatExist {
-		http.Redirect(w, r, "/start", http.StatusSeeOther)
+	if err = change(r.Context(), chatId, seq, user, mux.Vars(r)["reaction"]); err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Готовим сообщение для отправки
-	msg := models.SendMessage{
-		Msg:         "Новое название чата - " + getRoomName,
-		Author:      usersHub[getUserID].UserName,
-		MessageType: 1,
-		ChatId:      getRoomID,
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Отметка сообщений чата до номера из пути включительно прочитанными текущим пользователем
+// Отметка только сдвигается вперед, участники чата получают событие message.read
+func (h *Handler) MarkRead(w http.ResponseWriter, r *http.Request) {
+	chatId, seq, err := messageRef(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
 	}
 
-	// Кодируем
-	b, err := json.Marshal(msg)
+	user, err := sessionUser(r)
 	if err != nil {
-		fmt.Println("js message marshal err")
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Отправляем полученное сообщение в Nats----------------------------------------------------------------Nats--------------------------------
-	if _, err = h.js.Publish(context.Background(), "events.us.page_loaded", b); err != nil {
-		fmt.Println("failed to publish message", err)
+	if err = h.chats.MarkRead(r.Context(), chatId, seq, user); err != nil {
+		h.renderError(w, r, err)
 		return
 	}
 
-	// Изменяем название текущего чата (название комнаты) в карте
-	chatsHub[getRoomID].Room.RoomName = getRoomName
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ID чата и номер сообщения из пути запроса
+func messageRef(r *http.Request) (int, int64, error) {
+	vars := mux.Vars(r)
 
-	// Перезаходим в чат
-	http.Redirect(w, r, "/go-chat/"+strconv.Itoa(getRoomID), http.StatusSeeOther)
+	chatId, err := strconv.Atoi(vars["chatId"])
+	if err != nil {
+		return 0, 0, service.NotFound("chat not found")
+	}
+	seq, err := strconv.ParseInt(vars["seq"], 10, 64)
+	if err != nil {
+		return 0, 0, service.NotFound("message not found")
+	}
+
+	return chatId, seq, nil
 }
 
-// Вывод всех чатов
+// Вывод всех чатов с подключенными участниками
 func (h *Handler) GetChats(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	response, err := json.Marshal(chatsHub)
+	// Непрочитанные сообщения считаются только для пользователя с сессией
+	user, _ := sessionUser(r)
+
+	chats, err := h.chats.GetChatsWithMembers(r.Context(), user)
 	if err != nil {
-		fmt.Println("filed to marshal response data")
-		w.WriteHeader(http.StatusInternalServerError)
+		h.renderError(w, r, err)
 		return
 	}
-	w.Write(response)
+	h.writeJSON(w, r, http.StatusOK, chats)
 }
 
+// Вывод всех комнат
 func (h *Handler) GetRooms(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	response, err := json.Marshal(roomsHub)
+	rooms, err := h.chats.GetChats(r.Context())
 	if err != nil {
-		fmt.Println("filed to marshal response data")
-		w.WriteHeader(http.StatusInternalServerError)
+		h.renderError(w, r, err)
 		return
 	}
-	w.Write(response)
+	h.writeJSON(w, r, http.StatusOK, rooms)
 }
 
-// Вывод всех пользователей
+// Вывод всех пользователей, заходивших в чаты
 func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	response, err := json.Marshal(usersHub)
-	if err != nil {
-		fmt.Println("filed to marshal response data")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	w.Write(response)
+	h.writeJSON(w, r, http.StatusOK, h.chats.GetUsers())
 }
 
 // Тест - Получаем от клиента данные JSON и возвращаем JSON
 func (h *Handler) Test(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
 
 	// Читаем из Body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		fmt.Println("1")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.renderError(w, r, errors.Wrap(err, "failed to read body"))
 		return
 	}
 	defer r.Body.Close()
@@ -710,19 +721,20 @@ func (h *Handler) Test(w http.ResponseWriter, r *http.Request) {
 	switch contentType {
 	case "application/json":
 		// Обработка данных в формате JSON
-		fmt.Println("get json")
 		var data map[string]interface{}
 		err := json.Unmarshal(body, &data)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			h.renderError(w, r, &service.Error{Kind: service.ErrValidation, Message: "invalid json", Err: err})
 			return
 		}
-		fmt.Println(data["userId"])
-		fmt.Println(data["title"])
-		fmt.Println(data["completed"])
+		h.logger(r.Context()).Debug().
+			Interface("user_id", data["userId"]).
+			Interface("title", data["title"]).
+			Interface("completed", data["completed"]).
+			Msg("test json received")
 	default:
 		// Обработка данных в другом формате
-		fmt.Println("not json")
+		h.logger(r.Context()).Debug().Str("content_type", contentType).Msg("test body is not json")
 	}
 
 	// Готовим сообщение для отправки
@@ -733,60 +745,65 @@ func (h *Handler) Test(w http.ResponseWriter, r *http.Request) {
 		ChatId:      1,
 	}
 
-	// Кодируем
-	b, err := json.Marshal(msg)
+	h.writeJSON(w, r, http.StatusOK, msg)
+}
+
+// Сессия пользователя, прошедшего авторизацию через Google
+func authSession(r *http.Request) (*sessions.Session, error) {
+	session, err := store.Get(r, "session-name")
 	if err != nil {
-		fmt.Println("js message marshal err")
-		return
+		// Поврежденная или устаревшая кука равносильна ее отсутствию
+		return nil, &service.Error{Kind: service.ErrUnauthorized, Message: "authorization required", Err: err}
+	}
+
+	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+		return nil, service.Unauthorized("authorization required")
 	}
 
-	w.Write(b)
+	return session, nil
 }
 
-func New(log zerolog.Logger, oauthConfig *oauth2.Config, service Service, js jetstream.JetStream) *Handler {
-	return &Handler{
-		log:         log,
-		oauthConfig: oauthConfig,
-		service:     service,
-		js:          js,
+// Пользователь из сессии
+func sessionUser(r *http.Request) (models.UserStruct, error) {
+	session, err := authSession(r)
+	if err != nil {
+		return models.UserStruct{}, err
 	}
-}
 
-// Воркер
-// Должен видеть chatsHub !!!!!!!!!!!!!!!!!!!!!
-func (h *Handler) Worker(id int, jobs <-chan *models.SendMessage) {
-	// Ожидаем получения данных для работы
-	// Если данных нет в канале - блокировка
-	for j := range jobs {
-		fmt.Println("worker", id, "принял сообщение: ", j)
+	userId, _ := session.Values["ID"].(string)
+	userName, _ := session.Values["Name"].(string)
 
-		// Проверка на существование чата (вдруг кто-то удалил)
-		if _, chatExist := chatsHub[j.ChatId]; !chatExist {
-			continue
-		}
+	return models.UserStruct{UserId: userId, UserName: userName}, nil
+}
 
-		// Рассылка сообщения всем участникам чата
-		for i, conn := range chatsHub[j.ChatId].Ws {
+// Включение входа без Google по токену
+func (h *Handler) WithTestAuth(token string) *Handler {
+	h.testToken = token
+	return h
+}
 
-			// Готовим сообщение JSON для отправки
-			msg := models.MessageOnScreen{
-				Msg:    j.Msg,
-				Author: j.Author,
-			}
+// Включение загрузки и скачивания вложений размером до maxSize байт
+// Загрузка и скачивание файла ограничены transferTimeout, а не таймаутами чтения и записи сервера
+func (h *Handler) WithAttachments(attachments Attachments, maxSize int64, transferTimeout time.Duration) *Handler {
+	h.attachments = attachments
+	h.maxAttachmentSize = maxSize
+	h.transferTimeout = transferTimeout
+	return h
+}
 
-			// Кодируем
-			b, err := json.Marshal(msg)
-			if err != nil {
-				fmt.Println("js message marshal err")
-				return
-			}
+// Время на запись сообщения клиенту WebSocket, не успевший клиент отключается
+func (h *Handler) WithWriteTimeout(timeout time.Duration) *Handler {
+	h.writeWait = timeout
+	return h
+}
 
-			if err := conn.WriteMessage(j.MessageType, b); err != nil {
-				log.Println("Ошибка при рассылке, ID подключения - ", i, " Ошибка:  ", err)
-				continue
-			}
-		}
-		fmt.Println("worker", id, "разослал сообщение: ", j)
+func New(log zerolog.Logger, oauthConfig *oauth2.Config, service Service, chats Chats) *Handler {
+	return &Handler{
+		log:         log,
+		oauthConfig: oauthConfig,
+		service:     service,
+		chats:       chats,
+		writeWait:   defaultWriteWait,
+		chatConns:   make(map[int]int),
 	}
-
 }
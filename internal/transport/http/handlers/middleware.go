@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Заголовок идентификатора запроса
+const requestIDHeader = "X-Request-ID"
+
+// Допустимый идентификатор запроса от клиента или прокси
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type ctxKey int
+
+const requestIDKey ctxKey = iota
+
+// Присваивает запросу X-Request-ID (или берет пришедший), кладет в контекст логгер с request_id
+// и после обработки пишет строку access лога
+func (h *Handler) RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = newID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		logCtx := h.log.With().Str("request_id", requestID)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logCtx = logCtx.Str("trace_id", sc.TraceID().String())
+		}
+		logger := logCtx.Logger()
+
+		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+		r = r.WithContext(logger.WithContext(ctx))
+
+		m := httpsnoop.CaptureMetrics(next, w, r)
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+
+		logger.Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("route", route).
+			Int("status", m.Code).
+			Int64("bytes", m.Written).
+			Dur("duration", m.Duration).
+			Str("remote_addr", r.RemoteAddr).
+			Str("user_agent", r.UserAgent()).
+			Msg("http request")
+	})
+}
+
+// Логгер из контекста (с request_id, nats_seq и т.д.), либо общий логгер обработчика
+func (h *Handler) logger(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &h.log
+}
+
+// Идентификатор запроса из контекста
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Случайный идентификатор для запросов и подключений
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/metrics"
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/service"
+	"github.com/Yury132/Golang-Task-3/internal/tracing"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Время на отправку кадра закрытия WebSocket
+const closeWriteWait = time.Second
+
+// Время на запись сообщения клиенту по умолчанию
+const defaultWriteWait = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Разрешение открытия WebSocket подключения всем клиентам
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Участник чата, подключенный по WebSocket
+type wsClient struct {
+	id     string
+	conn   *websocket.Conn
+	user   models.UserStruct
+	logger zerolog.Logger
+	// Время на запись одного сообщения
+	writeWait time.Duration
+
+	// gorilla/websocket допускает только одного писателя одновременно
+	writeMu sync.Mutex
+}
+
+func (c *wsClient) User() models.UserStruct {
+	return c.user
+}
+
+// Отправка сообщения чата со своим спаном
+// Клиент, который не успел принять сообщение за writeWait, отключается: иначе он задерживал бы
+// воркер рассылки вместе со всеми чатами этого воркера
+func (c *wsClient) Send(ctx context.Context, msg *models.SendMessage) error {
+	// Готовим сообщение JSON для отправки
+	screen := models.MessageOnScreen{
+		Type:       msg.Event,
+		Seq:        msg.Seq,
+		Version:    msg.Version,
+		ParentSeq:  msg.ParentSeq,
+		ReplyCount: msg.ReplyCount,
+		Msg:        msg.Msg,
+		Html:       msg.Html,
+		Author:     msg.Author,
+		// Вложения есть только у нового сообщения, превью ссылок - у события message.updated
+		Attachments: msg.Attachments,
+		Previews:    msg.Previews,
+	}
+	switch msg.Event {
+	case models.EventReactionAdded, models.EventReactionRemoved:
+		screen.Reaction = msg.Reaction
+		screen.UserId = msg.AuthorId
+		screen.Count = msg.ReactionCount
+	case models.EventTypingStart, models.EventTypingStop, models.EventMessageRead:
+		screen.UserId = msg.AuthorId
+	case models.EventPresence:
+		screen.UserId = msg.AuthorId
+		screen.Status = msg.Status
+		screen.LastSeen = msg.LastSeen
+	}
+	b, err := json.Marshal(screen)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal message")
+	}
+
+	_, span := tracing.Tracer().Start(ctx, "ws.write", trace.WithAttributes(
+		attribute.String("conn_id", c.id),
+		attribute.String("remote_addr", c.conn.RemoteAddr().String()),
+	))
+	defer span.End()
+
+	c.writeMu.Lock()
+	if err = c.conn.SetWriteDeadline(time.Now().Add(c.writeWait)); err == nil {
+		err = c.conn.WriteMessage(msg.MessageType, b)
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		// После ошибки записи подключение непригодно, reader получит ошибку и отключит клиента от чата
+		if closeErr := c.conn.Close(); closeErr != nil {
+			c.logger.Debug().Err(closeErr).Msg("failed to close websocket connection")
+		}
+		return errors.Wrapf(err, "failed to write to connection %s", c.id)
+	}
+
+	if !msg.PublishedAt.IsZero() {
+		metrics.DeliveryLatency.Observe(time.Since(msg.PublishedAt).Seconds())
+	}
+
+	return nil
+}
+
+// Сообщение об ошибке команды только этому клиенту
+func (c *wsClient) sendError(ctx context.Context, chatId int, message string) {
+	msg := &models.SendMessage{
+		Event:       models.EventError,
+		Msg:         message,
+		MessageType: websocket.TextMessage,
+		ChatId:      chatId,
+	}
+	if err := c.Send(ctx, msg); err != nil {
+		c.logger.Debug().Err(err).Msg("failed to send error")
+	}
+}
+
+// Закрытие подключения, например при удалении чата
+func (c *wsClient) Close(reason string) {
+	c.close(websocket.CloseNormalClosure, reason)
+}
+
+// Кадр закрытия с кодом и причиной, затем закрытие подключения
+// Ожидающий сообщений reader получит ошибку и отключит клиента от чата
+func (c *wsClient) close(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+
+	c.writeMu.Lock()
+	err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteWait))
+	c.writeMu.Unlock()
+	if err != nil {
+		c.logger.Debug().Err(err).Msg("failed to send close frame")
+	}
+
+	if err = c.conn.Close(); err != nil {
+		c.logger.Debug().Err(err).Msg("failed to close websocket connection")
+	}
+}
+
+// Подключение через WebSocket
+// Сюда приходят все клиенты
+func (h *Handler) WsEndpoint(w http.ResponseWriter, r *http.Request) {
+
+	// ID комнаты (чата)
+	chatId, err := strconv.Atoi(r.URL.Query().Get("roomId"))
+	if err != nil || chatId < 1 {
+		h.renderError(w, r, service.NotFound("chat not found"))
+		return
+	}
+
+	// Пользователь берется из сессии, а не из параметров запроса
+	user, err := sessionUser(r)
+	if err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	// Проверка на существование чата до открытия подключения
+	if _, err = h.chats.GetChat(r.Context(), chatId); err != nil {
+		h.renderError(w, r, err)
+		return
+	}
+
+	// Идентификатор подключения для логов
+	connId := newID()
+	logger := h.logger(r.Context()).With().
+		Str("user_id", user.UserId).
+		Int("chat_id", chatId).
+		Str("conn_id", connId).
+		Logger()
+
+	// Уникальное подключение *websocket.Conn
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to upgrade connection")
+		return
+	}
+
+	client := &wsClient{id: connId, conn: conn, user: user, logger: logger, writeWait: h.writeWait}
+
+	// Контекст запроса заканчивается вместе с подключением, логгер переносим в фоновый контекст
+	ctx := logger.WithContext(context.Background())
+
+	// Чат мог быть удален, пока открывалось подключение
+	if err = h.chats.Join(ctx, chatId, client); err != nil {
+		logger.Warn().Err(err).Msg("failed to join chat")
+		client.Close("chat not found")
+		return
+	}
+	defer h.chats.Leave(chatId, client)
+
+	h.clients.Store(client, struct{}{})
+	defer h.clients.Delete(client)
+
+	logger.Info().Msg("websocket connected")
+
+	// Подключение считается открытым, пока работает reader
+	h.trackConnection(chatId, 1)
+	defer h.trackConnection(chatId, -1)
+
+	// Сообщение клиенту
+	welcome := &models.SendMessage{
+		Msg:         "Добро пожаловать в чат!",
+		Author:      user.UserName,
+		MessageType: websocket.TextMessage,
+		ChatId:      chatId,
+	}
+	if err = client.Send(ctx, welcome); err != nil {
+		logger.Error().Err(err).Msg("failed to write welcome message")
+	}
+
+	// В бесконечном цикле прослушиваем входящие сообщения клиента
+	h.reader(ctx, client, chatId)
+}
+
+// Изменение числа подключений чата в метрике
+// Серия чата удаляется вместе с последним подключением, в том числе при удалении чата,
+// поэтому число серий не растет с числом когда-либо созданных чатов
+func (h *Handler) trackConnection(chatId int, delta int) {
+	label := strconv.Itoa(chatId)
+
+	h.connMu.Lock()
+	defer h.connMu.Unlock()
+
+	count := h.chatConns[chatId] + delta
+	if count <= 0 {
+		delete(h.chatConns, chatId)
+		metrics.WebsocketConnections.DeleteLabelValues(label)
+		return
+	}
+	h.chatConns[chatId] = count
+	metrics.WebsocketConnections.WithLabelValues(label).Set(float64(count))
+}
+
+// В бесконечном цикле прослушиваем входящие сообщения от клиента и выполняем их
+// Цикл заканчивается, когда подключение закрывается
+func (h *Handler) reader(ctx context.Context, client *wsClient, chatId int) {
+	logger := client.logger
+	defer func() {
+		if err := client.conn.Close(); err != nil {
+			logger.Debug().Err(err).Msg("failed to close websocket connection")
+		}
+	}()
+
+	for {
+		// Ждем сообщение от клиента
+		messageType, p, err := client.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Warn().Err(err).Msg("websocket read failed")
+			} else {
+				logger.Info().Msg("websocket disconnected")
+			}
+			return
+		}
+
+		logger.Debug().Int("size", len(p)).Msg("message received")
+
+		cmd := parseCommand(p)
+		switch cmd.Type {
+		case models.CommandSendMessage:
+			err = h.sendMessage(ctx, client, chatId, messageType, cmd)
+		case models.CommandSubscribeThread:
+			err = h.chats.SubscribeThread(ctx, chatId, cmd.Seq, client)
+		case models.CommandUnsubscribeThread:
+			h.chats.UnsubscribeThread(chatId, cmd.Seq, client)
+		case models.CommandTypingStart:
+			err = h.chats.SetTyping(ctx, chatId, client, true)
+		case models.CommandTypingStop:
+			err = h.chats.SetTyping(ctx, chatId, client, false)
+		case models.CommandPresenceAway:
+			err = h.chats.SetAway(ctx, chatId, client, true)
+		case models.CommandPresenceActive:
+			err = h.chats.SetAway(ctx, chatId, client, false)
+		case models.CommandMarkRead:
+			err = h.chats.MarkRead(ctx, chatId, cmd.Seq, client.user)
+		default:
+			err = service.Validation("unknown command " + cmd.Type)
+		}
+
+		if status, _, message := classifyError(err); err != nil && status < http.StatusInternalServerError {
+			// Некорректную команду отклоняем, подключение оставляем открытым
+			logger.Debug().Err(err).Str("command", cmd.Type).Msg("command rejected")
+			client.sendError(ctx, chatId, message)
+			continue
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("command", cmd.Type).Msg("failed to handle command")
+			return
+		}
+	}
+}
+
+// Команда клиента в формате JSON
+// Остальной текст считается сообщением в чат, как до появления команд
+func parseCommand(p []byte) models.ClientCommand {
+	var cmd models.ClientCommand
+	if err := json.Unmarshal(p, &cmd); err != nil || cmd.Type == "" {
+		return models.ClientCommand{Type: models.CommandSendMessage, Msg: string(p)}
+	}
+
+	return cmd
+}
+
+// Сохранение сообщения клиента и его отправка в шину
+func (h *Handler) sendMessage(ctx context.Context, client *wsClient, chatId int, messageType int, cmd models.ClientCommand) error {
+	// Готовим сообщение для отправки
+	msg := &models.SendMessage{
+		Msg:         cmd.Msg,
+		ParentSeq:   cmd.ParentSeq,
+		Author:      client.user.UserName,
+		AuthorId:    client.user.UserId,
+		MessageType: messageType,
+		ChatId:      chatId,
+	}
+	for _, id := range cmd.Attachments {
+		msg.Attachments = append(msg.Attachments, models.Attachment{Id: id})
+	}
+
+	// Трассировка сообщения начинается с его получения от клиента
+	msgCtx, span := tracing.Tracer().Start(ctx, "ws.receive", trace.WithAttributes(
+		attribute.Int("chat_id", chatId),
+		attribute.String("user_id", client.user.UserId),
+	))
+	defer span.End()
+
+	// Сохраняем сообщение и отправляем его в шину
+	if err := h.chats.SendMessage(msgCtx, msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	client.logger.Debug().Int64("seq", msg.Seq).Msg("message sent")
+
+	return nil
+}
+
+// Закрытие всех WebSocket подключений при остановке сервера
+// Клиенты получают кадр закрытия с кодом 1001 (going away)
+func (h *Handler) CloseConnections() {
+	h.clients.Range(func(key, _ interface{}) bool {
+		key.(*wsClient).close(websocket.CloseGoingAway, "server is shutting down")
+		return true
+	})
+}
@@ -3,16 +3,21 @@ package http
 import (
 	"net/http"
 
+	"github.com/Yury132/Golang-Task-3/internal/metrics"
+	"github.com/Yury132/Golang-Task-3/internal/tracing"
 	"github.com/Yury132/Golang-Task-3/internal/transport/http/handlers"
 	"github.com/gorilla/mux"
 )
 
 func InitRoutes(h *handlers.Handler) *mux.Router {
 	r := mux.NewRouter()
+	r.Use(tracing.HTTPMiddleware, h.RequestLogger, metrics.HTTPMiddleware)
 
 	r.HandleFunc("/", h.Home).Methods(http.MethodGet)
 	r.HandleFunc("/auth", h.Auth).Methods(http.MethodGet)
 	r.HandleFunc("/callback", h.Callback).Methods(http.MethodGet)
+	// Вход без Google для нагрузочного тестирования
+	r.HandleFunc("/auth/test", h.TestLogin).Methods(http.MethodPost)
 	r.HandleFunc("/me", h.Me).Methods(http.MethodGet)
 	r.HandleFunc("/logout", h.Logout).Methods(http.MethodGet)
 	r.HandleFunc("/users-list", h.GetUsersList).Methods(http.MethodGet)
@@ -34,9 +39,29 @@ func InitRoutes(h *handlers.Handler) *mux.Router {
 	r.HandleFunc("/delete-chat/{chatId:[0-9]+}", h.DeleteChat)
 	// Изменение названия чата
 	r.HandleFunc("/edit-chat", h.EditChat).Methods(http.MethodPost)
+	// История сообщений чата
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/messages", h.GetMessages).Methods(http.MethodGet)
+	// Участники чата с присутствием
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/members", h.GetMembers).Methods(http.MethodGet)
+	// Изменение и удаление сообщения
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/messages/{seq:[0-9]+}", h.EditMessage).Methods(http.MethodPatch)
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/messages/{seq:[0-9]+}", h.DeleteMessage).Methods(http.MethodDelete)
+	// Реакции текущего пользователя на сообщение
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/messages/{seq:[0-9]+}/reactions/{reaction}", h.AddReaction).Methods(http.MethodPut)
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/messages/{seq:[0-9]+}/reactions/{reaction}", h.RemoveReaction).Methods(http.MethodDelete)
+	// Отметка сообщений до этого включительно прочитанными
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/messages/{seq:[0-9]+}/read", h.MarkRead).Methods(http.MethodPut)
+	// Ответы в треде сообщения
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/messages/{seq:[0-9]+}/replies", h.GetReplies).Methods(http.MethodGet)
+	// Полнотекстовый поиск сообщений
+	r.HandleFunc("/api/v1/search", h.SearchMessages).Methods(http.MethodGet)
+	// Загрузка вложения, оно прикрепляется к следующему отправленному с ним сообщению
+	r.HandleFunc("/api/v1/chats/{chatId:[0-9]+}/attachments", h.UploadAttachment).Methods(http.MethodPost)
+	// Скачивание вложения и миниатюры изображения
+	r.HandleFunc("/api/v1/attachments/{attachmentId:[0-9a-f]+}", h.GetAttachment).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/attachments/{attachmentId:[0-9a-f]+}/thumbnail", h.GetThumbnail).Methods(http.MethodGet)
 	// Тест - Получаем от клиента данные JSON и возвращаем JSON
 	r.HandleFunc("/test", h.Test).Methods(http.MethodPost)
-	http.Handle("/", r)
 
 	return r
 }
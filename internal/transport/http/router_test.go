@@ -0,0 +1,1480 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/Yury132/Golang-Task-3/internal/blob"
+	"github.com/Yury132/Golang-Task-3/internal/bus"
+	"github.com/Yury132/Golang-Task-3/internal/metrics"
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/natsserver"
+	"github.com/Yury132/Golang-Task-3/internal/presence"
+	"github.com/Yury132/Golang-Task-3/internal/service"
+	"github.com/Yury132/Golang-Task-3/internal/service/servicetest"
+	"github.com/Yury132/Golang-Task-3/internal/transport/http/handlers"
+	"github.com/Yury132/Golang-Task-3/internal/worker"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog"
+)
+
+// Время ожидания сообщений по WebSocket
+const waitTimeout = 5 * time.Second
+
+// Максимальный размер вложения
+const testAttachmentSize = 64 << 10
+
+// Шаблоны страниц читаются относительно корня репозитория
+func TestMain(m *testing.M) {
+	if err := os.Chdir("../../.."); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// Сервер со всеми маршрутами, шиной и пулом рассылки
+// Хранилища заменены заглушками, OAuth и Google - тестовыми серверами
+type testServer struct {
+	*httptest.Server
+	handler *handlers.Handler
+	google  *servicetest.GoogleAPI
+}
+
+// Шина в памяти процесса
+func newMemoryBus(t *testing.T) bus.Bus {
+	return bus.NewMemory(zerolog.Nop(), 64)
+}
+
+// Шина на встроенном NATS сервере
+func newJetStreamBus(t *testing.T) bus.Bus {
+	t.Helper()
+
+	srv, err := natsserver.New(zerolog.Nop(), "127.0.0.1", -1, "")
+	if err != nil {
+		t.Fatalf("failed to start nats server: %v", err)
+	}
+	t.Cleanup(srv.Shutdown)
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("failed to create jetstream: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+
+	stream, err := js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:      "EVENTS",
+		Subjects:  []string{"events.>"},
+		Retention: jetstream.LimitsPolicy,
+		Storage:   jetstream.MemoryStorage,
+	})
+	if err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+
+	cons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:   "test",
+		AckPolicy: jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		t.Fatalf("failed to create consumer: %v", err)
+	}
+
+	return bus.NewJetStream(zerolog.Nop(), nc, js, cons, "events.test", "signals.test")
+}
+
+// Страницы для превью ссылок
+var testPages = map[string]models.LinkPreview{
+	"https://example.com/page": {Title: "Example page", Description: "Page <b>description</b>", SiteName: "Example"},
+}
+
+func newTestServer(t *testing.T, newBus func(t *testing.T) bus.Bus, opts ...func(h *handlers.Handler)) *testServer {
+	t.Helper()
+
+	// OAuth сервер выдает токен "token-<code>"
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%s","token_type":"Bearer"}`, r.Form.Get("code"))
+	}))
+	t.Cleanup(tokenSrv.Close)
+
+	oauthCfg := &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: tokenSrv.URL + "/auth", TokenURL: tokenSrv.URL + "/token"},
+	}
+
+	google := &servicetest.GoogleAPI{ByToken: make(map[string][]byte)}
+	msgBus := newBus(t)
+
+	svc := service.New(zerolog.Nop(), oauthCfg, google, &servicetest.Storage{})
+	presenceStore := presence.NewMemory(zerolog.Nop(), "test")
+	chatStorage := servicetest.NewChatStorage()
+	chats := service.NewChats(zerolog.Nop(), chatStorage, msgBus, presenceStore)
+	blobs, err := blob.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal() error = %v", err)
+	}
+	attachments := service.NewAttachments(zerolog.Nop(), chatStorage, blobs, service.AttachmentOptions{
+		MaxSize:       testAttachmentSize,
+		AllowedTypes:  []string{"image/*", "text/plain"},
+		ThumbnailSize: 32,
+		MaxPixels:     1 << 20,
+	})
+	h := handlers.New(zerolog.Nop(), oauthCfg, svc, chats).WithAttachments(attachments, testAttachmentSize, time.Minute)
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	pool := worker.New(zerolog.Nop(), 2, 16, chats.Deliver)
+	pool.Start()
+	// Ссылки разворачиваются без сети, страницы - в testPages
+	previews := service.NewPreviews(zerolog.Nop(), chatStorage, &servicetest.Fetcher{Pages: testPages}, msgBus, service.PreviewOptions{
+		Workers:    1,
+		QueueSize:  16,
+		CacheTTL:   time.Hour,
+		FailureTTL: time.Hour,
+	})
+	previews.Start()
+	sub, err := msgBus.Subscribe(func(ctx context.Context, msg *models.SendMessage) error {
+		if err := pool.Submit(ctx, msg); err != nil {
+			return err
+		}
+		previews.HandleMessage(ctx, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	signals, err := msgBus.SubscribeBroadcast(chats.Deliver)
+	if err != nil {
+		t.Fatalf("SubscribeBroadcast() error = %v", err)
+	}
+	presenceWatch, err := presenceStore.Watch(chats.ApplyPresence)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	srv := httptest.NewServer(InitRoutes(h))
+	t.Cleanup(func() {
+		h.CloseConnections()
+		srv.Close()
+		sub.Stop()
+		signals.Stop()
+		presenceWatch.Stop()
+		pool.Stop()
+		previews.Stop()
+	})
+
+	return &testServer{Server: srv, handler: h, google: google}
+}
+
+// Пользователь, прошедший авторизацию через Google
+type testUser struct {
+	id     string
+	name   string
+	client *http.Client
+}
+
+// Авторизация через /callback, сессия сохраняется в cookie jar клиента
+func (s *testServer) login(t *testing.T, id string, name string) *testUser {
+	t.Helper()
+
+	s.google.ByToken["token-"+id] = []byte(fmt.Sprintf(`{"id":%q,"name":%q,"email":"%s@example.com"}`, id, name, id))
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &testUser{id: id, name: name, client: &http.Client{Jar: jar}}
+
+	resp := user.get(t, s.URL+"/callback?state=pseudo-random&code="+id, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("callback status = %d, want 200", resp.StatusCode)
+	}
+
+	return user
+}
+
+// Анонимный пользователь без сессии
+func anonymous() *testUser {
+	return &testUser{client: &http.Client{}}
+}
+
+// GET запрос, тело ответа вычитывается
+func (u *testUser) get(t *testing.T, rawURL string, header http.Header) *response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return u.do(t, req)
+}
+
+// POST запрос формы
+func (u *testUser) postForm(t *testing.T, rawURL string, form url.Values) *response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, rawURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return u.do(t, req)
+}
+
+func (u *testUser) do(t *testing.T, req *http.Request) *response {
+	t.Helper()
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &response{Response: resp, body: string(body)}
+}
+
+// Загрузка файла в чат формой multipart/form-data
+func (u *testUser) upload(t *testing.T, rawURL string, name string, data []byte) *response {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req, err := http.NewRequest(http.MethodPost, rawURL, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return u.do(t, req)
+}
+
+// Подключение к чату по WebSocket с сессией пользователя
+func (s *testServer) dial(t *testing.T, u *testUser, chatId int) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+
+	dialer := websocket.Dialer{Jar: u.client.Jar, HandshakeTimeout: waitTimeout}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?roomId="+strconv.Itoa(chatId), nil)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+type response struct {
+	*http.Response
+	body string
+}
+
+// Ответ с ошибкой в формате JSON
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+// Следующее сообщение WebSocket без событий присутствия, их проверяет TestPresence
+func readMessage(t *testing.T, conn *websocket.Conn) models.MessageOnScreen {
+	t.Helper()
+
+	for {
+		msg := readEvent(t, conn)
+		if msg.Type != models.EventPresence {
+			return msg
+		}
+	}
+}
+
+// Следующее сообщение WebSocket
+func readEvent(t *testing.T, conn *websocket.Conn) models.MessageOnScreen {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	var msg models.MessageOnScreen
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("failed to read websocket message: %v", err)
+	}
+	return msg
+}
+
+func createChat(t *testing.T, s *testServer, u *testUser, name string) models.RoomStruct {
+	t.Helper()
+
+	if resp := u.postForm(t, s.URL+"/create-chat", url.Values{"chatName": {name}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("create chat status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+
+	var rooms []models.RoomStruct
+	if err := json.Unmarshal([]byte(u.get(t, s.URL+"/get-rooms", nil).body), &rooms); err != nil {
+		t.Fatalf("failed to decode rooms: %v", err)
+	}
+	for _, room := range rooms {
+		if room.RoomName == name {
+			return room
+		}
+	}
+	t.Fatalf("chat %q is not in %+v", name, rooms)
+	return models.RoomStruct{}
+}
+
+// Одновременные входы не смешивают данные пользователей в сессиях
+func TestConcurrentLogins(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+
+	var users []*testUser
+	for i := 1; i <= 10; i++ {
+		id := strconv.Itoa(i)
+		s.google.ByToken["token-"+id] = []byte(fmt.Sprintf(`{"id":%q,"name":"User %s","email":"%s@example.com"}`, id, id, id))
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, &testUser{id: id, name: "User " + id, client: &http.Client{Jar: jar}})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(users))
+	for _, u := range users {
+		wg.Add(1)
+		go func(u *testUser) {
+			defer wg.Done()
+			resp, err := u.client.Get(s.URL + "/callback?state=pseudo-random&code=" + u.id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				errs <- fmt.Errorf("callback of %s: status %d", u.id, resp.StatusCode)
+			}
+		}(u)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for _, u := range users {
+		resp := u.get(t, s.URL+"/me", nil)
+		if !strings.Contains(resp.body, u.name+"<") || !strings.Contains(resp.body, u.id+"@example.com") {
+			t.Errorf("/me of %s: body = %s", u.id, resp.body)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+
+	resp := anonymous().get(t, s.URL+"/me", nil)
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(resp.body, "авторизуйтесь") {
+		t.Errorf("anonymous /me: status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+
+	alice := s.login(t, "1", "Alice")
+	resp = alice.get(t, s.URL+"/me", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, "Alice") || !strings.Contains(resp.body, "1@example.com") {
+		t.Errorf("/me: status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+
+	resp = anonymous().get(t, s.URL+"/callback?state=wrong&code=1", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("callback with wrong state: status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestTestLogin(t *testing.T) {
+	login := func(s *testServer, token string, id string) (*testUser, *response) {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := &testUser{client: &http.Client{Jar: jar}}
+
+		req, err := http.NewRequest(http.MethodPost, s.URL+"/auth/test", strings.NewReader(url.Values{"id": {id}, "name": {"Load " + id}}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		return user, user.do(t, req)
+	}
+
+	disabled := newTestServer(t, newMemoryBus)
+	if _, resp := login(disabled, "", "1"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("disabled test login: status = %d, want 404", resp.StatusCode)
+	}
+
+	s := newTestServer(t, newMemoryBus, func(h *handlers.Handler) { h.WithTestAuth("secret") })
+	if _, resp := login(s, "wrong", "1"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d, want 401", resp.StatusCode)
+	}
+	if _, resp := login(s, "secret", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty id: status = %d, want 400", resp.StatusCode)
+	}
+
+	user, resp := login(s, "secret", "1")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("test login: status = %d, want 204", resp.StatusCode)
+	}
+	if resp = user.get(t, s.URL+"/me", nil); resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, "Load 1") {
+		t.Errorf("/me after test login: status = %d", resp.StatusCode)
+	}
+}
+
+func TestChatPages(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+
+	chat := createChat(t, s, alice, "general")
+
+	resp := alice.get(t, s.URL+"/start", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, "/go-chat/"+strconv.Itoa(chat.RoomId)) {
+		t.Errorf("/start: status = %d, body does not link chat", resp.StatusCode)
+	}
+
+	// Переименование перенаправляет обратно в чат
+	resp = alice.postForm(t, s.URL+"/edit-chat", url.Values{"chatID": {strconv.Itoa(chat.RoomId)}, "chatName": {"renamed"}})
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/go-chat/"+strconv.Itoa(chat.RoomId) || !strings.Contains(resp.body, "renamed") {
+		t.Errorf("edit chat: status = %d, path = %s", resp.StatusCode, resp.Request.URL.Path)
+	}
+
+	// Переименовать и удалить чат может только его администратор
+	bob := s.login(t, "2", "Bob")
+	if resp = bob.postForm(t, s.URL+"/edit-chat", url.Values{"chatID": {strconv.Itoa(chat.RoomId)}, "chatName": {"hacked"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("edit chat by other user: status = %d, want 403", resp.StatusCode)
+	}
+	if resp = bob.get(t, s.URL+"/delete-chat/"+strconv.Itoa(chat.RoomId), nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("delete chat by other user: status = %d, want 403", resp.StatusCode)
+	}
+	if resp = anonymous().get(t, s.URL+"/delete-chat/"+strconv.Itoa(chat.RoomId), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous delete chat: status = %d, want 401", resp.StatusCode)
+	}
+
+	resp = alice.get(t, s.URL+"/delete-chat/"+strconv.Itoa(chat.RoomId), nil)
+	if resp.StatusCode != http.StatusOK || strings.Contains(resp.body, "renamed") {
+		t.Errorf("delete chat: status = %d, chat is still listed", resp.StatusCode)
+	}
+
+	// Переход в удаленный чат возвращает к списку чатов
+	resp = alice.get(t, s.URL+"/go-chat/"+strconv.Itoa(chat.RoomId), nil)
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/start" {
+		t.Errorf("deleted chat: status = %d, path = %s", resp.StatusCode, resp.Request.URL.Path)
+	}
+
+	resp = anonymous().get(t, s.URL+"/start", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous /start: status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	jsonHeader := http.Header{"Accept": {"application/json"}}
+
+	tests := []struct {
+		name   string
+		resp   func() *response
+		status int
+		code   string
+	}{
+		{
+			name:   "invalid after_seq",
+			resp:   func() *response { return alice.get(t, s.URL+"/api/v1/chats/1/messages?after_seq=x", nil) },
+			status: http.StatusBadRequest,
+			code:   "validation",
+		},
+		{
+			name:   "negative after_seq",
+			resp:   func() *response { return alice.get(t, s.URL+"/api/v1/chats/1/messages?after_seq=-1", nil) },
+			status: http.StatusBadRequest,
+			code:   "validation",
+		},
+		{
+			name:   "anonymous history",
+			resp:   func() *response { return anonymous().get(t, s.URL+"/api/v1/chats/1/messages", nil) },
+			status: http.StatusUnauthorized,
+			code:   "unauthorized",
+		},
+		{
+			name:   "anonymous replies",
+			resp:   func() *response { return anonymous().get(t, s.URL+"/api/v1/chats/1/messages/1/replies", nil) },
+			status: http.StatusUnauthorized,
+			code:   "unauthorized",
+		},
+		{
+			name:   "delete missing chat",
+			resp:   func() *response { return alice.get(t, s.URL+"/delete-chat/42", jsonHeader) },
+			status: http.StatusNotFound,
+			code:   "not_found",
+		},
+		{
+			name:   "empty chat name",
+			resp:   func() *response { return alice.postForm(t, s.URL+"/create-chat", url.Values{"chatName": {" "}}) },
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "anonymous json",
+			resp:   func() *response { return anonymous().get(t, s.URL+"/start", jsonHeader) },
+			status: http.StatusUnauthorized,
+			code:   "unauthorized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := tt.resp()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d, body = %s", resp.StatusCode, tt.status, resp.body)
+			}
+
+			if tt.code == "" {
+				// Браузер получает страницу ошибки
+				if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+					t.Errorf("Content-Type = %q, want text/html", resp.Header.Get("Content-Type"))
+				}
+				return
+			}
+
+			var body apiError
+			if err := json.Unmarshal([]byte(resp.body), &body); err != nil {
+				t.Fatalf("failed to decode error %q: %v", resp.body, err)
+			}
+			if body.Error.Code != tt.code || body.Error.Message == "" {
+				t.Errorf("error = %+v, want code %q", body.Error, tt.code)
+			}
+			if body.RequestID == "" || body.RequestID != resp.Header.Get("X-Request-ID") {
+				t.Errorf("request_id = %q, X-Request-ID = %q", body.RequestID, resp.Header.Get("X-Request-ID"))
+			}
+		})
+	}
+}
+
+func TestWebsocketBroadcast(t *testing.T) {
+	for name, newBus := range map[string]func(t *testing.T) bus.Bus{
+		"memory":    newMemoryBus,
+		"jetstream": newJetStreamBus,
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, newBus)
+			alice := s.login(t, "1", "Alice")
+			bob := s.login(t, "2", "Bob")
+			chat := createChat(t, s, alice, "general")
+
+			aliceConn, _, err := s.dial(t, alice, chat.RoomId)
+			if err != nil {
+				t.Fatalf("alice dial: %v", err)
+			}
+			bobConn, _, err := s.dial(t, bob, chat.RoomId)
+			if err != nil {
+				t.Fatalf("bob dial: %v", err)
+			}
+
+			// Приветствие без номера
+			for _, conn := range []*websocket.Conn{aliceConn, bobConn} {
+				if msg := readMessage(t, conn); msg.Seq != 0 || msg.Msg == "" {
+					t.Errorf("welcome message = %+v", msg)
+				}
+			}
+
+			for _, text := range []string{"hello", "how are you"} {
+				if err = aliceConn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+
+			// Оба участника получают сообщения по порядку номеров
+			for _, conn := range []*websocket.Conn{aliceConn, bobConn} {
+				for i, text := range []string{"hello", "how are you"} {
+					msg := readMessage(t, conn)
+					if msg.Seq != int64(i+1) || msg.Msg != text || msg.Author != "Alice" {
+						t.Errorf("message %d = %+v", i, msg)
+					}
+				}
+			}
+
+			// Те же сообщения доступны в истории
+			var history []models.Message
+			resp := bob.get(t, s.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/messages?after_seq=1", nil)
+			if err = json.Unmarshal([]byte(resp.body), &history); err != nil {
+				t.Fatalf("failed to decode history %q: %v", resp.body, err)
+			}
+			if len(history) != 1 || history[0].Seq != 2 || history[0].Msg != "how are you" {
+				t.Errorf("history = %+v", history)
+			}
+		})
+	}
+}
+
+// Изменение и удаление сообщения рассылаются участникам как события с тем же номером
+// Клиент, который не читает сообщения, отключается и не задерживает рассылку остальным
+func TestSlowClient(t *testing.T) {
+	s := newTestServer(t, newMemoryBus, func(h *handlers.Handler) { h.WithWriteTimeout(200 * time.Millisecond) })
+	alice := s.login(t, "1", "Alice")
+	bob := s.login(t, "2", "Bob")
+	chat := createChat(t, s, alice, "general")
+
+	aliceConn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	readMessage(t, aliceConn)
+
+	// Маленький буфер приема, чтобы запись сервера быстро заблокировалась
+	dialer := websocket.Dialer{
+		Jar:              bob.client.Jar,
+		HandshakeTimeout: waitTimeout,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err == nil {
+				err = conn.(*net.TCPConn).SetReadBuffer(4 << 10)
+			}
+			return conn, err
+		},
+	}
+	bobConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?roomId="+strconv.Itoa(chat.RoomId), nil)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+
+	text := strings.Repeat("x", 64<<10)
+	for i := 0; i < 150; i++ {
+		if err = aliceConn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if msg := readMessage(t, aliceConn); msg.Seq != int64(i+1) {
+			t.Fatalf("message %d = seq %d", i, msg.Seq)
+		}
+	}
+
+	// Сервер закрыл подключение и отключил клиента от чата
+	membersURL := s.URL + "/api/v1/chats/" + strconv.Itoa(chat.RoomId) + "/members"
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		var members []models.Member
+		if err = json.Unmarshal([]byte(alice.get(t, membersURL, nil).body), &members); err != nil {
+			t.Fatalf("failed to decode members: %v", err)
+		}
+		if len(members) == 2 && members[1].UserName == "Bob" && members[1].Status == models.PresenceOffline {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slow client is not disconnected: members = %+v", members)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Серия метрики подключений чата есть, только пока в чате есть подключения
+func TestConnectionsMetric(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	chat := createChat(t, s, alice, "general")
+
+	for i := 0; i < 2; i++ {
+		conn, _, err := s.dial(t, alice, chat.RoomId)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		readMessage(t, conn)
+	}
+	if value, ok := connectionsMetric(t, chat.RoomId); !ok || value != 2 {
+		t.Errorf("connections = %v, %v, want 2", value, ok)
+	}
+
+	// Подключения удаленного чата закрываются, серия удаляется
+	alice.get(t, s.URL+"/delete-chat/"+strconv.Itoa(chat.RoomId), nil)
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		value, ok := connectionsMetric(t, chat.RoomId)
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connections of deleted chat = %v", value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Значение метрики подключений чата, false если серии нет
+func connectionsMetric(t *testing.T, chatId int) (float64, bool) {
+	t.Helper()
+
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if !strings.HasSuffix(family.GetName(), "_websocket_connections") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "chat_id" && label.GetValue() == strconv.Itoa(chatId) {
+					return metric.GetGauge().GetValue(), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestMessageEditAndDelete(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	bob := s.login(t, "2", "Bob")
+	chat := createChat(t, s, alice, "general")
+
+	bobConn, _, err := s.dial(t, bob, chat.RoomId)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	readMessage(t, bobConn)
+
+	if err = bobConn.WriteMessage(websocket.TextMessage, []byte("helo")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sent := readMessage(t, bobConn)
+
+	msgURL := s.URL + "/api/v1/chats/" + strconv.Itoa(chat.RoomId) + "/messages/" + strconv.FormatInt(sent.Seq, 10)
+	request := func(u *testUser, method string, body string) *response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, msgURL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return u.do(t, req)
+	}
+
+	if resp := request(anonymous(), http.MethodPatch, `{"msg":"hacked"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous edit: status = %d, want 401", resp.StatusCode)
+	}
+	carol := s.login(t, "3", "Carol")
+	if resp := request(carol, http.MethodPatch, `{"msg":"hacked"}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("edit by other user: status = %d, want 403", resp.StatusCode)
+	}
+
+	resp := request(bob, http.MethodPatch, `{"msg":"hello"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("edit: status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+	var edited models.Message
+	if err = json.Unmarshal([]byte(resp.body), &edited); err != nil || edited.Msg != "hello" || edited.Version != 2 {
+		t.Errorf("edit response = %s, %v", resp.body, err)
+	}
+	if msg := readMessage(t, bobConn); msg.Type != models.EventMessageEdited || msg.Seq != sent.Seq || msg.Version != 2 || msg.Msg != "hello" {
+		t.Errorf("edit event = %+v", msg)
+	}
+
+	// Создатель чата удаляет чужое сообщение
+	if resp = request(alice, http.MethodDelete, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+	if msg := readMessage(t, bobConn); msg.Type != models.EventMessageDeleted || msg.Seq != sent.Seq || msg.Msg != "" {
+		t.Errorf("delete event = %+v", msg)
+	}
+	if resp = request(bob, http.MethodPatch, `{"msg":"again"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("edit of deleted message: status = %d, want 409", resp.StatusCode)
+	}
+
+	// В истории остается отметка об удалении
+	var history []models.Message
+	resp = bob.get(t, s.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/messages", nil)
+	if err = json.Unmarshal([]byte(resp.body), &history); err != nil {
+		t.Fatalf("failed to decode history %q: %v", resp.body, err)
+	}
+	if len(history) != 1 || history[0].DeletedAt == nil || history[0].Msg != "" {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	bob := s.login(t, "2", "Bob")
+	chat := createChat(t, s, alice, "general")
+
+	aliceConn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	readMessage(t, aliceConn)
+
+	if err = aliceConn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sent := readMessage(t, aliceConn)
+
+	messagesURL := s.URL + "/api/v1/chats/" + strconv.Itoa(chat.RoomId) + "/messages"
+	reactionURL := messagesURL + "/" + strconv.FormatInt(sent.Seq, 10) + "/reactions/" + url.PathEscape("👍")
+	request := func(u *testUser, method string) *response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, reactionURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.do(t, req)
+	}
+
+	if resp := request(anonymous(), http.MethodPut); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous reaction: status = %d, want 401", resp.StatusCode)
+	}
+
+	// Повторная реакция не меняет счетчик и не рассылается
+	for i := 0; i < 2; i++ {
+		if resp := request(bob, http.MethodPut); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("add reaction: status = %d, body = %s", resp.StatusCode, resp.body)
+		}
+	}
+	if msg := readMessage(t, aliceConn); msg.Type != models.EventReactionAdded || msg.Seq != sent.Seq ||
+		msg.Reaction != "👍" || msg.UserId != "2" || msg.Count != 1 {
+		t.Errorf("reaction event = %+v", msg)
+	}
+
+	var history []models.Message
+	resp := alice.get(t, messagesURL, nil)
+	if err = json.Unmarshal([]byte(resp.body), &history); err != nil {
+		t.Fatalf("failed to decode history %q: %v", resp.body, err)
+	}
+	if len(history) != 1 || len(history[0].Reactions) != 1 || history[0].Reactions[0].Count != 1 ||
+		history[0].Reactions[0].UserIds[0] != "2" {
+		t.Errorf("history = %+v", history)
+	}
+
+	if resp = request(bob, http.MethodDelete); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("remove reaction: status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+	if msg := readMessage(t, aliceConn); msg.Type != models.EventReactionRemoved || msg.UserId != "2" || msg.Count != 0 {
+		t.Errorf("reaction event = %+v", msg)
+	}
+
+	reactionURL = messagesURL + "/" + strconv.FormatInt(sent.Seq, 10) + "/reactions/like"
+	if resp = request(bob, http.MethodPut); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("text reaction: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+// Сигналы набора текста идут через шину без сохранения, набирающий их не получает
+func TestTyping(t *testing.T) {
+	for name, newBus := range map[string]func(t *testing.T) bus.Bus{
+		"memory":    newMemoryBus,
+		"jetstream": newJetStreamBus,
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, newBus)
+			alice := s.login(t, "1", "Alice")
+			bob := s.login(t, "2", "Bob")
+			chat := createChat(t, s, alice, "general")
+
+			aliceConn, _, err := s.dial(t, alice, chat.RoomId)
+			if err != nil {
+				t.Fatalf("alice dial: %v", err)
+			}
+			bobConn, _, err := s.dial(t, bob, chat.RoomId)
+			if err != nil {
+				t.Fatalf("bob dial: %v", err)
+			}
+			readMessage(t, aliceConn)
+			readMessage(t, bobConn)
+
+			for _, command := range []string{models.CommandTypingStart, models.CommandTypingStop} {
+				if err = aliceConn.WriteJSON(models.ClientCommand{Type: command}); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				if msg := readMessage(t, bobConn); msg.Type != command || msg.UserId != "1" || msg.Author != "Alice" {
+					t.Errorf("typing event = %+v, want %s", msg, command)
+				}
+			}
+
+			// Следующее, что получает набиравший, - его сообщение, а не свои сигналы
+			if err = aliceConn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if msg := readMessage(t, aliceConn); msg.Type != "" || msg.Msg != "hello" {
+				t.Errorf("typing user received %+v", msg)
+			}
+		})
+	}
+}
+
+// Присутствие по WebSocket и список участников чата
+func TestPresence(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	bob := s.login(t, "2", "Bob")
+	chat := createChat(t, s, alice, "general")
+
+	aliceConn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	if msg := readEvent(t, aliceConn); msg.Type != models.EventPresence || msg.UserId != "1" || msg.Status != models.PresenceOnline {
+		t.Errorf("own presence event = %+v", msg)
+	}
+	readMessage(t, aliceConn)
+
+	bobConn, _, err := s.dial(t, bob, chat.RoomId)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	readMessage(t, bobConn)
+
+	// Остальные участники узнают о подключении, уходе со вкладки и отключении
+	expectPresence := func(status string) models.MessageOnScreen {
+		t.Helper()
+		msg := readEvent(t, aliceConn)
+		if msg.Type != models.EventPresence || msg.UserId != "2" || msg.Author != "Bob" || msg.Status != status {
+			t.Errorf("presence event = %+v, want Bob %s", msg, status)
+		}
+		return msg
+	}
+	expectPresence(models.PresenceOnline)
+
+	if err = bobConn.WriteJSON(models.ClientCommand{Type: models.CommandPresenceAway}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	expectPresence(models.PresenceAway)
+
+	membersURL := s.URL + "/api/v1/chats/" + strconv.Itoa(chat.RoomId) + "/members"
+	resp := alice.get(t, membersURL, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("members status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+	var members []models.Member
+	if err = json.Unmarshal([]byte(resp.body), &members); err != nil {
+		t.Fatalf("failed to decode members: %v", err)
+	}
+	if len(members) != 2 || members[0].UserName != "Alice" || members[0].Status != models.PresenceOnline ||
+		members[1].UserName != "Bob" || members[1].Status != models.PresenceAway {
+		t.Errorf("members = %+v", members)
+	}
+
+	bobConn.Close()
+	if msg := expectPresence(models.PresenceOffline); msg.LastSeen == nil {
+		t.Errorf("offline event without last_seen: %+v", msg)
+	}
+
+	if resp = anonymous().get(t, membersURL, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous members status = %d, want 401", resp.StatusCode)
+	}
+	if resp = alice.get(t, s.URL+"/api/v1/chats/999/members", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing chat members status = %d, want 404", resp.StatusCode)
+	}
+}
+
+// Отметки прочтения по REST и WebSocket, непрочитанные в списке чатов и на /start
+func TestReadReceipts(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	bob := s.login(t, "2", "Bob")
+	chat := createChat(t, s, alice, "general")
+
+	aliceConn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	bobConn, _, err := s.dial(t, bob, chat.RoomId)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	readMessage(t, aliceConn)
+	readMessage(t, bobConn)
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err = bobConn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		readMessage(t, aliceConn)
+		readMessage(t, bobConn)
+	}
+
+	unread := func() int {
+		t.Helper()
+		var chats []models.ChatStruct
+		if err := json.Unmarshal([]byte(alice.get(t, s.URL+"/get-chats", nil).body), &chats); err != nil {
+			t.Fatalf("failed to decode chats: %v", err)
+		}
+		if len(chats) != 1 {
+			t.Fatalf("chats = %+v", chats)
+		}
+		return chats[0].Unread
+	}
+	if got := unread(); got != 3 {
+		t.Errorf("unread = %d, want 3", got)
+	}
+	if resp := alice.get(t, s.URL+"/start", nil); !strings.Contains(resp.body, ">3</span>") {
+		t.Errorf("start page has no unread badge: %s", resp.body)
+	}
+
+	readURL := s.URL + "/api/v1/chats/" + strconv.Itoa(chat.RoomId) + "/messages/2/read"
+	req, _ := http.NewRequest(http.MethodPut, readURL, nil)
+	if resp := alice.do(t, req); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("mark read status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+	if msg := readMessage(t, bobConn); msg.Type != models.EventMessageRead || msg.UserId != "1" || msg.Seq != 2 {
+		t.Errorf("read receipt = %+v", msg)
+	}
+	// Другие подключения прочитавшего тоже узнают об отметке
+	if msg := readMessage(t, aliceConn); msg.Type != models.EventMessageRead || msg.Seq != 2 {
+		t.Errorf("own read receipt = %+v", msg)
+	}
+	if got := unread(); got != 1 {
+		t.Errorf("unread after REST = %d, want 1", got)
+	}
+
+	if err = aliceConn.WriteJSON(models.ClientCommand{Type: models.CommandMarkRead, Seq: 3}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if msg := readMessage(t, bobConn); msg.Type != models.EventMessageRead || msg.Seq != 3 {
+		t.Errorf("read receipt = %+v", msg)
+	}
+	if got := unread(); got != 0 {
+		t.Errorf("unread after websocket = %d, want 0", got)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, readURL, nil)
+	if resp := anonymous().do(t, req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous mark read status = %d, want 401", resp.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodPut, s.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/messages/99/read", nil)
+	if resp := alice.do(t, req); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("mark read of missing message status = %d, want 404", resp.StatusCode)
+	}
+}
+
+// Поиск сообщений: параметры запроса, ответ JSON и ошибки
+func TestSearch(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	chat := createChat(t, s, alice, "general")
+
+	conn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	readMessage(t, conn)
+	for _, text := range []string{"release notes", "lunch", "next release"} {
+		if err = conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		readMessage(t, conn)
+	}
+
+	searchURL := s.URL + "/api/v1/search?"
+	today := time.Now().UTC().Format("2006-01-02")
+	resp := alice.get(t, searchURL+url.Values{
+		"q": {"release"}, "chat_id": {strconv.Itoa(chat.RoomId)}, "author": {"Alice"},
+		"from": {today}, "to": {today}, "limit": {"1"},
+	}.Encode(), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("search status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+	var page models.SearchPage
+	if err = json.Unmarshal([]byte(resp.body), &page); err != nil {
+		t.Fatalf("failed to decode search page: %v", err)
+	}
+	if len(page.Results) != 1 || page.Results[0].Seq != 3 || page.Results[0].ChatName != "general" || page.NextOffset != 1 {
+		t.Errorf("search page = %+v", page)
+	}
+
+	tests := []struct {
+		name   string
+		user   *testUser
+		query  string
+		status int
+	}{
+		{"anonymous", anonymous(), "q=release", http.StatusUnauthorized},
+		{"empty query", alice, "q=", http.StatusBadRequest},
+		{"bad chat id", alice, "q=release&chat_id=x", http.StatusBadRequest},
+		{"bad date", alice, "q=release&from=yesterday", http.StatusBadRequest},
+		{"missing chat", alice, "q=release&chat_id=999", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := tt.user.get(t, searchURL+tt.query, nil); resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d, body = %s", resp.StatusCode, tt.status, resp.body)
+			}
+		})
+	}
+}
+
+// Команды треда по WebSocket: подписка, ответ и сводка для остальных участников
+func TestAttachments(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	bob := s.login(t, "2", "Bob")
+	chat := createChat(t, s, alice, "general")
+	uploadURL := s.URL + "/api/v1/chats/" + strconv.Itoa(chat.RoomId) + "/attachments"
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 100, 50))); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := alice.upload(t, uploadURL, "cat.png", img.Bytes())
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+	var uploaded models.Attachment
+	if err := json.Unmarshal([]byte(resp.body), &uploaded); err != nil {
+		t.Fatalf("failed to decode attachment: %v", err)
+	}
+	if uploaded.MimeType != "image/png" || uploaded.Size != int64(img.Len()) || uploaded.ThumbnailURL == "" {
+		t.Errorf("uploaded = %+v", uploaded)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		user   *testUser
+		url    string
+		data   []byte
+		status int
+	}{
+		{name: "anonymous", user: anonymous(), url: uploadURL, data: []byte("hi"), status: http.StatusUnauthorized},
+		{name: "missing chat", user: alice, url: s.URL + "/api/v1/chats/999/attachments", data: []byte("hi"), status: http.StatusNotFound},
+		{name: "too large", user: alice, url: uploadURL, data: bytes.Repeat([]byte("a"), testAttachmentSize+1), status: http.StatusBadRequest},
+		{name: "not allowed", user: alice, url: uploadURL, data: []byte("<html><script>alert(1)</script>"), status: http.StatusBadRequest},
+	} {
+		if resp := tt.user.upload(t, tt.url, "file", tt.data); resp.StatusCode != tt.status {
+			t.Errorf("upload %s: status = %d, want %d, body = %s", tt.name, resp.StatusCode, tt.status, resp.body)
+		}
+	}
+
+	// До отправки вложение доступно только загрузившему
+	if resp := bob.get(t, s.URL+uploaded.URL, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bob before send: status = %d, want 404", resp.StatusCode)
+	}
+
+	aliceConn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	bobConn, _, err := s.dial(t, bob, chat.RoomId)
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	// Приветствие
+	readMessage(t, bobConn)
+
+	cmd := models.ClientCommand{Type: models.CommandSendMessage, Attachments: []string{uploaded.Id}}
+	if err = aliceConn.WriteJSON(cmd); err != nil {
+		t.Fatalf("failed to send command: %v", err)
+	}
+	msg := readMessage(t, bobConn)
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Name != "cat.png" || msg.Attachments[0].URL != uploaded.URL {
+		t.Fatalf("bob received %+v", msg)
+	}
+
+	resp = bob.get(t, s.URL+uploaded.URL, nil)
+	if resp.StatusCode != http.StatusOK || resp.body != img.String() {
+		t.Fatalf("download status = %d, size = %d", resp.StatusCode, len(resp.body))
+	}
+	for header, want := range map[string]string{
+		"Content-Type":           "image/png",
+		"Content-Disposition":    `inline; filename=cat.png`,
+		"X-Content-Type-Options": "nosniff",
+		"ETag":                   `"` + uploaded.Checksum + `"`,
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if resp = bob.get(t, s.URL+uploaded.URL, http.Header{"If-None-Match": {`"` + uploaded.Checksum + `"`}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional download status = %d, want 304", resp.StatusCode)
+	}
+
+	resp = bob.get(t, s.URL+uploaded.ThumbnailURL, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("thumbnail status = %d, type = %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	if resp = anonymous().get(t, s.URL+uploaded.URL, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous download status = %d, want 401", resp.StatusCode)
+	}
+
+	// История возвращает вложения с адресами
+	var history []models.Message
+	if err = json.Unmarshal([]byte(bob.get(t, s.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/messages", nil).body), &history); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	if len(history) != 1 || len(history[0].Attachments) != 1 || history[0].Attachments[0].ThumbnailURL != uploaded.ThumbnailURL {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+// Загрузка файла дольше таймаутов сервера не обрывается
+func TestSlowUpload(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	chat := createChat(t, s, alice, "general")
+
+	// Тот же обработчик за сервером с короткими таймаутами, cookie сессии не зависят от порта
+	slow := httptest.NewUnstartedServer(s.Config.Handler)
+	slow.Config.ReadTimeout = 200 * time.Millisecond
+	slow.Config.WriteTimeout = 200 * time.Millisecond
+	slow.Start()
+	t.Cleanup(slow.Close)
+
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", "slow.txt")
+		for i := 0; i < 4 && err == nil; i++ {
+			time.Sleep(100 * time.Millisecond)
+			_, err = part.Write([]byte("chunk "))
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, slow.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/attachments", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if resp := alice.do(t, req); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("slow upload status = %d, body = %s", resp.StatusCode, resp.body)
+	}
+}
+
+func TestLinkPreviews(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	chat := createChat(t, s, alice, "general")
+
+	conn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	readMessage(t, conn)
+
+	if err = conn.WriteMessage(websocket.TextMessage, []byte("look https://example.com/page and https://example.com/missing")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sent := readMessage(t, conn)
+	if sent.Type != "" || len(sent.Previews) != 0 {
+		t.Errorf("new message = %+v", sent)
+	}
+
+	// Превью приходят отдельным событием после сообщения
+	updated := readMessage(t, conn)
+	if updated.Type != models.EventMessageUpdated || updated.Seq != sent.Seq || updated.Version != 1 ||
+		len(updated.Previews) != 1 || updated.Previews[0].URL != "https://example.com/page" || updated.Previews[0].Title != "Example page" {
+		t.Errorf("message.updated = %+v", updated)
+	}
+
+	var history []models.Message
+	resp := alice.get(t, s.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/messages", nil)
+	if err = json.Unmarshal([]byte(resp.body), &history); err != nil {
+		t.Fatalf("failed to decode history %q: %v", resp.body, err)
+	}
+	if len(history) != 1 || len(history[0].Previews) != 1 || history[0].Previews[0].SiteName != "Example" {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestMessageFormatting(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	chat := createChat(t, s, alice, "general")
+
+	conn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	readMessage(t, conn)
+
+	// Текст с HTML приходит экранированным, опасная ссылка остается текстом
+	text := `<img src=x onerror=alert(1)> **bold** [x](javascript:alert(1))`
+	wantHTML := `&lt;img src=x onerror=alert(1)&gt; <strong>bold</strong> [x](javascript:alert(1))`
+	if err = conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if sent := readMessage(t, conn); sent.Msg != text || sent.Html != wantHTML {
+		t.Errorf("new message = %+v", sent)
+	}
+
+	var history []models.Message
+	resp := alice.get(t, s.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/messages", nil)
+	if err = json.Unmarshal([]byte(resp.body), &history); err != nil {
+		t.Fatalf("failed to decode history %q: %v", resp.body, err)
+	}
+	if len(history) != 1 || history[0].Msg != text || history[0].Html != wantHTML {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	bob := s.login(t, "2", "Bob")
+	chat := createChat(t, s, alice, "general")
+
+	aliceConn, _, err := s.dial(t, alice, chat.RoomId)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	bobConn, _, err := s.dial(t, bob, chat.RoomId)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	readMessage(t, aliceConn)
+	readMessage(t, bobConn)
+
+	// Обычный текст - по-прежнему сообщение в чат
+	if err = aliceConn.WriteMessage(websocket.TextMessage, []byte("question")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	root := readMessage(t, aliceConn)
+	readMessage(t, bobConn)
+
+	if err = bobConn.WriteJSON(models.ClientCommand{Type: models.CommandSubscribeThread, Seq: root.Seq}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// Ошибка команды приходит только отправителю, подключение остается открытым
+	// Команды выполняются по порядку, поэтому после ответа на нее подписка уже действует
+	if err = bobConn.WriteJSON(models.ClientCommand{Type: models.CommandSubscribeThread, Seq: root.Seq + 100}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if msg := readMessage(t, bobConn); msg.Type != models.EventError || msg.Msg == "" {
+		t.Errorf("error event = %+v", msg)
+	}
+
+	if err = aliceConn.WriteJSON(models.ClientCommand{Type: models.CommandSendMessage, Msg: "answer", ParentSeq: root.Seq}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if msg := readMessage(t, bobConn); msg.Type != "" || msg.ParentSeq != root.Seq || msg.Msg != "answer" {
+		t.Errorf("subscriber received %+v, want the reply", msg)
+	}
+	if msg := readMessage(t, aliceConn); msg.Type != models.EventThreadUpdated || msg.ParentSeq != root.Seq || msg.ReplyCount != 1 {
+		t.Errorf("chat member received %+v, want thread.updated", msg)
+	}
+
+	var replies []models.Message
+	resp := bob.get(t, s.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/messages/"+strconv.FormatInt(root.Seq, 10)+"/replies", nil)
+	if err = json.Unmarshal([]byte(resp.body), &replies); err != nil {
+		t.Fatalf("failed to decode replies %q: %v", resp.body, err)
+	}
+	if len(replies) != 1 || replies[0].Msg != "answer" {
+		t.Errorf("replies = %+v", replies)
+	}
+
+	var history []models.Message
+	resp = bob.get(t, s.URL+"/api/v1/chats/"+strconv.Itoa(chat.RoomId)+"/messages", nil)
+	if err = json.Unmarshal([]byte(resp.body), &history); err != nil {
+		t.Fatalf("failed to decode history %q: %v", resp.body, err)
+	}
+	if len(history) != 1 || history[0].ReplyCount != 1 {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestWebsocketRejectsBeforeUpgrade(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	chat := createChat(t, s, alice, "general")
+
+	if _, resp, err := s.dial(t, anonymous(), chat.RoomId); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous dial: err = %v, resp = %v, want 401", err, resp)
+	}
+	if _, resp, err := s.dial(t, alice, chat.RoomId+1); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("dial missing chat: err = %v, resp = %v, want 404", err, resp)
+	}
+}
+
+// Участники удаленного чата и все клиенты при остановке сервера получают кадр закрытия
+func TestWebsocketClose(t *testing.T) {
+	s := newTestServer(t, newMemoryBus)
+	alice := s.login(t, "1", "Alice")
+	general := createChat(t, s, alice, "general")
+	other := createChat(t, s, alice, "other")
+
+	generalConn, _, err := s.dial(t, alice, general.RoomId)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	otherConn, _, err := s.dial(t, alice, other.RoomId)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	readMessage(t, generalConn)
+	readMessage(t, otherConn)
+
+	alice.get(t, s.URL+"/delete-chat/"+strconv.Itoa(general.RoomId), nil)
+	expectClose(t, generalConn, websocket.CloseNormalClosure)
+
+	s.handler.CloseConnections()
+	expectClose(t, otherConn, websocket.CloseGoingAway)
+}
+
+// Кадр закрытия с кодом code, события до него пропускаются
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, code) {
+		t.Errorf("read error = %v, want close code %d", err, code)
+	}
+}
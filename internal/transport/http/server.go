@@ -1,21 +1,38 @@
 package http
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/Yury132/Golang-Task-3/internal/transport/http/handlers"
+	"github.com/rs/zerolog"
+)
+
+// Таймауты по умолчанию
+const (
+	defaultReadTimeout       = 15 * time.Second
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultWriteTimeout      = 15 * time.Second
+	defaultIdleTimeout       = 60 * time.Second
 )
 
 type Server struct {
 	*http.Server
+	// Сертификат TLS, nil если сервер работает по HTTP
+	certs *certReloader
 }
 
 func New(addr string) *Server {
 	return &Server{
-		&http.Server{
-			Addr:         addr,
-			WriteTimeout: http.DefaultClient.Timeout,
-			ReadTimeout:  http.DefaultClient.Timeout,
+		Server: &http.Server{
+			Addr:              addr,
+			ReadTimeout:       defaultReadTimeout,
+			ReadHeaderTimeout: defaultReadHeaderTimeout,
+			WriteTimeout:      defaultWriteTimeout,
+			IdleTimeout:       defaultIdleTimeout,
 		},
 	}
 }
@@ -25,10 +42,72 @@ func (s *Server) WithHandler(handler *handlers.Handler) *Server {
 	return s
 }
 
+// Произвольный обработчик, например для служебных серверов
+func (s *Server) WithRouter(handler http.Handler) *Server {
+	s.Handler = handler
+	return s
+}
+
+// Таймауты чтения запроса, чтения заголовков, записи ответа и простоя keep-alive подключения
+// Нулевые значения оставляют таймауты по умолчанию
+func (s *Server) WithTimeouts(read, readHeader, write, idle time.Duration) *Server {
+	if read > 0 {
+		s.ReadTimeout = read
+	}
+	if readHeader > 0 {
+		s.ReadHeaderTimeout = readHeader
+	}
+	if write > 0 {
+		s.WriteTimeout = write
+	}
+	if idle > 0 {
+		s.IdleTimeout = idle
+	}
+	return s
+}
+
+// Включение TLS
+// При reloadInterval > 0 файлы сертификата проверяются с этим интервалом и перечитываются при изменении
+func (s *Server) WithTLS(logger zerolog.Logger, certFile string, keyFile string, reloadInterval time.Duration) (*Server, error) {
+	certs, err := newCertReloader(logger, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if reloadInterval > 0 {
+		go certs.watch(reloadInterval)
+	}
+
+	s.certs = certs
+	s.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	return s, nil
+}
+
+// Запуск сервера
+// После вызова Shutdown возвращает nil
 func (s *Server) Run() error {
-	if err := s.ListenAndServe(); err != nil {
+	var err error
+	if s.certs != nil {
+		err = s.ListenAndServeTLS("", "")
+	} else {
+		err = s.ListenAndServe()
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 
 	return nil
 }
+
+// Остановка сервера и слежения за сертификатом
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.certs != nil {
+		s.certs.Stop()
+	}
+
+	return s.Server.Shutdown(ctx)
+}
@@ -0,0 +1,131 @@
+package http
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Сертификат TLS с перечитыванием файлов при их изменении
+// Позволяет обновлять сертификат без перезапуска сервиса
+type certReloader struct {
+	logger   zerolog.Logger
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func newCertReloader(logger zerolog.Logger, certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		logger:   logger,
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{}),
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Для tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Периодическая проверка файлов сертификата
+func (r *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			changed, err := r.changed()
+			if err != nil {
+				r.logger.Error().Err(err).Msg("failed to check tls certificate")
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			// Пока файлы записаны не полностью, остается старый сертификат
+			if err = r.load(); err != nil {
+				r.logger.Error().Err(err).Msg("failed to reload tls certificate")
+				continue
+			}
+			r.logger.Info().Str("cert_file", r.certFile).Msg("tls certificate reloaded")
+		}
+	}
+}
+
+func (r *certReloader) Stop() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+// Загрузка пары сертификат-ключ
+func (r *certReloader) load() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load tls key pair")
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Изменились ли файлы с момента последней загрузки
+func (r *certReloader) changed() (bool, error) {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return !modTime.Equal(r.modTime), nil
+}
+
+// Время последнего изменения сертификата или ключа
+func (r *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "failed to stat tls file")
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+
+	return last, nil
+}
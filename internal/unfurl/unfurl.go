@@ -0,0 +1,343 @@
+package unfurl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// Ограничения длины полей превью в символах
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 500
+	maxSiteNameLength    = 100
+	// Адрес страницы или изображения, совпадает с размером колонки в БД
+	MaxURLLength = 2048
+)
+
+// Ограничение размера заголовков ответа
+const maxHeaderBytes = 64 << 10
+
+var (
+	// Адрес ведет во внутреннюю сеть или на локальный узел
+	ErrBlocked = errors.New("address is not allowed")
+	// Страница не HTML
+	ErrNotHTML = errors.New("page is not html")
+	// На странице нет заголовка
+	ErrNoPreview = errors.New("page has no title")
+)
+
+// Разворачивание ссылки: метаданные страницы для превью
+type Fetcher interface {
+	// Метаданные OpenGraph страницы, а без них - ее заголовок и описание
+	Fetch(ctx context.Context, rawURL string) (models.LinkPreview, error)
+}
+
+// Параметры загрузки страниц
+type Options struct {
+	// Общее время запроса вместе с перенаправлениями и чтением тела
+	Timeout time.Duration
+	// Читается не больше MaxBodySize байт страницы, метаданные должны быть в ее начале
+	MaxBodySize int64
+	// Максимальное число перенаправлений
+	MaxRedirects int
+	UserAgent    string
+}
+
+// Диапазоны адресов, недоступные для запросов: частные сети, loopback, link-local,
+// служебные и зарезервированные диапазоны, в том числе IPv6 с вложенным IPv4
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// Адрес недоступен для запросов
+// Зона IPv6 не учитывается: адрес с зоной, как fe80::1%eth0, проверяется как адрес без нее
+func Blocked(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type fetcher struct {
+	client    *http.Client
+	userAgent string
+	maxBody   int64
+}
+
+// Запрос страницы
+// Адрес проверяется после разрешения имени при каждом подключении, в том числе после перенаправления,
+// поэтому имя, которое указывает на внутренний адрес, не поможет обойти запрет
+// Прокси из окружения не используется
+func (f *fetcher) Fetch(ctx context.Context, rawURL string) (models.LinkPreview, error) {
+	preview := models.LinkPreview{URL: rawURL}
+
+	target, err := checkURL(rawURL)
+	if err != nil {
+		return preview, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return preview, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return preview, errors.Wrap(err, "failed to fetch page")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return preview, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return preview, ErrNotHTML
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, f.maxBody), contentType)
+	if err != nil {
+		return preview, errors.Wrap(err, "failed to detect charset")
+	}
+
+	meta := parse(body)
+	preview.Title = clean(first(meta["og:title"], meta["twitter:title"], meta["title"]), maxTitleLength)
+	preview.Description = clean(first(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescriptionLength)
+	preview.SiteName = clean(meta["og:site_name"], maxSiteNameLength)
+	preview.Image = imageURL(resp.Request.URL, first(meta["og:image:secure_url"], meta["og:image:url"], meta["og:image"], meta["twitter:image"]))
+	if preview.Title == "" {
+		return preview, ErrNoPreview
+	}
+
+	return preview, nil
+}
+
+// Разбор адреса страницы: только http и https без логина и пароля
+func checkURL(rawURL string) (*url.URL, error) {
+	if len(rawURL) > MaxURLLength {
+		return nil, errors.New("url is too long")
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid url")
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+	if target.Hostname() == "" {
+		return nil, errors.New("url has no host")
+	}
+	if target.User != nil {
+		return nil, errors.New("url with credentials is not allowed")
+	}
+	target.Fragment = ""
+
+	return target, nil
+}
+
+// Метаданные из заголовка страницы: title и мета-теги по name или property в нижнем регистре
+// Разбор заканчивается на теле страницы, повторные теги не заменяют первые
+func parse(r io.Reader) map[string]string {
+	meta := make(map[string]string)
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return meta
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "head":
+				return meta
+			case "title":
+				inTitle = false
+			}
+		case html.TextToken:
+			if inTitle && meta["title"] == "" {
+				meta["title"] = string(tokenizer.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "body":
+				return meta
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for hasAttr {
+					var attr, value []byte
+					attr, value, hasAttr = tokenizer.TagAttr()
+					switch string(attr) {
+					case "property", "name":
+						if key == "" {
+							key = strings.ToLower(strings.TrimSpace(string(value)))
+						}
+					case "content":
+						content = string(value)
+					}
+				}
+				if key != "" && key != "title" && meta[key] == "" {
+					meta[key] = content
+				}
+			}
+		}
+	}
+}
+
+// Первое непустое значение
+func first(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Текст без управляющих символов, с одиночными пробелами, не длиннее limit символов
+func clean(text string, limit int) string {
+	text = strings.ToValidUTF8(text, "")
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+
+	if utf8.RuneCountInString(text) > limit {
+		runes := []rune(text)
+		text = strings.TrimSpace(string(runes[:limit-1])) + "…"
+	}
+
+	return text
+}
+
+// Абсолютный адрес изображения относительно страницы, только http и https
+func imageURL(page *url.URL, raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	ref, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	image := page.ResolveReference(ref)
+	if image.Scheme != "http" && image.Scheme != "https" || image.Host == "" || image.User != nil {
+		return ""
+	}
+	if result := image.String(); len(result) <= MaxURLLength {
+		return result
+	}
+	return ""
+}
+
+// Отказ в подключении к запрещенному адресу
+// Вызывается для уже разрешенного адреса перед каждым подключением
+func dialControl(blocked func(netip.AddrPort) bool) func(network, address string, _ syscall.RawConn) error {
+	return func(_, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return errors.Wrap(err, "invalid address")
+		}
+		if blocked(addrPort) {
+			return errors.Wrapf(ErrBlocked, "address %s", addrPort.Addr())
+		}
+		return nil
+	}
+}
+
+func newFetcher(opts Options, blocked func(netip.AddrPort) bool) *fetcher {
+	dialer := &net.Dialer{
+		Timeout: opts.Timeout,
+		Control: dialControl(blocked),
+	}
+	transport := &http.Transport{
+		Proxy:                  nil,
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    opts.Timeout,
+		ResponseHeaderTimeout:  opts.Timeout,
+		MaxResponseHeaderBytes: maxHeaderBytes,
+		MaxIdleConns:           10,
+		IdleConnTimeout:        30 * time.Second,
+		ForceAttemptHTTP2:      true,
+	}
+
+	return &fetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > opts.MaxRedirects {
+					return errors.New("too many redirects")
+				}
+				_, err := checkURL(req.URL.String())
+				return err
+			},
+		},
+		userAgent: opts.UserAgent,
+		maxBody:   opts.MaxBodySize,
+	}
+}
+
+func New(opts Options) Fetcher {
+	return newFetcher(opts, func(addrPort netip.AddrPort) bool {
+		return Blocked(addrPort.Addr())
+	})
+}
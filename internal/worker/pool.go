@@ -0,0 +1,193 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/Yury132/Golang-Task-3/internal/tracing"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Пауза перед перезапуском упавшего воркера
+const restartDelay = 100 * time.Millisecond
+
+var ErrStopped = errors.New("worker pool is stopped")
+
+// Рассылка сообщения участникам чата
+type DeliverFunc func(ctx context.Context, msg *models.SendMessage) error
+
+// Пул воркеров для рассылки сообщений
+// У каждого воркера своя очередь, сообщения одного чата всегда попадают к одному воркеру,
+// поэтому порядок сообщений внутри чата сохраняется
+type Pool struct {
+	logger  zerolog.Logger
+	deliver DeliverFunc
+	queues  []chan job
+
+	mu      sync.RWMutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// Задача воркеру
+// ctx хранит только спан и логгер получения сообщения, чтобы рассылка попала в ту же трассировку и логи
+type job struct {
+	ctx context.Context
+	msg *models.SendMessage
+	// Вызывается после рассылки с ее результатом, может быть nil
+	done func(err error)
+}
+
+// Запуск воркеров
+func (p *Pool) Start() {
+	for id := range p.queues {
+		p.wg.Add(1)
+		go p.supervise(id)
+	}
+}
+
+// Передача сообщения воркеру, ответственному за чат
+// Блокируется, пока в очереди воркера нет места
+func (p *Pool) Submit(ctx context.Context, msg *models.SendMessage) error {
+	return p.SubmitFunc(ctx, msg, nil)
+}
+
+// Передача сообщения воркеру, done вызывается воркером после рассылки с ее результатом
+// Если сообщение не принято, возвращается ошибка, а done не вызывается
+func (p *Pool) SubmitFunc(ctx context.Context, msg *models.SendMessage, done func(err error)) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		return ErrStopped
+	}
+
+	select {
+	case p.queues[p.shard(msg.ChatId)] <- job{ctx: detach(ctx), msg: msg, done: done}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Количество сообщений, ожидающих рассылки
+func (p *Pool) QueueDepth() int {
+	depth := 0
+	for _, q := range p.queues {
+		depth += len(q)
+	}
+
+	return depth
+}
+
+// Остановка пула
+// Новые сообщения не принимаются, воркеры дорабатывают уже полученные
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// Номер воркера для чата
+func (p *Pool) shard(chatId int) int {
+	if chatId < 0 {
+		chatId = -chatId
+	}
+
+	return chatId % len(p.queues)
+}
+
+// Следим за воркером и перезапускаем его после паники
+func (p *Pool) supervise(id int) {
+	defer p.wg.Done()
+
+	for !p.run(id) {
+		p.logger.Warn().Int("worker_id", id).Msg("restarting worker")
+		time.Sleep(restartDelay)
+	}
+}
+
+// Работа воркера
+// Возвращает true, если очередь закрыта и воркер завершился штатно
+func (p *Pool) run(id int) (done bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logger.Error().Int("worker_id", id).Str("panic", fmt.Sprint(r)).Msg("worker panicked")
+			done = false
+		}
+	}()
+
+	for j := range p.queues[id] {
+		p.process(id, j)
+	}
+
+	return true
+}
+
+// Рассылка одного сообщения
+func (p *Pool) process(id int, j job) {
+	ctx, span := tracing.Tracer().Start(j.ctx, "worker.deliver", trace.WithAttributes(
+		attribute.Int("worker_id", id),
+		attribute.Int("chat_id", j.msg.ChatId),
+		attribute.Int64("seq", j.msg.Seq),
+	))
+	defer span.End()
+
+	logger := p.logger
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		logger = *l
+	}
+	logger = logger.With().Int("worker_id", id).Logger()
+	ctx = logger.WithContext(ctx)
+
+	err := p.deliver(ctx, j.msg)
+	if err != nil {
+		logger.Error().Err(err).Int("chat_id", j.msg.ChatId).Msg("failed to deliver message")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if j.done != nil {
+		j.done(err)
+	}
+}
+
+// Контекст задачи без отмены исходного, но с его спаном и логгером
+func detach(ctx context.Context) context.Context {
+	detached := tracing.Detach(ctx)
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		detached = l.WithContext(detached)
+	}
+
+	return detached
+}
+
+func New(logger zerolog.Logger, size int, queueSize int, deliver DeliverFunc) *Pool {
+	if size < 1 {
+		size = 1
+	}
+
+	queues := make([]chan job, size)
+	for i := range queues {
+		queues[i] = make(chan job, queueSize)
+	}
+
+	return &Pool{
+		logger:  logger,
+		deliver: deliver,
+		queues:  queues,
+	}
+}
@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/Yury132/Golang-Task-3/internal/models"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Разосланные сообщения по чатам
+type recorder struct {
+	mu    sync.Mutex
+	chats map[int][]int64
+}
+
+func (r *recorder) deliver(_ context.Context, msg *models.SendMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.chats == nil {
+		r.chats = make(map[int][]int64)
+	}
+	r.chats[msg.ChatId] = append(r.chats[msg.ChatId], msg.Seq)
+	return nil
+}
+
+func (r *recorder) seqs(chatId int) []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]int64(nil), r.chats[chatId]...)
+}
+
+// Сообщения одного чата рассылаются в порядке отправки
+func TestPoolKeepsChatOrder(t *testing.T) {
+	rec := &recorder{}
+	pool := New(zerolog.Nop(), 4, 8, rec.deliver)
+	pool.Start()
+
+	const chats, perChat = 10, 100
+	ctx := context.Background()
+	for seq := int64(1); seq <= perChat; seq++ {
+		for chatId := 1; chatId <= chats; chatId++ {
+			if err := pool.Submit(ctx, &models.SendMessage{ChatId: chatId, Seq: seq}); err != nil {
+				t.Fatalf("Submit() error = %v", err)
+			}
+		}
+	}
+	pool.Stop()
+
+	for chatId := 1; chatId <= chats; chatId++ {
+		seqs := rec.seqs(chatId)
+		if len(seqs) != perChat {
+			t.Fatalf("chat %d: delivered %d messages, want %d", chatId, len(seqs), perChat)
+		}
+		for i, seq := range seqs {
+			if seq != int64(i+1) {
+				t.Fatalf("chat %d: message %d has seq %d", chatId, i, seq)
+			}
+		}
+	}
+}
+
+// done вызывается после рассылки с ее результатом
+func TestPoolSubmitFuncCallsDone(t *testing.T) {
+	failure := errors.New("failure")
+	pool := New(zerolog.Nop(), 1, 8, func(_ context.Context, msg *models.SendMessage) error {
+		if msg.Seq == 2 {
+			return failure
+		}
+		return nil
+	})
+	pool.Start()
+
+	results := make(chan error, 2)
+	for seq := int64(1); seq <= 2; seq++ {
+		if err := pool.SubmitFunc(context.Background(), &models.SendMessage{ChatId: 1, Seq: seq}, func(err error) {
+			results <- err
+		}); err != nil {
+			t.Fatalf("SubmitFunc() error = %v", err)
+		}
+	}
+	pool.Stop()
+
+	if err := <-results; err != nil {
+		t.Errorf("done(%v) for seq 1, want nil", err)
+	}
+	if err := <-results; !errors.Is(err, failure) {
+		t.Errorf("done(%v) for seq 2, want failure", err)
+	}
+}
+
+// Паника при рассылке не останавливает воркер
+func TestPoolRecoversFromPanic(t *testing.T) {
+	rec := &recorder{}
+	pool := New(zerolog.Nop(), 1, 8, func(ctx context.Context, msg *models.SendMessage) error {
+		if msg.Seq == 2 {
+			panic("boom")
+		}
+		return rec.deliver(ctx, msg)
+	})
+	pool.Start()
+
+	ctx := context.Background()
+	for seq := int64(1); seq <= 3; seq++ {
+		if err := pool.Submit(ctx, &models.SendMessage{ChatId: 1, Seq: seq}); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+	pool.Stop()
+
+	if got := rec.seqs(1); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Errorf("delivered %v, want [1 3]", got)
+	}
+}
+
+func TestPoolRejectsAfterStop(t *testing.T) {
+	pool := New(zerolog.Nop(), 2, 1, (&recorder{}).deliver)
+	pool.Start()
+	pool.Stop()
+
+	if err := pool.Submit(context.Background(), &models.SendMessage{ChatId: 1}); !errors.Is(err, ErrStopped) {
+		t.Errorf("Submit() after Stop() error = %v, want ErrStopped", err)
+	}
+}
+
+// Submit ждет места в очереди не дольше ctx
+func TestPoolSubmitHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	pool := New(zerolog.Nop(), 1, 1, func(context.Context, *models.SendMessage) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	pool.Start()
+	defer func() {
+		close(release)
+		pool.Stop()
+	}()
+
+	ctx := context.Background()
+	// Первое сообщение занимает воркер, второе - очередь
+	if err := pool.Submit(ctx, &models.SendMessage{ChatId: 1, Seq: 1}); err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	<-started
+	if err := pool.Submit(ctx, &models.SendMessage{ChatId: 1, Seq: 2}); err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	if depth := pool.QueueDepth(); depth != 1 {
+		t.Errorf("QueueDepth() = %d, want 1", depth)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := pool.Submit(canceled, &models.SendMessage{ChatId: 1, Seq: 3}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Submit() to full queue error = %v, want context.Canceled", err)
+	}
+}